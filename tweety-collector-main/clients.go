@@ -10,6 +10,12 @@ import (
 	com "gitlab.com/leapbit-practice/tweety-lib-communication/comms"
 )
 
+// Interval between status requests of a Tweety-Counter job.
+const counterJobPollInterval = 5 * time.Second
+
+// Jobs unfinished after counterJobMaxWait are given up on, their unfinished ids are sent again.
+const counterJobMaxWait = 30 * time.Minute
+
 // Cache struct represents Tweety-Counter client
 // internal cache for ids that failed to sent.
 type Cache struct {
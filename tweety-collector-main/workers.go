@@ -11,7 +11,6 @@ import (
 
 	"github.com/prometheus/client_golang/prometheus"
 	com "gitlab.com/leapbit-practice/tweety-lib-communication/comms"
-	tw "gitlab.com/leapbit-practice/tweety-lib-twitter/twitter"
 )
 
 // Method initializes workers as separate goroutines.
@@ -123,26 +122,65 @@ func (client *HTTPClientDBSaver) databaseLocationSenderWorker(app *App) {
 }
 
 // Method handles user ids data sending to Tweety-Counter server.
+// Counter answers with a job, which is polled until every user is processed.
+// Ids that failed, were cancelled or are unfinished after counterJobMaxWait
+// are returned to be sent again.
 func (client *HTTPClientCounter) counterIdsSender(ids []string) ([]string, error) {
-	var counterRespIds tw.RespFriends
+	var job com.RespCounterJob
 	resp, err := com.SendIdsDataToCounter(ids, &client.Client, client.Addr, client.Port)
 	if err != nil {
-		return counterRespIds.Friends_ids, fmt.Errorf("counterIdsSender function error: %s", err)
+		return nil, fmt.Errorf("counterIdsSender function error: %s", err)
 	}
 	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		return counterRespIds.Friends_ids, fmt.Errorf("counterIdsSender function error: %s", http.StatusText(resp.StatusCode))
+	if resp.StatusCode != http.StatusAccepted {
+		return nil, fmt.Errorf("counterIdsSender function error: %s", http.StatusText(resp.StatusCode))
 	}
-	client.Logger.LogData(com.INFO, "Session friends ids data successfully sent to Tweety-Counter server!")
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return counterRespIds.Friends_ids, fmt.Errorf("counterIdsSender function error: %s", err)
+		return nil, fmt.Errorf("counterIdsSender function error: %s", err)
 	}
-	err = json.Unmarshal(body, &counterRespIds)
+	err = json.Unmarshal(body, &job)
 	if err != nil {
-		return counterRespIds.Friends_ids, fmt.Errorf("counterIdsSender function error: %s", err)
+		return nil, fmt.Errorf("counterIdsSender function error: %s", err)
+	}
+	client.Logger.LogData(com.INFO, "Session friends ids data successfully sent to Tweety-Counter server as job %s!", job.Id)
+
+	deadline := time.Now().Add(counterJobMaxWait)
+	for job.Status != com.JOB_DONE {
+		if time.Now().After(deadline) {
+			client.Logger.LogData(com.WARNING, "Tweety-Counter job %s unfinished after %s, resending its unfinished ids.", job.Id, counterJobMaxWait)
+			break
+		}
+		time.Sleep(counterJobPollInterval)
+
+		resp, polled, err := com.GetCounterJob(job.Id, &client.Client, client.Addr, client.Port)
+		if resp != nil {
+			resp.Body.Close()
+		}
+		if resp != nil && resp.StatusCode == http.StatusNotFound {
+			// Counter restarted and lost the job, everything unfinished is sent again.
+			client.Logger.LogData(com.WARNING, "Tweety-Counter job %s not found, resending its unfinished ids.", job.Id)
+			break
+		}
+		if err != nil {
+			client.Logger.LogData(com.ERROR, "counterIdsSender function error: %s", err)
+			continue
+		}
+		job = polled
+	}
+
+	// Ids the job never reported on are unfinished too.
+	finished := make(map[string]bool, len(job.Users))
+	for _, user := range job.Users {
+		finished[user.UserId] = user.Status == com.JOB_DONE || user.Status == com.JOB_SKIPPED
+	}
+	var failedIds []string
+	for _, id := range ids {
+		if !finished[id] {
+			failedIds = append(failedIds, id)
+		}
 	}
-	return counterRespIds.Friends_ids, nil
+	return failedIds, nil
 }
 
 // Method handles user data sending to Tweety-DBSaver server.
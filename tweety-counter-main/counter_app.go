@@ -1,18 +1,21 @@
 package main
 
 import (
-	"archive/zip"
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"math"
+	"mime"
 	"net/http"
+	"os"
+	"os/signal"
 	"sort"
 	"strconv"
-	"strings"
-	"sync"
+	"syscall"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -21,6 +24,7 @@ import (
 	clientv3 "go.etcd.io/etcd/client/v3"
 
 	com "gitlab.com/leapbit-practice/tweety-lib-communication/comms"
+	text "gitlab.com/leapbit-practice/tweety-lib-text/text"
 	tw "gitlab.com/leapbit-practice/tweety-lib-twitter/twitter"
 )
 
@@ -33,13 +37,26 @@ const (
 	lastTweetEndpoint   = "user_last_tweet"
 	sendTweetEndpoint   = "user_tweets"
 	sendImagesEndpoint  = "user_images"
+	imagesEndpoint      = "user_current_images"
+	tweetWindowEndpoint = "user_tweet_window"
+	userStatusEndpoint  = "user_status"
+	frequencyEndpoint   = "document_frequencies"
 	etcdEndpoint        = "tweety-database-tck-test.demobet.lan:2379"
+
+	// Below it sentiment is scored with every lexicon instead of the detected language.
+	minLanguageConfidence = 0.5
+	// Twitter serves at most 3200 tweets of a timeline, 16 pages of 200.
+	defaultMaxPages = 16
+	// Terms used fewer times are mostly typos and are never distinctive.
+	minDistinctiveCount = 2
 )
 
 type App struct {
 	Ctw     HttpClientTW `json:"client_twitter"`
 	Cdb     HttpClientDB `json:"client_database"`
 	Metrics Metrics      `json:"metrics"`
+	Words   text.Options `json:"words"`
+	Jobs    *jobQueue    `json:"-"`
 }
 
 type Metrics struct {
@@ -47,15 +64,18 @@ type Metrics struct {
 	UserIdsRequestsDuration prometheus.Histogram
 	TotalSentRequests       *prometheus.CounterVec
 	SentRequestsDuration    *prometheus.HistogramVec
+	QueuedUsers             prometheus.Gauge
 }
 
 type HttpRequestClient struct {
 	Client http.Client
 }
 
+// TweetNo is also the page size when paging back to the last stored tweet.
 type HttpClientTW struct {
 	RequestClient HttpRequestClient
 	TweetNo       uint64 `json:"tweet_no"`
+	MaxPages      int    `json:"max_pages"`
 	Bearer        string `json:"bearer_token"`
 }
 
@@ -65,9 +85,12 @@ type HttpClientDB struct {
 }
 
 type Config struct {
-	TweetNo     uint64 `json:"tweet_no"`
-	Bearer      string `json:"bearer_token"`
-	DbIpAndPort string `json:"db_ip_port"`
+	TweetNo     uint64       `json:"tweet_no"`
+	MaxPages    int          `json:"max_pages"`
+	Jobs        JobsConfig   `json:"jobs"`
+	Bearer      string       `json:"bearer_token"`
+	DbIpAndPort string       `json:"db_ip_port"`
+	Words       text.Options `json:"words"`
 }
 
 func setUpMetrics() Metrics {
@@ -93,20 +116,30 @@ func setUpMetrics() Metrics {
 		Buckets: prometheus.LinearBuckets(0, 2, 10),
 	}, []string{"method"})
 
+	QueuedUsers := promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "QueuedUsers",
+		Help: "The number of user ids waiting for a worker.",
+	})
+
 	metrics := Metrics{
 		UserIdsTotalRequests:    UserIdsTotalRequests,
 		UserIdsRequestsDuration: UserIdsRequestsDuration,
 		TotalSentRequests:       TotalSentRequests,
 		SentRequestsDuration:    SentRequestsDuration,
+		QueuedUsers:             QueuedUsers,
 	}
 
 	return metrics
 }
 
-func NewHttpClientTW(tweetNo uint64, bearer string) HttpClientTW {
+func NewHttpClientTW(tweetNo uint64, maxPages int, bearer string) HttpClientTW {
 	var ctw HttpClientTW
 	ctw.RequestClient = HttpRequestClient{Client: http.Client{Timeout: time.Duration(15) * time.Second}}
 	ctw.TweetNo = tweetNo
+	ctw.MaxPages = maxPages
+	if ctw.MaxPages <= 0 {
+		ctw.MaxPages = defaultMaxPages
+	}
 	ctw.Bearer = bearer
 	return ctw
 }
@@ -130,28 +163,6 @@ func (rc *HttpRequestClient) DownloadFile(url string) ([]byte, error) {
 	return img, nil
 }
 
-func ZipFiles(imgNames []string, imgData [][]byte) ([]byte, error) {
-	buf := new(bytes.Buffer)
-	zipWriter := zip.NewWriter(buf)
-	for i := 0; i < len(imgNames); i++ {
-		zipEntry, err := zipWriter.Create(imgNames[i])
-		if err != nil {
-			return nil, fmt.Errorf("failed to zip %s Error: %s", imgNames[i], err.Error())
-		}
-
-		_, err = zipEntry.Write(imgData[i])
-		if err != nil {
-			return nil, fmt.Errorf("failed to zip %s Error: %s", imgNames[i], err.Error())
-		}
-	}
-	err := zipWriter.Close()
-	if err != nil {
-		return nil, fmt.Errorf("failed to close zipWriter. Error: %s", err.Error())
-	}
-
-	return buf.Bytes(), nil
-}
-
 func (rc *HttpRequestClient) performRequest(httpMethod string, path string, data interface{}) (body []byte, err error, errMsg error) {
 	var jsonRequestData []byte
 	if data != nil {
@@ -164,6 +175,9 @@ func (rc *HttpRequestClient) performRequest(httpMethod string, path string, data
 	if errMsg != nil {
 		return nil, nil, fmt.Errorf("cannot create a request. Error: %s", errMsg.Error())
 	}
+	if data != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
 
 	resp, err := rc.Client.Do(req)
 	if err != nil {
@@ -183,32 +197,127 @@ func (rc *HttpRequestClient) performRequest(httpMethod string, path string, data
 	return body, nil, nil
 }
 
-func rankMostUsedWords(tweets []tw.RespTwitterApiTweet) []com.KvPair {
+func rankMostUsedWords(tweets []tw.RespTwitterApiTweet, options text.Options) []com.KvPair {
 	wordCount := make(map[string]uint64)
 
-	var words []string
 	for i := range tweets {
-		words = strings.Fields(tweets[i].Text)
-		for j := range words {
-			wordCount[words[j]]++
+		for _, term := range options.Terms(tweets[i].Text) {
+			wordCount[term]++
 		}
 	}
 
 	var kvPairs []com.KvPair
-	for k, v := range wordCount {
-		kvPairs = append(kvPairs, com.KvPair{Word: k, Count: v})
+	for _, term := range options.Top(wordCount) {
+		kvPairs = append(kvPairs, com.KvPair{Word: term.Term, Count: term.Count})
+	}
+
+	return kvPairs
+}
+
+// Function ranks terms by TF-IDF, (1 + ln tf) * (1 + ln((1 + N) / (1 + df))),
+// where N is the number of tweets in the corpus and df the number containing the term.
+func scoreDistinctiveTerms(counts map[string]uint64, frequencies com.RespDocumentFrequencies, topN int) []com.TermScore {
+	var scores []com.TermScore
+
+	for term, count := range counts {
+		if count < minDistinctiveCount {
+			continue
+		}
+		tf := 1 + math.Log(float64(count))
+		idf := 1 + math.Log(float64(1+frequencies.Documents)/float64(1+frequencies.Frequencies[term]))
+		scores = append(scores, com.TermScore{Term: term, Score: tf * idf})
 	}
-	sort.Slice(kvPairs, func(i, j int) bool {
-		return kvPairs[i].Count > kvPairs[j].Count
+
+	sort.Slice(scores, func(i, j int) bool {
+		if scores[i].Score == scores[j].Score {
+			return scores[i].Term < scores[j].Term
+		}
+		return scores[i].Score > scores[j].Score
 	})
+	if len(scores) > topN {
+		scores = scores[:topN]
+	}
+
+	return scores
+}
+
+func (app *App) getDocumentFrequencies(terms []string) (frequencies com.RespDocumentFrequencies, err error, errMsg error) {
+	app.Metrics.TotalSentRequests.WithLabelValues("getDocumentFrequencies").Inc()
+	methodTimer := prometheus.NewTimer(app.Metrics.SentRequestsDuration.WithLabelValues("getDocumentFrequencies"))
+	defer methodTimer.ObserveDuration()
 
-	upperBound := 10
-	if len(kvPairs) < 10 {
-		upperBound = len(kvPairs)
+	reqFrequencies := com.ReqDocumentFrequencies{
+		Terms:   terms,
+		AppName: AppName,
+		SentAt:  time.Now(),
 	}
-	kvPairs = kvPairs[:upperBound]
 
-	return kvPairs
+	body, err, errMsg := app.Cdb.RequestClient.performRequest(http.MethodPost, fmt.Sprintf(httpRequestTemplate, app.Cdb.DbIpAndPort, frequencyEndpoint), reqFrequencies)
+	if err != nil {
+		return frequencies, fmt.Errorf("cannot perform request. Error: %s", err.Error()), nil
+	}
+
+	if errMsg != nil {
+		return frequencies, nil, fmt.Errorf("cannot perform request. Error: %s", errMsg.Error())
+	}
+
+	errMsg = json.Unmarshal(body, &frequencies)
+	if errMsg != nil {
+		return frequencies, nil, fmt.Errorf("cannot unmarshal body. Error: %s", errMsg.Error())
+	}
+
+	return frequencies, nil, nil
+}
+
+// Function scores the terms of a user's tweets against the corpus of DBSaver.
+func (app *App) rankDistinctiveTerms(tweets []tw.RespTwitterApiTweet) ([]com.TermScore, error) {
+	texts := make([]string, 0, len(tweets))
+	for i := range tweets {
+		texts = append(texts, tweets[i].Text)
+	}
+
+	counts := app.Words.Count(texts)
+	terms := make([]string, 0, len(counts))
+	for term, count := range counts {
+		if count >= minDistinctiveCount {
+			terms = append(terms, term)
+		}
+	}
+	if len(terms) == 0 {
+		return nil, nil
+	}
+
+	frequencies, err, errMsg := app.getDocumentFrequencies(terms)
+	if errMsg != nil {
+		return nil, errMsg
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return scoreDistinctiveTerms(counts, frequencies, app.Words.TopN), nil
+}
+
+// Function detects the language and scores each tweet, keyed by tweet id_str.
+func analyzeTweets(tweets []tw.RespTwitterApiTweet) map[string]com.TweetAnalysis {
+	analysis := make(map[string]com.TweetAnalysis, len(tweets))
+
+	for i := range tweets {
+		language, confidence := text.DetectLanguage(tweets[i].Text)
+
+		sentimentLanguage := ""
+		if confidence >= minLanguageConfidence {
+			sentimentLanguage = language
+		}
+
+		analysis[tweets[i].Id_str] = com.TweetAnalysis{
+			Sentiment:          text.AnalyzeSentiment(tweets[i].Text, sentimentLanguage).Compound,
+			Language:           language,
+			LanguageConfidence: confidence,
+		}
+	}
+
+	return analysis
 }
 
 func (app *App) getImageUrlsFromTwitter(userId string) (string, string, error) {
@@ -226,23 +335,52 @@ func (app *App) getImageUrlsFromTwitter(userId string) (string, string, error) {
 		return "", "", fmt.Errorf("internal error occurred while communicating with Twitter. Error: %s", errMsg.Error())
 	}
 	if err != nil {
-		return "", "", fmt.Errorf("error occurred while communicating with Twitter. Error: %s", err.Error())
+		return "", "", fmt.Errorf("error occurred while communicating with Twitter. Error: %w", err)
 	}
 	com.TweetyLog(com.INFO, fmt.Sprintf("Getting image urls from twitter for user %s DONE.", userId))
 
 	return respImages.UrlProfileImage, respImages.UrlBanner, nil
 }
 
-func (app *App) sendImagesToDB(userId string, zippedData []byte) (err error, errMsg error) {
+func (app *App) getCurrentImages(userId string) (images com.RespUserImages, err error, errMsg error) {
+	app.Metrics.TotalSentRequests.WithLabelValues("getCurrentImages").Inc()
+	methodTimer := prometheus.NewTimer(app.Metrics.SentRequestsDuration.WithLabelValues("getCurrentImages"))
+	defer methodTimer.ObserveDuration()
+
+	reqUserId := com.ReqUserId{
+		UserId:  userId,
+		AppName: AppName,
+		SentAt:  time.Now(),
+	}
+
+	imagesUrl := fmt.Sprintf(httpRequestTemplate, app.Cdb.DbIpAndPort, imagesEndpoint) + "?" + reqUserId.Query().Encode()
+	body, err, errMsg := app.Cdb.RequestClient.performRequest(http.MethodGet, imagesUrl, nil)
+	if err != nil {
+		return images, fmt.Errorf("cannot perform request. Error: %s", err.Error()), nil
+	}
+
+	if errMsg != nil {
+		return images, nil, fmt.Errorf("cannot perform request. Error: %s", errMsg.Error())
+	}
+
+	errMsg = json.Unmarshal(body, &images)
+	if errMsg != nil {
+		return images, nil, fmt.Errorf("cannot unmarshal body. Error: %s", errMsg.Error())
+	}
+
+	return images, nil, nil
+}
+
+func (app *App) sendImagesToDB(userId string, userImages []com.UserImage) (err error, errMsg error) {
 	app.Metrics.TotalSentRequests.WithLabelValues("sendImagesToDB").Inc()
 	methodTimer := prometheus.NewTimer(app.Metrics.SentRequestsDuration.WithLabelValues("sendImagesToDB"))
 	defer methodTimer.ObserveDuration()
 
 	images := com.ReqImagesForDB{
-		UserId:     userId,
-		UserImages: zippedData,
-		AppName:    AppName,
-		SentAt:     time.Now(),
+		UserId:  userId,
+		Images:  userImages,
+		AppName: AppName,
+		SentAt:  time.Now(),
 	}
 
 	_, err, errMsg = app.Cdb.RequestClient.performRequest(http.MethodPost, fmt.Sprintf(httpRequestTemplate, app.Cdb.DbIpAndPort, sendImagesEndpoint), images)
@@ -250,17 +388,25 @@ func (app *App) sendImagesToDB(userId string, zippedData []byte) (err error, err
 	return err, errMsg
 }
 
-func (app *App) sendTweetsToDB(userTweets []tw.RespTwitterApiTweet, rankedWordCount []com.KvPair) (err error, errMsg error) {
+func (app *App) sendTweetsToDB(userId string, userTweets []tw.RespTwitterApiTweet, rankedWordCount []com.KvPair, distinctiveTerms []com.TermScore,
+	analysis map[string]com.TweetAnalysis, sinceId string) (err error, errMsg error) {
+	if len(userTweets) == 0 {
+		return nil, fmt.Errorf("no tweets to send for user %s", userId)
+	}
+
 	app.Metrics.TotalSentRequests.WithLabelValues("sendTweetsToDB").Inc()
 	methodTimer := prometheus.NewTimer(app.Metrics.SentRequestsDuration.WithLabelValues("sendTweetsToDB"))
 	defer methodTimer.ObserveDuration()
 
 	reqTweetsForDB := com.ReqTweetsForDB{
-		UserId:    strconv.FormatUint(userTweets[0].User.Id, 10),
-		Tweets:    userTweets,
-		WordCount: rankedWordCount,
-		AppName:   AppName,
-		SentAt:    time.Now(),
+		UserId:           userId,
+		Tweets:           userTweets,
+		WordCount:        rankedWordCount,
+		DistinctiveTerms: distinctiveTerms,
+		Analysis:         analysis,
+		SinceId:          sinceId,
+		AppName:          AppName,
+		SentAt:           time.Now(),
 	}
 
 	_, err, errMsg = app.Cdb.RequestClient.performRequest(http.MethodPost, fmt.Sprintf(httpRequestTemplate, app.Cdb.DbIpAndPort, sendTweetEndpoint), reqTweetsForDB)
@@ -268,41 +414,35 @@ func (app *App) sendTweetsToDB(userTweets []tw.RespTwitterApiTweet, rankedWordCo
 	return err, errMsg
 }
 
-func (app *App) hasNewTweets(lastTweet tw.RespTwitterApiTweet) (hasNew bool, err error, errMsg error) {
-	app.Metrics.TotalSentRequests.WithLabelValues("hasNewTweets").Inc()
-	methodTimer := prometheus.NewTimer(app.Metrics.SentRequestsDuration.WithLabelValues("hasNewTweets"))
+// Function returns the id of the newest tweet DBSaver stored for a user, empty when none is stored.
+func (app *App) getLastTweetId(userId string) (lastTweetId string, err error, errMsg error) {
+	app.Metrics.TotalSentRequests.WithLabelValues("getLastTweetId").Inc()
+	methodTimer := prometheus.NewTimer(app.Metrics.SentRequestsDuration.WithLabelValues("getLastTweetId"))
 	defer methodTimer.ObserveDuration()
 
-	userId := com.ReqUserId{
-		UserId:  strconv.FormatUint(lastTweet.User.Id, 10),
+	reqUserId := com.ReqUserId{
+		UserId:  userId,
 		AppName: AppName,
 		SentAt:  time.Now(),
 	}
 	var respTweetId com.RespTweetId
 
-	body, err, errMsg := app.Cdb.RequestClient.performRequest(http.MethodGet, fmt.Sprintf(httpRequestTemplate, app.Cdb.DbIpAndPort, lastTweetEndpoint), userId)
+	lastTweetUrl := fmt.Sprintf(httpRequestTemplate, app.Cdb.DbIpAndPort, lastTweetEndpoint) + "?" + reqUserId.Query().Encode()
+	body, err, errMsg := app.Cdb.RequestClient.performRequest(http.MethodGet, lastTweetUrl, nil)
 	if err != nil {
-		return false, fmt.Errorf("cannot perform request. Error: %s", err.Error()), nil
+		return "", fmt.Errorf("cannot perform request. Error: %s", err.Error()), nil
 	}
 
 	if errMsg != nil {
-		return false, nil, fmt.Errorf("cannot perform request. Error: %s", errMsg.Error())
+		return "", nil, fmt.Errorf("cannot perform request. Error: %s", errMsg.Error())
 	}
 
 	errMsg = json.Unmarshal(body, &respTweetId)
 	if errMsg != nil {
-		return false, nil, fmt.Errorf("cannot unmarshal body. Error: %s", errMsg.Error())
-	}
-
-	if respTweetId.Id == "" {
-		return true, nil, nil
+		return "", nil, fmt.Errorf("cannot unmarshal body. Error: %s", errMsg.Error())
 	}
 
-	if respTweetId.Id == lastTweet.Id_str {
-		return false, nil, nil
-	}
-
-	return true, nil, nil
+	return respTweetId.Id, nil, nil
 }
 
 func readConfigEtcd(config *Config) {
@@ -322,226 +462,260 @@ func readConfigEtcd(config *Config) {
 	json.Unmarshal(configData, config)
 }
 
-func (app *App) getTweetsFromTwitter(userId string) ([]tw.RespTwitterApiTweet, error) {
+// Function fetches tweets of a user newer than the last one DBSaver stored, which
+// is returned as sinceId. Users without stored tweets get their latest TweetNo tweets.
+// The latest TweetNo tweets are also returned as window, whether they are new or not.
+func (app *App) getTweetsFromTwitter(userId string) (tweets []tw.RespTwitterApiTweet, sinceId string, window []tw.RespTwitterApiTweet, err error) {
+	var errMsg error
+
+	com.TweetyLog(com.INFO, fmt.Sprintf("Getting last stored tweet of user %s...", userId))
+	sinceId, err, errMsg = app.getLastTweetId(userId)
+	if errMsg != nil {
+		return nil, "", nil, fmt.Errorf("internal error occurred while communicating with database. Error: %s", errMsg.Error())
+	}
+	if err != nil {
+		return nil, "", nil, fmt.Errorf("error occurred while communicating with database. Error: %s", err.Error())
+	}
+	com.TweetyLog(com.INFO, fmt.Sprintf("Getting last stored tweet of user %s DONE.", userId))
+
 	app.Metrics.TotalSentRequests.WithLabelValues("getTweetsFromTwitter").Inc()
 	methodTimer := prometheus.NewTimer(app.Metrics.SentRequestsDuration.WithLabelValues("getTweetsFromTwitter"))
 	defer methodTimer.ObserveDuration()
 
-	var tweets []tw.RespTwitterApiTweet
-	var err error
-	var errMsg error
-
 	com.TweetyLog(com.INFO, fmt.Sprintf("Getting tweets from Twitter for user %s...", userId))
-	tweets, err, errMsg = tw.UserGetTweets(userId, app.Ctw.TweetNo, &app.Ctw.RequestClient.Client, app.Ctw.Bearer)
+	window, err, errMsg = tw.UserGetTimeline(userId, tw.TimelineQuery{Count: app.Ctw.TweetNo}, &app.Ctw.RequestClient.Client, app.Ctw.Bearer)
+	if errMsg == nil && err == nil && sinceId != "" {
+		tweets, err, errMsg = app.tweetsAfter(userId, sinceId, window)
+	} else {
+		tweets = window
+	}
 	if errMsg != nil {
-		return nil, fmt.Errorf("internal error occurred while communicating with Twitter. Error: %s", errMsg.Error())
+		return nil, "", nil, fmt.Errorf("internal error occurred while communicating with Twitter. Error: %s", errMsg.Error())
 	}
 	if err != nil {
-		return nil, fmt.Errorf("error occurred while communicating with Twitter. Error: %s", err.Error())
+		return nil, "", nil, fmt.Errorf("error occurred while communicating with Twitter. Error: %w", err)
+	}
+	if sinceId != "" && uint64(len(tweets)) >= app.Ctw.TweetNo*uint64(app.Ctw.MaxPages) {
+		com.TweetyLog(com.WARNING, fmt.Sprintf("Reached %d pages of tweets for user %s, older tweets after %s are skipped.", app.Ctw.MaxPages, userId, sinceId))
 	}
 	com.TweetyLog(com.INFO, fmt.Sprintf("Getting tweets from Twitter for user %s DONE.", userId))
 
-	return tweets, nil
+	return tweets, sinceId, window, nil
 }
 
-func (app *App) checkAndSendTweetsToDB(userId string, tweets []tw.RespTwitterApiTweet) error {
-	var err error
-	var errMsg error
-	var hasNew bool
+// Function returns the tweets newer than sinceId, starting with the ones on the
+// latest page. Older pages are read only when every tweet on it is new.
+func (app *App) tweetsAfter(userId string, sinceId string, latest []tw.RespTwitterApiTweet) ([]tw.RespTwitterApiTweet, error, error) {
+	since, errMsg := strconv.ParseUint(sinceId, 10, 64)
+	if errMsg != nil {
+		return nil, nil, fmt.Errorf("invalid last tweet id %q. Error: %s", sinceId, errMsg.Error())
+	}
 
-	com.TweetyLog(com.INFO, fmt.Sprintf("Checking if user %s has any new tweets...", userId))
-	if len(tweets) > 0 {
-		hasNew, err, errMsg = app.hasNewTweets(tweets[0])
-		if errMsg != nil {
-			return fmt.Errorf("internal error occurred while communicating with database. Error: %s", errMsg.Error())
-		}
-		if err != nil {
-			return fmt.Errorf("error occurred while communicating with database. Error: %s", err.Error())
+	var tweets []tw.RespTwitterApiTweet
+	for _, tweet := range latest {
+		if tweet.Id > since {
+			tweets = append(tweets, tweet)
 		}
-	} else {
-		hasNew = false
 	}
-	com.TweetyLog(com.INFO, fmt.Sprintf("Checking if user %s has any new tweets DONE.", userId))
 
-	if hasNew {
-		com.TweetyLog(com.INFO, fmt.Sprintf("Ranking most used words from user %s...", userId))
-		rankedWordCount := rankMostUsedWords(tweets)
-		com.TweetyLog(com.INFO, fmt.Sprintf("Ranking most used words from user %s DONE.", userId))
+	if len(tweets) == 0 || len(tweets) < len(latest) || app.Ctw.MaxPages <= 1 {
+		return tweets, nil, nil
+	}
 
-		com.TweetyLog(com.INFO, fmt.Sprintf("Sending tweets from user %s to database...", userId))
-		err, errMsg := app.sendTweetsToDB(tweets, rankedWordCount)
-		if errMsg != nil {
-			return fmt.Errorf("internal error occurred while communicating with database. Error: %s", errMsg.Error())
-		}
-		if err != nil {
-			return fmt.Errorf("error occurred while communicating with database. Error: %s", err.Error())
-		}
-		com.TweetyLog(com.INFO, fmt.Sprintf("Sending tweets from user %s to database DONE.", userId))
-	} else {
+	oldest := latest[len(latest)-1].Id
+	older, err, errMsg := tw.UserGetTweetsBetween(userId, sinceId, strconv.FormatUint(oldest-1, 10), app.Ctw.TweetNo, app.Ctw.MaxPages-1,
+		&app.Ctw.RequestClient.Client, app.Ctw.Bearer)
+	return append(tweets, older...), err, errMsg
+}
+
+// Function sends tweets fetched after sinceId with their word counts and analysis.
+func (app *App) checkAndSendTweetsToDB(userId string, tweets []tw.RespTwitterApiTweet, sinceId string) error {
+	if len(tweets) == 0 {
 		com.TweetyLog(com.INFO, fmt.Sprintf("User %s doesn't have any new tweets.", userId))
+		return nil
 	}
 
+	com.TweetyLog(com.INFO, fmt.Sprintf("Ranking most used words from user %s...", userId))
+	rankedWordCount := rankMostUsedWords(tweets, app.Words)
+	com.TweetyLog(com.INFO, fmt.Sprintf("Ranking most used words from user %s DONE.", userId))
+
+	// Distinctive terms are optional, tweets are still sent when the corpus is unavailable.
+	com.TweetyLog(com.INFO, fmt.Sprintf("Ranking distinctive terms from user %s...", userId))
+	distinctiveTerms, err := app.rankDistinctiveTerms(tweets)
+	if err != nil {
+		com.TweetyLog(com.WARNING, fmt.Sprintf("Cannot rank distinctive terms from user %s. Error: %s", userId, err.Error()))
+	} else {
+		com.TweetyLog(com.INFO, fmt.Sprintf("Ranking distinctive terms from user %s DONE.", userId))
+	}
+
+	com.TweetyLog(com.INFO, fmt.Sprintf("Analyzing tweets from user %s...", userId))
+	analysis := analyzeTweets(tweets)
+	com.TweetyLog(com.INFO, fmt.Sprintf("Analyzing tweets from user %s DONE.", userId))
+
+	com.TweetyLog(com.INFO, fmt.Sprintf("Sending %d tweets from user %s to database...", len(tweets), userId))
+	err, errMsg := app.sendTweetsToDB(userId, tweets, rankedWordCount, distinctiveTerms, analysis, sinceId)
+	if errMsg != nil {
+		return fmt.Errorf("internal error occurred while communicating with database. Error: %s", errMsg.Error())
+	}
+	if err != nil {
+		return fmt.Errorf("error occurred while communicating with database. Error: %s", err.Error())
+	}
+	com.TweetyLog(com.INFO, fmt.Sprintf("Sending tweets from user %s to database DONE.", userId))
+
 	return nil
 }
 
-func contains(s []string, e string) bool {
-	for _, a := range s {
-		if a == e {
-			return true
-		}
-	}
-	return false
+// Function writes a machine-readable error response.
+func writeError(w http.ResponseWriter, status int, code string, msg string, fields []com.FieldError) {
+	com.TweetyLog(com.ERROR, fmt.Sprintf("%s Sending error response with code %v", msg, status))
+	resp, _ := json.Marshal(com.RespError{Error: msg, Code: code, Fields: fields})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(resp)
 }
 
-func (app *App) processUserIds(w http.ResponseWriter, req *http.Request) {
-	app.Metrics.UserIdsTotalRequests.Inc()
-	userIdsTimer := prometheus.NewTimer(app.Metrics.UserIdsRequestsDuration)
-	defer userIdsTimer.ObserveDuration()
+// Function checks method, content type and body of a /user_ids request
+// and writes the error response itself when the request is refused.
+func decodeUserIdsRequest(w http.ResponseWriter, req *http.Request, reqFriends *tw.ReqFriends) bool {
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", fmt.Sprintf("Method %s not allowed.", req.Method), nil)
+		return false
+	}
 
-	com.TweetyLog(com.INFO, "New request received on /user_ids")
-	var reqFriends tw.ReqFriends
-	var respDoneFriends tw.RespDoneFriends
+	if contentType := req.Header.Get("Content-Type"); contentType != "" {
+		mediaType, _, err := mime.ParseMediaType(contentType)
+		if err != nil || mediaType != "application/json" {
+			writeError(w, http.StatusUnsupportedMediaType, "unsupported_media_type", fmt.Sprintf("Content-Type %q is not application/json.", contentType), nil)
+			return false
+		}
+	}
 
 	body, err := ioutil.ReadAll(req.Body)
 	if err != nil {
-		com.TweetyLog(com.ERROR, fmt.Sprintf("Cannot read body. Error: %s Sending response with code %v", err.Error(), http.StatusBadRequest))
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
+		writeError(w, http.StatusBadRequest, "bad_request", fmt.Sprintf("Cannot read body. Error: %s", err.Error()), nil)
+		return false
 	}
 
-	err = json.Unmarshal(body, &reqFriends)
+	err = json.Unmarshal(body, reqFriends)
 	if err != nil {
-		com.TweetyLog(com.ERROR, fmt.Sprintf("Cannot unmarshal body. Error: %s Sending error response with code %v", err.Error(), http.StatusBadRequest))
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
+		writeError(w, http.StatusBadRequest, "bad_request", fmt.Sprintf("Cannot unmarshal body. Error: %s", err.Error()), nil)
+		return false
 	}
-	com.TweetyLog(com.INFO, fmt.Sprintf("Unpacked user_ids from request: %v", reqFriends.Friends_ids))
-	w.Header().Set("Content-Type", "application/json")
-
-	inputChannel := make(chan string, len(reqFriends.Friends_ids))
-	outputChannel := make(chan string, len(reqFriends.Friends_ids))
-	allDoneChannel := make(chan bool, 1)
 
-	for _, id := range reqFriends.Friends_ids {
-		inputChannel <- id
+	err = com.Validate(reqFriends)
+	if err != nil {
+		var validationErr *com.ValidationError
+		errors.As(err, &validationErr)
+		writeError(w, http.StatusUnprocessableEntity, "validation_failed", err.Error(), validationErr.Fields)
+		return false
 	}
-	close(inputChannel)
 
-	doneCounter := len(reqFriends.Friends_ids)
-	mutex := &sync.Mutex{}
-	com.TweetyLog(com.INFO, "Starting workers...")
-	for i := 0; i < 10; i++ {
-		go app.userIdWorker(inputChannel, outputChannel, allDoneChannel, mutex, &doneCounter)
-	}
+	return true
+}
 
-	select {
-	case <-allDoneChannel:
-		com.TweetyLog(com.INFO, fmt.Sprintf("All user ids sucessfully processed. Sending unsuccessful user ids in response: %v", respDoneFriends.Friends_ids))
-		resp, err := json.Marshal(respDoneFriends)
-		if err != nil {
-			com.TweetyLog(com.ERROR, fmt.Sprintf("Cannot create response body. Error: %s Sending error response with code %v", err.Error(), http.StatusInternalServerError))
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+// Function downloads the images of a user that changed since DBSaver stored
+// them. An image from the stored url is not downloaded again and one with
+// the stored SHA-256 is not sent again, only its SHA-256 is sent so that
+// DBSaver sees it as still current.
+func (app *App) changedImages(userId string, urls map[string]string) ([]com.UserImage, error) {
+	current := make(map[string]com.ImageVersion)
+	stored, err, errMsg := app.getCurrentImages(userId)
+	if errMsg != nil {
+		com.TweetyLog(com.WARNING, fmt.Sprintf("Internal error while getting current images of user %s, sending all. Error: %s", userId, errMsg.Error()))
+	} else if err != nil {
+		com.TweetyLog(com.WARNING, fmt.Sprintf("Cannot get current images of user %s, sending all. Error: %s", userId, err.Error()))
+	} else {
+		for _, image := range stored.Images {
+			current[image.Kind] = image
 		}
-		w.WriteHeader(http.StatusOK)
-		fmt.Fprint(w, string(resp))
-
-	case <-time.After(20 * time.Second):
-		var doneIds []string
-		close(outputChannel)
-		for doneId := range outputChannel {
-			doneIds = append(doneIds, doneId)
+	}
+
+	var images []com.UserImage
+	for _, kind := range []string{com.IMAGE_PROFILE, com.IMAGE_BANNER} {
+		url := urls[kind]
+		if url == "" {
+			continue
 		}
-		for _, id := range reqFriends.Friends_ids {
-			if !contains(doneIds, id) {
-				respDoneFriends.Friends_ids = append(respDoneFriends.Friends_ids, id)
-			}
+		if image, ok := current[kind]; ok && image.SourceUrl == url {
+			com.TweetyLog(com.INFO, fmt.Sprintf("The %s image of user %s has the stored url, skipping download.", kind, userId))
+			images = append(images, com.UserImage{Kind: kind, SourceUrl: url, Sha256: image.Sha256})
+			continue
 		}
-		com.TweetyLog(com.INFO, fmt.Sprintf("20 seconds have passed since the request came. Sending unsuccessful user ids in response: %v", respDoneFriends.Friends_ids))
-		resp, err := json.Marshal(respDoneFriends)
+
+		com.TweetyLog(com.INFO, fmt.Sprintf("Downloading %s image of user %s...", kind, userId))
+		data, err := app.Ctw.RequestClient.DownloadFile(url)
 		if err != nil {
-			com.TweetyLog(com.ERROR, fmt.Sprintf("Cannot create response body. Error: %s Sending error response with code %v", err.Error(), http.StatusInternalServerError))
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+			return nil, err
 		}
-		w.WriteHeader(http.StatusOK)
-		fmt.Fprint(w, string(resp))
-
-	}
-}
+		com.TweetyLog(com.INFO, fmt.Sprintf("Downloading %s image of user %s DONE.", kind, userId))
 
-func (app *App) userIdWorker(inputChannel chan string, outputChannel chan string, allDoneChannel chan bool, mutex *sync.Mutex, doneCounter *int) {
-	for userId := range inputChannel {
-		urlProfileImage, urlBanner, err := app.getImageUrlsFromTwitter(userId)
-		if err != nil {
-			com.TweetyLog(com.ERROR, fmt.Sprintf("Worker failed to process user id: %s. Error: %s", userId, err.Error()))
+		if image, ok := current[kind]; ok && image.Sha256 == com.ImageDigest(data) {
+			com.TweetyLog(com.INFO, fmt.Sprintf("The %s image of user %s is unchanged, skipping upload.", kind, userId))
+			images = append(images, com.UserImage{Kind: kind, SourceUrl: url, Sha256: image.Sha256})
 			continue
 		}
-
-		imgNames := make([]string, 0)
-		dataToZip := make([][]byte, 0)
-
-		if urlProfileImage != "" {
-			com.TweetyLog(com.INFO, fmt.Sprintf("Downloading profile image of user %s...", userId))
-			img1, err := app.Ctw.RequestClient.DownloadFile(urlProfileImage)
-			if err != nil {
-				com.TweetyLog(com.ERROR, fmt.Sprintf("Worker failed to process user id: %s. Error: %s", userId, err.Error()))
-				continue
-			}
-			com.TweetyLog(com.INFO, fmt.Sprintf("Downloading profile image of user %s DONE.", userId))
-			imgNames = append(imgNames, "profile_image.png")
-			dataToZip = append(dataToZip, img1)
+		if com.ImageMimeType(data) == "" {
+			com.TweetyLog(com.WARNING, fmt.Sprintf("The %s image of user %s is not a supported image, skipping.", kind, userId))
+			continue
 		}
+		images = append(images, com.UserImage{Kind: kind, SourceUrl: url, Data: data})
+	}
 
-		if urlBanner != "" {
-			com.TweetyLog(com.INFO, fmt.Sprintf("Downloading profile banner of user %s...", userId))
-			img2, err := app.Ctw.RequestClient.DownloadFile(urlBanner)
-			if err != nil {
-				com.TweetyLog(com.ERROR, fmt.Sprintf("Worker failed to process user id: %s. Error: %s", userId, err.Error()))
-				continue
-			}
-			com.TweetyLog(com.INFO, fmt.Sprintf("Downloading profile banner of user %s DONE.", userId))
-			imgNames = append(imgNames, "banner.png")
-			dataToZip = append(dataToZip, img2)
-		}
+	return images, nil
+}
 
-		if len(dataToZip) > 0 {
-			com.TweetyLog(com.INFO, fmt.Sprintf("Zipping images of user %s...", userId))
-			zippedData, err := ZipFiles(imgNames, dataToZip)
-			if err != nil {
-				com.TweetyLog(com.ERROR, fmt.Sprintf("Worker failed to process user id: %s. Error: %s", userId, err.Error()))
-				continue
-			}
-			com.TweetyLog(com.INFO, fmt.Sprintf("Zipping images of user %s DONE.", userId))
-
-			com.TweetyLog(com.INFO, fmt.Sprintf("Sending images of user %s to database...", userId))
-			err, errMsg := app.sendImagesToDB(userId, zippedData)
-			if err != nil || errMsg != nil {
-				com.TweetyLog(com.ERROR, fmt.Sprintf("Worker failed to process user id: %s. Error: %s", userId, err.Error()))
-				continue
-			}
-			com.TweetyLog(com.INFO, fmt.Sprintf("Sending images of user %s to database DONE.", userId))
-		}
+// Function fetches changed images and new tweets of one user and sends them to DBSaver,
+// then marks stored tweets missing from the latest ones as deleted. Users Twitter
+// does not serve are recorded as protected or suspended instead. The status is only
+// sent when it differs from storedStatus, empty when the stored status is unknown.
+func (app *App) processUser(userId string, storedStatus string) error {
+	urlProfileImage, urlBanner, err := app.getImageUrlsFromTwitter(userId)
+	if status, ok := accountStatus(err); ok {
+		app.recordUserStatus(userId, storedStatus, status)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
 
-		tweets, err := app.getTweetsFromTwitter(userId)
-		if err != nil {
-			com.TweetyLog(com.ERROR, fmt.Sprintf("Worker failed to process user id: %s. Error: %s", userId, err.Error()))
-			continue
+	images, err := app.changedImages(userId, map[string]string{com.IMAGE_PROFILE: urlProfileImage, com.IMAGE_BANNER: urlBanner})
+	if err != nil {
+		return err
+	}
+
+	if len(images) > 0 {
+		com.TweetyLog(com.INFO, fmt.Sprintf("Sending images of user %s to database...", userId))
+		err, errMsg := app.sendImagesToDB(userId, images)
+		if errMsg != nil {
+			return fmt.Errorf("internal error occurred while communicating with database. Error: %s", errMsg.Error())
 		}
-		err = app.checkAndSendTweetsToDB(userId, tweets)
 		if err != nil {
-			com.TweetyLog(com.ERROR, fmt.Sprintf("Worker failed to process user id: %s. Error: %s", userId, err.Error()))
-			continue
+			return fmt.Errorf("error occurred while communicating with database. Error: %s", err.Error())
 		}
-		outputChannel <- userId
+		com.TweetyLog(com.INFO, fmt.Sprintf("Sending images of user %s to database DONE.", userId))
+	}
 
-		mutex.Lock()
-		*doneCounter = *doneCounter - 1
-		if *doneCounter == 0 {
-			allDoneChannel <- true
-		}
-		mutex.Unlock()
+	tweets, sinceId, window, err := app.getTweetsFromTwitter(userId)
+	if status, ok := accountStatus(err); ok {
+		app.recordUserStatus(userId, storedStatus, status)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := app.checkAndSendTweetsToDB(userId, tweets, sinceId); err != nil {
+		return err
+	}
+
+	// Users without stored tweets have nothing to reconcile.
+	if sinceId != "" {
+		app.reconcileTweets(userId, window)
 	}
+	app.recordUserStatus(userId, storedStatus, com.USER_ACTIVE)
+
+	return nil
 }
 
 func main() {
@@ -551,20 +725,50 @@ func main() {
 	com.TweetyLog(com.INFO, "Creating clients and loading configuration...")
 	var config Config
 	readConfigEtcd(&config)
-	ctw := NewHttpClientTW(config.TweetNo, config.Bearer)
+	if err := config.Words.Validate(); err != nil {
+		com.TweetyLog(com.ERROR, fmt.Sprintf("Invalid words config. Error: %s", err.Error()))
+		os.Exit(1)
+	}
+	ctw := NewHttpClientTW(config.TweetNo, config.MaxPages, config.Bearer)
 	cdb := NewHttpClientDB(config.DbIpAndPort)
 	metrics := setUpMetrics()
 	app := &App{
 		Ctw:     ctw,
 		Cdb:     cdb,
 		Metrics: metrics,
+		Words:   config.Words.WithDefaults(),
 	}
+	app.Jobs = newJobQueue(config.Jobs, app.countUser, metrics.QueuedUsers)
 	com.TweetyLog(com.INFO, "Clients created and configuration loaded.")
 	fmt.Printf("\n\n")
 
-	http.HandleFunc("/user_ids", app.processUserIds)
-	http.Handle("/metrics", promhttp.Handler())
+	app.Jobs.start()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/user_ids", app.processUserIds)
+	mux.HandleFunc("/jobs/", app.jobHandler)
+	mux.Handle("/metrics", promhttp.Handler())
+	server := &http.Server{Addr: ":8090", Handler: mux}
+
+	bye := make(chan os.Signal, 1)
+	signal.Notify(bye, os.Interrupt, syscall.SIGTERM)
 
-	log.Fatal(http.ListenAndServe(":8090", nil))
+	go func() {
+		err := server.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	sig := <-bye
+	com.TweetyLog(com.INFO, fmt.Sprintf("Detected os signal %s.", sig))
+
+	// New jobs are refused first, then workers finish the users they hold.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	if err := server.Shutdown(ctx); err != nil {
+		com.TweetyLog(com.ERROR, fmt.Sprintf("Error %s.", err.Error()))
+	}
+	cancel()
 
+	app.Jobs.stop()
 }
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	com "gitlab.com/leapbit-practice/tweety-lib-communication/comms"
+)
+
+const (
+	lastCountedEndpoint = "user_last_counted"
+	countedEndpoint     = "user_counted"
+)
+
+// Users counted within the freshness window, by the time they were counted.
+// DBSaver keeps the same times, the cache saves asking it about users this
+// process counted itself. A zero or negative window keeps nothing.
+type recentUsers struct {
+	mutex   sync.Mutex
+	window  time.Duration
+	counted map[string]time.Time
+}
+
+func newRecentUsers(window time.Duration) *recentUsers {
+	return &recentUsers{
+		window:  window,
+		counted: make(map[string]time.Time),
+	}
+}
+
+func (r *recentUsers) within(countedAt time.Time) bool {
+	return r.window > 0 && time.Since(countedAt) < r.window
+}
+
+func (r *recentUsers) fresh(userId string) (time.Time, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	countedAt, ok := r.counted[userId]
+	if !ok || !r.within(countedAt) {
+		return time.Time{}, false
+	}
+	return countedAt, true
+}
+
+func (r *recentUsers) mark(userId string, countedAt time.Time) {
+	if !r.within(countedAt) {
+		return
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if countedAt.After(r.counted[userId]) {
+		r.counted[userId] = countedAt
+	}
+}
+
+func (r *recentUsers) prune() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for userId, countedAt := range r.counted {
+		if !r.within(countedAt) {
+			delete(r.counted, userId)
+		}
+	}
+}
+
+func (app *App) getLastCounted(userId string) (lastCounted com.RespLastCounted, err error, errMsg error) {
+	app.Metrics.TotalSentRequests.WithLabelValues("getLastCounted").Inc()
+	methodTimer := prometheus.NewTimer(app.Metrics.SentRequestsDuration.WithLabelValues("getLastCounted"))
+	defer methodTimer.ObserveDuration()
+
+	reqUserId := com.ReqUserId{
+		UserId:  userId,
+		AppName: AppName,
+		SentAt:  time.Now(),
+	}
+
+	lastCountedUrl := fmt.Sprintf(httpRequestTemplate, app.Cdb.DbIpAndPort, lastCountedEndpoint) + "?" + reqUserId.Query().Encode()
+	body, err, errMsg := app.Cdb.RequestClient.performRequest(http.MethodGet, lastCountedUrl, nil)
+	if err != nil {
+		return lastCounted, fmt.Errorf("cannot perform request. Error: %s", err.Error()), nil
+	}
+
+	if errMsg != nil {
+		return lastCounted, nil, fmt.Errorf("cannot perform request. Error: %s", errMsg.Error())
+	}
+
+	errMsg = json.Unmarshal(body, &lastCounted)
+	if errMsg != nil {
+		return lastCounted, nil, fmt.Errorf("cannot unmarshal body. Error: %s", errMsg.Error())
+	}
+
+	return lastCounted, nil, nil
+}
+
+func (app *App) setLastCounted(userId string) (lastCounted com.RespLastCounted, err error, errMsg error) {
+	app.Metrics.TotalSentRequests.WithLabelValues("setLastCounted").Inc()
+	methodTimer := prometheus.NewTimer(app.Metrics.SentRequestsDuration.WithLabelValues("setLastCounted"))
+	defer methodTimer.ObserveDuration()
+
+	reqUserId := com.ReqUserId{
+		UserId:  userId,
+		AppName: AppName,
+		SentAt:  time.Now(),
+	}
+
+	body, err, errMsg := app.Cdb.RequestClient.performRequest(http.MethodPost, fmt.Sprintf(httpRequestTemplate, app.Cdb.DbIpAndPort, countedEndpoint), reqUserId)
+	if err != nil {
+		return lastCounted, fmt.Errorf("cannot perform request. Error: %s", err.Error()), nil
+	}
+
+	if errMsg != nil {
+		return lastCounted, nil, fmt.Errorf("cannot perform request. Error: %s", errMsg.Error())
+	}
+
+	errMsg = json.Unmarshal(body, &lastCounted)
+	if errMsg != nil {
+		return lastCounted, nil, fmt.Errorf("cannot unmarshal body. Error: %s", errMsg.Error())
+	}
+
+	return lastCounted, nil, nil
+}
+
+// Function counts a user unless it was counted within the freshness window,
+// then it only returns when the user was counted. DBSaver is asked when the
+// cache misses, a user is counted anyway if it cannot answer.
+func (app *App) countUser(userId string) (*time.Time, error) {
+	recent := app.Jobs.recent
+	if countedAt, ok := recent.fresh(userId); ok {
+		return &countedAt, nil
+	}
+
+	lastCounted, err, errMsg := app.getLastCounted(userId)
+	if errMsg != nil {
+		com.TweetyLog(com.WARNING, fmt.Sprintf("Internal error while getting last counted time of user %s. Error: %s", userId, errMsg.Error()))
+	} else if err != nil {
+		com.TweetyLog(com.WARNING, fmt.Sprintf("Cannot get last counted time of user %s. Error: %s", userId, err.Error()))
+	} else if lastCounted.LastCountedAt != nil && recent.within(*lastCounted.LastCountedAt) {
+		recent.mark(userId, *lastCounted.LastCountedAt)
+		return lastCounted.LastCountedAt, nil
+	}
+
+	if err := app.processUser(userId, lastCounted.Status); err != nil {
+		return nil, err
+	}
+
+	countedAt := time.Now()
+	lastCounted, err, errMsg = app.setLastCounted(userId)
+	if errMsg != nil {
+		com.TweetyLog(com.WARNING, fmt.Sprintf("Internal error while setting last counted time of user %s. Error: %s", userId, errMsg.Error()))
+	} else if err != nil {
+		com.TweetyLog(com.WARNING, fmt.Sprintf("Cannot set last counted time of user %s. Error: %s", userId, err.Error()))
+	} else if lastCounted.LastCountedAt != nil {
+		countedAt = *lastCounted.LastCountedAt
+	}
+	recent.mark(userId, countedAt)
+
+	return nil, nil
+}
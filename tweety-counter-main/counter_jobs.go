@@ -0,0 +1,423 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	com "gitlab.com/leapbit-practice/tweety-lib-communication/comms"
+	tw "gitlab.com/leapbit-practice/tweety-lib-twitter/twitter"
+)
+
+const (
+	defaultWorkers          = 10
+	defaultQueueSize        = 1000
+	defaultRetentionMinutes = 60
+	defaultShutdownSeconds  = 30
+	defaultFreshMinutes     = 30
+)
+
+var (
+	errQueueFull   = errors.New("job queue is full")
+	errQueueClosed = errors.New("job queue is shut down")
+)
+
+// QueueSize bounds the number of users waiting for a worker. Finished jobs
+// are kept for RetentionMinutes, and on shutdown workers get ShutdownSeconds
+// to finish the users they are processing. Users counted within the last
+// FreshMinutes are skipped, a negative FreshMinutes counts every user.
+type JobsConfig struct {
+	Workers          int `json:"workers"`
+	QueueSize        int `json:"queue_size"`
+	RetentionMinutes int `json:"retention_minutes"`
+	ShutdownSeconds  int `json:"shutdown_seconds"`
+	FreshMinutes     int `json:"fresh_minutes"`
+}
+
+func (config JobsConfig) WithDefaults() JobsConfig {
+	if config.Workers <= 0 {
+		config.Workers = defaultWorkers
+	}
+	if config.QueueSize <= 0 {
+		config.QueueSize = defaultQueueSize
+	}
+	if config.RetentionMinutes <= 0 {
+		config.RetentionMinutes = defaultRetentionMinutes
+	}
+	if config.ShutdownSeconds <= 0 {
+		config.ShutdownSeconds = defaultShutdownSeconds
+	}
+	if config.FreshMinutes == 0 {
+		config.FreshMinutes = defaultFreshMinutes
+	}
+	return config
+}
+
+type job struct {
+	id         string
+	createdAt  time.Time
+	finishedAt *time.Time
+	users      []com.CounterJobUser
+	pending    int
+}
+
+type jobTask struct {
+	job   *job
+	index int
+}
+
+// A flight is one run of a user shared by every job that asked for the
+// user while it was queued or running. Owner is the job that queued it.
+type flight struct {
+	userId string
+	owner  string
+	tasks  []jobTask
+}
+
+// Jobs are processed by a fixed pool of workers that runs for the whole
+// process. All job state is guarded by mutex. Process returns when the
+// user was last counted if it skipped the user as fresh.
+type jobQueue struct {
+	mutex     sync.Mutex
+	jobs      map[string]*job
+	inflight  map[string]*flight
+	tasks     chan *flight
+	quit      chan struct{}
+	closed    bool
+	workers   sync.WaitGroup
+	config    JobsConfig
+	recent    *recentUsers
+	process   func(userId string) (*time.Time, error)
+	queueSize prometheus.Gauge
+}
+
+func newJobQueue(config JobsConfig, process func(userId string) (*time.Time, error), queueSize prometheus.Gauge) *jobQueue {
+	config = config.WithDefaults()
+	return &jobQueue{
+		jobs:      make(map[string]*job),
+		inflight:  make(map[string]*flight),
+		tasks:     make(chan *flight, config.QueueSize),
+		quit:      make(chan struct{}),
+		config:    config,
+		recent:    newRecentUsers(time.Duration(config.FreshMinutes) * time.Minute),
+		process:   process,
+		queueSize: queueSize,
+	}
+}
+
+func newJobId() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func (q *jobQueue) start() {
+	com.TweetyLog(com.INFO, fmt.Sprintf("Starting %d workers...", q.config.Workers))
+	for i := 0; i < q.config.Workers; i++ {
+		q.workers.Add(1)
+		go q.worker()
+	}
+}
+
+// Method enqueues every distinct user id as one job. Users counted recently
+// are skipped right away and users queued or running in another job share
+// its run. The whole job is refused when the queue has no room for the rest,
+// so a job is never half queued.
+func (q *jobQueue) enqueue(userIds []string) (com.RespCounterJob, error) {
+	id, err := newJobId()
+	if err != nil {
+		return com.RespCounterJob{}, err
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.closed {
+		return com.RespCounterJob{}, errQueueClosed
+	}
+	q.prune()
+
+	now := time.Now()
+	j := &job{id: id, createdAt: now}
+	seen := make(map[string]bool, len(userIds))
+	room := 0
+	for _, userId := range userIds {
+		if seen[userId] {
+			continue
+		}
+		seen[userId] = true
+
+		user := com.CounterJobUser{UserId: userId, Status: com.JOB_QUEUED, UpdatedAt: now}
+		if countedAt, ok := q.recent.fresh(userId); ok {
+			user.Status = com.JOB_SKIPPED
+			user.LastCountedAt = &countedAt
+		} else if q.inflight[userId] == nil {
+			room++
+		}
+		j.users = append(j.users, user)
+	}
+
+	// Only enqueue sends while holding the mutex, so the free room can only grow until the sends below.
+	if cap(q.tasks)-len(q.tasks) < room {
+		return com.RespCounterJob{}, errQueueFull
+	}
+
+	q.jobs[id] = j
+	for i := range j.users {
+		user := &j.users[i]
+		if user.Status == com.JOB_SKIPPED {
+			continue
+		}
+
+		j.pending++
+		task := jobTask{job: j, index: i}
+		if f := q.inflight[user.UserId]; f != nil {
+			owner := f.tasks[0].job.users[f.tasks[0].index]
+			user.Status = owner.Status
+			user.SharedWith = f.owner
+			f.tasks = append(f.tasks, task)
+			continue
+		}
+
+		f := &flight{userId: user.UserId, owner: id, tasks: []jobTask{task}}
+		q.inflight[user.UserId] = f
+		q.tasks <- f
+	}
+	q.queueSize.Add(float64(room))
+
+	if j.pending == 0 {
+		j.finishedAt = &now
+	}
+
+	return j.snapshot(), nil
+}
+
+// Method removes finished jobs older than the retention. Callers hold the mutex.
+func (q *jobQueue) prune() {
+	retention := time.Duration(q.config.RetentionMinutes) * time.Minute
+	for id, j := range q.jobs {
+		if j.finishedAt != nil && time.Since(*j.finishedAt) > retention {
+			delete(q.jobs, id)
+		}
+	}
+	q.recent.prune()
+}
+
+func (q *jobQueue) get(id string) (com.RespCounterJob, bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	j, ok := q.jobs[id]
+	if !ok {
+		return com.RespCounterJob{}, false
+	}
+	return j.snapshot(), true
+}
+
+// Method returns a copy of the job for responses. Callers hold the mutex.
+func (j *job) snapshot() com.RespCounterJob {
+	resp := com.RespCounterJob{
+		Id:         j.id,
+		CreatedAt:  j.createdAt,
+		FinishedAt: j.finishedAt,
+		Users:      make([]com.CounterJobUser, len(j.users)),
+	}
+	copy(resp.Users, j.users)
+
+	queued := 0
+	for _, user := range j.users {
+		switch user.Status {
+		case com.JOB_QUEUED:
+			queued++
+		case com.JOB_FAILED:
+			resp.Failed++
+		case com.JOB_CANCELLED:
+			resp.Cancelled++
+		case com.JOB_SKIPPED:
+			resp.Skipped++
+		}
+	}
+
+	switch {
+	case j.pending == 0:
+		resp.Status = com.JOB_DONE
+	case queued+resp.Skipped == len(j.users):
+		resp.Status = com.JOB_QUEUED
+	default:
+		resp.Status = com.JOB_RUNNING
+	}
+	return resp
+}
+
+// Method sets the status of a user in every job sharing the flight. Once the
+// user is finished the flight is over, later jobs asking for it start a new one.
+func (q *jobQueue) setStatus(f *flight, status string, lastCountedAt *time.Time, err error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	now := time.Now()
+	for _, task := range f.tasks {
+		user := &task.job.users[task.index]
+		user.Status = status
+		user.UpdatedAt = now
+		user.LastCountedAt = lastCountedAt
+		if err != nil {
+			user.Error = err.Error()
+		}
+
+		if status != com.JOB_RUNNING {
+			task.job.pending--
+			if task.job.pending == 0 {
+				finishedAt := now
+				task.job.finishedAt = &finishedAt
+			}
+		}
+	}
+
+	if status != com.JOB_RUNNING && q.inflight[f.userId] == f {
+		delete(q.inflight, f.userId)
+	}
+}
+
+func (q *jobQueue) worker() {
+	defer q.workers.Done()
+
+	for {
+		// Quit is checked first, a select over both would keep taking tasks during shutdown.
+		select {
+		case <-q.quit:
+			return
+		default:
+		}
+
+		select {
+		case <-q.quit:
+			return
+		case f := <-q.tasks:
+			q.queueSize.Dec()
+			q.setStatus(f, com.JOB_RUNNING, nil, nil)
+
+			lastCountedAt, err := q.process(f.userId)
+			if err != nil {
+				com.TweetyLog(com.ERROR, fmt.Sprintf("Worker failed to process user id: %s. Error: %s", f.userId, err.Error()))
+				q.setStatus(f, com.JOB_FAILED, nil, err)
+				continue
+			}
+			if lastCountedAt != nil {
+				com.TweetyLog(com.INFO, fmt.Sprintf("Skipped user id: %s, counted at %s.", f.userId, lastCountedAt.Format(time.RFC3339)))
+				q.setStatus(f, com.JOB_SKIPPED, lastCountedAt, nil)
+				continue
+			}
+			q.setStatus(f, com.JOB_DONE, nil, nil)
+		}
+	}
+}
+
+// Method stops taking new jobs and waits up to ShutdownSeconds for workers to
+// finish the users they hold. Users still in the queue are cancelled.
+func (q *jobQueue) stop() {
+	q.mutex.Lock()
+	if q.closed {
+		q.mutex.Unlock()
+		return
+	}
+	q.closed = true
+	close(q.quit)
+	q.mutex.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		q.workers.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		com.TweetyLog(com.INFO, "All workers stopped.")
+	case <-time.After(time.Duration(q.config.ShutdownSeconds) * time.Second):
+		com.TweetyLog(com.WARNING, fmt.Sprintf("Workers did not stop within %d seconds.", q.config.ShutdownSeconds))
+	}
+
+	cancelled := 0
+	for {
+		select {
+		case f := <-q.tasks:
+			q.queueSize.Dec()
+			q.setStatus(f, com.JOB_CANCELLED, nil, errQueueClosed)
+			cancelled++
+		default:
+			if cancelled > 0 {
+				com.TweetyLog(com.WARNING, fmt.Sprintf("Cancelled %d queued users.", cancelled))
+			}
+			return
+		}
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	resp, err := json.Marshal(v)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", fmt.Sprintf("Cannot create response body. Error: %s", err.Error()), nil)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(resp)
+}
+
+// Handler enqueues the user ids of a request as a job and answers
+// right away with the job id, its status is polled on /jobs/{id}.
+func (app *App) processUserIds(w http.ResponseWriter, req *http.Request) {
+	app.Metrics.UserIdsTotalRequests.Inc()
+	userIdsTimer := prometheus.NewTimer(app.Metrics.UserIdsRequestsDuration)
+	defer userIdsTimer.ObserveDuration()
+
+	com.TweetyLog(com.INFO, "New request received on /user_ids")
+	var reqFriends tw.ReqFriends
+
+	if !decodeUserIdsRequest(w, req, &reqFriends) {
+		return
+	}
+	com.TweetyLog(com.INFO, fmt.Sprintf("Unpacked user_ids from request: %v", reqFriends.Friends_ids))
+
+	job, err := app.Jobs.enqueue(reqFriends.Friends_ids)
+	if err == errQueueFull || err == errQueueClosed {
+		w.Header().Set("Retry-After", "10")
+		writeError(w, http.StatusServiceUnavailable, "unavailable", fmt.Sprintf("Cannot enqueue user ids: %s.", err.Error()), nil)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", fmt.Sprintf("Cannot enqueue user ids. Error: %s", err.Error()), nil)
+		return
+	}
+
+	com.TweetyLog(com.INFO, fmt.Sprintf("Enqueued %d user ids as job %s.", len(job.Users), job.Id))
+	w.Header().Set("Location", "/jobs/"+job.Id)
+	writeJSON(w, http.StatusAccepted, job)
+}
+
+func (app *App) jobHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", fmt.Sprintf("Method %s not allowed.", req.Method), nil)
+		return
+	}
+
+	id := strings.TrimPrefix(req.URL.Path, "/jobs/")
+	job, ok := app.Jobs.get(id)
+	if !ok {
+		writeError(w, http.StatusNotFound, "not_found", fmt.Sprintf("Job %q not found.", id), nil)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, job)
+}
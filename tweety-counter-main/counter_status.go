@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	com "gitlab.com/leapbit-practice/tweety-lib-communication/comms"
+	tw "gitlab.com/leapbit-practice/tweety-lib-twitter/twitter"
+)
+
+// Function tells the status of an account Twitter did not serve, false when
+// err is not such an answer. Protected timelines answer 401, suspended or
+// deleted accounts answer 404.
+func accountStatus(err error) (string, bool) {
+	var statusErr *tw.StatusError
+	if !errors.As(err, &statusErr) {
+		return "", false
+	}
+
+	switch statusErr.StatusCode {
+	case http.StatusUnauthorized:
+		return com.USER_PROTECTED, true
+	case http.StatusNotFound:
+		return com.USER_SUSPENDED, true
+	}
+	return "", false
+}
+
+func (app *App) sendUserStatus(userId string, status string) (userStatus com.RespUserStatus, err error, errMsg error) {
+	app.Metrics.TotalSentRequests.WithLabelValues("sendUserStatus").Inc()
+	methodTimer := prometheus.NewTimer(app.Metrics.SentRequestsDuration.WithLabelValues("sendUserStatus"))
+	defer methodTimer.ObserveDuration()
+
+	reqStatus := com.ReqUserStatusForDB{
+		UserId:  userId,
+		Status:  status,
+		AppName: AppName,
+		SentAt:  time.Now(),
+	}
+
+	body, err, errMsg := app.Cdb.RequestClient.performRequest(http.MethodPost, fmt.Sprintf(httpRequestTemplate, app.Cdb.DbIpAndPort, userStatusEndpoint), reqStatus)
+	if err != nil {
+		return userStatus, fmt.Errorf("cannot perform request. Error: %s", err.Error()), nil
+	}
+
+	if errMsg != nil {
+		return userStatus, nil, fmt.Errorf("cannot perform request. Error: %s", errMsg.Error())
+	}
+
+	errMsg = json.Unmarshal(body, &userStatus)
+	if errMsg != nil {
+		return userStatus, nil, fmt.Errorf("cannot unmarshal body. Error: %s", errMsg.Error())
+	}
+
+	return userStatus, nil, nil
+}
+
+func (app *App) sendTweetWindow(userId string, window []tw.RespTwitterApiTweet) (reconciled com.RespTweetWindow, err error, errMsg error) {
+	app.Metrics.TotalSentRequests.WithLabelValues("sendTweetWindow").Inc()
+	methodTimer := prometheus.NewTimer(app.Metrics.SentRequestsDuration.WithLabelValues("sendTweetWindow"))
+	defer methodTimer.ObserveDuration()
+
+	reqWindow := com.ReqTweetWindowForDB{
+		UserId:   userId,
+		OldestId: window[len(window)-1].Id_str,
+		NewestId: window[0].Id_str,
+		AppName:  AppName,
+		SentAt:   time.Now(),
+	}
+	for _, tweet := range window {
+		reqWindow.TweetIds = append(reqWindow.TweetIds, tweet.Id_str)
+	}
+
+	body, err, errMsg := app.Cdb.RequestClient.performRequest(http.MethodPost, fmt.Sprintf(httpRequestTemplate, app.Cdb.DbIpAndPort, tweetWindowEndpoint), reqWindow)
+	if err != nil {
+		return reconciled, fmt.Errorf("cannot perform request. Error: %s", err.Error()), nil
+	}
+
+	if errMsg != nil {
+		return reconciled, nil, fmt.Errorf("cannot perform request. Error: %s", errMsg.Error())
+	}
+
+	errMsg = json.Unmarshal(body, &reconciled)
+	if errMsg != nil {
+		return reconciled, nil, fmt.Errorf("cannot unmarshal body. Error: %s", errMsg.Error())
+	}
+
+	return reconciled, nil, nil
+}
+
+// Function records the account status of a user in DBSaver when it differs
+// from the stored one. A user is counted even when it cannot be recorded.
+func (app *App) recordUserStatus(userId string, stored string, status string) {
+	if stored == status {
+		return
+	}
+
+	userStatus, err, errMsg := app.sendUserStatus(userId, status)
+	if errMsg != nil {
+		com.TweetyLog(com.WARNING, fmt.Sprintf("Internal error while recording status of user %s. Error: %s", userId, errMsg.Error()))
+	} else if err != nil {
+		com.TweetyLog(com.WARNING, fmt.Sprintf("Cannot record status of user %s. Error: %s", userId, err.Error()))
+	} else if userStatus.Changed {
+		com.TweetyLog(com.INFO, fmt.Sprintf("User %s is %s now.", userId, status))
+	}
+}
+
+// Function sends the latest tweets of a user to DBSaver, which marks stored
+// tweets between the oldest and newest of them that are missing as deleted.
+func (app *App) reconcileTweets(userId string, window []tw.RespTwitterApiTweet) {
+	if len(window) == 0 {
+		return
+	}
+
+	com.TweetyLog(com.INFO, fmt.Sprintf("Reconciling stored tweets of user %s...", userId))
+	reconciled, err, errMsg := app.sendTweetWindow(userId, window)
+	if errMsg != nil {
+		com.TweetyLog(com.WARNING, fmt.Sprintf("Internal error while reconciling tweets of user %s. Error: %s", userId, errMsg.Error()))
+		return
+	}
+	if err != nil {
+		com.TweetyLog(com.WARNING, fmt.Sprintf("Cannot reconcile tweets of user %s. Error: %s", userId, err.Error()))
+		return
+	}
+	com.TweetyLog(com.INFO, fmt.Sprintf("Reconciling stored tweets of user %s DONE, %d deleted and %d restored.", userId, len(reconciled.Deleted), len(reconciled.Restored)))
+}
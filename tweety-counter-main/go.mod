@@ -5,7 +5,10 @@ go 1.15
 require (
 	github.com/prometheus/client_golang v1.11.0
 	github.com/leapbit-internship/tweety-lib-communication v0.0.0-20210721104227-2d3ec71ad8df
+	github.com/leapbit-internship/tweety-lib-text v0.0.0-00010101000000-000000000000
 	github.com/leapbit-internship/tweety-lib-twitter v0.0.0-20210722131939-519d914cbd4f
 	go.etcd.io/etcd/client/v3 v3.5.0
 	go.etcd.io/etcd/pkg/v3 v3.5.0-alpha.0 // indirect
 )
+
+replace github.com/leapbit-internship/tweety-lib-text => ../tweety-lib-text-main
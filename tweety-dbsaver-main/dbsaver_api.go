@@ -0,0 +1,505 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	db "gitlab.com/leapbit-practice/tweety-lib-db/db"
+)
+
+type pageResponse struct {
+	Data       interface{} `json:"data"`
+	NextCursor string      `json:"next_cursor,omitempty"`
+}
+
+// Invalid cursors are the client's fault, every other query error is ours.
+func queryError(msg string, err error) error {
+	if errors.Is(err, db.ErrInvalidCursor) {
+		return newAPIError(http.StatusBadRequest, "Invalid cursor!", err)
+	}
+	return newAPIError(http.StatusInternalServerError, msg, err)
+}
+
+func parseLimit(r *http.Request) (int, error) {
+	limit := r.URL.Query().Get("limit")
+	if limit == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(limit)
+	if err != nil {
+		return 0, newAPIError(http.StatusBadRequest, "Invalid limit parameter!", err)
+	}
+	return n, nil
+}
+
+func parseTimeParam(r *http.Request, name string) (time.Time, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return t, newAPIError(http.StatusBadRequest, "Invalid "+name+" parameter!", err)
+	}
+	return t, nil
+}
+
+// Function returns the {id} segment of /users/{id}[/...] paths.
+func userPathId(r *http.Request) string {
+	return strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/users/"), "/"), "/")[0]
+}
+
+func (application *Application) usersHandler(r *http.Request, _ struct{}) (pageResponse, error) {
+	query := r.URL.Query()
+	filter := db.UserFilter{Location: query.Get("location"), Cursor: query.Get("cursor")}
+
+	var err error
+	if verified := query.Get("verified"); verified != "" {
+		v, err := strconv.ParseBool(verified)
+		if err != nil {
+			return pageResponse{}, newAPIError(http.StatusBadRequest, "Invalid verified parameter!", err)
+		}
+		filter.Verified = &v
+	}
+
+	if minFollowers := query.Get("min_followers"); minFollowers != "" {
+		filter.MinFollowers, err = strconv.ParseUint(minFollowers, 10, 64)
+		if err != nil {
+			return pageResponse{}, newAPIError(http.StatusBadRequest, "Invalid min_followers parameter!", err)
+		}
+	}
+
+	filter.Limit, err = parseLimit(r)
+	if err != nil {
+		return pageResponse{}, err
+	}
+
+	users, next, err := db.GetUsers(filter, application.DB)
+	if err != nil {
+		return pageResponse{}, queryError("Cannot get users!", err)
+	}
+
+	return pageResponse{Data: users, NextCursor: next}, nil
+}
+
+// Method builds the handler for /users/{id}, /users/{id}/tweets, /users/{id}/friends,
+// /users/{id}/timeline, /users/{id}/growth, /users/{id}/status, /users/{id}/bot, /users/{id}/activity,
+// /users/{id}/images and /users/{id}/images/{kind}.
+func (application *Application) userRouter() http.Handler {
+	byId := application.endpoint("/users/{id}", "User", Handle(application.userByIdHandler), withMethods(http.MethodGet))
+	tweets := application.endpoint("/users/{id}/tweets", "User Tweets", Handle(application.userTweetsHandler), withMethods(http.MethodGet))
+	friends := application.endpoint("/users/{id}/friends", "User Friends", Handle(application.userFriendsHandler), withMethods(http.MethodGet))
+	timeline := application.endpoint("/users/{id}/timeline", "User Timeline", Handle(application.userTimelineHandler), withMethods(http.MethodGet))
+	growth := application.endpoint("/users/{id}/growth", "User Growth", Handle(application.userGrowthHandler), withMethods(http.MethodGet))
+	status := application.endpoint("/users/{id}/status", "User Status Changes", Handle(application.userStatusChangesHandler), withMethods(http.MethodGet))
+	bot := application.endpoint("/users/{id}/bot", "User Bot Score", Handle(application.userBotScoreHandler), withMethods(http.MethodGet))
+	activity := application.endpoint("/users/{id}/activity", "User Activity", Handle(application.userActivityHandler), withMethods(http.MethodGet))
+	images := application.endpoint("/users/{id}/images", "User Images", Handle(application.userImagesHandler), withMethods(http.MethodGet))
+	imageFile := application.endpoint("/users/{id}/images/{kind}", "User Image File", http.HandlerFunc(application.userImageFileHandler), withMethods(http.MethodGet, http.MethodHead))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/users/"), "/"), "/")
+
+		switch {
+		case parts[0] == "":
+			http.NotFound(w, r)
+		case len(parts) == 1:
+			byId.ServeHTTP(w, r)
+		case len(parts) == 2 && parts[1] == "tweets":
+			tweets.ServeHTTP(w, r)
+		case len(parts) == 2 && parts[1] == "friends":
+			friends.ServeHTTP(w, r)
+		case len(parts) == 2 && parts[1] == "timeline":
+			timeline.ServeHTTP(w, r)
+		case len(parts) == 2 && parts[1] == "growth":
+			growth.ServeHTTP(w, r)
+		case len(parts) == 2 && parts[1] == "status":
+			status.ServeHTTP(w, r)
+		case len(parts) == 2 && parts[1] == "bot":
+			bot.ServeHTTP(w, r)
+		case len(parts) == 2 && parts[1] == "activity":
+			activity.ServeHTTP(w, r)
+		case len(parts) == 2 && parts[1] == "images":
+			images.ServeHTTP(w, r)
+		case len(parts) == 3 && parts[1] == "images":
+			imageFile.ServeHTTP(w, r)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+}
+
+func (application *Application) userByIdHandler(r *http.Request, _ struct{}) (db.UserInfo, error) {
+	userId := userPathId(r)
+	user, found, err := db.GetUser(userId, application.DB)
+	if err != nil {
+		return user, newAPIError(http.StatusInternalServerError, "Cannot get user with id = "+userId, err)
+	}
+
+	if !found {
+		return user, newAPIError(http.StatusNotFound, "User not found!", nil)
+	}
+
+	return user, nil
+}
+
+func (application *Application) userTweetsHandler(r *http.Request, _ struct{}) (pageResponse, error) {
+	userId := userPathId(r)
+	filter := db.TweetFilter{Cursor: r.URL.Query().Get("cursor")}
+
+	var err error
+	filter.Since, filter.Until, err = parseTimeWindow(r)
+	if err != nil {
+		return pageResponse{}, err
+	}
+
+	filter.Limit, err = parseLimit(r)
+	if err != nil {
+		return pageResponse{}, err
+	}
+
+	tweets, next, found, err := db.GetUserTweets(userId, filter, application.DB)
+	if err != nil {
+		return pageResponse{}, queryError("Cannot get tweets for user with id = "+userId, err)
+	}
+
+	if !found {
+		return pageResponse{}, newAPIError(http.StatusNotFound, "User not found!", nil)
+	}
+
+	return pageResponse{Data: tweets, NextCursor: next}, nil
+}
+
+func (application *Application) userFriendsHandler(r *http.Request, _ struct{}) (pageResponse, error) {
+	userId := userPathId(r)
+	limit, err := parseLimit(r)
+	if err != nil {
+		return pageResponse{}, err
+	}
+
+	friends, next, found, err := db.GetUserFriends(userId, r.URL.Query().Get("cursor"), limit, application.DB)
+	if err != nil {
+		return pageResponse{}, queryError("Cannot get friends for user with id = "+userId, err)
+	}
+
+	if !found {
+		return pageResponse{}, newAPIError(http.StatusNotFound, "User not found!", nil)
+	}
+
+	return pageResponse{Data: friends, NextCursor: next}, nil
+}
+
+// Handler lists the profile snapshots of a user, oldest first, with what each changed.
+// Query parameters are field, to list only changes of one tracked field, since and until.
+func (application *Application) userTimelineHandler(r *http.Request, _ struct{}) (pageResponse, error) {
+	userId := userPathId(r)
+
+	field := r.URL.Query().Get("field")
+	if field != "" && !db.IsTrackedField(field) {
+		return pageResponse{}, newAPIError(http.StatusBadRequest, "Invalid field parameter!", fmt.Errorf("field %q is not tracked", field))
+	}
+
+	since, until, err := parseTimeWindow(r)
+	if err != nil {
+		return pageResponse{}, err
+	}
+
+	timeline, found, err := db.GetUserTimeline(userId, field, since, until, application.DB)
+	if err != nil {
+		return pageResponse{}, queryError("Cannot get timeline for user with id = "+userId, err)
+	}
+
+	if !found {
+		return pageResponse{}, newAPIError(http.StatusNotFound, "User not found!", nil)
+	}
+
+	return pageResponse{Data: timeline}, nil
+}
+
+// Count history of a user. Growth is nil when the user was observed fewer than two times.
+type userGrowth struct {
+	Growth *db.GrowthRate   `json:"growth"`
+	Daily  []db.DailyCounts `json:"daily"`
+	Spikes []db.CountSpike  `json:"spikes"`
+}
+
+// Handler returns follower growth, daily count deltas and z-score spikes of a
+// user between since and until, the last 30 days by default. Deltas at least
+// z standard deviations from the mean of the other deltas are spikes.
+func (application *Application) userGrowthHandler(r *http.Request, _ struct{}) (pageResponse, error) {
+	userId := userPathId(r)
+
+	until, err := parseTimeParam(r, "until")
+	if err != nil {
+		return pageResponse{}, err
+	}
+	if until.IsZero() {
+		until = time.Now()
+	}
+
+	since, err := parseTimeParam(r, "since")
+	if err != nil {
+		return pageResponse{}, err
+	}
+	if since.IsZero() {
+		since = until.AddDate(0, 0, -30)
+	}
+
+	threshold := db.DEFAULT_SPIKE_ZSCORE
+	if value := r.URL.Query().Get("z"); value != "" {
+		threshold, err = strconv.ParseFloat(value, 64)
+		if err != nil || threshold <= 0 {
+			return pageResponse{}, newAPIError(http.StatusBadRequest, "Invalid z parameter!", err)
+		}
+	}
+
+	var result userGrowth
+	growth, found, err := db.GetUserGrowth(userId, since, until, application.DB)
+	if err != nil {
+		return pageResponse{}, queryError("Cannot get growth for user with id = "+userId, err)
+	}
+	if found {
+		result.Growth = &growth
+	}
+
+	result.Daily, err = db.GetUserDailyCounts(userId, since, until, application.DB)
+	if err != nil {
+		return pageResponse{}, queryError("Cannot get daily counts for user with id = "+userId, err)
+	}
+	result.Spikes = db.CountSpikes(result.Daily, threshold)
+
+	return pageResponse{Data: result}, nil
+}
+
+// Function returns the since and until parameters of windowed endpoints,
+// everything until now by default.
+func parseTimeWindow(r *http.Request) (time.Time, time.Time, error) {
+	since, err := parseTimeParam(r, "since")
+	if err != nil {
+		return since, time.Time{}, err
+	}
+
+	until, err := parseTimeParam(r, "until")
+	if err != nil {
+		return since, until, err
+	}
+	if until.IsZero() {
+		until = time.Now()
+	}
+	if since.After(until) {
+		return since, until, newAPIError(http.StatusBadRequest, "Parameter since is after until!", nil)
+	}
+
+	return since, until, nil
+}
+
+// Handler returns hour-of-day and weekday histograms of the tweets of a user
+// in the timezone of its location, with burstiness of its tweeting.
+func (application *Application) userActivityHandler(r *http.Request, _ struct{}) (db.ActivityHistogram, error) {
+	userId := userPathId(r)
+	since, until, err := parseTimeWindow(r)
+	if err != nil {
+		return db.ActivityHistogram{}, err
+	}
+
+	activity, found, err := db.GetUserActivity(userId, since, until, application.DB)
+	if err != nil {
+		return activity, newAPIError(http.StatusInternalServerError, "Cannot get activity of user with id = "+userId, err)
+	}
+	if !found {
+		return activity, newAPIError(http.StatusNotFound, "User not found!", nil)
+	}
+
+	return activity, nil
+}
+
+// Handler lists the account status changes of a user, oldest first.
+func (application *Application) userStatusChangesHandler(r *http.Request, _ struct{}) (pageResponse, error) {
+	userId := userPathId(r)
+	changes, err := db.GetUserStatusChanges(userId, application.DB)
+	if err != nil {
+		return pageResponse{}, queryError("Cannot get status changes for user with id = "+userId, err)
+	}
+
+	return pageResponse{Data: changes}, nil
+}
+
+// Handler lists every distinct image a user had, last seen first per kind.
+func (application *Application) userImagesHandler(r *http.Request, _ struct{}) (pageResponse, error) {
+	userId := userPathId(r)
+	images, err := db.GetUserSeenImages(userId, application.DB)
+	if err != nil {
+		return pageResponse{}, queryError("Cannot get images for user with id = "+userId, err)
+	}
+
+	return pageResponse{Data: images}, nil
+}
+
+func (application *Application) locationsHandler(r *http.Request, _ struct{}) (pageResponse, error) {
+	limit, err := parseLimit(r)
+	if err != nil {
+		return pageResponse{}, err
+	}
+
+	locations, next, err := db.GetLocations(r.URL.Query().Get("cursor"), limit, application.DB)
+	if err != nil {
+		return pageResponse{}, queryError("Cannot get locations!", err)
+	}
+
+	return pageResponse{Data: locations, NextCursor: next}, nil
+}
+
+// Method builds the handler for /locations/{name}/activity.
+func (application *Application) locationRouter() http.Handler {
+	activity := application.endpoint("/locations/{name}/activity", "Location Activity", Handle(application.locationActivityHandler), withMethods(http.MethodGet))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/locations/"), "/"), "/")
+
+		switch {
+		case len(parts) == 2 && parts[0] != "" && parts[1] == "activity":
+			activity.ServeHTTP(w, r)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+}
+
+// Handler returns hour-of-day and weekday histograms of the tweets of users
+// at a location in its timezone, with burstiness of their tweeting.
+func (application *Application) locationActivityHandler(r *http.Request, _ struct{}) (db.ActivityHistogram, error) {
+	location := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/locations/"), "/"), "/")[0]
+	since, until, err := parseTimeWindow(r)
+	if err != nil {
+		return db.ActivityHistogram{}, err
+	}
+
+	activity, found, err := db.GetLocationActivity(location, since, until, application.DB)
+	if err != nil {
+		return activity, newAPIError(http.StatusInternalServerError, "Cannot get activity of location "+location, err)
+	}
+	if !found {
+		return activity, newAPIError(http.StatusNotFound, "Location not found!", nil)
+	}
+
+	return activity, nil
+}
+
+// File extensions of /reports/{type}/{id}.{ext} and the formats they render.
+var reportExtensions = map[string]string{
+	"json": FORMAT_JSON,
+	"md":   FORMAT_MARKDOWN,
+	"html": FORMAT_HTML,
+	"pdf":  FORMAT_PDF,
+}
+
+func (application *Application) reportRouter() http.Handler {
+	list := application.endpoint("/reports/{type}", "Reports", Handle(application.reportsHandler), withMethods(http.MethodGet))
+	file := application.endpoint("/reports/{type}/{id}", "Report File", http.HandlerFunc(application.reportFileHandler), withMethods(http.MethodGet))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/reports/"), "/"), "/")
+
+		switch {
+		case parts[0] == "":
+			http.NotFound(w, r)
+		case len(parts) == 1:
+			list.ServeHTTP(w, r)
+		case len(parts) == 2:
+			file.ServeHTTP(w, r)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+}
+
+func (application *Application) reportFileHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/reports/"), "/"), "/")
+	reportType := parts[0]
+
+	name, ext := parts[1], "json"
+	if i := strings.LastIndex(name, "."); i >= 0 {
+		name, ext = name[:i], strings.ToLower(name[i+1:])
+	}
+
+	format, ok := reportExtensions[ext]
+	if !ok {
+		writeError(w, r, newAPIError(http.StatusNotFound, "Unknown report format!", fmt.Errorf("extension %q", ext)))
+		return
+	}
+
+	id, err := strconv.ParseUint(name, 10, 64)
+	if err != nil {
+		writeError(w, r, newAPIError(http.StatusNotFound, "Invalid report id!", err))
+		return
+	}
+
+	switch reportType {
+	case db.REPORT_LOG, db.REPORT_TWEET, db.REPORT_LOCATION:
+	default:
+		writeError(w, r, newAPIError(http.StatusNotFound, "Unknown report type!", nil))
+		return
+	}
+
+	report, found, err := db.GetReport(reportType, id, application.DB)
+	if err != nil {
+		writeError(w, r, newAPIError(http.StatusInternalServerError, "Cannot get report!", err))
+		return
+	}
+	if !found {
+		writeError(w, r, newAPIError(http.StatusNotFound, fmt.Sprintf("No %s report with id = %d!", reportType, id), nil))
+		return
+	}
+
+	data, contentType, err := renderReport(report, format, application.Config.Render)
+	if errors.Is(err, errPDFDisabled) {
+		writeError(w, r, newAPIError(http.StatusNotImplemented, "PDF reports are not enabled!", err))
+		return
+	}
+	if err != nil {
+		writeError(w, r, newAPIError(http.StatusInternalServerError, "Cannot render report!", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	if format == FORMAT_PDF {
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"tweety-%s-report-%d.pdf\"", reportType, id))
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+
+	requestLog(r).Resp = fmt.Sprintf("%d - %s!", http.StatusOK, http.StatusText(http.StatusOK))
+}
+
+// Handler serves /reports/{type} where type is log, tweet or location.
+func (application *Application) reportsHandler(r *http.Request, _ struct{}) (pageResponse, error) {
+	reportType := strings.Trim(strings.TrimPrefix(r.URL.Path, "/reports/"), "/")
+	switch reportType {
+	case db.REPORT_LOG, db.REPORT_TWEET, db.REPORT_LOCATION:
+	default:
+		return pageResponse{}, newAPIError(http.StatusNotFound, "Unknown report type!", nil)
+	}
+
+	kind := strings.ToUpper(r.URL.Query().Get("kind"))
+	switch kind {
+	case "", "HOURLY", "DAILY", "WEEKLY", "MONTHLY":
+	default:
+		return pageResponse{}, newAPIError(http.StatusBadRequest, "Invalid kind parameter!", nil)
+	}
+
+	limit, err := parseLimit(r)
+	if err != nil {
+		return pageResponse{}, err
+	}
+
+	reports, next, err := db.GetReports(reportType, kind, r.URL.Query().Get("cursor"), limit, application.DB)
+	if err != nil {
+		return pageResponse{}, queryError("Cannot get reports!", err)
+	}
+
+	return pageResponse{Data: reports, NextCursor: next}, nil
+}
@@ -4,11 +4,12 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io/ioutil"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
@@ -17,85 +18,51 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	com "gitlab.com/leapbit-practice/tweety-lib-communication/comms"
 	db "gitlab.com/leapbit-practice/tweety-lib-db/db"
+	text "gitlab.com/leapbit-practice/tweety-lib-text/text"
 	clientv3 "go.etcd.io/etcd/client/v3"
 )
 
 type Application struct {
-	DB      *sql.DB
-	Server  *http.Server
-	Metrics Metrics
+	DB         *sql.DB
+	Server     *http.Server
+	Metrics    Metrics
+	Config     Config
+	Watchlists *watchlistCache
 }
 
-type Metrics struct {
-	TotalRequests    *prometheus.CounterVec
-	RequestsDuration *prometheus.HistogramVec
+type Config struct {
+	db.Configuration
+	Scheduler SchedulerConfig `json:"scheduler"`
+	Delivery  DeliveryConfig  `json:"delivery"`
+	Render    RenderConfig    `json:"render"`
+	Images    ImagesConfig    `json:"images"`
+	Bot       BotConfig       `json:"bot"`
+	Words     text.Options    `json:"words"`
 }
 
-func (application *Application) lastTweetHandler(w http.ResponseWriter, r *http.Request) {
-	msg := "Last Tweet Handler starting..."
-	com.TweetyLog(com.INFO, msg)
-
-	lastTweetTimer := prometheus.NewTimer(application.Metrics.RequestsDuration.WithLabelValues("/user_last_tweet"))
-
-	application.Metrics.TotalRequests.WithLabelValues("/user_last_tweet").Inc()
-	defer lastTweetTimer.ObserveDuration()
-
-	startTime := time.Now()
-	dbLog := &db.DBLog{AppName: "", Address: r.RemoteAddr, ArrivedAt: startTime, SentAt: time.Time{}, Req: db.Request{Method: r.Method, URI: r.RequestURI, Body: ""}, Resp: ""}
-
-	defer db.SaveLog(dbLog, application.DB)
-	defer r.Body.Close()
-	defer com.TweetyLog(com.INFO, "Last Tweet Handler finished.")
-
-	var userId com.ReqUserId
-
-	body, err := ioutil.ReadAll(r.Body)
-
-	if err != nil {
-		msg := "400 - Cannot read body!"
-		dbLog.Resp = msg
-		com.TweetyLog(com.ERROR, fmt.Sprintf("%s Error: %s", msg, err.Error()))
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(msg))
-		return
+// Method checks the config at startup, DBSaver does not start with an invalid one.
+func (config Config) validate() error {
+	if err := config.Delivery.validate(config.Render); err != nil {
+		return fmt.Errorf("delivery: %s", err.Error())
 	}
-
-	bodyStr := string(body)
-	dbLog.Req.Body = bodyStr
-
-	err = json.Unmarshal(body, &userId)
-
-	if err != nil {
-		msg := "400 - Cannot unmarshal body!"
-		dbLog.Resp = msg
-		com.TweetyLog(com.ERROR, fmt.Sprintf("%s. Error: %s", msg, err.Error()))
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(msg))
-		return
+	if err := config.Bot.validate(); err != nil {
+		return fmt.Errorf("bot: %s", err.Error())
+	}
+	if err := config.Words.Validate(); err != nil {
+		return fmt.Errorf("words: %s", err.Error())
 	}
+	return nil
+}
 
-	dbLog.SentAt = userId.SentAt
-	dbLog.AppName = userId.AppName
+type Metrics struct {
+	TotalRequests    *prometheus.CounterVec
+	RequestsDuration *prometheus.HistogramVec
+}
 
+func (application *Application) lastTweetHandler(r *http.Request, userId com.ReqUserId) (com.RespTweetId, error) {
 	tweetId, err := db.GetLastTweet(userId.UserId, application.DB)
 	if err != nil {
-		msg := "500 - Cannot get last tweet!"
-		dbLog.Resp = msg
-		com.TweetyLog(com.ERROR, fmt.Sprintf("%s Error: %s", msg, err.Error()))
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte("500 - Cannot get last tweet!"))
-		return
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-	js, err := json.Marshal(tweetId)
-	if err != nil {
-		msg := "500 - Cannot marshal data!"
-		dbLog.Resp = msg
-		com.TweetyLog(com.ERROR, fmt.Sprintf("%s Error: %s", msg, err.Error()))
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(msg))
-		return
+		return tweetId, newAPIError(http.StatusInternalServerError, "Cannot get last tweet!", err)
 	}
 
 	if tweetId.Id == "" {
@@ -104,371 +71,215 @@ func (application *Application) lastTweetHandler(w http.ResponseWriter, r *http.
 		com.TweetyLog(com.INFO, fmt.Sprintf("Returning last tweet with id = %s.", tweetId.Id))
 	}
 
-	w.WriteHeader(http.StatusOK)
-	w.Write(js)
-	dbLog.Resp = "200 - OK!"
+	return tweetId, nil
 }
 
-func (application *Application) tweetsSavingHandler(w http.ResponseWriter, r *http.Request) {
-	msg := "Tweets Saving Handler starting..."
-	com.TweetyLog(com.INFO, msg)
-
-	tweetsTimer := prometheus.NewTimer(application.Metrics.RequestsDuration.WithLabelValues("/user_tweets"))
-
-	application.Metrics.TotalRequests.WithLabelValues("/user_tweets").Inc()
-	defer tweetsTimer.ObserveDuration()
-
-	dbLog := &db.DBLog{AppName: "", Address: r.RemoteAddr, ArrivedAt: time.Now(), SentAt: time.Time{}, Req: db.Request{Method: r.Method, URI: r.RequestURI, Body: ""}, Resp: ""}
-
-	defer db.SaveLog(dbLog, application.DB)
-	defer r.Body.Close()
-	defer com.TweetyLog(com.INFO, "Tweets Saving Handler finished.")
-
-	var tweets com.ReqTweetsForDB
-
-	body, err := ioutil.ReadAll(r.Body)
-
-	if err != nil {
-		msg := "400 - Cannot read body!"
-		dbLog.Resp = msg
-		com.TweetyLog(com.ERROR, fmt.Sprintf("%s Error: %s", msg, err.Error()))
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(msg))
-		return
-	}
-
-	bodyStr := string(body)
-
-	dbLog.Req.Body = bodyStr
-
-	err = json.Unmarshal(body, &tweets)
-
+func (application *Application) lastCountedHandler(r *http.Request, userId com.ReqUserId) (com.RespLastCounted, error) {
+	lastCounted, err := db.GetLastCounted(userId.UserId, application.DB)
 	if err != nil {
-		msg := "400 - Cannot unmarshal body!"
-		dbLog.Resp = msg
-		com.TweetyLog(com.ERROR, fmt.Sprintf("%s Error: %s", msg, err.Error()))
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(msg))
-		return
+		return lastCounted, newAPIError(http.StatusInternalServerError, "Cannot get last counted time of user with id = "+userId.UserId, err)
 	}
 
-	dbLog.SentAt = tweets.SentAt
-	dbLog.AppName = tweets.AppName
-
-	for _, t := range tweets.Tweets {
-		tweet := db.Tweet{Id: t.Id, Id_str: t.Id_str, UserId: tweets.UserId, Text: t.Text, Created_at: t.Created_at.Time, Url: t.Url}
-		err = db.SaveTweet(tweet, application.DB)
-		if err != nil {
-			msg := "500 - Cannot insert tweet! id = " + t.Id_str
-			dbLog.Resp = msg
-			com.TweetyLog(com.ERROR, fmt.Sprintf("%s. Error: %s", msg, err.Error()))
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte("500 - Cannot insert tweet"))
-			continue
-		}
+	if lastCounted.LastCountedAt == nil {
+		com.TweetyLog(com.INFO, fmt.Sprintf("User with id = %s was never counted.", userId.UserId))
+	} else {
+		com.TweetyLog(com.INFO, fmt.Sprintf("Returning last counted time %s.", lastCounted.LastCountedAt.Format(time.RFC3339)))
 	}
 
-	com.TweetyLog(com.INFO, fmt.Sprintf("Tweets saved for user with id = %s", tweets.UserId))
+	return lastCounted, nil
+}
 
-	err = db.UpdateWordCount(tweets.UserId, tweets.WordCount, application.DB)
+// Counter reports every user it finished, so users counted recently are not counted again.
+func (application *Application) countedHandler(r *http.Request, userId com.ReqUserId) (com.RespLastCounted, error) {
+	lastCounted, err := db.SetLastCounted(userId.UserId, application.DB)
 	if err != nil {
-		msg := "500 - Cannot update word count!"
-		dbLog.Resp = msg
-		com.TweetyLog(com.ERROR, fmt.Sprintf("%s Error: %s", msg, err.Error()))
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(msg))
-		return
+		return lastCounted, newAPIError(http.StatusInternalServerError, "Cannot set last counted time of user with id = "+userId.UserId, err)
 	}
 
-	com.TweetyLog(com.INFO, fmt.Sprintf("Updated word count for user with id = %s", tweets.UserId))
-
-	w.Header().Set("Content-Type", "application/json")
+	com.TweetyLog(com.INFO, fmt.Sprintf("User with id = %s counted.", userId.UserId))
 
-	w.WriteHeader(http.StatusOK)
-
-	dbLog.Resp = "200 - OK!"
+	return lastCounted, nil
 }
 
-func (application *Application) existsHandler(w http.ResponseWriter, r *http.Request) {
-	msg := "Exists Handler starting..."
-	com.TweetyLog(com.INFO, msg)
-
-	existsTimer := prometheus.NewTimer(application.Metrics.RequestsDuration.WithLabelValues("/user_exists"))
-	application.Metrics.TotalRequests.WithLabelValues("/user_exists").Inc()
-
-	defer existsTimer.ObserveDuration()
-
-	dbLog := &db.DBLog{AppName: "", Address: r.RemoteAddr, ArrivedAt: time.Now(), SentAt: time.Time{}, Req: db.Request{Method: r.Method, URI: r.RequestURI, Body: ""}, Resp: ""}
-
-	defer db.SaveLog(dbLog, application.DB)
-	defer r.Body.Close()
-	defer com.TweetyLog(com.INFO, "Exists Handler finished.")
-
-	var userId com.ReqUserId
-
-	body, err := ioutil.ReadAll(r.Body)
-
+// Handler marks stored tweets missing from the latest tweets of a user as deleted.
+func (application *Application) tweetWindowHandler(r *http.Request, window com.ReqTweetWindowForDB) (com.RespTweetWindow, error) {
+	reconciled, err := db.ReconcileTweets(window.UserId, window.OldestId, window.NewestId, window.TweetIds, application.DB)
 	if err != nil {
-		msg := "400 - Cannot read body!"
-		dbLog.Resp = msg
-		com.TweetyLog(com.ERROR, fmt.Sprintf("%s Error: %s", msg, err.Error()))
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(msg))
-		return
+		return reconciled, newAPIError(http.StatusInternalServerError, "Cannot reconcile tweets of user with id = "+window.UserId, err)
 	}
 
-	bodyStr := string(body)
-	dbLog.Req.Body = bodyStr
-
-	err = json.Unmarshal(body, &userId)
-
-	if err != nil {
-		msg := "400 - Cannot unmarshal body!"
-		dbLog.Resp = msg
-		com.TweetyLog(com.ERROR, fmt.Sprintf("%s Error: %s", msg, err.Error()))
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(msg))
-		return
+	if len(reconciled.Deleted) > 0 || len(reconciled.Restored) > 0 {
+		com.TweetyLog(com.INFO, fmt.Sprintf("User with id = %s deleted %d and restored %d tweets.", window.UserId, len(reconciled.Deleted), len(reconciled.Restored)))
 	}
 
-	dbLog.SentAt = userId.SentAt
-	dbLog.AppName = userId.AppName
+	return reconciled, nil
+}
 
-	existsResponse, err := db.UserExists(userId.UserId, application.DB)
+func (application *Application) userStatusHandler(r *http.Request, status com.ReqUserStatusForDB) (com.RespUserStatus, error) {
+	stored, err := db.SetUserStatus(status.UserId, status.Status, application.DB)
 	if err != nil {
-		msg := "500 - Cannot check user with id = " + userId.UserId
-		dbLog.Resp = msg
-		com.TweetyLog(com.ERROR, fmt.Sprintf("%s. Error: %s", msg, err.Error()))
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(msg))
-		return
+		return stored, newAPIError(http.StatusInternalServerError, "Cannot set status of user with id = "+status.UserId, err)
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	js, err := json.Marshal(existsResponse)
-	if err != nil {
-		msg := "500 - Cannot marshal data!"
-		dbLog.Resp = msg
-		com.TweetyLog(com.ERROR, fmt.Sprintf("%s Error: %s", msg, err.Error()))
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(msg))
-		return
+	if stored.Changed {
+		com.TweetyLog(com.INFO, fmt.Sprintf("User with id = %s is %s now.", status.UserId, status.Status))
 	}
 
-	com.TweetyLog(com.INFO, fmt.Sprintf("User exists returning value %t.", existsResponse.Exists))
-
-	w.WriteHeader(http.StatusOK)
-	w.Write(js)
-	dbLog.Resp = "200 - OK!"
+	return stored, nil
 }
 
-func (application *Application) metadataHandler(w http.ResponseWriter, r *http.Request) {
-	msg := "Metadata Handler starting..."
-	com.TweetyLog(com.INFO, msg)
-
-	metadataTimer := prometheus.NewTimer(application.Metrics.RequestsDuration.WithLabelValues("/user_metadata"))
-	application.Metrics.TotalRequests.WithLabelValues("/user_metadata").Inc()
-	defer metadataTimer.ObserveDuration()
-
-	dbLog := &db.DBLog{AppName: "", Address: r.RemoteAddr, ArrivedAt: time.Now(), SentAt: time.Time{}, Req: db.Request{Method: r.Method, URI: r.RequestURI, Body: ""}, Resp: ""}
-
-	defer db.SaveLog(dbLog, application.DB)
-	defer r.Body.Close()
-	defer com.TweetyLog(com.INFO, "Metadata Handler finished.")
-
-	var user com.ReqUser
-
-	body, err := ioutil.ReadAll(r.Body)
-
+// Counter asks for document frequencies to score the terms of a user by TF-IDF.
+func (application *Application) documentFrequenciesHandler(r *http.Request, req com.ReqDocumentFrequencies) (com.RespDocumentFrequencies, error) {
+	frequencies, err := db.GetDocumentFrequencies(req.Terms, application.DB)
 	if err != nil {
-		msg := "400 - Cannot read body!"
-		dbLog.Resp = msg
-		com.TweetyLog(com.ERROR, fmt.Sprintf("%s Error: %s", msg, err.Error()))
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(msg))
-		return
+		return frequencies, newAPIError(http.StatusInternalServerError, "Cannot get document frequencies!", err)
 	}
+	return frequencies, nil
+}
 
-	bodyStr := string(body)
-	dbLog.Req.Body = bodyStr
-
-	err = json.Unmarshal(body, &user)
+// Handler saves the tweets of a request with the word counts of their user and
+// the alerts they raise in one transaction. When any of them cannot be saved
+// none is, and Counter sends them again.
+func (application *Application) tweetsSavingHandler(r *http.Request, tweets com.ReqTweetsForDB) (empty, error) {
+	batch := make([]db.Tweet, 0, len(tweets.Tweets))
+	for _, t := range tweets.Tweets {
+		tweet := db.Tweet{Id: t.Id, Id_str: t.Id_str, UserId: tweets.UserId, Text: t.Text, Created_at: t.Created_at.Time, Url: t.Url}
+		if analysis, ok := tweets.Analysis[t.Id_str]; ok {
+			sentiment := analysis.Sentiment
+			tweet.Sentiment = &sentiment
+			tweet.Language, tweet.LanguageConfidence = analysis.Language, analysis.LanguageConfidence
+		}
+		tweet.Terms = application.Config.Words.Terms(t.Text)
+		for _, hashtag := range t.Entities.Hashtags {
+			tweet.Hashtags = append(tweet.Hashtags, hashtag.Text)
+		}
+		for _, mention := range t.Entities.User_mentions {
+			tweet.Mentions = append(tweet.Mentions, db.TweetMention{UserId: mention.Id_str, Screen_name: mention.Screen_name})
+		}
+		for _, u := range t.Entities.Urls {
+			link := u.Expanded_url
+			if link == "" {
+				link = u.Url
+			}
+			tweet.Urls = append(tweet.Urls, db.TweetUrl{Url: link, Kind: db.URL_LINK})
+		}
+		for _, media := range t.AllMedia() {
+			tweet.Urls = append(tweet.Urls, db.TweetUrl{Url: media.Media_url_https, Kind: media.Type})
+		}
+		batch = append(batch, tweet)
+	}
 
+	alerts, err := application.matchWatchlists(tweets)
 	if err != nil {
-		msg := "400 - Cannot unmarshal body!"
-		dbLog.Resp = msg
-		com.TweetyLog(com.ERROR, fmt.Sprintf("%s Error: %s", msg, err.Error()))
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(msg))
-		return
+		return empty{}, newAPIError(http.StatusInternalServerError, "Cannot match tweets against watchlists!", err)
 	}
 
-	dbLog.SentAt = user.Sent_at
-	dbLog.AppName = user.App_name
-
-	err = db.SaveUserMetadata(user, application.DB)
+	// With SinceId the terms of newly inserted tweets are merged into the stored
+	// word counts, resent tweets are not counted again.
+	created, err := db.SaveTweets(db.TweetBatch{UserId: tweets.UserId, Tweets: batch, WordCount: tweets.WordCount,
+		DistinctiveTerms: tweets.DistinctiveTerms, Merge: tweets.SinceId != "", Alerts: alerts}, application.DB)
 	if err != nil {
-		msg := "500 - Cannot save the user!"
-		dbLog.Resp = msg
-		com.TweetyLog(com.ERROR, fmt.Sprintf("%s Error: %s", msg, err.Error()))
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(msg))
-		return
+		return empty{}, newAPIError(http.StatusInternalServerError, "Cannot insert tweets!", err)
 	}
 
-	com.TweetyLog(com.INFO, fmt.Sprintf("Saved metadata for user with id = %s and name = %s.", user.Id_str, user.Name))
-
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
+	com.TweetyLog(com.INFO, fmt.Sprintf("Tweets saved for user with id = %s", tweets.UserId))
+	com.TweetyLog(com.INFO, fmt.Sprintf("Updated word count for user with id = %s", tweets.UserId))
+	if created > 0 {
+		com.TweetyLog(com.INFO, fmt.Sprintf("Raised %d watchlist alerts for user with id = %s", created, tweets.UserId))
+	}
+	application.rescoreUser(tweets.UserId)
 
-	dbLog.Resp = "200 - OK!"
+	return empty{}, nil
 }
 
-func (application *Application) locationHandler(w http.ResponseWriter, r *http.Request) {
-	msg := "Location Handler starting..."
-	com.TweetyLog(com.INFO, msg)
-
-	locationTimer := prometheus.NewTimer(application.Metrics.RequestsDuration.WithLabelValues("/location"))
-
-	application.Metrics.TotalRequests.WithLabelValues("/location").Inc()
-	defer locationTimer.ObserveDuration()
-
-	dbLog := &db.DBLog{AppName: "", Address: r.RemoteAddr, ArrivedAt: time.Now(), SentAt: time.Time{}, Req: db.Request{Method: r.Method, URI: r.RequestURI, Body: ""}, Resp: ""}
-
-	defer db.SaveLog(dbLog, application.DB)
-	defer r.Body.Close()
-	defer com.TweetyLog(com.INFO, "Location Handler finished.")
-
-	//var user com.ReqUser
-	var location com.ReqLocationForDB
-
-	body, err := ioutil.ReadAll(r.Body)
-
+func (application *Application) existsHandler(r *http.Request, userId com.ReqUserId) (com.RespUserExists, error) {
+	existsResponse, err := db.UserExists(userId.UserId, application.DB)
 	if err != nil {
-		msg := "400 - Cannot read body!"
-		dbLog.Resp = msg
-		com.TweetyLog(com.ERROR, fmt.Sprintf("%s Error: %s", msg, err.Error()))
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(msg))
-		return
+		return existsResponse, newAPIError(http.StatusInternalServerError, "Cannot check user with id = "+userId.UserId, err)
 	}
 
-	bodyStr := string(body)
-	dbLog.Req.Body = bodyStr
+	com.TweetyLog(com.INFO, fmt.Sprintf("User exists returning value %t.", existsResponse.Exists))
 
-	err = json.Unmarshal(body, &location)
+	return existsResponse, nil
+}
 
+func (application *Application) metadataHandler(r *http.Request, user com.ReqUser) (empty, error) {
+	changed, err := db.SaveUserMetadata(user, application.DB)
 	if err != nil {
-		msg := "400 - Cannot unmarshal body!"
-		dbLog.Resp = msg
-		com.TweetyLog(com.ERROR, fmt.Sprintf("%s Error: %s", msg, err.Error()))
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(msg))
-		return
+		return empty{}, newAPIError(http.StatusInternalServerError, "Cannot save the user!", err)
 	}
 
-	dbLog.SentAt = location.SentAt
-	dbLog.AppName = location.AppName
+	com.TweetyLog(com.INFO, fmt.Sprintf("Saved metadata for user with id = %s and name = %s.", user.Id_str, user.Name))
+	if len(changed) > 0 {
+		com.TweetyLog(com.INFO, fmt.Sprintf("Snapshot of user with id = %s, changed fields: %s.", user.Id_str, strings.Join(changed, ", ")))
+	}
+	application.rescoreUser(user.Id_str)
+
+	return empty{}, nil
+}
 
+func (application *Application) locationHandler(r *http.Request, location com.ReqLocationForDB) (empty, error) {
 	//save location
-	locationInfo := db.LocationInfo{Name: location.LocationInfo.Name, Languages: location.LocationInfo.Languages, Population: location.LocationInfo.Population, RegionalBlocks: location.LocationInfo.RegionalBlocs}
-	err = db.SaveLocation(locationInfo, application.DB)
+	locationInfo := db.LocationInfo{Name: location.LocationInfo.Name, Languages: location.LocationInfo.Languages, Population: location.LocationInfo.Population, RegionalBlocks: location.LocationInfo.RegionalBlocs,
+		Timezones: location.LocationInfo.Timezones}
+	err := db.SaveLocation(locationInfo, application.DB)
 	if err != nil {
-		msg := "500 - Cannot save the location!"
-		dbLog.Resp = msg
-		com.TweetyLog(com.ERROR, fmt.Sprintf("%s Error: %s", msg, err.Error()))
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(msg))
-		return
+		return empty{}, newAPIError(http.StatusInternalServerError, "Cannot save the location!", err)
 	}
 
 	com.TweetyLog(com.INFO, fmt.Sprintf("Saved location %s to database", location.LocationInfo.Name))
-	//save location name to user
 
+	//save location name to user
 	locationName := db.LocationName{UserId: location.UserId, LocationName: location.LocationInfo.Name}
 	err = db.SaveLocationNameToUser(locationName, application.DB)
 	if err != nil {
-		msg := "500 - Cannot save the location name to user table!"
-		dbLog.Resp = msg
-		com.TweetyLog(com.ERROR, fmt.Sprintf("%s Error: %s", msg, err.Error()))
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(msg))
-		return
+		return empty{}, newAPIError(http.StatusInternalServerError, "Cannot save the location name to user table!", err)
 	}
 
 	com.TweetyLog(com.INFO, fmt.Sprintf("Saved location %s to user id = %s.", location.LocationInfo.Name, location.UserId))
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-
-	dbLog.Resp = "200 - OK!"
+	return empty{}, nil
 }
 
-func (application *Application) imagesHandler(w http.ResponseWriter, r *http.Request) {
-	com.TweetyLog(com.INFO, "Images Handler starting...")
-
-	imagesTimer := prometheus.NewTimer(application.Metrics.RequestsDuration.WithLabelValues("user_images"))
-
-	application.Metrics.TotalRequests.WithLabelValues("/user_images").Inc()
-	defer imagesTimer.ObserveDuration()
+// Images are stored content-addressed, an image equal to the current one of
+// its kind adds no new version and is only seen again. Current versions of
+// the sent kinds are returned.
+func (application *Application) imagesHandler(r *http.Request, images com.ReqImagesForDB) (com.RespUserImages, error) {
+	resp := com.RespUserImages{Images: make([]com.ImageVersion, 0, len(images.Images))}
 
-	dbLog := &db.DBLog{AppName: "", Address: r.RemoteAddr, ArrivedAt: time.Now(), SentAt: time.Time{}, Req: db.Request{Method: r.Method, URI: r.RequestURI, Body: ""}, Resp: ""}
-
-	defer db.SaveLog(dbLog, application.DB)
-	defer r.Body.Close()
-	defer com.TweetyLog(com.INFO, "Images Handler finished.")
-
-	//var user com.ReqUser
-	var image com.ReqImagesForDB
-
-	body, err := ioutil.ReadAll(r.Body)
-
-	if err != nil {
-		msg := "400 - Cannot read body!"
-		dbLog.Resp = msg
-		com.TweetyLog(com.ERROR, fmt.Sprintf("%s Error: %s", msg, err.Error()))
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(msg))
-		return
-	}
-
-	bodyStr := string(body)
-	dbLog.Req.Body = bodyStr
-
-	err = json.Unmarshal(body, &image)
+	for _, image := range images.Images {
+		stored, changed, err := db.SaveUserImage(images.UserId, image, application.DB)
+		if errors.Is(err, db.ErrImageNotCurrent) {
+			return resp, newAPIError(http.StatusConflict, fmt.Sprintf("The %s image %s is not the current one, send its data!", image.Kind, image.Sha256), err)
+		}
+		if err != nil {
+			return resp, newAPIError(http.StatusInternalServerError, "Cannot save the images!", err)
+		}
 
-	if err != nil {
-		msg := "400 - Cannot unmarshal body!"
-		dbLog.Resp = msg
-		com.TweetyLog(com.ERROR, fmt.Sprintf("%s Error: %s", msg, err.Error()))
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(msg))
-		return
+		if changed {
+			com.TweetyLog(com.INFO, fmt.Sprintf("Saved %s image %s (%s) as version %d of user id = %s.", stored.Kind, stored.Sha256, stored.MimeType, stored.Version, images.UserId))
+		} else {
+			com.TweetyLog(com.INFO, fmt.Sprintf("The %s image of user id = %s is unchanged.", stored.Kind, images.UserId))
+		}
+		resp.Images = append(resp.Images, stored)
 	}
 
-	dbLog.SentAt = image.SentAt
-	dbLog.AppName = image.AppName
+	return resp, nil
+}
 
-	//save images
-	err = db.UpdateUserImage(image, application.DB)
+// Counter compares the current images of a user with the downloaded ones and sends only the changed.
+func (application *Application) currentImagesHandler(r *http.Request, userId com.ReqUserId) (com.RespUserImages, error) {
+	images, err := db.GetUserImages(userId.UserId, application.DB)
 	if err != nil {
-		msg := "500 - Cannot save the location!"
-		dbLog.Resp = msg
-		com.TweetyLog(com.ERROR, fmt.Sprintf("%s Error: %s", msg, err.Error()))
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(msg))
-		return
+		return com.RespUserImages{}, newAPIError(http.StatusInternalServerError, "Cannot get images of user with id = "+userId.UserId, err)
 	}
 
-	com.TweetyLog(com.INFO, fmt.Sprintf("Saved images to user id = %s.", image.UserId))
-
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
+	com.TweetyLog(com.INFO, fmt.Sprintf("Returning %d current images of user id = %s.", len(images), userId.UserId))
 
-	dbLog.Resp = "200 - OK!"
+	return com.RespUserImages{Images: images}, nil
 }
 
-func readConfig() (string, db.ServerConfig) {
+func readConfig() Config {
 
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 
@@ -492,91 +303,14 @@ func readConfig() (string, db.ServerConfig) {
 		com.TweetyLog(com.ERROR, fmt.Sprintf("Cannot read config file. Error: %s", err.Error()))
 	}*/
 
-	var config db.Configuration
+	var config Config
 
 	err = json.Unmarshal(data.Kvs[0].Value, &config)
 	if err != nil {
 		com.TweetyLog(com.ERROR, fmt.Sprintf("Cannot unmarshal config file. Error: %s", err.Error()))
 	}
 
-	DBinfo := fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=disable", config.Database.Host, config.Database.Port, config.Database.User, config.Database.Password, config.Database.DBname)
-	ServerInfo := config.Server
-	return DBinfo, ServerInfo
-}
-
-func (application *Application) report(done chan int) {
-	ticker_hour := time.NewTicker(1 * time.Hour)
-	ticker_day := time.NewTicker(24 * time.Hour)
-	ticker_week := time.NewTicker(7 * 24 * time.Hour)
-	ticker_month := time.NewTicker(30 * 24 * time.Hour)
-	var reportType string
-
-	for {
-		select {
-
-		// 1 hour
-		case <-ticker_hour.C:
-			reportType = "HOURLY"
-			com.TweetyLog(com.INFO, "Hourly report starting...")
-			err := db.SaveLogReport(db.LAST_HOUR, reportType, application.DB)
-			if err != nil {
-				com.TweetyLog(com.ERROR, fmt.Sprintf("Cannot save log report. Error: %s", err.Error()))
-			}
-			com.TweetyLog(com.INFO, "Hourly report finished.")
-
-		// 1 day
-		case <-ticker_day.C:
-			com.TweetyLog(com.INFO, "Daily report starting...")
-			reportType = "DAILY"
-			err := db.SaveLogReport(db.LAST_DAY, reportType, application.DB)
-			if err != nil {
-				com.TweetyLog(com.ERROR, fmt.Sprintf("Cannot save log report. Error: %s", err.Error()))
-			}
-			err = db.SaveTweetReport(db.LAST_DAY, reportType, application.DB)
-			if err != nil {
-				com.TweetyLog(com.ERROR, fmt.Sprintf("Cannot save tweet report. Error: %s", err.Error()))
-			}
-			err = db.SaveLocationReport(db.LAST_DAY, reportType, application.DB)
-			if err != nil {
-				com.TweetyLog(com.ERROR, fmt.Sprintf("Cannot save location report. Error: %s", err.Error()))
-			}
-			com.TweetyLog(com.INFO, "Daily report finished.")
-
-		// 1 week
-		case <-ticker_week.C:
-			reportType = "WEEKLY"
-			com.TweetyLog(com.INFO, "Weekly report starting...")
-			err := db.SaveLogReport(db.LAST_WEEK, reportType, application.DB)
-			if err != nil {
-				com.TweetyLog(com.ERROR, fmt.Sprintf("Cannot save log report. Error: %s", err.Error()))
-			}
-			err = db.SaveTweetReport(db.LAST_WEEK, reportType, application.DB)
-			if err != nil {
-				com.TweetyLog(com.ERROR, fmt.Sprintf("Cannot save tweet report. Error: %s", err.Error()))
-			}
-			err = db.SaveLocationReport(db.LAST_WEEK, reportType, application.DB)
-			if err != nil {
-				com.TweetyLog(com.ERROR, fmt.Sprintf("Cannot save location report. Error: %s", err.Error()))
-			}
-			com.TweetyLog(com.INFO, "Weekly report finished.")
-
-		// 1 month
-		case <-ticker_month.C:
-			reportType = "MONTHLY"
-			com.TweetyLog(com.INFO, "Monthly report starting...")
-			err := db.SaveTweetReport(db.LAST_MONTH, reportType, application.DB)
-			if err != nil {
-				com.TweetyLog(com.ERROR, fmt.Sprintf("Cannot save tweet report. Error: %s", err.Error()))
-			}
-			err = db.SaveLocationReport(db.LAST_MONTH, reportType, application.DB)
-			if err != nil {
-				com.TweetyLog(com.ERROR, fmt.Sprintf("Cannot save location report. Error: %s", err.Error()))
-			}
-			com.TweetyLog(com.INFO, "Monthly report finished.")
-		case <-done:
-			return
-		}
-	}
+	return config
 }
 
 func setUpMetrics() Metrics {
@@ -605,7 +339,13 @@ func setUpAppInfo() Application {
 		configPath = "config.json"
 	}*/
 
-	DBInfo, ServerInfo := readConfig()
+	config := readConfig()
+	if err := config.validate(); err != nil {
+		com.TweetyLog(com.ERROR, fmt.Sprintf("Invalid config. Error: %s", err.Error()))
+		os.Exit(1)
+	}
+	DBInfo := fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=disable", config.Database.Host, config.Database.Port, config.Database.User, config.Database.Password, config.Database.DBname)
+	ServerInfo := config.Server
 
 	DB, err := db.ConnectToDB(DBInfo)
 
@@ -613,14 +353,42 @@ func setUpAppInfo() Application {
 		com.TweetyLog(com.ERROR, fmt.Sprintf("Cannot connect to database. Error: %s", err.Error()))
 	}
 
+	err = db.MigrateDB(DB)
+	if err != nil {
+		com.TweetyLog(com.ERROR, fmt.Sprintf("Cannot migrate database. Error: %s", err.Error()))
+	}
+
 	mux := http.NewServeMux()
 
-	mux.HandleFunc("/user_metadata", application.metadataHandler)
-	mux.HandleFunc("/user_last_tweet", application.lastTweetHandler)
-	mux.HandleFunc("/user_exists", application.existsHandler)
-	mux.HandleFunc("/user_tweets", application.tweetsSavingHandler)
-	mux.HandleFunc("/location", application.locationHandler)
-	mux.HandleFunc("/user_images", application.imagesHandler)
+	mux.Handle("/user_metadata", application.endpoint("/user_metadata", "Metadata", Handle(application.metadataHandler), withMethods(http.MethodPost)))
+	mux.Handle("/user_last_tweet", application.endpoint("/user_last_tweet", "Last Tweet", Handle(application.lastTweetHandler), withMethods(http.MethodGet)))
+	mux.Handle("/user_last_counted", application.endpoint("/user_last_counted", "Last Counted", Handle(application.lastCountedHandler), withMethods(http.MethodGet)))
+	mux.Handle("/user_counted", application.endpoint("/user_counted", "Counted", Handle(application.countedHandler), withMethods(http.MethodPost)))
+	mux.Handle("/user_tweet_window", application.endpoint("/user_tweet_window", "Tweet Window", Handle(application.tweetWindowHandler), withMethods(http.MethodPost)))
+	mux.Handle("/user_status", application.endpoint("/user_status", "User Status", Handle(application.userStatusHandler), withMethods(http.MethodPost)))
+	mux.Handle("/user_exists", application.endpoint("/user_exists", "Exists", Handle(application.existsHandler), withMethods(http.MethodGet)))
+	mux.Handle("/user_tweets", application.endpoint("/user_tweets", "Tweets Saving", Handle(application.tweetsSavingHandler), withMethods(http.MethodPost)))
+	mux.Handle("/document_frequencies", application.endpoint("/document_frequencies", "Document Frequencies", Handle(application.documentFrequenciesHandler), withMethods(http.MethodPost)))
+	mux.Handle("/location", application.endpoint("/location", "Location", Handle(application.locationHandler), withMethods(http.MethodPost)))
+	mux.Handle("/user_images", application.endpoint("/user_images", "Images", Handle(application.imagesHandler), withMethods(http.MethodPost)))
+	mux.Handle("/avatars/similar", application.endpoint("/avatars/similar", "Similar Avatars", Handle(application.similarAvatarsHandler), withMethods(http.MethodGet)))
+	mux.Handle("/user_current_images", application.endpoint("/user_current_images", "Current Images", Handle(application.currentImagesHandler), withMethods(http.MethodGet)))
+	mux.Handle("/graph", application.endpoint("/graph", "Graph Export", http.HandlerFunc(application.graphExportHandler), withMethods(http.MethodGet)))
+	mux.Handle("/users", application.endpoint("/users", "Users", Handle(application.usersHandler), withMethods(http.MethodGet)))
+	mux.Handle("/users/", application.userRouter())
+	mux.Handle("/locations", application.endpoint("/locations", "Locations", Handle(application.locationsHandler), withMethods(http.MethodGet)))
+	mux.Handle("/locations/", application.locationRouter())
+	mux.Handle("/reports/", application.reportRouter())
+	mux.Handle("/watchlists", application.endpoint("/watchlists", "Watchlists", byMethod(map[string]http.Handler{
+		http.MethodGet:  Handle(application.watchlistsHandler),
+		http.MethodPost: Handle(application.createWatchlistHandler),
+	})))
+	mux.Handle("/watchlists/", application.watchlistRouter())
+	mux.Handle("/alerts", application.endpoint("/alerts", "Alerts", Handle(application.alertsHandler), withMethods(http.MethodGet)))
+	mux.Handle("/admin/reports/backfill", application.endpoint("/admin/reports/backfill", "Report Backfill", Handle(application.backfillHandler), withMethods(http.MethodPost)))
+	mux.Handle("/admin/reports/backfill/", application.endpoint("/admin/reports/backfill/{id}", "Report Backfill Status", Handle(application.backfillStatusHandler), withMethods(http.MethodGet)))
+	mux.Handle("/admin/deliveries", application.endpoint("/admin/deliveries", "Deliveries", Handle(application.deliveriesHandler), withMethods(http.MethodGet)))
+	mux.Handle("/admin/deliveries/retry", application.endpoint("/admin/deliveries/retry", "Delivery Retry", Handle(application.retryDeliveriesHandler), withMethods(http.MethodPost)))
 	mux.Handle("/metrics", promhttp.Handler())
 
 	s := &http.Server{
@@ -631,6 +399,8 @@ func setUpAppInfo() Application {
 	application.DB = DB
 	application.Server = s
 	application.Metrics = setUpMetrics()
+	application.Config = config
+	application.Watchlists = &watchlistCache{}
 
 	return application
 }
@@ -659,6 +429,9 @@ func main() {
 
 	ch := make(chan int, 1)
 	go application.report(ch)
+	go application.deliver(ch)
+	go application.scoreBots(ch)
+	go application.hashStoredImages(ch)
 
 	// wait for the SIGINT
 	sig := <-bye
@@ -671,6 +444,6 @@ func main() {
 		com.TweetyLog(com.ERROR, fmt.Sprintf("Error %s.", err.Error()))
 	}
 
-	ch <- 1
+	close(ch)
 
 }
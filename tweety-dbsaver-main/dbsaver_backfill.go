@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	com "gitlab.com/leapbit-practice/tweety-lib-communication/comms"
+	db "gitlab.com/leapbit-practice/tweety-lib-db/db"
+)
+
+const (
+	maxBackfillWindows = 10000
+	backfillTick       = 24
+)
+
+// Backfill remakes reports of one kind for every scheduled window that lies
+// inside [from, to]. Reports defaults to the ones of the kind's schedule.
+// Remade reports are sent to webhooks and emails only with deliver.
+// It is stored and made by the report scheduler, see backfill.
+type backfillRequest struct {
+	Kind    string    `json:"kind" validate:"required"`
+	From    time.Time `json:"from"`
+	To      time.Time `json:"to"`
+	Reports []string  `json:"reports"`
+	Deliver bool      `json:"deliver"`
+}
+
+func (req backfillRequest) Validate() error {
+	var fields []com.FieldError
+
+	if _, err := reportWindowStart(req.Kind, time.Now()); err != nil {
+		fields = append(fields, com.FieldError{Field: "kind", Rule: "oneof", Message: "must be HOURLY, DAILY, WEEKLY or MONTHLY"})
+	}
+	if req.From.IsZero() || req.To.IsZero() || !req.From.Before(req.To) {
+		fields = append(fields, com.FieldError{Field: "from", Rule: "range", Message: "from and to are required and from must be before to"})
+	}
+	if req.To.After(time.Now()) {
+		fields = append(fields, com.FieldError{Field: "to", Rule: "range", Message: "must not be in the future"})
+	}
+	for _, report := range req.Reports {
+		if report != db.REPORT_LOG && report != db.REPORT_TWEET && report != db.REPORT_LOCATION {
+			fields = append(fields, com.FieldError{Field: "reports", Rule: "oneof", Message: fmt.Sprintf("unknown report %q", report)})
+		}
+	}
+
+	if len(fields) > 0 {
+		return &com.ValidationError{Fields: fields}
+	}
+	return nil
+}
+
+// Function returns the activation times of schedule whose whole window lies in [from, to].
+func backfillTimes(schedule reportSchedule, from time.Time, to time.Time) ([]time.Time, error) {
+	var times []time.Time
+
+	for t := schedule.cron.next(from.Add(-time.Minute)); !t.IsZero() && !t.After(to); t = schedule.cron.next(t) {
+		start, _ := reportWindowStart(schedule.kind, t)
+		if start.Before(from) {
+			continue
+		}
+		if len(times) == maxBackfillWindows {
+			return nil, fmt.Errorf("range covers more than %d windows", maxBackfillWindows)
+		}
+		times = append(times, t)
+	}
+
+	return times, nil
+}
+
+// Handler stores a backfill and returns it. Its windows are made in the
+// background by the leading report scheduler, the backfill is polled for progress.
+func (application *Application) backfillHandler(r *http.Request, req backfillRequest) (db.ReportBackfill, error) {
+	backfill := db.ReportBackfill{Kind: req.Kind, Reports: req.Reports, From: req.From, To: req.To, Deliver: req.Deliver}
+
+	schedule, err := application.Config.Scheduler.schedule(req.Kind)
+	if err != nil {
+		return backfill, newAPIError(http.StatusInternalServerError, "Cannot read report schedule!", err)
+	}
+
+	if len(backfill.Reports) == 0 {
+		backfill.Reports = schedule.reports
+	}
+
+	times, err := backfillTimes(schedule, req.From, req.To)
+	if err != nil {
+		return backfill, newAPIError(http.StatusBadRequest, "Backfill range is too large!", err)
+	}
+
+	backfill, err = db.CreateReportBackfill(backfill, application.DB)
+	if err != nil {
+		return backfill, newAPIError(http.StatusInternalServerError, "Cannot save backfill!", err)
+	}
+
+	com.TweetyLog(com.INFO, fmt.Sprintf("Queued backfill %d of %d %s windows from %s to %s.", backfill.Id, len(times), req.Kind, req.From.Format(time.RFC3339), req.To.Format(time.RFC3339)))
+
+	return backfill, nil
+}
+
+// Handler serves /admin/reports/backfill/{id}.
+func (application *Application) backfillStatusHandler(r *http.Request, _ struct{}) (db.ReportBackfill, error) {
+	id, err := strconv.ParseUint(strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/reports/backfill/"), "/"), 10, 64)
+	if err != nil {
+		return db.ReportBackfill{}, newAPIError(http.StatusNotFound, "Invalid backfill id!", err)
+	}
+
+	backfill, found, err := db.GetReportBackfill(id, application.DB)
+	if err != nil {
+		return backfill, newAPIError(http.StatusInternalServerError, "Cannot get backfill!", err)
+	}
+	if !found {
+		return backfill, newAPIError(http.StatusNotFound, "Backfill not found!", nil)
+	}
+
+	return backfill, nil
+}
+
+// Method makes the next windows of pending backfills, at most backfillTick of
+// them per tick so scheduled runs are not held up. Progress is stored, so a
+// new leader continues where the old one stopped.
+func (scheduler *reportScheduler) backfill() {
+	backfills, err := db.GetPendingReportBackfills(scheduler.application.DB)
+	if err != nil {
+		com.TweetyLog(com.ERROR, fmt.Sprintf("Cannot get pending backfills. Error: %s", err.Error()))
+		return
+	}
+
+	budget := backfillTick
+	for _, backfill := range backfills {
+		if budget == 0 {
+			return
+		}
+		budget -= scheduler.advanceBackfill(backfill, budget)
+	}
+}
+
+// Method makes at most limit windows of backfill and returns how many it made.
+func (scheduler *reportScheduler) advanceBackfill(backfill db.ReportBackfill, limit int) int {
+	var failed []db.BackfillWindow
+
+	schedule, err := scheduler.application.Config.Scheduler.schedule(backfill.Kind)
+	var times []time.Time
+	if err == nil {
+		times, err = backfillTimes(schedule, backfill.From, backfill.To)
+	}
+	if err != nil {
+		// The schedule changed since the backfill was stored, it cannot be made any more.
+		failed = append(failed, db.BackfillWindow{From: backfill.From, To: backfill.To, Error: err.Error()})
+		scheduler.saveBackfillProgress(backfill, backfill.To, 0, failed, true)
+		return 0
+	}
+
+	for len(times) > 0 && backfill.DoneThrough != nil && !times[0].After(*backfill.DoneThrough) {
+		times = times[1:]
+	}
+
+	finished := len(times) <= limit
+	if !finished {
+		times = times[:limit]
+	}
+
+	var doneThrough time.Time
+	for _, t := range times {
+		start, _ := reportWindowStart(backfill.Kind, t)
+		if err := scheduler.application.makeReports(backfill.Kind, backfill.Reports, schedule.sections, start, t, backfill.Deliver); err != nil {
+			failed = append(failed, db.BackfillWindow{From: start, To: t, Error: err.Error()})
+		}
+		doneThrough = t
+	}
+	if finished {
+		doneThrough = backfill.To
+	}
+
+	scheduler.saveBackfillProgress(backfill, doneThrough, len(times), failed, finished)
+	return len(times)
+}
+
+func (scheduler *reportScheduler) saveBackfillProgress(backfill db.ReportBackfill, doneThrough time.Time, windows int, failed []db.BackfillWindow, finished bool) {
+	if err := db.AdvanceReportBackfill(backfill.Id, doneThrough, windows, failed, finished, scheduler.application.DB); err != nil {
+		com.TweetyLog(com.ERROR, fmt.Sprintf("Cannot save progress of backfill %d. Error: %s", backfill.Id, err.Error()))
+		return
+	}
+	if finished {
+		com.TweetyLog(com.INFO, fmt.Sprintf("Backfill %d of %s reports finished.", backfill.Id, backfill.Kind))
+	}
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	com "gitlab.com/leapbit-practice/tweety-lib-communication/comms"
+	db "gitlab.com/leapbit-practice/tweety-lib-db/db"
+)
+
+const (
+	// Tweet cadence and repeated text are only scored once a user has this many stored tweets.
+	botMinSampleTweets = 10
+	botNewAccountDays  = 30
+	botHighCadence     = 50.0
+	botFollowSpam      = 1000
+	botFollowSpamRatio = 0.1
+	botRegularCV       = 0.2
+	botRepeatedShare   = 0.5
+	botRescoreBatch    = 200
+
+	defaultBotRescoreIntervalSeconds = 60
+
+	defaultAvatarMarker = "default_profile_images"
+)
+
+// Weights of the bot score, by rule or feature name. Rules add their weight
+// when they hold, features add their weight times their value. The sum with
+// bias is the log-odds of an account being a bot.
+var defaultBotWeights = map[string]float64{
+	"bias": -1.5,
+
+	"account_age":             -0.3,
+	"followers_friends_ratio": -0.5,
+	"statuses_per_day":        0.4,
+	"repeated_text":           2.0,
+	"interval_regularity":     1.0,
+
+	"new_account":      1.0,
+	"default_avatar":   1.5,
+	"verified":         -3.0,
+	"follow_spam":      1.5,
+	"high_cadence":     1.0,
+	"regular_interval": 1.0,
+	"duplicate_tweets": 1.0,
+}
+
+// Weights override the default weights by name, see defaultBotWeights.
+// Users saved before bot scores existed are scored in batches every
+// RescoreIntervalSeconds, a minute by default.
+type BotConfig struct {
+	Weights                map[string]float64 `json:"weights"`
+	RescoreIntervalSeconds int                `json:"rescore_interval_seconds"`
+}
+
+// Method rejects weights of unknown names, a misspelled weight would
+// otherwise be ignored and the default one used.
+func (config BotConfig) validate() error {
+	for name := range config.Weights {
+		if _, ok := defaultBotWeights[name]; !ok {
+			return fmt.Errorf("unknown bot weight %q", name)
+		}
+	}
+	return nil
+}
+
+func (config BotConfig) WithDefaults() BotConfig {
+	weights := make(map[string]float64, len(defaultBotWeights))
+	for name, weight := range defaultBotWeights {
+		weights[name] = weight
+	}
+	for name, weight := range config.Weights {
+		weights[name] = weight
+	}
+	config.Weights = weights
+	if config.RescoreIntervalSeconds <= 0 {
+		config.RescoreIntervalSeconds = defaultBotRescoreIntervalSeconds
+	}
+	return config
+}
+
+// Features of an account a bot score is computed from. Optional ones are nil
+// when the account has too little data for them. IntervalCV is the coefficient
+// of variation of the gaps between tweets, low for accounts tweeting like a clock.
+type botFeatures struct {
+	AccountAgeDays        *float64 `json:"account_age_days"`
+	FollowersFriendsRatio float64  `json:"followers_friends_ratio"`
+	StatusesPerDay        *float64 `json:"statuses_per_day"`
+	Followers             uint64   `json:"followers"`
+	Friends               uint64   `json:"friends"`
+	DefaultAvatar         bool     `json:"default_avatar"`
+	Verified              bool     `json:"verified"`
+	SampledTweets         int      `json:"sampled_tweets"`
+	IntervalCV            *float64 `json:"interval_cv"`
+	RepeatedText          float64  `json:"repeated_text"`
+}
+
+// What a rule or feature added to the log-odds of the score.
+type botContribution struct {
+	Name         string  `json:"name"`
+	Kind         string  `json:"kind"`
+	Value        float64 `json:"value"`
+	Weight       float64 `json:"weight"`
+	Contribution float64 `json:"contribution"`
+}
+
+type botBreakdown struct {
+	Score         float64           `json:"score"`
+	LogOdds       float64           `json:"log_odds"`
+	Features      botFeatures       `json:"features"`
+	Contributions []botContribution `json:"contributions"`
+}
+
+func optional(value float64) *float64 {
+	return &value
+}
+
+// Function drops links and mentions so tweets differing only in them count as repeated.
+func normalizeTweetText(text string) string {
+	var words []string
+	for _, word := range strings.Fields(strings.ToLower(text)) {
+		if strings.HasPrefix(word, "http://") || strings.HasPrefix(word, "https://") || strings.HasPrefix(word, "@") {
+			continue
+		}
+		words = append(words, word)
+	}
+	return strings.Join(words, " ")
+}
+
+// Function extracts the features of an account at now.
+func extractBotFeatures(inputs db.BotInputs, now time.Time) botFeatures {
+	features := botFeatures{
+		FollowersFriendsRatio: float64(inputs.Followers) / math.Max(float64(inputs.Friends), 1),
+		Followers:             inputs.Followers,
+		Friends:               inputs.Friends,
+		DefaultAvatar:         strings.Contains(inputs.ProfileImageUrl, defaultAvatarMarker),
+		Verified:              inputs.Verified,
+		SampledTweets:         len(inputs.TweetTimes),
+	}
+
+	if inputs.CreatedAt != nil && inputs.CreatedAt.Unix() > 0 {
+		days := math.Max(now.Sub(*inputs.CreatedAt).Hours()/24, 0)
+		features.AccountAgeDays = optional(days)
+		features.StatusesPerDay = optional(float64(inputs.Statuses) / math.Max(days, 1))
+	}
+
+	times := append([]time.Time(nil), inputs.TweetTimes...)
+	sort.Slice(times, func(i, j int) bool { return times[i].Before(times[j]) })
+
+	if len(times) >= 3 {
+		gaps := make([]float64, 0, len(times)-1)
+		var sum float64
+		for i := 1; i < len(times); i++ {
+			gap := times[i].Sub(times[i-1]).Seconds()
+			gaps = append(gaps, gap)
+			sum += gap
+		}
+		mean := sum / float64(len(gaps))
+		if mean > 0 {
+			var squares float64
+			for _, gap := range gaps {
+				squares += (gap - mean) * (gap - mean)
+			}
+			features.IntervalCV = optional(math.Sqrt(squares/float64(len(gaps))) / mean)
+		}
+	}
+
+	if len(inputs.TweetTexts) > 0 {
+		counts := make(map[string]int)
+		for _, text := range inputs.TweetTexts {
+			counts[normalizeTweetText(text)]++
+		}
+		repeated := 0
+		for text, count := range counts {
+			if text != "" && count > 1 {
+				repeated += count
+			}
+		}
+		features.RepeatedText = float64(repeated) / float64(len(inputs.TweetTexts))
+	}
+
+	return features
+}
+
+// Method scores features with the configured weights. Continuous features
+// are log scaled, so a few very active accounts do not dominate the sum.
+func (config BotConfig) score(features botFeatures) botBreakdown {
+	weights := config.WithDefaults().Weights
+	breakdown := botBreakdown{Features: features, Contributions: make([]botContribution, 0)}
+
+	add := func(name string, kind string, value float64) {
+		weight := weights[name]
+		if value == 0 || weight == 0 {
+			return
+		}
+		contribution := weight * value
+		breakdown.LogOdds += contribution
+		breakdown.Contributions = append(breakdown.Contributions, botContribution{Name: name, Kind: kind, Value: value, Weight: weight, Contribution: contribution})
+	}
+	rule := func(name string, holds bool) {
+		if holds {
+			add(name, "rule", 1)
+		}
+	}
+
+	add("bias", "bias", 1)
+
+	if features.AccountAgeDays != nil {
+		add("account_age", "feature", math.Log1p(*features.AccountAgeDays))
+		rule("new_account", *features.AccountAgeDays < botNewAccountDays)
+	}
+	add("followers_friends_ratio", "feature", math.Log1p(features.FollowersFriendsRatio))
+	if features.StatusesPerDay != nil {
+		add("statuses_per_day", "feature", math.Log1p(*features.StatusesPerDay))
+		rule("high_cadence", *features.StatusesPerDay > botHighCadence)
+	}
+	rule("default_avatar", features.DefaultAvatar)
+	rule("verified", features.Verified)
+	rule("follow_spam", features.Friends >= botFollowSpam && features.FollowersFriendsRatio < botFollowSpamRatio)
+
+	if features.SampledTweets >= botMinSampleTweets {
+		add("repeated_text", "feature", features.RepeatedText)
+		rule("duplicate_tweets", features.RepeatedText >= botRepeatedShare)
+		if features.IntervalCV != nil {
+			add("interval_regularity", "feature", 1-math.Min(*features.IntervalCV, 1))
+			rule("regular_interval", *features.IntervalCV < botRegularCV)
+		}
+	}
+
+	breakdown.Score = 1 / (1 + math.Exp(-breakdown.LogOdds))
+	return breakdown
+}
+
+// Method recomputes and stores the bot score of a user. Users without
+// metadata are not scored.
+func (application *Application) scoreUser(userId string) error {
+	inputs, found, err := db.GetBotInputs(userId, application.DB)
+	if err != nil || !found {
+		return err
+	}
+
+	breakdown := application.Config.Bot.score(extractBotFeatures(inputs, time.Now()))
+	jsonBreakdown, err := json.Marshal(breakdown)
+	if err != nil {
+		return err
+	}
+
+	return db.SaveBotScore(userId, breakdown.Score, jsonBreakdown, application.DB)
+}
+
+// Method scores a user after its data changed. The save it follows
+// succeeded, so failures are only logged.
+func (application *Application) rescoreUser(userId string) {
+	if err := application.scoreUser(userId); err != nil {
+		com.TweetyLog(com.WARNING, fmt.Sprintf("Cannot score user with id = %s. Error: %s", userId, err.Error()))
+	}
+}
+
+// Method scores users saved before bot scores existed, botRescoreBatch of them
+// per call, until every user with metadata has a score.
+func (application *Application) scoreUnscoredUsers() {
+	userIds, err := db.GetUnscoredUsers(botRescoreBatch, application.DB)
+	if err != nil {
+		com.TweetyLog(com.ERROR, fmt.Sprintf("Cannot get unscored users. Error: %s", err.Error()))
+		return
+	}
+
+	for _, userId := range userIds {
+		application.rescoreUser(userId)
+	}
+	if len(userIds) > 0 {
+		com.TweetyLog(com.INFO, fmt.Sprintf("Scored %d users without a bot score.", len(userIds)))
+	}
+}
+
+func (application *Application) scoreBots(done chan int) {
+	interval := time.Duration(application.Config.Bot.WithDefaults().RescoreIntervalSeconds) * time.Second
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			application.scoreUnscoredUsers()
+		case <-done:
+			return
+		}
+	}
+}
+
+// Handler returns the stored bot score of a user with the features and
+// weights it was computed from.
+func (application *Application) userBotScoreHandler(r *http.Request, _ struct{}) (db.BotScore, error) {
+	userId := userPathId(r)
+	score, found, err := db.GetBotScore(userId, application.DB)
+	if err != nil {
+		return score, newAPIError(http.StatusInternalServerError, "Cannot get bot score of user with id = "+userId, err)
+	}
+
+	if !found {
+		return score, newAPIError(http.StatusNotFound, "User is not scored!", nil)
+	}
+
+	return score, nil
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	db "gitlab.com/leapbit-practice/tweety-lib-db/db"
+)
+
+func TestExtractBotFeatures(t *testing.T) {
+	now := time.Date(2021, 7, 10, 12, 0, 0, 0, time.UTC)
+	tenDaysAgo := now.AddDate(0, 0, -10)
+	tomorrow := now.AddDate(0, 0, 1)
+	hourly := []time.Time{now.Add(-2 * time.Hour), now, now.Add(-3 * time.Hour), now.Add(-time.Hour)}
+
+	tests := []struct {
+		name   string
+		inputs db.BotInputs
+		want   botFeatures
+	}{
+		{
+			name:   "no data",
+			inputs: db.BotInputs{},
+			want:   botFeatures{},
+		},
+		{
+			name:   "account age and cadence",
+			inputs: db.BotInputs{CreatedAt: &tenDaysAgo, Statuses: 100, Followers: 50, Friends: 25},
+			want:   botFeatures{AccountAgeDays: optional(10), StatusesPerDay: optional(10), FollowersFriendsRatio: 2, Followers: 50, Friends: 25},
+		},
+		{
+			name:   "accounts younger than a day tweet per day",
+			inputs: db.BotInputs{CreatedAt: &tomorrow, Statuses: 30},
+			want:   botFeatures{AccountAgeDays: optional(0), StatusesPerDay: optional(30)},
+		},
+		{
+			name:   "without friends",
+			inputs: db.BotInputs{Followers: 40},
+			want:   botFeatures{FollowersFriendsRatio: 40, Followers: 40},
+		},
+		{
+			name:   "default avatar and verified",
+			inputs: db.BotInputs{ProfileImageUrl: "https://abs.twimg.com/sticky/default_profile_images/default_profile_normal.png", Verified: true},
+			want:   botFeatures{DefaultAvatar: true, Verified: true},
+		},
+		{
+			name:   "tweets at regular intervals",
+			inputs: db.BotInputs{TweetTimes: hourly},
+			want:   botFeatures{SampledTweets: 4, IntervalCV: optional(0)},
+		},
+		{
+			name:   "too few tweets for intervals",
+			inputs: db.BotInputs{TweetTimes: hourly[:2]},
+			want:   botFeatures{SampledTweets: 2},
+		},
+		{
+			name:   "repeated text ignores links and mentions",
+			inputs: db.BotInputs{TweetTexts: []string{"Buy now @alice https://a.co/1", "buy NOW @bob", "something else"}},
+			want:   botFeatures{RepeatedText: 2.0 / 3.0},
+		},
+	}
+
+	for _, test := range tests {
+		if got := extractBotFeatures(test.inputs, now); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: extractBotFeatures() = %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestBotScore(t *testing.T) {
+	weights := defaultBotWeights
+
+	tests := []struct {
+		name          string
+		config        BotConfig
+		features      botFeatures
+		wantLogOdds   float64
+		contributions []string
+	}{
+		{
+			name:          "bias only",
+			wantLogOdds:   weights["bias"],
+			contributions: []string{"bias"},
+		},
+		{
+			name:          "verified",
+			features:      botFeatures{Verified: true},
+			wantLogOdds:   weights["bias"] + weights["verified"],
+			contributions: []string{"bias", "verified"},
+		},
+		{
+			name:          "new account with a default avatar",
+			features:      botFeatures{AccountAgeDays: optional(5), DefaultAvatar: true},
+			wantLogOdds:   weights["bias"] + weights["account_age"]*math.Log1p(5) + weights["new_account"] + weights["default_avatar"],
+			contributions: []string{"bias", "account_age", "new_account", "default_avatar"},
+		},
+		{
+			name:          "high cadence",
+			features:      botFeatures{StatusesPerDay: optional(99)},
+			wantLogOdds:   weights["bias"] + weights["statuses_per_day"]*math.Log1p(99) + weights["high_cadence"],
+			contributions: []string{"bias", "statuses_per_day", "high_cadence"},
+		},
+		{
+			name:          "follow spam",
+			features:      botFeatures{Friends: 2000, Followers: 100, FollowersFriendsRatio: 0.05},
+			wantLogOdds:   weights["bias"] + weights["followers_friends_ratio"]*math.Log1p(0.05) + weights["follow_spam"],
+			contributions: []string{"bias", "followers_friends_ratio", "follow_spam"},
+		},
+		{
+			name:          "tweets are not scored below the sample size",
+			features:      botFeatures{SampledTweets: botMinSampleTweets - 1, RepeatedText: 1, IntervalCV: optional(0)},
+			wantLogOdds:   weights["bias"],
+			contributions: []string{"bias"},
+		},
+		{
+			name:     "repeated tweets at regular intervals",
+			features: botFeatures{SampledTweets: botMinSampleTweets, RepeatedText: 0.6, IntervalCV: optional(0.1)},
+			wantLogOdds: weights["bias"] + weights["repeated_text"]*0.6 + weights["duplicate_tweets"] +
+				weights["interval_regularity"]*0.9 + weights["regular_interval"],
+			contributions: []string{"bias", "repeated_text", "duplicate_tweets", "interval_regularity", "regular_interval"},
+		},
+		{
+			name:          "configured weights override the defaults",
+			config:        BotConfig{Weights: map[string]float64{"bias": 0, "verified": -1}},
+			features:      botFeatures{Verified: true},
+			wantLogOdds:   -1,
+			contributions: []string{"verified"},
+		},
+	}
+
+	for _, test := range tests {
+		breakdown := test.config.score(test.features)
+
+		if math.Abs(breakdown.LogOdds-test.wantLogOdds) > 1e-9 {
+			t.Errorf("%s: log odds = %f, want %f", test.name, breakdown.LogOdds, test.wantLogOdds)
+		}
+		if want := 1 / (1 + math.Exp(-test.wantLogOdds)); math.Abs(breakdown.Score-want) > 1e-9 {
+			t.Errorf("%s: score = %f, want %f", test.name, breakdown.Score, want)
+		}
+
+		names := make([]string, 0)
+		for _, contribution := range breakdown.Contributions {
+			names = append(names, contribution.Name)
+		}
+		if !reflect.DeepEqual(names, test.contributions) {
+			t.Errorf("%s: contributions = %v, want %v", test.name, names, test.contributions)
+		}
+	}
+}
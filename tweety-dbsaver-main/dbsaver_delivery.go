@@ -0,0 +1,429 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	com "gitlab.com/leapbit-practice/tweety-lib-communication/comms"
+	db "gitlab.com/leapbit-practice/tweety-lib-db/db"
+)
+
+const (
+	defaultMaxDeliveryAttempts = 5
+	defaultDeliveryBackoff     = 30 * time.Second
+	maxDeliveryBackoff         = time.Hour
+	deliveryTick               = 15 * time.Second
+	deliveryBatch              = 10
+	staleDeliveryAfter         = 10 * time.Minute
+	base64LineLength           = 76
+)
+
+type DeliveryConfig struct {
+	Webhooks            []WebhookConfig `json:"webhooks"`
+	SMTP                SMTPConfig      `json:"smtp"`
+	Emails              []EmailConfig   `json:"emails"`
+	MaxAttempts         int             `json:"max_attempts"`
+	RetryBackoffSeconds int             `json:"retry_backoff_seconds"`
+}
+
+// Reports and Kinds limit which reports are sent, empty lists match every report.
+// Deliveries find the webhook by Name, which defaults to URL.
+type WebhookConfig struct {
+	Name    string   `json:"name"`
+	URL     string   `json:"url"`
+	Secret  string   `json:"secret"`
+	Format  string   `json:"format"`
+	Reports []string `json:"reports"`
+	Kinds   []string `json:"kinds"`
+}
+
+type SMTPConfig struct {
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	From     string `json:"from"`
+}
+
+type EmailConfig struct {
+	To      []string `json:"to"`
+	Format  string   `json:"format"`
+	Reports []string `json:"reports"`
+	Kinds   []string `json:"kinds"`
+}
+
+func (webhook WebhookConfig) name() string {
+	if webhook.Name == "" {
+		return webhook.URL
+	}
+	return webhook.Name
+}
+
+func (config DeliveryConfig) webhook(name string) (WebhookConfig, bool) {
+	for _, webhook := range config.Webhooks {
+		if webhook.name() == name {
+			return webhook, true
+		}
+	}
+	return WebhookConfig{}, false
+}
+
+// Method checks that every webhook has a URL and a name of its own, and that
+// webhooks and emails ask for formats render can make.
+func (config DeliveryConfig) validate(render RenderConfig) error {
+	names := make(map[string]bool, len(config.Webhooks))
+	for _, webhook := range config.Webhooks {
+		if webhook.URL == "" {
+			return fmt.Errorf("webhook %q has no url", webhook.Name)
+		}
+		if names[webhook.name()] {
+			return fmt.Errorf("webhook name %q is used twice", webhook.name())
+		}
+		names[webhook.name()] = true
+		if err := render.checkFormat(deliveryFormat(webhook.Format)); err != nil {
+			return fmt.Errorf("webhook %q: %s", webhook.name(), err.Error())
+		}
+	}
+	for _, email := range config.Emails {
+		if err := render.checkFormat(deliveryFormat(email.Format)); err != nil {
+			return fmt.Errorf("email to %v: %s", email.To, err.Error())
+		}
+	}
+	return nil
+}
+
+type retryDeliveriesRequest struct {
+	ReportType string `json:"report_type"`
+	ReportId   uint64 `json:"report_id"`
+}
+
+type retryDeliveriesResponse struct {
+	Retried int64 `json:"retried"`
+}
+
+var deliveryClient = &http.Client{Timeout: 10 * time.Second}
+
+func matches(values []string, value string) bool {
+	if len(values) == 0 {
+		return true
+	}
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// Function returns the render format of a configured one, which may also be
+// a report file extension.
+func deliveryFormat(format string) string {
+	if format == "" {
+		return FORMAT_JSON
+	}
+	if extFormat, ok := reportExtensions[format]; ok {
+		return extFormat
+	}
+	return format
+}
+
+// Method queues the report for every webhook and email recipient list it is
+// configured for. The deliverer sends them in the background.
+func (application *Application) enqueueDeliveries(reportType string, kind string, reportId uint64) {
+	config := application.Config.Delivery
+	var deliveries []db.ReportDelivery
+
+	for _, webhook := range config.Webhooks {
+		if matches(webhook.Reports, reportType) && matches(webhook.Kinds, kind) {
+			deliveries = append(deliveries, db.ReportDelivery{Channel: db.DELIVERY_WEBHOOK, Webhook: webhook.name(), Target: webhook.URL, Format: deliveryFormat(webhook.Format)})
+		}
+	}
+	for _, email := range config.Emails {
+		if matches(email.Reports, reportType) && matches(email.Kinds, kind) && len(email.To) > 0 {
+			deliveries = append(deliveries, db.ReportDelivery{Channel: db.DELIVERY_EMAIL, Target: strings.Join(email.To, ","), Format: deliveryFormat(email.Format)})
+		}
+	}
+
+	for _, delivery := range deliveries {
+		delivery.ReportType, delivery.ReportId = reportType, reportId
+		if err := db.CreateReportDelivery(delivery, application.DB); err != nil {
+			com.TweetyLog(com.ERROR, fmt.Sprintf("Cannot queue %s delivery of %s report %d. Error: %s", delivery.Channel, reportType, reportId, err.Error()))
+		}
+	}
+}
+
+// Function signs timestamp.body with the webhook secret, receivers recompute
+// it to check that the report comes from DBSaver and was not replayed.
+func signPayload(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (application *Application) sendWebhook(delivery db.ReportDelivery, body []byte, contentType string) error {
+	webhook, found := application.Config.Delivery.webhook(delivery.Webhook)
+	if !found {
+		return fmt.Errorf("webhook %q is not configured", delivery.Webhook)
+	}
+
+	headers := http.Header{}
+	headers.Set("X-Tweety-Delivery", strconv.FormatUint(delivery.Id, 10))
+	headers.Set("X-Tweety-Report", fmt.Sprintf("%s/%d", delivery.ReportType, delivery.ReportId))
+	return postWebhook(delivery.Target, webhook.Secret, body, contentType, headers)
+}
+
+// Function posts body to target with headers, timestamped and signed when
+// secret is set.
+func postWebhook(target string, secret string, body []byte, contentType string, headers http.Header) error {
+	req, err := http.NewRequest(http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	for name, values := range headers {
+		req.Header[name] = values
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("X-Tweety-Timestamp", timestamp)
+	if secret != "" {
+		req.Header.Set("X-Tweety-Signature", signPayload(secret, timestamp, body))
+	}
+
+	resp, err := deliveryClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook answered with status %s", resp.Status)
+	}
+	return nil
+}
+
+// Function names the attachment of a report like /reports/{type}/{id}.{ext} does.
+func reportFilename(report db.ReportRecord, format string) string {
+	for ext, extFormat := range reportExtensions {
+		if extFormat == format {
+			return fmt.Sprintf("tweety-%s-report-%d.%s", report.Type, report.Id, ext)
+		}
+	}
+	return fmt.Sprintf("tweety-%s-report-%d", report.Type, report.Id)
+}
+
+// Function writes data base64 encoded in lines short enough for mail transfer.
+func writeBase64(w io.Writer, data []byte) error {
+	encoded := base64.StdEncoding.EncodeToString(data)
+	for len(encoded) > 0 {
+		n := base64LineLength
+		if len(encoded) < n {
+			n = len(encoded)
+		}
+		if _, err := io.WriteString(w, encoded[:n]+"\r\n"); err != nil {
+			return err
+		}
+		encoded = encoded[n:]
+	}
+	return nil
+}
+
+// Method mails the report as a base64 attachment named filename, after a short
+// text part, so binary formats and long lines survive mail transfer.
+func (application *Application) sendEmail(delivery db.ReportDelivery, title string, filename string, body []byte, contentType string) error {
+	config := application.Config.Delivery.SMTP
+	if config.Host == "" {
+		return fmt.Errorf("smtp is not configured")
+	}
+
+	to := strings.Split(delivery.Target, ",")
+
+	var msg bytes.Buffer
+	parts := multipart.NewWriter(&msg)
+	fmt.Fprintf(&msg, "From: %s\r\n", config.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", "Tweety: "+title))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&msg, "Content-Type: multipart/mixed; boundary=%s\r\n", parts.Boundary())
+	fmt.Fprintf(&msg, "\r\n")
+
+	part, err := parts.CreatePart(textproto.MIMEHeader{"Content-Type": {"text/plain; charset=utf-8"}})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(part, "%s is attached as %s.\r\n", title, filename)
+
+	part, err = parts.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {contentType},
+		"Content-Transfer-Encoding": {"base64"},
+		"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": filename})},
+	})
+	if err != nil {
+		return err
+	}
+	if err := writeBase64(part, body); err != nil {
+		return err
+	}
+	if err := parts.Close(); err != nil {
+		return err
+	}
+
+	var auth smtp.Auth
+	if config.Username != "" {
+		auth = smtp.PlainAuth("", config.Username, config.Password, config.Host)
+	}
+
+	return smtp.SendMail(fmt.Sprintf("%s:%d", config.Host, config.Port), auth, config.From, to, msg.Bytes())
+}
+
+func (application *Application) send(delivery db.ReportDelivery) error {
+	report, found, err := db.GetReport(delivery.ReportType, delivery.ReportId, application.DB)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("%s report %d does not exist", delivery.ReportType, delivery.ReportId)
+	}
+
+	format := deliveryFormat(delivery.Format)
+	body, contentType, err := renderReport(report, format, application.Config.Render)
+	if err != nil {
+		return err
+	}
+
+	switch delivery.Channel {
+	case db.DELIVERY_WEBHOOK:
+		return application.sendWebhook(delivery, body, contentType)
+	case db.DELIVERY_EMAIL:
+		return application.sendEmail(delivery, reportTitle(report), reportFilename(report, format), body, contentType)
+	}
+	return fmt.Errorf("unknown delivery channel %q", delivery.Channel)
+}
+
+// Function returns the wait before the next attempt, doubled after every failed one.
+func deliveryBackoff(base time.Duration, attempts int) time.Duration {
+	backoff := base
+	for i := 1; i < attempts && backoff < maxDeliveryBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxDeliveryBackoff {
+		backoff = maxDeliveryBackoff
+	}
+	return backoff
+}
+
+// Method returns how many times a send is attempted and the wait after the first failed one.
+func (config DeliveryConfig) retryPolicy() (int, time.Duration) {
+	maxAttempts := config.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = defaultMaxDeliveryAttempts
+	}
+	backoff := time.Duration(config.RetryBackoffSeconds) * time.Second
+	if backoff <= 0 {
+		backoff = defaultDeliveryBackoff
+	}
+	return maxAttempts, backoff
+}
+
+func (application *Application) deliverPending() {
+	maxAttempts, backoff := application.Config.Delivery.retryPolicy()
+
+	err := db.ResetStaleReportDeliveries(time.Now().Add(-staleDeliveryAfter), application.DB)
+	if err != nil {
+		com.TweetyLog(com.ERROR, fmt.Sprintf("Cannot reset stale deliveries. Error: %s", err.Error()))
+	}
+
+	deliveries, err := db.ClaimReportDeliveries(deliveryBatch, application.DB)
+	if err != nil {
+		com.TweetyLog(com.ERROR, fmt.Sprintf("Cannot get pending deliveries. Error: %s", err.Error()))
+		return
+	}
+
+	for _, delivery := range deliveries {
+		status, next := db.DELIVERY_SENT, time.Now()
+
+		sendErr := application.send(delivery)
+		if sendErr != nil {
+			status, next = db.DELIVERY_PENDING, time.Now().Add(deliveryBackoff(backoff, delivery.Attempts))
+			if delivery.Attempts >= maxAttempts {
+				status = db.DELIVERY_FAILED
+			}
+			com.TweetyLog(com.ERROR, fmt.Sprintf("Delivery %d of %s report %d to %s failed (attempt %d). Error: %s", delivery.Id, delivery.ReportType, delivery.ReportId, delivery.Target, delivery.Attempts, sendErr.Error()))
+		} else {
+			com.TweetyLog(com.INFO, fmt.Sprintf("Delivered %s report %d to %s.", delivery.ReportType, delivery.ReportId, delivery.Target))
+		}
+
+		err := db.FinishReportDelivery(delivery, status, sendErr, next, application.DB)
+		if err != nil {
+			com.TweetyLog(com.ERROR, fmt.Sprintf("Cannot save status of delivery %d. Error: %s", delivery.Id, err.Error()))
+		}
+	}
+}
+
+func (application *Application) deliver(done chan int) {
+	ticker := time.NewTicker(deliveryTick)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			application.deliverPending()
+			application.deliverAlerts()
+		case <-done:
+			return
+		}
+	}
+}
+
+func (application *Application) deliveriesHandler(r *http.Request, _ struct{}) (pageResponse, error) {
+	query := r.URL.Query()
+
+	var reportId uint64
+	if id := query.Get("report_id"); id != "" {
+		var err error
+		reportId, err = strconv.ParseUint(id, 10, 64)
+		if err != nil {
+			return pageResponse{}, newAPIError(http.StatusBadRequest, "Invalid report_id parameter!", err)
+		}
+	}
+
+	limit, err := parseLimit(r)
+	if err != nil {
+		return pageResponse{}, err
+	}
+
+	deliveries, next, err := db.GetReportDeliveries(strings.ToUpper(query.Get("status")), query.Get("report_type"), reportId, query.Get("cursor"), limit, application.DB)
+	if err != nil {
+		return pageResponse{}, queryError("Cannot get deliveries!", err)
+	}
+
+	return pageResponse{Data: deliveries, NextCursor: next}, nil
+}
+
+func (application *Application) retryDeliveriesHandler(r *http.Request, req retryDeliveriesRequest) (retryDeliveriesResponse, error) {
+	retried, err := db.RetryReportDeliveries(req.ReportType, req.ReportId, application.DB)
+	if err != nil {
+		return retryDeliveriesResponse{}, newAPIError(http.StatusInternalServerError, "Cannot retry deliveries!", err)
+	}
+
+	com.TweetyLog(com.INFO, fmt.Sprintf("Queued %d failed deliveries again.", retried))
+
+	return retryDeliveriesResponse{Retried: retried}, nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+func TestDeliveryConfigValidate(t *testing.T) {
+	pdf := RenderConfig{PDFCommand: []string{"wkhtmltopdf", "-", "-"}}
+
+	tests := []struct {
+		name    string
+		config  DeliveryConfig
+		render  RenderConfig
+		wantErr bool
+	}{
+		{
+			name:   "default formats",
+			config: DeliveryConfig{Webhooks: []WebhookConfig{{URL: "http://a"}}, Emails: []EmailConfig{{To: []string{"a@b"}}}},
+		},
+		{
+			name:   "formats and extensions",
+			config: DeliveryConfig{Webhooks: []WebhookConfig{{URL: "http://a", Format: "md"}, {URL: "http://b", Format: FORMAT_MARKDOWN}}, Emails: []EmailConfig{{Format: FORMAT_HTML}}},
+		},
+		{
+			name:    "unknown webhook format",
+			config:  DeliveryConfig{Webhooks: []WebhookConfig{{URL: "http://a", Format: "xml"}}},
+			wantErr: true,
+		},
+		{
+			name:    "unknown email format",
+			config:  DeliveryConfig{Emails: []EmailConfig{{Format: "txt"}}},
+			wantErr: true,
+		},
+		{
+			name:    "pdf without command",
+			config:  DeliveryConfig{Emails: []EmailConfig{{Format: FORMAT_PDF}}},
+			wantErr: true,
+		},
+		{
+			name:   "pdf with command",
+			config: DeliveryConfig{Emails: []EmailConfig{{Format: FORMAT_PDF}}},
+			render: pdf,
+		},
+		{
+			name:    "webhook without url",
+			config:  DeliveryConfig{Webhooks: []WebhookConfig{{Name: "a"}}},
+			wantErr: true,
+		},
+		{
+			name:    "webhook name used twice",
+			config:  DeliveryConfig{Webhooks: []WebhookConfig{{URL: "http://a"}, {Name: "http://a", URL: "http://b"}}},
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.config.validate(test.render)
+			if (err != nil) != test.wantErr {
+				t.Errorf("validate() = %v, wantErr %t", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestWriteBase64(t *testing.T) {
+	for _, size := range []int{0, 1, 57, 58, 1000} {
+		data := bytes.Repeat([]byte{0xff, 0x00, 'a'}, size)[:size]
+
+		var buf bytes.Buffer
+		if err := writeBase64(&buf, data); err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+
+		lines := strings.Split(strings.TrimSuffix(buf.String(), "\r\n"), "\r\n")
+		for _, line := range lines {
+			if len(line) > base64LineLength {
+				t.Errorf("size %d: line of %d characters", size, len(line))
+			}
+		}
+
+		decoded, err := base64.StdEncoding.DecodeString(strings.Join(lines, ""))
+		if err != nil || !bytes.Equal(decoded, data) {
+			t.Errorf("size %d: decoded %v, %v", size, decoded, err)
+		}
+	}
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	com "gitlab.com/leapbit-practice/tweety-lib-communication/comms"
+	db "gitlab.com/leapbit-practice/tweety-lib-db/db"
+)
+
+type graphWriter interface {
+	begin() error
+	node(n db.GraphNode) error
+	edge(e db.GraphEdge) error
+	end() error
+}
+
+type graphFormat struct {
+	contentType string
+	extension   string
+	newWriter   func(w io.Writer) graphWriter
+}
+
+var graphFormats = map[string]graphFormat{
+	"graphml": {"application/graphml+xml", "graphml", func(w io.Writer) graphWriter { return &graphMLWriter{w: w} }},
+	"gexf":    {"application/gexf+xml", "gexf", func(w io.Writer) graphWriter { return &gexfWriter{w: w} }},
+	"dot":     {"text/vnd.graphviz", "dot", func(w io.Writer) graphWriter { return &dotWriter{w: w} }},
+	"csv":     {"text/csv", "csv", func(w io.Writer) graphWriter { return &csvWriter{w: csv.NewWriter(w)} }},
+}
+
+func xmlEscape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+type graphMLWriter struct {
+	w     io.Writer
+	edges uint64
+}
+
+func (g *graphMLWriter) begin() error {
+	_, err := io.WriteString(g.w, `<?xml version="1.0" encoding="UTF-8"?>
+<graphml xmlns="http://graphml.graphdrawing.org/xmlns">
+  <key id="name" for="node" attr.name="name" attr.type="string"/>
+  <key id="screen_name" for="node" attr.name="screen_name" attr.type="string"/>
+  <key id="followers_count" for="node" attr.name="followers_count" attr.type="long"/>
+  <key id="friends_count" for="node" attr.name="friends_count" attr.type="long"/>
+  <key id="location_name" for="node" attr.name="location_name" attr.type="string"/>
+  <key id="verified" for="node" attr.name="verified" attr.type="boolean"/>
+  <key id="degree" for="node" attr.name="degree" attr.type="long"/>
+  <graph id="tweety" edgedefault="directed">
+`)
+	return err
+}
+
+func (g *graphMLWriter) node(n db.GraphNode) error {
+	_, err := fmt.Fprintf(g.w, `    <node id="%s">
+      <data key="name">%s</data>
+      <data key="screen_name">%s</data>
+      <data key="followers_count">%d</data>
+      <data key="friends_count">%d</data>
+      <data key="location_name">%s</data>
+      <data key="verified">%t</data>
+      <data key="degree">%d</data>
+    </node>
+`, xmlEscape(n.Id), xmlEscape(n.Name), xmlEscape(n.Screen_name), n.Followers_count, n.Friends_count,
+		xmlEscape(n.Location_name), n.Verified, n.Degree)
+	return err
+}
+
+func (g *graphMLWriter) edge(e db.GraphEdge) error {
+	g.edges++
+	_, err := fmt.Fprintf(g.w, "    <edge id=\"e%d\" source=\"%s\" target=\"%s\"/>\n", g.edges, xmlEscape(e.Source), xmlEscape(e.Target))
+	return err
+}
+
+func (g *graphMLWriter) end() error {
+	_, err := io.WriteString(g.w, "  </graph>\n</graphml>\n")
+	return err
+}
+
+// GEXF needs all nodes before the edges block, ExportGraph guarantees that order.
+type gexfWriter struct {
+	w       io.Writer
+	inEdges bool
+	edges   uint64
+}
+
+func (g *gexfWriter) begin() error {
+	_, err := fmt.Fprintf(g.w, `<?xml version="1.0" encoding="UTF-8"?>
+<gexf xmlns="http://www.gexf.net/1.3" version="1.3">
+  <meta lastmodifieddate="%s">
+    <creator>Tweety-DBSaver</creator>
+  </meta>
+  <graph defaultedgetype="directed">
+    <attributes class="node">
+      <attribute id="0" title="screen_name" type="string"/>
+      <attribute id="1" title="followers_count" type="long"/>
+      <attribute id="2" title="friends_count" type="long"/>
+      <attribute id="3" title="location_name" type="string"/>
+      <attribute id="4" title="verified" type="boolean"/>
+      <attribute id="5" title="degree" type="long"/>
+    </attributes>
+    <nodes>
+`, time.Now().Format("2006-01-02"))
+	return err
+}
+
+func (g *gexfWriter) node(n db.GraphNode) error {
+	_, err := fmt.Fprintf(g.w, `      <node id="%s" label="%s">
+        <attvalues>
+          <attvalue for="0" value="%s"/>
+          <attvalue for="1" value="%d"/>
+          <attvalue for="2" value="%d"/>
+          <attvalue for="3" value="%s"/>
+          <attvalue for="4" value="%t"/>
+          <attvalue for="5" value="%d"/>
+        </attvalues>
+      </node>
+`, xmlEscape(n.Id), xmlEscape(n.Name), xmlEscape(n.Screen_name), n.Followers_count, n.Friends_count,
+		xmlEscape(n.Location_name), n.Verified, n.Degree)
+	return err
+}
+
+func (g *gexfWriter) edge(e db.GraphEdge) error {
+	if !g.inEdges {
+		if _, err := io.WriteString(g.w, "    </nodes>\n    <edges>\n"); err != nil {
+			return err
+		}
+		g.inEdges = true
+	}
+	g.edges++
+	_, err := fmt.Fprintf(g.w, "      <edge id=\"%d\" source=\"%s\" target=\"%s\"/>\n", g.edges, xmlEscape(e.Source), xmlEscape(e.Target))
+	return err
+}
+
+func (g *gexfWriter) end() error {
+	if !g.inEdges {
+		if _, err := io.WriteString(g.w, "    </nodes>\n    <edges>\n"); err != nil {
+			return err
+		}
+	}
+	_, err := io.WriteString(g.w, "    </edges>\n  </graph>\n</gexf>\n")
+	return err
+}
+
+type dotWriter struct {
+	w io.Writer
+}
+
+func dotQuote(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	s = strings.ReplaceAll(s, "\n", `\n`)
+	return `"` + s + `"`
+}
+
+func (g *dotWriter) begin() error {
+	_, err := io.WriteString(g.w, "digraph tweety {\n")
+	return err
+}
+
+func (g *dotWriter) node(n db.GraphNode) error {
+	_, err := fmt.Fprintf(g.w, "  %s [label=%s, screen_name=%s, followers_count=%d, friends_count=%d, location_name=%s, verified=%t, degree=%d];\n",
+		dotQuote(n.Id), dotQuote(n.Name), dotQuote(n.Screen_name), n.Followers_count, n.Friends_count,
+		dotQuote(n.Location_name), n.Verified, n.Degree)
+	return err
+}
+
+func (g *dotWriter) edge(e db.GraphEdge) error {
+	_, err := fmt.Fprintf(g.w, "  %s -> %s;\n", dotQuote(e.Source), dotQuote(e.Target))
+	return err
+}
+
+func (g *dotWriter) end() error {
+	_, err := io.WriteString(g.w, "}\n")
+	return err
+}
+
+// CSV export is a plain edge list, node attributes are left out.
+type csvWriter struct {
+	w *csv.Writer
+}
+
+func (g *csvWriter) begin() error {
+	return g.w.Write([]string{"source", "target"})
+}
+
+func (g *csvWriter) node(n db.GraphNode) error {
+	return nil
+}
+
+func (g *csvWriter) edge(e db.GraphEdge) error {
+	return g.w.Write([]string{e.Source, e.Target})
+}
+
+func (g *csvWriter) end() error {
+	g.w.Flush()
+	return g.w.Error()
+}
+
+func parseGraphFilter(r *http.Request) (db.GraphFilter, error) {
+	var filter db.GraphFilter
+	var err error
+
+	query := r.URL.Query()
+
+	if from := query.Get("from"); from != "" {
+		filter.From, err = time.Parse(time.RFC3339, from)
+		if err != nil {
+			return filter, fmt.Errorf("invalid from parameter: %s", err.Error())
+		}
+	}
+
+	if to := query.Get("to"); to != "" {
+		filter.To, err = time.Parse(time.RFC3339, to)
+		if err != nil {
+			return filter, fmt.Errorf("invalid to parameter: %s", err.Error())
+		}
+	}
+
+	if minDegree := query.Get("min_degree"); minDegree != "" {
+		filter.MinDegree, err = strconv.ParseUint(minDegree, 10, 64)
+		if err != nil {
+			return filter, fmt.Errorf("invalid min_degree parameter: %s", err.Error())
+		}
+	}
+
+	filter.Location = query.Get("location")
+
+	return filter, nil
+}
+
+func (application *Application) graphExportHandler(w http.ResponseWriter, r *http.Request) {
+	dbLog := requestLog(r)
+
+	formatName := strings.ToLower(r.URL.Query().Get("format"))
+	if formatName == "" {
+		formatName = "graphml"
+	}
+
+	format, ok := graphFormats[formatName]
+	if !ok {
+		writeError(w, r, newAPIError(http.StatusBadRequest, "Unknown graph format!", fmt.Errorf("format %q", formatName)))
+		return
+	}
+
+	filter, err := parseGraphFilter(r)
+	if err != nil {
+		writeError(w, r, newAPIError(http.StatusBadRequest, "Invalid graph filter!", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", format.contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"tweety.%s\"", format.extension))
+	w.WriteHeader(http.StatusOK)
+
+	// Response is already committed, from here on errors can only be logged.
+	buf := bufio.NewWriter(w)
+	writer := format.newWriter(buf)
+
+	var nodes, edges uint64
+	err = writer.begin()
+	if err == nil {
+		err = db.ExportGraph(filter, application.DB,
+			func(n db.GraphNode) error {
+				nodes++
+				return writer.node(n)
+			},
+			func(e db.GraphEdge) error {
+				edges++
+				return writer.edge(e)
+			})
+	}
+	if err == nil {
+		err = writer.end()
+	}
+	if err == nil {
+		err = buf.Flush()
+	}
+	if err != nil {
+		msg := "500 - Graph export interrupted!"
+		dbLog.Resp = msg
+		com.TweetyLog(com.ERROR, fmt.Sprintf("%s Error: %s", msg, err.Error()))
+		return
+	}
+
+	com.TweetyLog(com.INFO, fmt.Sprintf("Exported graph with %d nodes and %d edges as %s.", nodes, edges, formatName))
+}
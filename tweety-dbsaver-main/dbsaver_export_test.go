@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/xml"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+
+	db "gitlab.com/leapbit-practice/tweety-lib-db/db"
+)
+
+func writeGraph(t *testing.T, format string, nodes []db.GraphNode, edges []db.GraphEdge) string {
+	t.Helper()
+
+	var buf bytes.Buffer
+	writer := graphFormats[format].newWriter(&buf)
+	if err := writer.begin(); err != nil {
+		t.Fatalf("begin: %v", err)
+	}
+	for _, n := range nodes {
+		if err := writer.node(n); err != nil {
+			t.Fatalf("node: %v", err)
+		}
+	}
+	for _, e := range edges {
+		if err := writer.edge(e); err != nil {
+			t.Fatalf("edge: %v", err)
+		}
+	}
+	if err := writer.end(); err != nil {
+		t.Fatalf("end: %v", err)
+	}
+	return buf.String()
+}
+
+func wellFormedXML(t *testing.T, out string) {
+	t.Helper()
+
+	decoder := xml.NewDecoder(strings.NewReader(out))
+	for {
+		_, err := decoder.Token()
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			t.Fatalf("malformed xml: %v\n%s", err, out)
+		}
+	}
+}
+
+func TestGraphWriters(t *testing.T) {
+	nodes := []db.GraphNode{
+		{Id: "1", Name: `Tom & "Jerry"`, Screen_name: "tom<3", Followers_count: 10, Friends_count: 2, Location_name: "Zagreb", Verified: true, Degree: 1},
+		{Id: "2", Name: "Line\nbreak", Screen_name: `back\slash`, Degree: 1},
+	}
+	edges := []db.GraphEdge{{Source: "1", Target: "2"}}
+
+	tests := []struct {
+		format string
+		xml    bool
+		want   []string
+	}{
+		{
+			format: "graphml",
+			xml:    true,
+			want: []string{
+				`<node id="1">`,
+				`<data key="name">Tom &amp; &#34;Jerry&#34;</data>`,
+				`<data key="screen_name">tom&lt;3</data>`,
+				`<data key="followers_count">10</data>`,
+				`<data key="verified">true</data>`,
+				`<edge id="e1" source="1" target="2"/>`,
+			},
+		},
+		{
+			format: "gexf",
+			xml:    true,
+			want: []string{
+				`<node id="1" label="Tom &amp; &#34;Jerry&#34;">`,
+				`<attvalue for="0" value="tom&lt;3"/>`,
+				`<attvalue for="5" value="1"/>`,
+				"</nodes>\n    <edges>\n",
+				`<edge id="1" source="1" target="2"/>`,
+			},
+		},
+		{
+			format: "dot",
+			want: []string{
+				"digraph tweety {\n",
+				`"1" [label="Tom & \"Jerry\"", screen_name="tom<3", followers_count=10, friends_count=2, location_name="Zagreb", verified=true, degree=1];`,
+				`"2" [label="Line\nbreak", screen_name="back\\slash"`,
+				`"1" -> "2";`,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.format, func(t *testing.T) {
+			out := writeGraph(t, test.format, nodes, edges)
+			if test.xml {
+				wellFormedXML(t, out)
+			}
+			for _, want := range test.want {
+				if !strings.Contains(out, want) {
+					t.Errorf("output misses %q\n%s", want, out)
+				}
+			}
+		})
+	}
+}
+
+func TestGEXFWithoutEdges(t *testing.T) {
+	out := writeGraph(t, "gexf", []db.GraphNode{{Id: "1"}}, nil)
+	wellFormedXML(t, out)
+	if !strings.Contains(out, "</nodes>\n    <edges>\n    </edges>") {
+		t.Errorf("empty edges block missing\n%s", out)
+	}
+}
+
+func TestCSVWriter(t *testing.T) {
+	edges := []db.GraphEdge{{Source: "1", Target: "2"}, {Source: "a,b", Target: `"c"`}}
+	out := writeGraph(t, "csv", []db.GraphNode{{Id: "1"}, {Id: "2"}}, edges)
+
+	records, err := csv.NewReader(strings.NewReader(out)).ReadAll()
+	if err != nil {
+		t.Fatalf("malformed csv: %v\n%s", err, out)
+	}
+	want := [][]string{{"source", "target"}, {"1", "2"}, {"a,b", `"c"`}}
+	if !reflect.DeepEqual(records, want) {
+		t.Errorf("records = %q, want %q", records, want)
+	}
+}
@@ -0,0 +1,412 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"reflect"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	com "gitlab.com/leapbit-practice/tweety-lib-communication/comms"
+	db "gitlab.com/leapbit-practice/tweety-lib-db/db"
+)
+
+// Request bodies carry at most a user with its friend ids or two images.
+const maxBodySize = 32 << 20
+
+type contextKey int
+
+const logContextKey contextKey = 0
+
+type middleware func(http.Handler) http.Handler
+
+// Requests implementing sender fill in the application name and send time of the log entry.
+type sender interface {
+	Sender() (string, time.Time)
+}
+
+// Requests implementing validator are checked right after decoding.
+type validator interface {
+	Validate() error
+}
+
+// Handlers with nothing to return use empty as their response type
+// and answer with the status code only.
+type empty struct{}
+
+type apiError struct {
+	Status int
+	Msg    string
+	Err    error
+	Fields []com.FieldError
+}
+
+var errorCodes = map[int]string{
+	http.StatusBadRequest:            "bad_request",
+	http.StatusNotFound:              "not_found",
+	http.StatusMethodNotAllowed:      "method_not_allowed",
+	http.StatusConflict:              "conflict",
+	http.StatusRequestEntityTooLarge: "payload_too_large",
+	http.StatusUnsupportedMediaType:  "unsupported_media_type",
+	http.StatusUnprocessableEntity:   "validation_failed",
+	http.StatusInternalServerError:   "internal_error",
+	http.StatusNotImplemented:        "not_implemented",
+	http.StatusServiceUnavailable:    "unavailable",
+}
+
+func (e *apiError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("%d - %s Error: %s", e.Status, e.Msg, e.Err.Error())
+	}
+	return fmt.Sprintf("%d - %s", e.Status, e.Msg)
+}
+
+func (e *apiError) Unwrap() error {
+	return e.Err
+}
+
+func newAPIError(status int, msg string, err error) *apiError {
+	return &apiError{Status: status, Msg: msg, Err: err}
+}
+
+func newValidationError(err error) *apiError {
+	apiErr := newAPIError(http.StatusUnprocessableEntity, "Request validation failed!", err)
+	var validationErr *com.ValidationError
+	if errors.As(err, &validationErr) {
+		apiErr.Fields = validationErr.Fields
+	}
+	return apiErr
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *statusRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	return rec.ResponseWriter.Write(b)
+}
+
+func (rec *statusRecorder) Flush() {
+	if flusher, ok := rec.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func chain(h http.Handler, middlewares ...middleware) http.Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		h = middlewares[i](h)
+	}
+	return h
+}
+
+// Function returns the log entry of the current request.
+// Outside of withRequestLog a detached entry is returned so handlers never get nil.
+func requestLog(r *http.Request) *db.DBLog {
+	if dbLog, ok := r.Context().Value(logContextKey).(*db.DBLog); ok {
+		return dbLog
+	}
+	return &db.DBLog{Address: r.RemoteAddr, ArrivedAt: time.Now(), Req: db.Request{Method: r.Method, URI: r.RequestURI}}
+}
+
+// Method wraps handler with the standard middleware chain every DBSaver endpoint uses,
+// extra middlewares run innermost, right before the handler.
+func (application *Application) endpoint(label string, name string, h http.Handler, extra ...middleware) http.Handler {
+	middlewares := []middleware{
+		application.withMetrics(label),
+		application.withRequestLog(name),
+		withRecovery(),
+		withBodyLimit(maxBodySize),
+	}
+	return chain(h, append(middlewares, extra...)...)
+}
+
+func (application *Application) withMetrics(label string) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			timer := prometheus.NewTimer(application.Metrics.RequestsDuration.WithLabelValues(label))
+			application.Metrics.TotalRequests.WithLabelValues(label).Inc()
+			defer timer.ObserveDuration()
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func (application *Application) withRequestLog(name string) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			com.TweetyLog(com.INFO, fmt.Sprintf("%s Handler starting...", name))
+
+			dbLog := &db.DBLog{AppName: "", Address: r.RemoteAddr, ArrivedAt: time.Now(), SentAt: time.Time{}, Req: db.Request{Method: r.Method, URI: r.RequestURI, Body: ""}, Resp: ""}
+			rec := &statusRecorder{ResponseWriter: w}
+
+			defer com.TweetyLog(com.INFO, fmt.Sprintf("%s Handler finished.", name))
+			defer func() {
+				if dbLog.Resp == "" && rec.status != 0 {
+					dbLog.Resp = fmt.Sprintf("%d - %s!", rec.status, http.StatusText(rec.status))
+				}
+				db.SaveLog(dbLog, application.DB)
+			}()
+
+			next.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), logContextKey, dbLog)))
+		})
+	}
+}
+
+func withRecovery() middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer func() {
+				if p := recover(); p != nil {
+					if p == http.ErrAbortHandler {
+						panic(p)
+					}
+					com.TweetyLog(com.ERROR, fmt.Sprintf("Handler panic: %v\n%s", p, debug.Stack()))
+					writeError(w, r, newAPIError(http.StatusInternalServerError, "Internal server error!", fmt.Errorf("%v", p)))
+				}
+			}()
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func withMethods(methods ...string) middleware {
+	allow := strings.Join(methods, ", ")
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for _, method := range methods {
+				if r.Method == method {
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+			w.Header().Set("Allow", allow)
+			writeError(w, r, newAPIError(http.StatusMethodNotAllowed, "Method not allowed!", fmt.Errorf("method %s, allowed %s", r.Method, allow)))
+		})
+	}
+}
+
+// Function dispatches a request to the handler of its method, other methods
+// are not allowed.
+func byMethod(handlers map[string]http.Handler) http.Handler {
+	methods := make([]string, 0, len(handlers))
+	for method := range handlers {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+
+	return withMethods(methods...)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handlers[r.Method].ServeHTTP(w, r)
+	}))
+}
+
+func withBodyLimit(limit int64) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r.Body = http.MaxBytesReader(w, r.Body, limit)
+			defer r.Body.Close()
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// Function reads and unmarshals the JSON body into req.
+// Empty bodies are allowed and leave req at its zero value.
+func decodeBody(r *http.Request, dbLog *db.DBLog, req interface{}) error {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			return newAPIError(http.StatusRequestEntityTooLarge, "Request body too large!", err)
+		}
+		return newAPIError(http.StatusBadRequest, "Cannot read body!", err)
+	}
+
+	dbLog.Req.Body = string(body)
+
+	if len(body) == 0 {
+		return nil
+	}
+
+	// Older clients send no Content-Type at all, only an explicit non-JSON type is refused.
+	if contentType := r.Header.Get("Content-Type"); contentType != "" {
+		mediaType, _, err := mime.ParseMediaType(contentType)
+		if err != nil || mediaType != "application/json" {
+			return newAPIError(http.StatusUnsupportedMediaType, "Content-Type must be application/json!", fmt.Errorf("content type %q", contentType))
+		}
+	}
+
+	err = json.Unmarshal(body, req)
+	if err != nil {
+		return newAPIError(http.StatusBadRequest, "Cannot unmarshal body!", err)
+	}
+
+	return nil
+}
+
+// Function fills the fields of struct req from URL query parameters,
+// matching parameter names against the json tags of the fields.
+func decodeQuery(query url.Values, req interface{}) error {
+	value := reflect.ValueOf(req).Elem()
+	if value.Kind() != reflect.Struct {
+		return nil
+	}
+
+	t := value.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" || field.PkgPath != "" {
+			continue
+		}
+		param, ok := query[name]
+		if !ok || len(param) == 0 {
+			continue
+		}
+
+		fieldValue := value.Field(i)
+		raw := param[0]
+		var err error
+		switch {
+		case fieldValue.Type() == reflect.TypeOf(time.Time{}):
+			var t time.Time
+			t, err = time.Parse(time.RFC3339Nano, raw)
+			fieldValue.Set(reflect.ValueOf(t))
+		case fieldValue.Kind() == reflect.String:
+			fieldValue.SetString(raw)
+		case fieldValue.Kind() == reflect.Bool:
+			var b bool
+			b, err = strconv.ParseBool(raw)
+			fieldValue.SetBool(b)
+		case fieldValue.Kind() >= reflect.Int && fieldValue.Kind() <= reflect.Int64:
+			var n int64
+			n, err = strconv.ParseInt(raw, 10, 64)
+			fieldValue.SetInt(n)
+		case fieldValue.Kind() >= reflect.Uint && fieldValue.Kind() <= reflect.Uint64:
+			var n uint64
+			n, err = strconv.ParseUint(raw, 10, 64)
+			fieldValue.SetUint(n)
+		case fieldValue.Kind() == reflect.Slice && fieldValue.Type().Elem().Kind() == reflect.String:
+			fieldValue.Set(reflect.ValueOf(param))
+		}
+		if err != nil {
+			return newValidationError(&com.ValidationError{Fields: []com.FieldError{{Field: name, Rule: "type", Message: err.Error()}}})
+		}
+	}
+
+	return nil
+}
+
+// Function turns a typed handler into an http.Handler. The request is decoded
+// from the JSON body, or from query parameters when a GET carries no body,
+// and validated before fn runs. Its result or error is written as JSON.
+func Handle[Req any, Resp any](fn func(r *http.Request, req Req) (Resp, error)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		dbLog := requestLog(r)
+
+		var req Req
+		if err := decodeBody(r, dbLog, &req); err != nil {
+			writeError(w, r, err)
+			return
+		}
+
+		if dbLog.Req.Body == "" && r.Method == http.MethodGet {
+			if err := decodeQuery(r.URL.Query(), &req); err != nil {
+				writeError(w, r, err)
+				return
+			}
+		}
+
+		if s, ok := any(req).(sender); ok {
+			dbLog.AppName, dbLog.SentAt = s.Sender()
+		}
+
+		if err := com.Validate(req); err != nil {
+			writeError(w, r, newValidationError(err))
+			return
+		}
+
+		if v, ok := any(req).(validator); ok {
+			if err := v.Validate(); err != nil {
+				writeError(w, r, newValidationError(err))
+				return
+			}
+		}
+
+		resp, err := fn(r, req)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+
+		writeResponse(w, r, http.StatusOK, resp)
+	})
+}
+
+func writeResponse(w http.ResponseWriter, r *http.Request, status int, resp interface{}) {
+	dbLog := requestLog(r)
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if _, ok := resp.(empty); ok {
+		w.WriteHeader(status)
+		dbLog.Resp = fmt.Sprintf("%d - %s!", status, http.StatusText(status))
+		return
+	}
+
+	js, err := json.Marshal(resp)
+	if err != nil {
+		writeError(w, r, newAPIError(http.StatusInternalServerError, "Cannot marshal data!", err))
+		return
+	}
+
+	w.WriteHeader(status)
+	w.Write(js)
+	dbLog.Resp = fmt.Sprintf("%d - %s!", status, http.StatusText(status))
+}
+
+// Function maps err to a status code and writes it as a JSON error body.
+// Errors that are not *apiError are treated as internal errors.
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	var apiErr *apiError
+	if !errors.As(err, &apiErr) {
+		apiErr = newAPIError(http.StatusInternalServerError, "Internal server error!", err)
+	}
+
+	dbLog := requestLog(r)
+	dbLog.Resp = fmt.Sprintf("%d - %s", apiErr.Status, apiErr.Msg)
+	com.TweetyLog(com.ERROR, apiErr.Error())
+
+	code, ok := errorCodes[apiErr.Status]
+	if !ok {
+		code = strings.ReplaceAll(strings.ToLower(http.StatusText(apiErr.Status)), " ", "_")
+	}
+
+	js, _ := json.Marshal(com.RespError{Error: apiErr.Msg, Code: code, Fields: apiErr.Fields})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(apiErr.Status)
+	w.Write(js)
+}
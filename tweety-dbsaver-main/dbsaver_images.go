@@ -0,0 +1,533 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"math/bits"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	com "gitlab.com/leapbit-practice/tweety-lib-communication/comms"
+	db "gitlab.com/leapbit-practice/tweety-lib-db/db"
+)
+
+const (
+	// Difference hashes of resized or recompressed copies of an image are at most a few bits apart.
+	defaultAvatarDistance = 4
+	minHashBlockBits      = 8
+	defaultAvatarClusters = 50
+
+	// Blobs and legacy zips are hashed in batches, images are large.
+	imageHashBatch                  = 50
+	defaultImageHashIntervalSeconds = 60
+
+	defaultImageMaxAgeSeconds = 3600
+	defaultMaxThumbnailSize   = 1024
+	thumbnailJPEGQuality      = 85
+)
+
+// Thumbnails are cached in CacheDir, tweety-thumbnails in the temp directory
+// by default. Clients may cache images for MaxAgeSeconds and thumbnails are
+// at most MaxThumbnailSize pixels on their longer side. Blobs and legacy zips
+// stored before difference hashes are hashed every HashIntervalSeconds,
+// a minute by default.
+type ImagesConfig struct {
+	CacheDir            string `json:"cache_dir"`
+	MaxAgeSeconds       int    `json:"max_age_seconds"`
+	MaxThumbnailSize    int    `json:"max_thumbnail_size"`
+	HashIntervalSeconds int    `json:"hash_interval_seconds"`
+}
+
+func (config ImagesConfig) WithDefaults() ImagesConfig {
+	if config.CacheDir == "" {
+		config.CacheDir = filepath.Join(os.TempDir(), "tweety-thumbnails")
+	}
+	if config.MaxAgeSeconds <= 0 {
+		config.MaxAgeSeconds = defaultImageMaxAgeSeconds
+	}
+	if config.MaxThumbnailSize <= 0 {
+		config.MaxThumbnailSize = defaultMaxThumbnailSize
+	}
+	if config.HashIntervalSeconds <= 0 {
+		config.HashIntervalSeconds = defaultImageHashIntervalSeconds
+	}
+	return config
+}
+
+// Names of the images in the zips stored before images were content-addressed.
+var legacyImageNames = map[string]string{
+	com.IMAGE_PROFILE: "profile_image.png",
+	com.IMAGE_BANNER:  "banner.png",
+}
+
+// Users whose current images are at most the requested distance apart,
+// directly or through other users of the cluster. MaxDistance is the
+// largest distance between two images of the cluster.
+type avatarCluster struct {
+	Users       []db.ImageHash `json:"users"`
+	MaxDistance int            `json:"max_distance"`
+}
+
+// Function groups images by difference hash and links hashes at most
+// maxDistance bits apart. Clusters with most users come first.
+func clusterImageHashes(hashes []db.ImageHash, maxDistance int) []avatarCluster {
+	byHash := make(map[uint64][]db.ImageHash)
+	for _, hash := range hashes {
+		byHash[hash.DHash] = append(byHash[hash.DHash], hash)
+	}
+
+	keys := make([]uint64, 0, len(byHash))
+	for key := range byHash {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+
+	parent := make([]int, len(keys))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(i int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+
+	for _, candidates := range hashCandidates(keys, maxDistance) {
+		for x, i := range candidates {
+			for _, j := range candidates[x+1:] {
+				if find(i) != find(j) && bits.OnesCount64(keys[i]^keys[j]) <= maxDistance {
+					parent[find(j)] = find(i)
+				}
+			}
+		}
+	}
+
+	members := make(map[int][]uint64)
+	for i, key := range keys {
+		root := find(i)
+		members[root] = append(members[root], key)
+	}
+
+	clusters := make([]avatarCluster, 0, len(members))
+	for _, clusterKeys := range members {
+		var cluster avatarCluster
+		for i, key := range clusterKeys {
+			cluster.Users = append(cluster.Users, byHash[key]...)
+			for _, other := range clusterKeys[i+1:] {
+				if distance := bits.OnesCount64(key ^ other); distance > cluster.MaxDistance {
+					cluster.MaxDistance = distance
+				}
+			}
+		}
+		sort.Slice(cluster.Users, func(i, j int) bool { return cluster.Users[i].UserId < cluster.Users[j].UserId })
+		clusters = append(clusters, cluster)
+	}
+
+	sort.Slice(clusters, func(i, j int) bool {
+		if len(clusters[i].Users) == len(clusters[j].Users) {
+			return clusters[i].Users[0].UserId < clusters[j].Users[0].UserId
+		}
+		return len(clusters[i].Users) > len(clusters[j].Users)
+	})
+
+	return clusters
+}
+
+// Function groups indexes of keys that may be at most maxDistance bits apart.
+// Split into maxDistance+1 blocks, two such hashes have at least one block
+// equal, so only hashes sharing a block are compared. Blocks narrower than
+// minHashBlockBits match almost everything, then all keys are one group.
+func hashCandidates(keys []uint64, maxDistance int) [][]int {
+	blocks := maxDistance + 1
+	if 64/blocks < minHashBlockBits {
+		all := make([]int, len(keys))
+		for i := range all {
+			all[i] = i
+		}
+		return [][]int{all}
+	}
+
+	groups := make([][]int, 0)
+	for block := 0; block < blocks; block++ {
+		from, to := block*64/blocks, (block+1)*64/blocks
+		mask := uint64(1)<<(to-from) - 1
+
+		byBlock := make(map[uint64][]int)
+		for i, key := range keys {
+			value := key >> from & mask
+			byBlock[value] = append(byBlock[value], i)
+		}
+		for _, group := range byBlock {
+			if len(group) > 1 {
+				groups = append(groups, group)
+			}
+		}
+	}
+
+	return groups
+}
+
+func parseIntParam(r *http.Request, name string, def int, min int, max int) (int, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < min || n > max {
+		return 0, newAPIError(http.StatusBadRequest, "Invalid "+name+" parameter!", err)
+	}
+	return n, nil
+}
+
+// Handler serves /avatars/similar, users sharing visually identical or near
+// identical current images. Query parameters are kind (profile or banner),
+// max_distance in bits, min_users per cluster, user_id to return only the
+// cluster of one user and limit.
+func (application *Application) similarAvatarsHandler(r *http.Request, _ struct{}) (pageResponse, error) {
+	query := r.URL.Query()
+
+	kind := query.Get("kind")
+	if kind == "" {
+		kind = com.IMAGE_PROFILE
+	}
+	if kind != com.IMAGE_PROFILE && kind != com.IMAGE_BANNER {
+		return pageResponse{}, newAPIError(http.StatusBadRequest, "Invalid kind parameter!", nil)
+	}
+
+	maxDistance, err := parseIntParam(r, "max_distance", defaultAvatarDistance, 0, 64)
+	if err != nil {
+		return pageResponse{}, err
+	}
+
+	minUsers, err := parseIntParam(r, "min_users", 2, 1, 1<<20)
+	if err != nil {
+		return pageResponse{}, err
+	}
+
+	limit, err := parseLimit(r)
+	if err != nil {
+		return pageResponse{}, err
+	}
+	if limit <= 0 {
+		limit = defaultAvatarClusters
+	}
+
+	hashes, err := db.GetCurrentImageHashes(kind, application.DB)
+	if err != nil {
+		return pageResponse{}, newAPIError(http.StatusInternalServerError, "Cannot get image hashes!", err)
+	}
+
+	userId := query.Get("user_id")
+	clusters := make([]avatarCluster, 0)
+	for _, cluster := range clusterImageHashes(hashes, maxDistance) {
+		if len(cluster.Users) < minUsers {
+			continue
+		}
+		if userId != "" && !clusterHasUser(cluster, userId) {
+			continue
+		}
+		clusters = append(clusters, cluster)
+		if len(clusters) == limit {
+			break
+		}
+	}
+
+	return pageResponse{Data: clusters}, nil
+}
+
+func clusterHasUser(cluster avatarCluster, userId string) bool {
+	for _, user := range cluster.Users {
+		if user.UserId == userId {
+			return true
+		}
+	}
+	return false
+}
+
+func unzipImage(zipped []byte, name string) ([]byte, bool, error) {
+	reader, err := zip.NewReader(bytes.NewReader(zipped), int64(len(zipped)))
+	if err != nil {
+		return nil, false, err
+	}
+
+	for _, file := range reader.File {
+		if file.Name != name {
+			continue
+		}
+		rc, err := file.Open()
+		if err != nil {
+			return nil, false, err
+		}
+		defer rc.Close()
+
+		data, err := io.ReadAll(rc)
+		return data, err == nil, err
+	}
+
+	return nil, false, nil
+}
+
+// Method returns the current image of kind of a user. Users without stored
+// images fall back to the zip they had before, whatever format its images are.
+func (application *Application) loadUserImage(userId string, kind string) (com.ImageVersion, []byte, bool, error) {
+	stored, data, found, err := db.GetUserImageData(userId, kind, application.DB)
+	if err != nil || found {
+		return stored, data, found, err
+	}
+
+	zipped, lastModified, found, err := db.GetLegacyUserImages(userId, application.DB)
+	if err != nil || !found {
+		return stored, nil, false, err
+	}
+
+	data, found, err = unzipImage(zipped, legacyImageNames[kind])
+	if err != nil || !found {
+		return stored, nil, false, err
+	}
+
+	stored = com.ImageVersion{
+		Kind:       kind,
+		Sha256:     com.ImageDigest(data),
+		MimeType:   com.ImageMimeType(data),
+		Size:       int64(len(data)),
+		CreatedAt:  lastModified,
+		LastSeenAt: lastModified,
+	}
+	if stored.MimeType == "" {
+		stored.MimeType = http.DetectContentType(data)
+	}
+
+	return stored, data, true, nil
+}
+
+// Method hashes imageHashBatch blobs stored before difference hashes existed
+// and imports imageHashBatch legacy zips, so their images are clustered too.
+func (application *Application) hashImages() {
+	hashed, err := db.HashImageBlobs(imageHashBatch, application.DB)
+	if err != nil {
+		com.TweetyLog(com.ERROR, fmt.Sprintf("Cannot hash image blobs. Error: %s", err.Error()))
+	} else if hashed > 0 {
+		com.TweetyLog(com.INFO, fmt.Sprintf("Hashed %d image blobs.", hashed))
+	}
+
+	legacy, err := db.GetUnimportedLegacyImages(imageHashBatch, application.DB)
+	if err != nil {
+		com.TweetyLog(com.ERROR, fmt.Sprintf("Cannot get legacy images. Error: %s", err.Error()))
+		return
+	}
+
+	for _, user := range legacy {
+		images := make([]com.UserImage, 0, len(legacyImageNames))
+		for kind, name := range legacyImageNames {
+			data, found, err := unzipImage(user.Zipped, name)
+			if err != nil {
+				com.TweetyLog(com.WARNING, fmt.Sprintf("Cannot unzip %s image of user with id = %s. Error: %s", kind, user.UserId, err.Error()))
+			}
+			if found && len(data) > 0 {
+				images = append(images, com.UserImage{Kind: kind, Data: data})
+			}
+		}
+
+		if err := db.ImportLegacyUserImages(user.UserId, images, user.LastModified, application.DB); err != nil {
+			com.TweetyLog(com.ERROR, fmt.Sprintf("Cannot import legacy images of user with id = %s. Error: %s", user.UserId, err.Error()))
+		}
+	}
+	if len(legacy) > 0 {
+		com.TweetyLog(com.INFO, fmt.Sprintf("Imported legacy images of %d users.", len(legacy)))
+	}
+}
+
+func (application *Application) hashStoredImages(done chan int) {
+	interval := time.Duration(application.Config.Images.WithDefaults().HashIntervalSeconds) * time.Second
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			application.hashImages()
+		case <-done:
+			return
+		}
+	}
+}
+
+// Function shrinks img to fit a size x size box keeping its aspect ratio,
+// every pixel gets the mean color of the pixels it covers. Images that
+// already fit are returned as they are.
+func resizeImage(img image.Image, size int) image.Image {
+	bounds := img.Bounds()
+	srcWidth, srcHeight := bounds.Dx(), bounds.Dy()
+	if srcWidth <= size && srcHeight <= size {
+		return img
+	}
+
+	width, height := size, srcHeight*size/srcWidth
+	if srcHeight > srcWidth {
+		width, height = srcWidth*size/srcHeight, size
+	}
+	if width < 1 {
+		width = 1
+	}
+	if height < 1 {
+		height = 1
+	}
+
+	dst := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0, y1 := bounds.Min.Y+y*srcHeight/height, bounds.Min.Y+(y+1)*srcHeight/height
+		for x := 0; x < width; x++ {
+			x0, x1 := bounds.Min.X+x*srcWidth/width, bounds.Min.X+(x+1)*srcWidth/width
+
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					pr, pg, pb, pa := img.At(sx, sy).RGBA()
+					r, g, b, a = r+uint64(pr), g+uint64(pg), b+uint64(pb), a+uint64(pa)
+					n++
+				}
+			}
+			if a == 0 {
+				continue
+			}
+			// Colors are premultiplied by alpha, dividing by it keeps edges of transparent images from darkening.
+			dst.SetNRGBA(x, y, color.NRGBA{
+				R: uint8(r * 0xff / a),
+				G: uint8(g * 0xff / a),
+				B: uint8(b * 0xff / a),
+				A: uint8(a / n >> 8),
+			})
+		}
+	}
+
+	return dst
+}
+
+// Function returns the MIME type and file extension thumbnails of an image
+// are encoded as. JPEG photos stay JPEG, everything else becomes PNG.
+func thumbnailFormat(mimeType string) (string, string) {
+	if mimeType == "image/jpeg" {
+		return "image/jpeg", ".jpg"
+	}
+	return "image/png", ".png"
+}
+
+func writeCacheFile(dir string, path string, data []byte) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(dir, ".thumbnail-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	// Rename is atomic, concurrent requests never read a half written thumbnail.
+	return os.Rename(tmp.Name(), path)
+}
+
+// Method returns a thumbnail of a stored image, from the disk cache when it was made
+// before. Thumbnails are cached by SHA-256 and size, so they never go stale.
+func (application *Application) thumbnail(stored com.ImageVersion, data []byte, size int) ([]byte, string, error) {
+	config := application.Config.Images.WithDefaults()
+	contentType, ext := thumbnailFormat(stored.MimeType)
+	path := filepath.Join(config.CacheDir, fmt.Sprintf("%s-%d%s", stored.Sha256, size, ext))
+
+	if cached, err := os.ReadFile(path); err == nil {
+		return cached, contentType, nil
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", err
+	}
+
+	var buf bytes.Buffer
+	thumb := resizeImage(img, size)
+	if contentType == "image/jpeg" {
+		err = jpeg.Encode(&buf, thumb, &jpeg.Options{Quality: thumbnailJPEGQuality})
+	} else {
+		err = png.Encode(&buf, thumb)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	if err := writeCacheFile(config.CacheDir, path, buf.Bytes()); err != nil {
+		com.TweetyLog(com.WARNING, fmt.Sprintf("Cannot cache thumbnail %s. Error: %s", path, err.Error()))
+	}
+
+	return buf.Bytes(), contentType, nil
+}
+
+// Handler serves /users/{id}/images/{kind}, the current profile or banner
+// image of a user. With size it serves a thumbnail at most size pixels on its
+// longer side. Images are revalidated by ETag, the SHA-256 of the image.
+func (application *Application) userImageFileHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/users/"), "/"), "/")
+	userId, kind := parts[0], parts[2]
+	config := application.Config.Images.WithDefaults()
+
+	if kind != com.IMAGE_PROFILE && kind != com.IMAGE_BANNER {
+		writeError(w, r, newAPIError(http.StatusNotFound, "Unknown image kind!", fmt.Errorf("kind %q", kind)))
+		return
+	}
+
+	size, err := parseIntParam(r, "size", 0, 1, config.MaxThumbnailSize)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	stored, data, found, err := application.loadUserImage(userId, kind)
+	if err != nil {
+		writeError(w, r, newAPIError(http.StatusInternalServerError, "Cannot get image!", err))
+		return
+	}
+	if !found {
+		writeError(w, r, newAPIError(http.StatusNotFound, fmt.Sprintf("No %s image for user with id = %s!", kind, userId), nil))
+		return
+	}
+
+	contentType, etag := stored.MimeType, fmt.Sprintf("\"%s\"", stored.Sha256)
+	if size > 0 {
+		thumb, thumbType, err := application.thumbnail(stored, data, size)
+		if err != nil {
+			// WebP images cannot be decoded, they are served at full size.
+			com.TweetyLog(com.WARNING, fmt.Sprintf("Cannot make thumbnail of %s image %s, serving it whole. Error: %s", kind, stored.Sha256, err.Error()))
+		} else {
+			data, contentType, etag = thumb, thumbType, fmt.Sprintf("\"%s-%d\"", stored.Sha256, size)
+		}
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", config.MaxAgeSeconds))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+
+	// ServeContent answers If-None-Match with 304 and HEAD requests without a body.
+	http.ServeContent(w, r, "", stored.CreatedAt.Truncate(time.Second), bytes.NewReader(data))
+}
@@ -0,0 +1,588 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	com "gitlab.com/leapbit-practice/tweety-lib-communication/comms"
+	db "gitlab.com/leapbit-practice/tweety-lib-db/db"
+	text "gitlab.com/leapbit-practice/tweety-lib-text/text"
+)
+
+const (
+	FORMAT_JSON     = "json"
+	FORMAT_MARKDOWN = "markdown"
+	FORMAT_HTML     = "html"
+	FORMAT_PDF      = "pdf"
+
+	chartWidth      = 640
+	chartLabelWidth = 180
+	chartBarHeight  = 18
+	chartBarGap     = 6
+	chartMaxBars    = 15
+
+	pdfTimeout = time.Minute
+)
+
+var formatContentTypes = map[string]string{
+	FORMAT_JSON:     "application/json",
+	FORMAT_MARKDOWN: "text/markdown; charset=utf-8",
+	FORMAT_HTML:     "text/html; charset=utf-8",
+	FORMAT_PDF:      "application/pdf",
+}
+
+// PDFCommand reads HTML on stdin and writes PDF to stdout,
+// e.g. ["wkhtmltopdf", "--quiet", "-", "-"]. PDF is off without it.
+type RenderConfig struct {
+	PDFCommand []string `json:"pdf_command"`
+}
+
+// Report columns decoded into tables, in the order they are rendered.
+type reportView struct {
+	Title      string
+	Kind       string
+	ReportedAt time.Time
+	WindowFrom *time.Time
+	WindowTo   *time.Time
+	Facts      [][2]string
+	Sections   []reportSection
+}
+
+// ChartColumn is the column drawn as a bar chart next to the table, 0 means no chart.
+type reportSection struct {
+	Title       string
+	Columns     []string
+	Rows        [][]string
+	ChartColumn int
+}
+
+func reportTitle(report db.ReportRecord) string {
+	kind := strings.ToLower(report.Kind)
+	if kind != "" {
+		kind = strings.ToUpper(kind[:1]) + kind[1:]
+	}
+	return strings.TrimSpace(fmt.Sprintf("%s %s report #%d", kind, report.Type, report.Id))
+}
+
+// Function makes a two column table of a {name: count} column, largest count first.
+func countSection(title string, column string, raw json.RawMessage) (reportSection, error) {
+	section := reportSection{Title: title, Columns: []string{column, "Count"}, ChartColumn: 1}
+	if len(raw) == 0 {
+		return section, nil
+	}
+
+	counts := make(map[string]uint64)
+	if err := json.Unmarshal(raw, &counts); err != nil {
+		return section, err
+	}
+
+	names := make([]string, 0, len(counts))
+	for name := range counts {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if counts[names[i]] == counts[names[j]] {
+			return names[i] < names[j]
+		}
+		return counts[names[i]] > counts[names[j]]
+	})
+
+	for _, name := range names {
+		section.Rows = append(section.Rows, []string{name, strconv.FormatUint(counts[name], 10)})
+	}
+	return section, nil
+}
+
+// Function makes a chart table of a ranked [{Word, Count}] column.
+func rankedSection(title string, column string, prefix string, raw json.RawMessage) (reportSection, error) {
+	section := reportSection{Title: title, Columns: []string{column, "Count"}, ChartColumn: 1}
+
+	var pairs []com.KvPair
+	if err := decodeColumn(raw, &pairs); err != nil {
+		return section, err
+	}
+	for _, pair := range pairs {
+		section.Rows = append(section.Rows, []string{prefix + pair.Word, strconv.FormatUint(pair.Count, 10)})
+	}
+	return section, nil
+}
+
+// Function makes a table of a [{name, average, tweets}] column. Averages can be
+// negative, so it has no chart.
+func sentimentSection(title string, column string, raw json.RawMessage) (reportSection, error) {
+	section := reportSection{Title: title, Columns: []string{column, "Average sentiment", "Tweets"}}
+
+	var averages []db.SentimentAverage
+	if err := decodeColumn(raw, &averages); err != nil {
+		return section, err
+	}
+	for _, average := range averages {
+		section.Rows = append(section.Rows, []string{average.Name, strconv.FormatFloat(average.Average, 'f', 3, 64),
+			strconv.FormatUint(average.Tweets, 10)})
+	}
+	return section, nil
+}
+
+// Function makes one row per account of a growth ranking, gained followers charted.
+func growthSection(title string, raw json.RawMessage) (reportSection, error) {
+	section := reportSection{Title: title, Columns: []string{"User", "Followers before", "Followers after", "Gained", "Growth (%)"}, ChartColumn: 3}
+
+	var growth []db.GrowthRate
+	if err := decodeColumn(raw, &growth); err != nil {
+		return section, err
+	}
+	for _, rate := range growth {
+		section.Rows = append(section.Rows, []string{rate.Name, strconv.FormatInt(rate.FromFollowers, 10), strconv.FormatInt(rate.ToFollowers, 10),
+			strconv.FormatInt(rate.Gained, 10), strconv.FormatFloat(rate.Rate*100, 'f', 2, 64)})
+	}
+	return section, nil
+}
+
+// Function makes one row per account of a bot score ranking.
+func botSection(title string, raw json.RawMessage) (reportSection, error) {
+	section := reportSection{Title: title, Columns: []string{"User", "User id", "Bot score"}, ChartColumn: 2}
+
+	var scores []db.BotScore
+	if err := decodeColumn(raw, &scores); err != nil {
+		return section, err
+	}
+	for _, score := range scores {
+		section.Rows = append(section.Rows, []string{score.Name, score.UserId, strconv.FormatFloat(score.Score, 'f', 3, 64)})
+	}
+	return section, nil
+}
+
+// Function makes one row per user or location of an activity column with
+// its busiest hour and weekday, the histograms themselves are kept in JSON.
+func activitySection(title string, column string, raw json.RawMessage) (reportSection, error) {
+	section := reportSection{Title: title, Columns: []string{column, "Timezone", "Tweets", "Busiest hour", "Busiest weekday", "Burstiness", "Memory"}, ChartColumn: 2}
+
+	var activities []db.NamedActivity
+	if err := decodeColumn(raw, &activities); err != nil {
+		return section, err
+	}
+	for _, activity := range activities {
+		hour, weekday := "", ""
+		if peak := activity.PeakHour(); peak >= 0 {
+			hour = fmt.Sprintf("%02d:00", peak)
+		}
+		if peak := activity.PeakWeekday(); peak >= 0 {
+			weekday = db.WEEKDAYS[peak]
+		}
+		section.Rows = append(section.Rows, []string{activity.Name, activity.Timezone, strconv.FormatUint(activity.Tweets, 10), hour, weekday,
+			formatOptional(activity.Burstiness), formatOptional(activity.Memory)})
+	}
+	return section, nil
+}
+
+func formatOptional(value *float64) string {
+	if value == nil {
+		return ""
+	}
+	return strconv.FormatFloat(*value, 'f', 3, 64)
+}
+
+// Function makes one row per location or bloc listing its distinctive terms.
+func distinctiveSection(title string, column string, raw json.RawMessage) (reportSection, error) {
+	section := reportSection{Title: title, Columns: []string{column, "Users", "Distinctive terms"}}
+
+	var groups []db.DistinctiveTerms
+	if err := decodeColumn(raw, &groups); err != nil {
+		return section, err
+	}
+	for _, group := range groups {
+		terms := make([]string, 0, len(group.Terms))
+		for _, term := range group.Terms {
+			terms = append(terms, term.Term)
+		}
+		section.Rows = append(section.Rows, []string{group.Name, strconv.FormatUint(group.Users, 10), strings.Join(terms, ", ")})
+	}
+	return section, nil
+}
+
+func decodeColumn(raw json.RawMessage, v interface{}) error {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil
+	}
+	return json.Unmarshal(raw, v)
+}
+
+func newReportView(report db.ReportRecord) (reportView, error) {
+	view := reportView{
+		Title:      reportTitle(report),
+		Kind:       report.Kind,
+		ReportedAt: report.ReportedAt,
+		WindowFrom: report.WindowFrom,
+		WindowTo:   report.WindowTo,
+	}
+
+	switch report.Type {
+	case db.REPORT_LOG:
+		view.Facts = append(view.Facts, [2]string{"Most requests", report.AppMostRequests})
+
+		var errorRequests db.TopErrorsReport
+		if err := decodeColumn(report.TopErrorRequests, &errorRequests); err != nil {
+			return view, err
+		}
+		section := reportSection{Title: "Error responses", Columns: []string{"Log id", "Application", "Response"}}
+		for _, request := range errorRequests.Request {
+			section.Rows = append(section.Rows, []string{request.LogId, request.ApplicationName, request.Response})
+		}
+		view.Sections = append(view.Sections, section)
+
+		for _, durations := range []struct {
+			title string
+			raw   json.RawMessage
+		}{{"Longest requests", report.TopLongestRequests}, {"Shortest requests", report.TopShortestRequests}} {
+			var requests db.TopDurationsReport
+			if err := decodeColumn(durations.raw, &requests); err != nil {
+				return view, err
+			}
+			section := reportSection{Title: durations.title, Columns: []string{"Log id", "Application", "Duration (s)"}}
+			for _, request := range requests.Requests {
+				section.Rows = append(section.Rows, []string{request.LogId, request.ApplicationName, strconv.FormatFloat(request.Duration, 'f', 3, 64)})
+			}
+			view.Sections = append(view.Sections, section)
+		}
+
+	case db.REPORT_TWEET:
+		section, err := countSection("Most tweets", "User", report.MostTweets)
+		if err != nil {
+			return view, err
+		}
+		view.Sections = append(view.Sections, section)
+
+		var lengths []db.TweetLenghts
+		if err := decodeColumn(report.LargestTweets, &lengths); err != nil {
+			return view, err
+		}
+		section = reportSection{Title: "Largest tweets", Columns: []string{"User", "Length"}}
+		for _, length := range lengths {
+			section.Rows = append(section.Rows, []string{length.UserName, strconv.FormatUint(length.Lenght, 10)})
+		}
+		view.Sections = append(view.Sections, section)
+
+		for _, ranked := range []struct {
+			title  string
+			column string
+			prefix string
+			raw    json.RawMessage
+		}{
+			{"Most used words", "Word", "", report.MostUsedWords},
+			{"Top hashtags", "Hashtag", "#", report.TopHashtags},
+			{"Most mentioned accounts", "Account", "@", report.TopMentions},
+			{"Most shared domains", "Domain", "", report.TopDomains},
+			{"Top emojis", "Emoji", "", report.TopEmojis},
+		} {
+			section, err := rankedSection(ranked.title, ranked.column, ranked.prefix, ranked.raw)
+			if err != nil {
+				return view, err
+			}
+			view.Sections = append(view.Sections, section)
+		}
+
+		section, err = sentimentSection("Average sentiment per user", "User", report.UserSentiment)
+		if err != nil {
+			return view, err
+		}
+		view.Sections = append(view.Sections, section)
+
+		// Only weekly reports rank growth.
+		if len(report.FastestGrowing) > 0 {
+			section, err = growthSection("Fastest growing accounts", report.FastestGrowing)
+			if err != nil {
+				return view, err
+			}
+			view.Sections = append(view.Sections, section)
+		}
+
+		section, err = activitySection("Posting activity of the most active users", "User", report.UserActivity)
+		if err != nil {
+			return view, err
+		}
+		view.Sections = append(view.Sections, section)
+
+		// Only daily reports list likely bots.
+		if len(report.LikelyBots) > 0 {
+			section, err = botSection("Most likely bots", report.LikelyBots)
+			if err != nil {
+				return view, err
+			}
+			view.Sections = append(view.Sections, section)
+		}
+
+	case db.REPORT_LOCATION:
+		view.Facts = append(view.Facts, [2]string{"Total population", strconv.FormatInt(report.TotalPopulation, 10)})
+
+		section, err := countSection("Top tweet locations", "Location", report.TopTweetLocation)
+		if err != nil {
+			return view, err
+		}
+		view.Sections = append(view.Sections, section)
+
+		section, err = countSection("Most spoken languages", "Language", report.MostSpokenLanguages)
+		if err != nil {
+			return view, err
+		}
+		view.Sections = append(view.Sections, section)
+
+		section, err = countSection("Languages tweeted", "Language", report.LanguagesTweeted)
+		if err != nil {
+			return view, err
+		}
+		for _, row := range section.Rows {
+			row[0] = fmt.Sprintf("%s (%s)", text.LanguageName(row[0]), row[0])
+		}
+		view.Sections = append(view.Sections, section)
+
+		var blocks []db.RegionalBlockCounts
+		if err := decodeColumn(report.TopTweetRegionalBlocks, &blocks); err != nil {
+			return view, err
+		}
+		section = reportSection{Title: "Top regional blocs", Columns: []string{"Regional bloc", "Tweets"}, ChartColumn: 1}
+		for _, block := range blocks {
+			section.Rows = append(section.Rows, []string{block.RegionalBlock, strconv.FormatUint(block.NumberOfTweets, 10)})
+		}
+		view.Sections = append(view.Sections, section)
+
+		section, err = sentimentSection("Sentiment per location", "Location", report.LocationSentiment)
+		if err != nil {
+			return view, err
+		}
+		view.Sections = append(view.Sections, section)
+
+		section, err = distinctiveSection("Distinctive terms per location", "Location", report.LocationTerms)
+		if err != nil {
+			return view, err
+		}
+		view.Sections = append(view.Sections, section)
+
+		section, err = distinctiveSection("Distinctive terms per regional bloc", "Regional bloc", report.BlocTerms)
+		if err != nil {
+			return view, err
+		}
+		view.Sections = append(view.Sections, section)
+
+		section, err = activitySection("Posting activity per location", "Location", report.LocationActivity)
+		if err != nil {
+			return view, err
+		}
+		view.Sections = append(view.Sections, section)
+
+	default:
+		return view, fmt.Errorf("unknown report type %q", report.Type)
+	}
+
+	return view, nil
+}
+
+func formatWindow(view reportView) string {
+	if view.WindowFrom == nil || view.WindowTo == nil {
+		return ""
+	}
+	return fmt.Sprintf("%s - %s", view.WindowFrom.Format(time.RFC3339), view.WindowTo.Format(time.RFC3339))
+}
+
+func markdownCell(value string) string {
+	value = strings.ReplaceAll(value, "|", "\\|")
+	return strings.ReplaceAll(value, "\n", " ")
+}
+
+func renderMarkdown(view reportView) []byte {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "# %s\n\n", view.Title)
+	if window := formatWindow(view); window != "" {
+		fmt.Fprintf(&b, "- Window: %s\n", window)
+	}
+	fmt.Fprintf(&b, "- Reported at: %s\n", view.ReportedAt.Format(time.RFC3339))
+	for _, fact := range view.Facts {
+		fmt.Fprintf(&b, "- %s: %s\n", fact[0], markdownCell(fact[1]))
+	}
+
+	for _, section := range view.Sections {
+		fmt.Fprintf(&b, "\n## %s\n\n", section.Title)
+		if len(section.Rows) == 0 {
+			b.WriteString("No data.\n")
+			continue
+		}
+		b.WriteString("| " + strings.Join(section.Columns, " | ") + " |\n")
+		b.WriteString(strings.Repeat("| --- ", len(section.Columns)) + "|\n")
+		for _, row := range section.Rows {
+			cells := make([]string, len(row))
+			for i, cell := range row {
+				cells[i] = markdownCell(cell)
+			}
+			b.WriteString("| " + strings.Join(cells, " | ") + " |\n")
+		}
+	}
+
+	return []byte(b.String())
+}
+
+// Function draws the chart column of section as a horizontal SVG bar chart,
+// so the HTML report needs no scripts or external files.
+func barChart(section reportSection) template.HTML {
+	if section.ChartColumn <= 0 || len(section.Rows) == 0 {
+		return ""
+	}
+
+	rows := section.Rows
+	if len(rows) > chartMaxBars {
+		rows = rows[:chartMaxBars]
+	}
+
+	values := make([]float64, len(rows))
+	max := 0.0
+	for i, row := range rows {
+		if section.ChartColumn < len(row) {
+			values[i], _ = strconv.ParseFloat(row[section.ChartColumn], 64)
+		}
+		if values[i] > max {
+			max = values[i]
+		}
+	}
+
+	barSpace := float64(chartWidth - chartLabelWidth - 60)
+	height := len(rows)*(chartBarHeight+chartBarGap) + chartBarGap
+
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" role="img" aria-label="%s">`, chartWidth, height, template.HTMLEscapeString(section.Title))
+	for i, row := range rows {
+		y := chartBarGap + i*(chartBarHeight+chartBarGap)
+		width := 0.0
+		if max > 0 && values[i] > 0 {
+			width = values[i] / max * barSpace
+		}
+		label := row[0]
+		if len([]rune(label)) > 24 {
+			label = string([]rune(label)[:23]) + "…"
+		}
+		fmt.Fprintf(&b, `<text x="%d" y="%d" text-anchor="end" class="label">%s</text>`, chartLabelWidth-8, y+chartBarHeight-5, template.HTMLEscapeString(label))
+		fmt.Fprintf(&b, `<rect x="%d" y="%d" width="%.1f" height="%d" class="bar"/>`, chartLabelWidth, y, width, chartBarHeight)
+		fmt.Fprintf(&b, `<text x="%.1f" y="%d" class="value">%s</text>`, float64(chartLabelWidth)+width+6, y+chartBarHeight-5, template.HTMLEscapeString(row[section.ChartColumn]))
+	}
+	b.WriteString(`</svg>`)
+
+	return template.HTML(b.String())
+}
+
+var reportTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"window": formatWindow,
+	"chart":  barChart,
+	"rfc3339": func(t time.Time) string {
+		return t.Format(time.RFC3339)
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { font-family: Helvetica, Arial, sans-serif; color: #222; margin: 2em auto; max-width: 52em; }
+h1 { border-bottom: 2px solid #1da1f2; padding-bottom: .3em; }
+h2 { margin-top: 2em; color: #1a6fa3; }
+ul.facts { list-style: none; padding: 0; color: #555; }
+table { border-collapse: collapse; margin-top: 1em; min-width: 24em; }
+th, td { border-bottom: 1px solid #ddd; padding: .3em .8em; text-align: left; }
+th { background: #f2f8fc; }
+svg .bar { fill: #1da1f2; }
+svg text { font-size: 12px; fill: #333; }
+section { page-break-inside: avoid; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<ul class="facts">
+{{with window .}}<li>Window: {{.}}</li>{{end}}
+<li>Reported at: {{rfc3339 .ReportedAt}}</li>
+{{range .Facts}}<li>{{index . 0}}: {{index . 1}}</li>
+{{end}}</ul>
+{{range .Sections}}<section>
+<h2>{{.Title}}</h2>
+{{if .Rows}}{{chart .}}
+<table>
+<tr>{{range .Columns}}<th>{{.}}</th>{{end}}</tr>
+{{range .Rows}}<tr>{{range .}}<td>{{.}}</td>{{end}}</tr>
+{{end}}</table>
+{{else}}<p>No data.</p>
+{{end}}</section>
+{{end}}</body>
+</html>
+`))
+
+var errPDFDisabled = errors.New("pdf rendering is not configured")
+
+// Method checks that format is known and, for PDF, that a command renders it.
+func (config RenderConfig) checkFormat(format string) error {
+	if _, ok := formatContentTypes[format]; !ok {
+		return fmt.Errorf("unknown report format %q", format)
+	}
+	if format == FORMAT_PDF && len(config.PDFCommand) == 0 {
+		return errPDFDisabled
+	}
+	return nil
+}
+
+// Function renders report in given format and returns it with its content type.
+func renderReport(report db.ReportRecord, format string, config RenderConfig) ([]byte, string, error) {
+	contentType, ok := formatContentTypes[format]
+	if !ok {
+		return nil, "", fmt.Errorf("unknown report format %q", format)
+	}
+
+	if format == FORMAT_JSON {
+		data, err := json.MarshalIndent(report, "", "  ")
+		return data, contentType, err
+	}
+
+	view, err := newReportView(report)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if format == FORMAT_MARKDOWN {
+		return renderMarkdown(view), contentType, nil
+	}
+
+	var buf bytes.Buffer
+	if err := reportTemplate.Execute(&buf, view); err != nil {
+		return nil, "", err
+	}
+	if format == FORMAT_HTML {
+		return buf.Bytes(), contentType, nil
+	}
+
+	pdf, err := renderPDF(config, buf.Bytes())
+	return pdf, contentType, err
+}
+
+// Function converts HTML to PDF with the configured external command.
+func renderPDF(config RenderConfig, html []byte) ([]byte, error) {
+	if len(config.PDFCommand) == 0 {
+		return nil, errPDFDisabled
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), pdfTimeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, config.PDFCommand[0], config.PDFCommand[1:]...)
+	cmd.Stdin = bytes.NewReader(html)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("pdf command failed: %s %s", err.Error(), strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
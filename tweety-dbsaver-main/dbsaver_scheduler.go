@@ -0,0 +1,370 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"time"
+
+	com "gitlab.com/leapbit-practice/tweety-lib-communication/comms"
+	db "gitlab.com/leapbit-practice/tweety-lib-db/db"
+)
+
+const (
+	defaultSchedulerLockKey = 7394201
+	defaultMaxCatchUp       = 24
+	defaultMaxRunAttempts   = 3
+	defaultRunTimeout       = time.Hour
+	schedulerTick           = time.Minute
+)
+
+// A failed run is retried until it made MaxAttempts attempts. A run still
+// running after RunTimeoutSeconds is taken to be abandoned and made again.
+type SchedulerConfig struct {
+	Schedules         []ScheduleConfig `json:"schedules"`
+	Timezone          string           `json:"timezone"`
+	LockKey           int64            `json:"lock_key"`
+	MaxCatchUp        int              `json:"max_catch_up"`
+	MaxAttempts       int              `json:"max_attempts"`
+	RunTimeoutSeconds int              `json:"run_timeout_seconds"`
+}
+
+// Kind is one of HOURLY, DAILY, WEEKLY or MONTHLY and decides the reported window,
+// Cron decides when the report is made. Reports lists log, tweet and location.
+// Sections lists the optional sections of the tweet report, see defaultSections.
+type ScheduleConfig struct {
+	Kind     string   `json:"kind"`
+	Cron     string   `json:"cron"`
+	Reports  []string `json:"reports"`
+	Sections []string `json:"sections"`
+}
+
+var defaultSchedules = []ScheduleConfig{
+	{Kind: "HOURLY", Cron: "@hourly", Reports: []string{db.REPORT_LOG}},
+	{Kind: "DAILY", Cron: "@daily", Reports: []string{db.REPORT_LOG, db.REPORT_TWEET, db.REPORT_LOCATION}},
+	{Kind: "WEEKLY", Cron: "@weekly", Reports: []string{db.REPORT_LOG, db.REPORT_TWEET, db.REPORT_LOCATION}},
+	{Kind: "MONTHLY", Cron: "@monthly", Reports: []string{db.REPORT_LOG, db.REPORT_TWEET, db.REPORT_LOCATION}},
+}
+
+// Follower counts move slowly, growth is ranked in weekly reports. Bot scores
+// are kept up to date as users are saved, daily reports list the likeliest.
+var defaultSections = map[string][]string{
+	"DAILY":  {db.SECTION_LIKELY_BOTS},
+	"WEEKLY": {db.SECTION_FASTEST_GROWING},
+}
+
+type reportSchedule struct {
+	kind     string
+	cron     *cronSchedule
+	reports  []string
+	sections []string
+}
+
+type reportScheduler struct {
+	application *Application
+	schedules   []reportSchedule
+	lockKey     int64
+	maxCatchUp  int
+	maxAttempts int
+	runTimeout  time.Duration
+	leader      *sql.Conn
+}
+
+// Function returns the start of the window reported by a run of given kind at t.
+// Calendar arithmetic keeps months and DST days at their real length.
+func reportWindowStart(kind string, t time.Time) (time.Time, error) {
+	switch kind {
+	case "HOURLY":
+		return t.Add(-time.Hour), nil
+	case "DAILY":
+		return t.AddDate(0, 0, -1), nil
+	case "WEEKLY":
+		return t.AddDate(0, 0, -7), nil
+	case "MONTHLY":
+		return t.AddDate(0, -1, 0), nil
+	}
+	return t, fmt.Errorf("unknown report kind %q", kind)
+}
+
+func (config SchedulerConfig) location() (*time.Location, error) {
+	if config.Timezone == "" {
+		return time.Local, nil
+	}
+	location, err := time.LoadLocation(config.Timezone)
+	if err != nil {
+		return nil, fmt.Errorf("invalid scheduler timezone: %s", err.Error())
+	}
+	return location, nil
+}
+
+func parseSchedule(scheduleConfig ScheduleConfig, location *time.Location) (reportSchedule, error) {
+	if _, err := reportWindowStart(scheduleConfig.Kind, time.Now()); err != nil {
+		return reportSchedule{}, err
+	}
+	cron, err := parseCron(scheduleConfig.Cron, location)
+	if err != nil {
+		return reportSchedule{}, fmt.Errorf("schedule %s: %s", scheduleConfig.Kind, err.Error())
+	}
+	sections := scheduleConfig.Sections
+	if sections == nil {
+		sections = defaultSections[scheduleConfig.Kind]
+	}
+	for _, section := range sections {
+		if section != db.SECTION_FASTEST_GROWING && section != db.SECTION_LIKELY_BOTS {
+			return reportSchedule{}, fmt.Errorf("schedule %s: unknown section %q", scheduleConfig.Kind, section)
+		}
+	}
+	return reportSchedule{kind: scheduleConfig.Kind, cron: cron, reports: scheduleConfig.Reports, sections: sections}, nil
+}
+
+// Method returns the configured schedule of given kind, or the default one
+// when the kind is not scheduled.
+func (config SchedulerConfig) schedule(kind string) (reportSchedule, error) {
+	location, err := config.location()
+	if err != nil {
+		return reportSchedule{}, err
+	}
+
+	for _, schedules := range [][]ScheduleConfig{config.Schedules, defaultSchedules} {
+		for _, scheduleConfig := range schedules {
+			if scheduleConfig.Kind == kind {
+				return parseSchedule(scheduleConfig, location)
+			}
+		}
+	}
+
+	return reportSchedule{}, fmt.Errorf("unknown report kind %q", kind)
+}
+
+func newReportScheduler(application *Application, config SchedulerConfig) (*reportScheduler, error) {
+	location, err := config.location()
+	if err != nil {
+		return nil, err
+	}
+
+	scheduleConfigs := config.Schedules
+	if len(scheduleConfigs) == 0 {
+		scheduleConfigs = defaultSchedules
+	}
+
+	scheduler := &reportScheduler{
+		application: application,
+		lockKey:     config.LockKey,
+		maxCatchUp:  config.MaxCatchUp,
+		maxAttempts: config.MaxAttempts,
+		runTimeout:  time.Duration(config.RunTimeoutSeconds) * time.Second,
+	}
+	if scheduler.lockKey == 0 {
+		scheduler.lockKey = defaultSchedulerLockKey
+	}
+	if scheduler.maxCatchUp <= 0 {
+		scheduler.maxCatchUp = defaultMaxCatchUp
+	}
+	if scheduler.maxAttempts <= 0 {
+		scheduler.maxAttempts = defaultMaxRunAttempts
+	}
+	if scheduler.runTimeout <= 0 {
+		scheduler.runTimeout = defaultRunTimeout
+	}
+
+	for _, scheduleConfig := range scheduleConfigs {
+		schedule, err := parseSchedule(scheduleConfig, location)
+		if err != nil {
+			return nil, err
+		}
+		scheduler.schedules = append(scheduler.schedules, schedule)
+	}
+
+	return scheduler, nil
+}
+
+// Method makes sure this replica holds the leader lock. Only the leader makes reports.
+func (scheduler *reportScheduler) lead(ctx context.Context) bool {
+	if scheduler.leader != nil {
+		if err := scheduler.leader.PingContext(ctx); err == nil {
+			return true
+		}
+		com.TweetyLog(com.WARNING, "Report scheduler lost its leader lock connection.")
+		scheduler.leader.Close()
+		scheduler.leader = nil
+	}
+
+	conn, locked, err := db.TryAdvisoryLock(ctx, scheduler.lockKey, scheduler.application.DB)
+	if err != nil {
+		com.TweetyLog(com.ERROR, fmt.Sprintf("Cannot take report scheduler lock. Error: %s", err.Error()))
+		return false
+	}
+	if !locked {
+		return false
+	}
+
+	com.TweetyLog(com.INFO, "Report scheduler became leader.")
+	scheduler.leader = conn
+	return true
+}
+
+func (scheduler *reportScheduler) resign() {
+	if scheduler.leader == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := db.ReleaseAdvisoryLock(ctx, scheduler.lockKey, scheduler.leader); err != nil {
+		com.TweetyLog(com.ERROR, fmt.Sprintf("Cannot release report scheduler lock. Error: %s", err.Error()))
+	}
+	scheduler.leader = nil
+}
+
+// Method returns activation times of schedule that are due at now. Runs missed
+// while no replica was up are caught up, failed and abandoned runs are retried.
+func (scheduler *reportScheduler) due(schedule reportSchedule, now time.Time) ([]time.Time, error) {
+	last, found, err := db.GetLastReportRun(schedule.kind, scheduler.application.DB)
+	if err != nil {
+		return nil, err
+	}
+
+	retry, err := db.GetRetryReportRuns(schedule.kind, scheduler.maxAttempts, now.Add(-scheduler.runTimeout), scheduler.application.DB)
+	if err != nil {
+		return nil, err
+	}
+
+	return dueTimes(schedule, last, found, retry, now, scheduler.maxCatchUp), nil
+}
+
+// Function returns the activation times of schedule after last, the last finished
+// run, up to now together with the retried ones, at most maxCatchUp most recent ones.
+// Without a finished run only the most recent activation is made.
+func dueTimes(schedule reportSchedule, last time.Time, found bool, retry []time.Time, now time.Time, maxCatchUp int) []time.Time {
+	if !found {
+		last, _ = reportWindowStart(schedule.kind, now)
+	}
+
+	var times []time.Time
+	for t := schedule.cron.next(last); !t.IsZero() && !t.After(now); t = schedule.cron.next(t) {
+		times = append(times, t)
+		if len(times) > maxCatchUp || (!found && len(times) > 1) {
+			times = times[1:]
+		}
+	}
+
+	for _, t := range retry {
+		if t.After(now) {
+			continue
+		}
+		i := sort.Search(len(times), func(i int) bool { return !times[i].Before(t) })
+		if i < len(times) && times[i].Equal(t) {
+			continue
+		}
+		times = append(times, time.Time{})
+		copy(times[i+1:], times[i:])
+		times[i] = t
+	}
+	if len(times) > maxCatchUp {
+		times = times[len(times)-maxCatchUp:]
+	}
+
+	return times
+}
+
+func (scheduler *reportScheduler) tick(ctx context.Context, now time.Time) {
+	if !scheduler.lead(ctx) {
+		return
+	}
+
+	for _, schedule := range scheduler.schedules {
+		times, err := scheduler.due(schedule, now)
+		if err != nil {
+			com.TweetyLog(com.ERROR, fmt.Sprintf("Cannot check %s report schedule. Error: %s", schedule.kind, err.Error()))
+			continue
+		}
+		for _, t := range times {
+			scheduler.run(schedule, t)
+		}
+	}
+
+	scheduler.backfill()
+}
+
+func (scheduler *reportScheduler) run(schedule reportSchedule, scheduledFor time.Time) {
+	from, _ := reportWindowStart(schedule.kind, scheduledFor)
+	run := &db.ReportRun{Kind: schedule.kind, ScheduledFor: scheduledFor, WindowFrom: from, WindowTo: scheduledFor}
+
+	started, err := db.StartReportRun(run, scheduler.maxAttempts, time.Now().Add(-scheduler.runTimeout), scheduler.application.DB)
+	if err != nil {
+		com.TweetyLog(com.ERROR, fmt.Sprintf("Cannot register %s report run. Error: %s", schedule.kind, err.Error()))
+		return
+	}
+	if !started {
+		return
+	}
+
+	com.TweetyLog(com.INFO, fmt.Sprintf("%s report for %s starting...", schedule.kind, scheduledFor.Format(time.RFC3339)))
+	runErr := scheduler.application.makeReports(schedule.kind, schedule.reports, schedule.sections, from, scheduledFor, true)
+
+	err = db.FinishReportRun(run, runErr, scheduler.application.DB)
+	if err != nil {
+		com.TweetyLog(com.ERROR, fmt.Sprintf("Cannot finish %s report run. Error: %s", schedule.kind, err.Error()))
+	}
+	com.TweetyLog(com.INFO, fmt.Sprintf("%s report for %s finished.", schedule.kind, scheduledFor.Format(time.RFC3339)))
+}
+
+// Method makes the requested reports for window [from, to), the tweet report with
+// sections, and queues their deliveries with deliver. Every report is attempted,
+// the returned error names the ones that failed.
+func (application *Application) makeReports(kind string, reports []string, sections []string, from time.Time, to time.Time, deliver bool) error {
+	var failed []string
+
+	for _, report := range reports {
+		var id uint64
+		var err error
+		switch report {
+		case db.REPORT_LOG:
+			id, err = db.SaveLogReport(from, to, kind, application.DB)
+		case db.REPORT_TWEET:
+			id, err = db.SaveTweetReport(from, to, kind, sections, application.Config.Words, application.DB)
+		case db.REPORT_LOCATION:
+			id, err = db.SaveLocationReport(from, to, kind, application.DB)
+		default:
+			err = fmt.Errorf("unknown report %q", report)
+		}
+		if err != nil {
+			com.TweetyLog(com.ERROR, fmt.Sprintf("Cannot save %s report. Error: %s", report, err.Error()))
+			failed = append(failed, report)
+			continue
+		}
+		if deliver {
+			application.enqueueDeliveries(report, kind, id)
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("failed reports: %v", failed)
+	}
+	return nil
+}
+
+func (application *Application) report(done chan int) {
+	scheduler, err := newReportScheduler(application, application.Config.Scheduler)
+	if err != nil {
+		com.TweetyLog(com.ERROR, fmt.Sprintf("Cannot start report scheduler. Error: %s", err.Error()))
+		return
+	}
+	defer scheduler.resign()
+
+	ticker := time.NewTicker(schedulerTick)
+	defer ticker.Stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	scheduler.tick(ctx, time.Now())
+	for {
+		select {
+		case now := <-ticker.C:
+			scheduler.tick(ctx, now)
+		case <-done:
+			return
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDueTimes(t *testing.T) {
+	at := func(day int, hour int) time.Time {
+		return time.Date(2021, 7, day, hour, 0, 0, 0, time.UTC)
+	}
+	now := at(10, 12).Add(30 * time.Minute)
+
+	tests := []struct {
+		name       string
+		kind       string
+		cron       string
+		last       time.Time
+		found      bool
+		retry      []time.Time
+		now        time.Time
+		maxCatchUp int
+		want       []time.Time
+	}{
+		{name: "first run makes the latest activation", kind: "HOURLY", cron: "@hourly", now: now, maxCatchUp: 24, want: []time.Time{at(10, 12)}},
+		{name: "first run at an activation", kind: "HOURLY", cron: "@hourly", now: at(10, 12), maxCatchUp: 24, want: []time.Time{at(10, 12)}},
+		{name: "nothing due", kind: "HOURLY", cron: "@hourly", last: at(10, 12), found: true, now: now, maxCatchUp: 24},
+		{name: "missed runs are caught up", kind: "HOURLY", cron: "@hourly", last: at(10, 9), found: true, now: now, maxCatchUp: 24,
+			want: []time.Time{at(10, 10), at(10, 11), at(10, 12)}},
+		{name: "catch up is limited to the latest", kind: "HOURLY", cron: "@hourly", last: at(8, 0), found: true, now: now, maxCatchUp: 3,
+			want: []time.Time{at(10, 10), at(10, 11), at(10, 12)}},
+		{name: "failed run is retried", kind: "HOURLY", cron: "@hourly", last: at(10, 12), found: true, retry: []time.Time{at(10, 11)}, now: now, maxCatchUp: 24,
+			want: []time.Time{at(10, 11)}},
+		{name: "retried run already due is made once", kind: "HOURLY", cron: "@hourly", last: at(10, 10), found: true, retry: []time.Time{at(10, 11)}, now: now, maxCatchUp: 24,
+			want: []time.Time{at(10, 11), at(10, 12)}},
+		{name: "retried runs are in order", kind: "HOURLY", cron: "@hourly", last: at(10, 11), found: true, retry: []time.Time{at(10, 8)}, now: now, maxCatchUp: 24,
+			want: []time.Time{at(10, 8), at(10, 12)}},
+		{name: "future retry is left out", kind: "HOURLY", cron: "@hourly", last: at(10, 12), found: true, retry: []time.Time{at(10, 13)}, now: now, maxCatchUp: 24},
+		{name: "retries count towards catch up", kind: "HOURLY", cron: "@hourly", last: at(10, 11), found: true, retry: []time.Time{at(10, 8), at(10, 9)}, now: now, maxCatchUp: 2,
+			want: []time.Time{at(10, 9), at(10, 12)}},
+		{name: "daily", kind: "DAILY", cron: "@daily", last: at(8, 0), found: true, now: now, maxCatchUp: 24,
+			want: []time.Time{at(9, 0), at(10, 0)}},
+	}
+
+	for _, test := range tests {
+		schedule, err := parseSchedule(ScheduleConfig{Kind: test.kind, Cron: test.cron}, time.UTC)
+		if err != nil {
+			t.Fatalf("%s: parseSchedule() error: %s", test.name, err)
+		}
+
+		got := dueTimes(schedule, test.last, test.found, test.retry, test.now, test.maxCatchUp)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: dueTimes() = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
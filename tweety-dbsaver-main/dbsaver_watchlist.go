@@ -0,0 +1,557 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	com "gitlab.com/leapbit-practice/tweety-lib-communication/comms"
+	db "gitlab.com/leapbit-practice/tweety-lib-db/db"
+)
+
+const (
+	// Every tweet saved is matched against every enabled watchlist.
+	maxWatchlistTerms      = 100
+	maxWatchlistTermLength = 200
+
+	// Other DBSaver instances see changed watchlists after watchlistCacheTTL.
+	watchlistCacheTTL = time.Minute
+)
+
+// Body of POST /watchlists and PUT /watchlists/{id}. Scope defaults to all
+// users and Enabled to true. Webhook names a configured webhook.
+type watchlistRequest struct {
+	Name     string   `json:"name" validate:"required"`
+	Keywords []string `json:"keywords"`
+	Regexes  []string `json:"regexes"`
+	Hashtags []string `json:"hashtags"`
+	Scope    string   `json:"scope" validate:"oneof=all location users"`
+	Location string   `json:"location"`
+	UserIds  []string `json:"user_ids"`
+	Webhook  string   `json:"webhook"`
+	Enabled  *bool    `json:"enabled"`
+}
+
+// Function checks that a list of a watchlist has at most maxWatchlistTerms
+// terms of at most maxWatchlistTermLength characters.
+func validateWatchlistTerms(field string, terms []string) []com.FieldError {
+	var fields []com.FieldError
+	if len(terms) > maxWatchlistTerms {
+		fields = append(fields, com.FieldError{Field: field, Rule: "max", Message: fmt.Sprintf("must have at most %d entries", maxWatchlistTerms)})
+	}
+	for _, term := range terms {
+		if utf8.RuneCountInString(term) > maxWatchlistTermLength {
+			fields = append(fields, com.FieldError{Field: field, Rule: "maxlength", Message: fmt.Sprintf("entries must be at most %d characters long", maxWatchlistTermLength)})
+			break
+		}
+	}
+	return fields
+}
+
+func (req watchlistRequest) Validate() error {
+	var fields []com.FieldError
+
+	if len(req.Keywords) == 0 && len(req.Regexes) == 0 && len(req.Hashtags) == 0 {
+		fields = append(fields, com.FieldError{Field: "keywords", Rule: "nonempty", Message: "keywords, regexes or hashtags are required"})
+	}
+	for _, keyword := range req.Keywords {
+		if strings.TrimSpace(keyword) == "" {
+			fields = append(fields, com.FieldError{Field: "keywords", Rule: "nonempty", Message: "must not contain empty keywords"})
+			break
+		}
+	}
+	for _, hashtag := range req.Hashtags {
+		if strings.TrimPrefix(strings.TrimSpace(hashtag), "#") == "" {
+			fields = append(fields, com.FieldError{Field: "hashtags", Rule: "nonempty", Message: "must not contain empty hashtags"})
+			break
+		}
+	}
+	fields = append(fields, validateWatchlistTerms("keywords", req.Keywords)...)
+	fields = append(fields, validateWatchlistTerms("regexes", req.Regexes)...)
+	fields = append(fields, validateWatchlistTerms("hashtags", req.Hashtags)...)
+	for _, expr := range req.Regexes {
+		if _, err := regexp.Compile(expr); err != nil {
+			fields = append(fields, com.FieldError{Field: "regexes", Rule: "regexp", Message: err.Error()})
+		}
+	}
+
+	switch req.Scope {
+	case db.WATCH_LOCATION:
+		if strings.TrimSpace(req.Location) == "" {
+			fields = append(fields, com.FieldError{Field: "location", Rule: "required", Message: "is required for location scope"})
+		}
+	case db.WATCH_USERS:
+		if len(req.UserIds) == 0 {
+			fields = append(fields, com.FieldError{Field: "user_ids", Rule: "nonempty", Message: "are required for users scope"})
+		}
+		for _, userId := range req.UserIds {
+			if _, err := strconv.ParseUint(userId, 10, 64); err != nil {
+				fields = append(fields, com.FieldError{Field: "user_ids", Rule: "numeric", Message: fmt.Sprintf("invalid user id %q", userId)})
+			}
+		}
+	}
+
+	if len(fields) > 0 {
+		return &com.ValidationError{Fields: fields}
+	}
+	return nil
+}
+
+// Method returns the watchlist the request describes. Hashtags are stored
+// without their #, the scope decides which of location and user ids are kept.
+func (req watchlistRequest) watchlist() db.Watchlist {
+	watchlist := db.Watchlist{
+		Name:    strings.TrimSpace(req.Name),
+		Regexes: req.Regexes,
+		Scope:   req.Scope,
+		Webhook: req.Webhook,
+		Enabled: req.Enabled == nil || *req.Enabled,
+	}
+	for _, keyword := range req.Keywords {
+		watchlist.Keywords = append(watchlist.Keywords, strings.TrimSpace(keyword))
+	}
+	for _, hashtag := range req.Hashtags {
+		watchlist.Hashtags = append(watchlist.Hashtags, strings.TrimPrefix(strings.TrimSpace(hashtag), "#"))
+	}
+
+	switch req.Scope {
+	case db.WATCH_LOCATION:
+		watchlist.Location = strings.TrimSpace(req.Location)
+	case db.WATCH_USERS:
+		watchlist.UserIds = req.UserIds
+	default:
+		watchlist.Scope = db.WATCH_ALL
+	}
+	return watchlist
+}
+
+// Watchlist ready for matching, keywords and hashtags are lower cased.
+type compiledWatchlist struct {
+	db.Watchlist
+	keywords []string
+	hashtags map[string]bool
+	regexes  []*regexp.Regexp
+}
+
+func compileWatchlist(watchlist db.Watchlist) (compiledWatchlist, error) {
+	compiled := compiledWatchlist{Watchlist: watchlist, hashtags: make(map[string]bool)}
+	for _, keyword := range watchlist.Keywords {
+		compiled.keywords = append(compiled.keywords, strings.ToLower(keyword))
+	}
+	for _, hashtag := range watchlist.Hashtags {
+		compiled.hashtags[strings.ToLower(hashtag)] = true
+	}
+	for _, expr := range watchlist.Regexes {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return compiled, err
+		}
+		compiled.regexes = append(compiled.regexes, re)
+	}
+	return compiled, nil
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_'
+}
+
+// Function tells whether phrase occurs in text as whole words, so a keyword
+// does not match inside a longer word. Both are expected lower cased.
+func containsWords(text string, phrase string) bool {
+	for start := 0; start < len(text); {
+		i := strings.Index(text[start:], phrase)
+		if i < 0 {
+			return false
+		}
+		i += start
+		end := i + len(phrase)
+
+		before, _ := utf8.DecodeLastRuneInString(text[:i])
+		after, _ := utf8.DecodeRuneInString(text[end:])
+		if (i == 0 || !isWordRune(before)) && (end == len(text) || !isWordRune(after)) {
+			return true
+		}
+
+		_, size := utf8.DecodeRuneInString(text[i:])
+		start = i + size
+	}
+	return false
+}
+
+// Method tells whether the watchlist applies to a user at location.
+func (watchlist compiledWatchlist) inScope(userId string, location string) bool {
+	switch watchlist.Scope {
+	case db.WATCH_LOCATION:
+		return location != "" && strings.EqualFold(watchlist.Location, location)
+	case db.WATCH_USERS:
+		for _, id := range watchlist.UserIds {
+			if id == userId {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// Method returns what of the watchlist a tweet matches as kind:term, nil when
+// nothing does. Keywords match whole words ignoring case, hashtags are the
+// ones of the tweet entities and regexes are matched as written.
+func (watchlist compiledWatchlist) match(text string, hashtags []string) []string {
+	var matches []string
+
+	lower := strings.ToLower(text)
+	for _, keyword := range watchlist.keywords {
+		if containsWords(lower, keyword) {
+			matches = append(matches, "keyword:"+keyword)
+		}
+	}
+	seen := make(map[string]bool)
+	for _, hashtag := range hashtags {
+		tag := strings.ToLower(hashtag)
+		if watchlist.hashtags[tag] && !seen[tag] {
+			seen[tag] = true
+			matches = append(matches, "hashtag:"+tag)
+		}
+	}
+	for _, re := range watchlist.regexes {
+		if re.MatchString(text) {
+			matches = append(matches, "regex:"+re.String())
+		}
+	}
+
+	return matches
+}
+
+// Enabled watchlists compiled for matching. They are loaded again after
+// watchlistCacheTTL or once a watchlist of this instance changes.
+type watchlistCache struct {
+	lock     sync.Mutex
+	compiled []compiledWatchlist
+	loadedAt time.Time
+}
+
+func (cache *watchlistCache) invalidate() {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	cache.loadedAt = time.Time{}
+}
+
+// Method returns the compiled enabled watchlists, loading them when the cache is stale.
+func (cache *watchlistCache) get(sqlDB *sql.DB) ([]compiledWatchlist, error) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	if !cache.loadedAt.IsZero() && time.Since(cache.loadedAt) < watchlistCacheTTL {
+		return cache.compiled, nil
+	}
+
+	watchlists, err := db.GetWatchlists(true, sqlDB)
+	if err != nil {
+		return nil, err
+	}
+
+	compiled := make([]compiledWatchlist, 0, len(watchlists))
+	for _, watchlist := range watchlists {
+		c, err := compileWatchlist(watchlist)
+		if err != nil {
+			com.TweetyLog(com.WARNING, fmt.Sprintf("Skipping watchlist %d with an invalid regex. Error: %s", watchlist.Id, err.Error()))
+			continue
+		}
+		compiled = append(compiled, c)
+	}
+
+	cache.compiled, cache.loadedAt = compiled, time.Now()
+	return compiled, nil
+}
+
+// Method matches tweets of a user against the enabled watchlists and returns
+// an alert for every watchlist a tweet matches, to be saved with the tweets.
+func (application *Application) matchWatchlists(tweets com.ReqTweetsForDB) ([]db.Alert, error) {
+	watchlists, err := application.Watchlists.get(application.DB)
+	if err != nil {
+		return nil, err
+	}
+
+	var location string
+	var locationLoaded bool
+	var inScope []compiledWatchlist
+	for _, watchlist := range watchlists {
+		if watchlist.Scope == db.WATCH_LOCATION && !locationLoaded {
+			location, err = db.GetUserLocationName(tweets.UserId, application.DB)
+			if err != nil {
+				return nil, err
+			}
+			locationLoaded = true
+		}
+
+		if watchlist.inScope(tweets.UserId, location) {
+			inScope = append(inScope, watchlist)
+		}
+	}
+
+	var alerts []db.Alert
+	for _, tweet := range tweets.Tweets {
+		var hashtags []string
+		for _, hashtag := range tweet.Entities.Hashtags {
+			hashtags = append(hashtags, hashtag.Text)
+		}
+
+		for _, watchlist := range inScope {
+			matches := watchlist.match(tweet.Text, hashtags)
+			if len(matches) == 0 {
+				continue
+			}
+
+			alert := db.Alert{WatchlistId: watchlist.Id, TweetId: tweet.Id_str, UserId: tweets.UserId, Text: tweet.Text, Matches: matches, Webhook: watchlist.Webhook}
+			if webhook, found := application.Config.Delivery.webhook(watchlist.Webhook); found {
+				alert.Target = webhook.URL
+			}
+			alerts = append(alerts, alert)
+		}
+	}
+
+	return alerts, nil
+}
+
+// Body of an alert webhook.
+type alertPayload struct {
+	Id          uint64    `json:"id"`
+	WatchlistId uint64    `json:"watchlist_id"`
+	Watchlist   string    `json:"watchlist"`
+	TweetId     string    `json:"tweet_id"`
+	UserId      string    `json:"user_id"`
+	Text        string    `json:"text"`
+	Matches     []string  `json:"matches"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// Method posts an alert to the configured webhook its watchlist names, signed
+// with the secret of that webhook.
+func (application *Application) sendAlert(alert db.Alert) error {
+	webhook, found := application.Config.Delivery.webhook(alert.Webhook)
+	if !found {
+		return fmt.Errorf("webhook %q is not configured", alert.Webhook)
+	}
+
+	body, err := json.Marshal(alertPayload{
+		Id:          alert.Id,
+		WatchlistId: alert.WatchlistId,
+		Watchlist:   alert.WatchlistName,
+		TweetId:     alert.TweetId,
+		UserId:      alert.UserId,
+		Text:        alert.Text,
+		Matches:     alert.Matches,
+		CreatedAt:   alert.CreatedAt,
+	})
+	if err != nil {
+		return err
+	}
+
+	headers := http.Header{}
+	headers.Set("X-Tweety-Alert", strconv.FormatUint(alert.Id, 10))
+	headers.Set("X-Tweety-Watchlist", strconv.FormatUint(alert.WatchlistId, 10))
+	return postWebhook(webhook.URL, webhook.Secret, body, "application/json", headers)
+}
+
+// Method sends pending alerts, retried like report deliveries.
+func (application *Application) deliverAlerts() {
+	maxAttempts, backoff := application.Config.Delivery.retryPolicy()
+
+	err := db.ResetStaleAlertDeliveries(time.Now().Add(-staleDeliveryAfter), application.DB)
+	if err != nil {
+		com.TweetyLog(com.ERROR, fmt.Sprintf("Cannot reset stale alerts. Error: %s", err.Error()))
+	}
+
+	alerts, err := db.ClaimAlertDeliveries(deliveryBatch, application.DB)
+	if err != nil {
+		com.TweetyLog(com.ERROR, fmt.Sprintf("Cannot get pending alerts. Error: %s", err.Error()))
+		return
+	}
+
+	for _, alert := range alerts {
+		status, next := db.DELIVERY_SENT, time.Now()
+
+		sendErr := application.sendAlert(alert)
+		if sendErr != nil {
+			status, next = db.DELIVERY_PENDING, time.Now().Add(deliveryBackoff(backoff, alert.Attempts))
+			if alert.Attempts >= maxAttempts {
+				status = db.DELIVERY_FAILED
+			}
+			com.TweetyLog(com.ERROR, fmt.Sprintf("Alert %d of watchlist %d to %s failed (attempt %d). Error: %s", alert.Id, alert.WatchlistId, alert.Webhook, alert.Attempts, sendErr.Error()))
+		} else {
+			com.TweetyLog(com.INFO, fmt.Sprintf("Sent alert %d of watchlist %d to %s.", alert.Id, alert.WatchlistId, alert.Webhook))
+		}
+
+		err := db.FinishAlertDelivery(alert, status, sendErr, next, application.DB)
+		if err != nil {
+			com.TweetyLog(com.ERROR, fmt.Sprintf("Cannot save status of alert %d. Error: %s", alert.Id, err.Error()))
+		}
+	}
+}
+
+// Method builds the handler for /watchlists/{id}.
+func (application *Application) watchlistRouter() http.Handler {
+	byId := application.endpoint("/watchlists/{id}", "Watchlist", byMethod(map[string]http.Handler{
+		http.MethodGet:    Handle(application.watchlistHandler),
+		http.MethodPut:    Handle(application.updateWatchlistHandler),
+		http.MethodDelete: Handle(application.deleteWatchlistHandler),
+	}))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/watchlists/"), "/"), "/")
+
+		switch {
+		case len(parts) == 1 && parts[0] != "":
+			byId.ServeHTTP(w, r)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+}
+
+func watchlistPathId(r *http.Request) (uint64, error) {
+	id, err := strconv.ParseUint(strings.Trim(strings.TrimPrefix(r.URL.Path, "/watchlists/"), "/"), 10, 64)
+	if err != nil {
+		return 0, newAPIError(http.StatusNotFound, "Invalid watchlist id!", err)
+	}
+	return id, nil
+}
+
+func (application *Application) watchlistsHandler(r *http.Request, _ struct{}) (pageResponse, error) {
+	watchlists, err := db.GetWatchlists(false, application.DB)
+	if err != nil {
+		return pageResponse{}, newAPIError(http.StatusInternalServerError, "Cannot get watchlists!", err)
+	}
+
+	return pageResponse{Data: watchlists}, nil
+}
+
+// Method checks that the webhook a watchlist names is configured.
+func (application *Application) checkWatchlistWebhook(req watchlistRequest) error {
+	if req.Webhook == "" {
+		return nil
+	}
+	if _, found := application.Config.Delivery.webhook(req.Webhook); !found {
+		return newValidationError(&com.ValidationError{Fields: []com.FieldError{{Field: "webhook", Rule: "configured", Message: fmt.Sprintf("no webhook named %q is configured", req.Webhook)}}})
+	}
+	return nil
+}
+
+func (application *Application) createWatchlistHandler(r *http.Request, req watchlistRequest) (db.Watchlist, error) {
+	if err := application.checkWatchlistWebhook(req); err != nil {
+		return db.Watchlist{}, err
+	}
+
+	watchlist, err := db.CreateWatchlist(req.watchlist(), application.DB)
+	if err != nil {
+		return watchlist, newAPIError(http.StatusInternalServerError, "Cannot create watchlist!", err)
+	}
+	application.Watchlists.invalidate()
+
+	com.TweetyLog(com.INFO, fmt.Sprintf("Created watchlist %d %q.", watchlist.Id, watchlist.Name))
+
+	return watchlist, nil
+}
+
+func (application *Application) watchlistHandler(r *http.Request, _ struct{}) (db.Watchlist, error) {
+	id, err := watchlistPathId(r)
+	if err != nil {
+		return db.Watchlist{}, err
+	}
+
+	watchlist, found, err := db.GetWatchlist(id, application.DB)
+	if err != nil {
+		return watchlist, newAPIError(http.StatusInternalServerError, fmt.Sprintf("Cannot get watchlist %d!", id), err)
+	}
+
+	if !found {
+		return watchlist, newAPIError(http.StatusNotFound, "Watchlist not found!", nil)
+	}
+
+	return watchlist, nil
+}
+
+// Handler replaces a watchlist. Alerts it raised so far are kept.
+func (application *Application) updateWatchlistHandler(r *http.Request, req watchlistRequest) (db.Watchlist, error) {
+	id, err := watchlistPathId(r)
+	if err != nil {
+		return db.Watchlist{}, err
+	}
+	if err := application.checkWatchlistWebhook(req); err != nil {
+		return db.Watchlist{}, err
+	}
+
+	watchlist := req.watchlist()
+	watchlist.Id = id
+	watchlist, found, err := db.UpdateWatchlist(watchlist, application.DB)
+	if err != nil {
+		return watchlist, newAPIError(http.StatusInternalServerError, fmt.Sprintf("Cannot update watchlist %d!", id), err)
+	}
+
+	if !found {
+		return watchlist, newAPIError(http.StatusNotFound, "Watchlist not found!", nil)
+	}
+	application.Watchlists.invalidate()
+
+	com.TweetyLog(com.INFO, fmt.Sprintf("Updated watchlist %d %q.", watchlist.Id, watchlist.Name))
+
+	return watchlist, nil
+}
+
+// Handler deletes a watchlist together with its alerts.
+func (application *Application) deleteWatchlistHandler(r *http.Request, _ struct{}) (empty, error) {
+	id, err := watchlistPathId(r)
+	if err != nil {
+		return empty{}, err
+	}
+
+	deleted, err := db.DeleteWatchlist(id, application.DB)
+	if err != nil {
+		return empty{}, newAPIError(http.StatusInternalServerError, fmt.Sprintf("Cannot delete watchlist %d!", id), err)
+	}
+
+	if !deleted {
+		return empty{}, newAPIError(http.StatusNotFound, "Watchlist not found!", nil)
+	}
+	application.Watchlists.invalidate()
+
+	com.TweetyLog(com.INFO, fmt.Sprintf("Deleted watchlist %d.", id))
+
+	return empty{}, nil
+}
+
+// Handler returns raised alerts newest first, optionally of one watchlist,
+// user or delivery status.
+func (application *Application) alertsHandler(r *http.Request, _ struct{}) (pageResponse, error) {
+	query := r.URL.Query()
+
+	var watchlistId uint64
+	if id := query.Get("watchlist_id"); id != "" {
+		var err error
+		watchlistId, err = strconv.ParseUint(id, 10, 64)
+		if err != nil {
+			return pageResponse{}, newAPIError(http.StatusBadRequest, "Invalid watchlist_id parameter!", err)
+		}
+	}
+
+	limit, err := parseLimit(r)
+	if err != nil {
+		return pageResponse{}, err
+	}
+
+	alerts, next, err := db.GetAlerts(watchlistId, query.Get("user_id"), strings.ToUpper(query.Get("status")), query.Get("cursor"), limit, application.DB)
+	if err != nil {
+		return pageResponse{}, queryError("Cannot get alerts!", err)
+	}
+
+	return pageResponse{Data: alerts, NextCursor: next}, nil
+}
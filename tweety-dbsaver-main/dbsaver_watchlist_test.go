@@ -0,0 +1,99 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	db "gitlab.com/leapbit-practice/tweety-lib-db/db"
+)
+
+func TestContainsWords(t *testing.T) {
+	tests := []struct {
+		text   string
+		phrase string
+		want   bool
+	}{
+		{"hello world", "world", true},
+		{"world", "world", true},
+		{"helloworld", "world", false},
+		{"worldwide", "world", false},
+		{"a_world", "world", false},
+		{"the world's end", "world", true},
+		{"#world", "world", true},
+		{"worlds and the world", "world", true},
+		{"new york city", "new york", true},
+		{"new yorker", "new york", false},
+		{"čaša", "aša", false},
+		{"žito i kruh", "žito", true},
+		{"", "world", false},
+	}
+
+	for _, test := range tests {
+		if got := containsWords(test.text, test.phrase); got != test.want {
+			t.Errorf("containsWords(%q, %q) = %t, want %t", test.text, test.phrase, got, test.want)
+		}
+	}
+}
+
+func TestWatchlistMatch(t *testing.T) {
+	tests := []struct {
+		name      string
+		watchlist db.Watchlist
+		text      string
+		hashtags  []string
+		want      []string
+	}{
+		{
+			name:      "keyword ignores case",
+			watchlist: db.Watchlist{Keywords: []string{"Go"}},
+			text:      "I love GO",
+			want:      []string{"keyword:go"},
+		},
+		{
+			name:      "keyword inside a word",
+			watchlist: db.Watchlist{Keywords: []string{"go"}},
+			text:      "gophers everywhere",
+		},
+		{
+			name:      "hashtags of the entities once",
+			watchlist: db.Watchlist{Hashtags: []string{"GoLang"}},
+			text:      "new release",
+			hashtags:  []string{"golang", "GOLANG"},
+			want:      []string{"hashtag:golang"},
+		},
+		{
+			name:      "hashtag only in the text",
+			watchlist: db.Watchlist{Hashtags: []string{"golang"}},
+			text:      "#golang",
+		},
+		{
+			name:      "regex as written",
+			watchlist: db.Watchlist{Regexes: []string{`\bv\d+\.\d+`}},
+			text:      "released v1.2 today",
+			want:      []string{`regex:\bv\d+\.\d+`},
+		},
+		{
+			name:      "regex is case sensitive",
+			watchlist: db.Watchlist{Regexes: []string{`\bv\d+\.\d+`}},
+			text:      "released V1.2 today",
+		},
+		{
+			name:      "keywords, hashtags and regexes",
+			watchlist: db.Watchlist{Keywords: []string{"release", "missing"}, Hashtags: []string{"go"}, Regexes: []string{`\d+`}},
+			text:      "Release 1 is out",
+			hashtags:  []string{"Go"},
+			want:      []string{"keyword:release", "hashtag:go", `regex:\d+`},
+		},
+	}
+
+	for _, test := range tests {
+		compiled, err := compileWatchlist(test.watchlist)
+		if err != nil {
+			t.Fatalf("%s: compileWatchlist() error: %s", test.name, err)
+		}
+
+		if got := compiled.match(test.text, test.hashtags); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: match(%q, %q) = %q, want %q", test.name, test.text, test.hashtags, got, test.want)
+		}
+	}
+}
@@ -1,11 +1,14 @@
 module github.com/leapbit-internship/tweety-dbsaver
 
-go 1.15
+go 1.19
 
 require (
 	github.com/prometheus/client_golang v1.11.0
 	github.com/leapbit-internship/tweety-lib-communication v0.0.0-20210721104227-2d3ec71ad8df
 	github.com/leapbit-internship/tweety-lib-db v0.0.0-20210726120231-a1dc0d25d781
+	github.com/leapbit-internship/tweety-lib-text v0.0.0-00010101000000-000000000000
 	go.etcd.io/etcd/client/v3 v3.5.0-alpha.0
 	gopkg.in/yaml.v2 v2.4.0 // indirect
 )
+
+replace github.com/leapbit-internship/tweety-lib-text => ../tweety-lib-text-main
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 
@@ -12,6 +13,7 @@ import (
 
 const (
 	httpCounterEndpoint         = "user_ids"
+	httpCounterJobsEndpoint     = "jobs"
 	httpDBSaverMetadataEndpoint = "user_metadata"
 	httpDBSaverExistsEndpoint   = "user_exists"
 	httpDBSaverLocationEndpoint = "location"
@@ -31,6 +33,26 @@ func SendIdsDataToCounter(ids []string, c *http.Client, addr string, port string
 	return resp, nil
 }
 
+// Function for communication between Tweety-Collector and Tweety-Counter.
+// Specifically, Collector asks Counter for the status of a job made from sent user ids.
+func GetCounterJob(jobId string, c *http.Client, addr string, port string) (*http.Response, RespCounterJob, error) {
+	var job RespCounterJob
+	url := fmt.Sprintf("%s:%s/%s/%s", addr, port, httpCounterJobsEndpoint, jobId)
+	resp, err := request("GetCounterJob", c, http.MethodGet, url, nil)
+	if err != nil {
+		return resp, job, err
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return resp, job, fmt.Errorf("%sGetCounterJob method body reading error: \n%s%s", space, space, err)
+	}
+	err = json.Unmarshal(body, &job)
+	if err != nil {
+		return resp, job, fmt.Errorf("%sGetCounterJob method unmarshalling error: \n%s%s", space, space, err)
+	}
+	return resp, job, nil
+}
+
 // Function for communication between Tweety-Collector and Tweety-DBSaver.
 // Specifically, function sends data from Collector to DBSaver via HTTP request.
 func SendUserDataToDatabase(user ReqUser, c *http.Client, addr string, port string) (*http.Response, error) {
@@ -46,8 +68,8 @@ func SendUserDataToDatabase(user ReqUser, c *http.Client, addr string, port stri
 // Specifically, Collector checks with DBSaver if user already exists in database via HTTP request.
 func CheckIfExists(userId ReqUserId, c *http.Client, addr string, port string) (*http.Response, RespUserExists, error) {
 	var exists RespUserExists
-	url := fmt.Sprintf("%s:%s/%s", addr, port, httpDBSaverExistsEndpoint)
-	resp, err := request("CheckIfExists", c, http.MethodGet, url, userId)
+	url := fmt.Sprintf("%s:%s/%s?%s", addr, port, httpDBSaverExistsEndpoint, userId.Query().Encode())
+	resp, err := request("CheckIfExists", c, http.MethodGet, url, nil)
 	if err != nil {
 		return resp, exists, err
 	}
@@ -72,15 +94,21 @@ func SendLocationDataToDatabase(locInfo ReqLocationForDB, c *http.Client, addr s
 }
 
 func request(funcName string, c *http.Client, method string, requestURL string, data interface{}) (*http.Response, error) {
-	reqData, err := json.Marshal(data)
-	if err != nil {
-		return nil, fmt.Errorf("%s%s method marshalling error: \n%s%s", space, funcName, space, err)
+	var body io.Reader
+	if data != nil {
+		reqData, err := json.Marshal(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s%s method marshalling error: \n%s%s", space, funcName, space, err)
+		}
+		body = bytes.NewBuffer(reqData)
 	}
-	req, err := http.NewRequest(method, requestURL, bytes.NewBufferString(string(reqData)))
+	req, err := http.NewRequest(method, requestURL, body)
 	if err != nil {
 		return nil, fmt.Errorf("%s%s method new request error: \n%s%s", space, funcName, space, err)
 	}
-	req.Header.Add("Content-Type", "application/json")
+	if data != nil {
+		req.Header.Add("Content-Type", "application/json")
+	}
 	resp, err := c.Do(req)
 	if err != nil {
 		return resp, fmt.Errorf("%s%s method server communication error: \n%s%s", space, funcName, space, err)
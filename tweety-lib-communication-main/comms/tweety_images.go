@@ -0,0 +1,134 @@
+package comms
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"net/http"
+	"time"
+)
+
+// Kinds of user images.
+const (
+	IMAGE_PROFILE = "profile"
+	IMAGE_BANNER  = "banner"
+)
+
+var imageMimeTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+	"image/webp": true,
+}
+
+// An image without Data tells that the image with Sha256 is still the
+// current one of its kind, so it is seen again without being sent again.
+type UserImage struct {
+	Kind      string `json:"kind" validate:"required,oneof=profile banner"`
+	SourceUrl string `json:"source_url"`
+	Sha256    string `json:"sha256,omitempty"`
+	Data      []byte `json:"data,omitempty" validate:"image"`
+}
+
+// One stored version of a user image. Versions of a kind are numbered
+// from 1 and a new one is stored only when the image changes.
+type ImageVersion struct {
+	Kind       string    `json:"kind"`
+	Version    int       `json:"version"`
+	Sha256     string    `json:"sha256"`
+	MimeType   string    `json:"mime_type"`
+	Size       int64     `json:"size"`
+	SourceUrl  string    `json:"source_url,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+}
+
+type RespUserImages struct {
+	Images []ImageVersion `json:"images"`
+}
+
+// Function sniffs the MIME type of image data from its first bytes,
+// empty when it is not a JPEG, PNG, GIF or WebP image.
+func ImageMimeType(data []byte) string {
+	mimeType := http.DetectContentType(data)
+	if !imageMimeTypes[mimeType] {
+		return ""
+	}
+	return mimeType
+}
+
+// Method checks that every image has data or the SHA-256 of the current one.
+func (images ReqImagesForDB) Validate() error {
+	var fields []FieldError
+
+	for i, image := range images.Images {
+		if len(image.Data) == 0 && image.Sha256 == "" {
+			fields = append(fields, FieldError{Field: fmt.Sprintf("images[%d].data", i), Rule: "required", Message: "is required without sha256"})
+		}
+	}
+
+	if len(fields) > 0 {
+		return &ValidationError{Fields: fields}
+	}
+	return nil
+}
+
+// Function returns the hex encoded SHA-256 images are stored under.
+func ImageDigest(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Function returns the 64 bit difference hash of an image. The image is
+// shrunk to 9x8 gray pixels and every bit tells whether a pixel is brighter
+// than its right neighbour, so resized or recompressed copies of an image
+// get hashes a few bits apart. WebP images cannot be decoded.
+func ImageDHash(data []byte) (uint64, error) {
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return 0, err
+	}
+
+	bounds := img.Bounds()
+	if bounds.Dx() == 0 || bounds.Dy() == 0 {
+		return 0, fmt.Errorf("image has no pixels")
+	}
+
+	// Every cell of the 9x8 grid gets the mean luminance of the pixels it covers.
+	var sums, counts [8][9]uint64
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		row := (y - bounds.Min.Y) * 8 / bounds.Dy()
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			col := (x - bounds.Min.X) * 9 / bounds.Dx()
+			r, g, b, _ := img.At(x, y).RGBA()
+			sums[row][col] += uint64((19595*r + 38470*g + 7471*b + 1<<15) >> 24)
+			counts[row][col]++
+		}
+	}
+
+	var hash uint64
+	for row := 0; row < 8; row++ {
+		for col := 0; col < 8; col++ {
+			left, right := cellMean(sums[row][col], counts[row][col]), cellMean(sums[row][col+1], counts[row][col+1])
+			hash <<= 1
+			if left > right {
+				hash |= 1
+			}
+		}
+	}
+
+	return hash, nil
+}
+
+// Images narrower than 9 or shorter than 8 pixels leave cells empty.
+func cellMean(sum uint64, count uint64) uint64 {
+	if count == 0 {
+		return 0
+	}
+	return sum * 256 / count
+}
@@ -1,6 +1,7 @@
 package comms
 
 import (
+	"net/url"
 	"time"
 
 	tw "gitlab.com/leapbit-practice/tweety-lib-twitter/twitter"
@@ -8,7 +9,7 @@ import (
 
 type ReqUser struct {
 	Id              uint64            `json:"id"`
-	Id_str          string            `json:"id_str"`
+	Id_str          string            `json:"id_str" validate:"required,numeric"`
 	Name            string            `json:"name"`
 	Screen_name     string            `json:"screen_name"`
 	Location        string            `json:"location"`
@@ -28,11 +29,21 @@ type ReqUser struct {
 }
 
 type ReqUserId struct {
-	UserId  string    `json:"user_id"`
+	UserId  string    `json:"user_id" validate:"required,numeric"`
 	AppName string    `json:"app_name"`
 	SentAt  time.Time `json:"timestamp"`
 }
 
+// Method encodes user id lookup as URL query parameters
+// used by GET lookup endpoints instead of a request body.
+func (userId ReqUserId) Query() url.Values {
+	query := url.Values{}
+	query.Set("user_id", userId.UserId)
+	query.Set("app_name", userId.AppName)
+	query.Set("timestamp", userId.SentAt.Format(time.RFC3339Nano))
+	return query
+}
+
 type RespUserExists struct {
 	Exists        bool      `json:"exists"`
 	Last_modified time.Time `json:"last_modified"`
@@ -42,19 +53,125 @@ type RespTweetId struct {
 	Id string `json:"tweet_id"`
 }
 
+// LastCountedAt is nil for users Counter never finished. Status is the stored
+// account status, empty when none was recorded.
+type RespLastCounted struct {
+	LastCountedAt *time.Time `json:"last_counted_at"`
+	Status        string     `json:"status,omitempty"`
+}
+
+// Analysis of one tweet made by Counter. Language is an ISO 639-1
+// code, empty when the tweet is too short to tell.
+type TweetAnalysis struct {
+	Sentiment          float64 `json:"sentiment"`
+	Language           string  `json:"language"`
+	LanguageConfidence float64 `json:"language_confidence"`
+}
+
+// Analysis is keyed by tweet id_str. DistinctiveTerms are scored
+// by TF-IDF against the corpus, most distinctive first. With SinceId
+// Tweets only hold tweets newer than it, and the terms of tweets not stored yet
+// are added to the stored counts.
 type ReqTweetsForDB struct {
-	UserId    string                   `json:"user_id"`
-	Tweets    []tw.RespTwitterApiTweet `json:"tweets"`
-	WordCount []KvPair                 `json:"word_count"`
-	AppName   string                   `json:"app_name"`
-	SentAt    time.Time                `json:"timestamp"`
+	UserId           string                   `json:"user_id" validate:"required,numeric"`
+	Tweets           []tw.RespTwitterApiTweet `json:"tweets" validate:"nonempty"`
+	WordCount        []KvPair                 `json:"word_count"`
+	DistinctiveTerms []TermScore              `json:"distinctive_terms"`
+	Analysis         map[string]TweetAnalysis `json:"analysis"`
+	SinceId          string                   `json:"since_id" validate:"numeric"`
+	AppName          string                   `json:"app_name"`
+	SentAt           time.Time                `json:"timestamp"`
 }
 
+// Latest tweets Counter fetched for a user, with ids OldestId to NewestId.
+// Stored tweets in that range missing from TweetIds were deleted.
+type ReqTweetWindowForDB struct {
+	UserId   string    `json:"user_id" validate:"required,numeric"`
+	OldestId string    `json:"oldest_id" validate:"required,numeric"`
+	NewestId string    `json:"newest_id" validate:"required,numeric"`
+	TweetIds []string  `json:"tweet_ids" validate:"nonempty"`
+	AppName  string    `json:"app_name"`
+	SentAt   time.Time `json:"timestamp"`
+}
+
+// Restored tweets were marked deleted before and are on the timeline again.
+type RespTweetWindow struct {
+	Deleted  []string `json:"deleted"`
+	Restored []string `json:"restored"`
+}
+
+// Statuses of Twitter accounts. Timelines of protected accounts cannot be read,
+// suspended accounts cannot be found at all.
+const (
+	USER_ACTIVE    = "active"
+	USER_PROTECTED = "protected"
+	USER_SUSPENDED = "suspended"
+)
+
+type ReqUserStatusForDB struct {
+	UserId  string    `json:"user_id" validate:"required,numeric"`
+	Status  string    `json:"status" validate:"required,oneof=active protected suspended"`
+	AppName string    `json:"app_name"`
+	SentAt  time.Time `json:"timestamp"`
+}
+
+// Changed tells whether Status differs from the one stored before,
+// ChangedAt is when the user last changed to Status.
+type RespUserStatus struct {
+	Status    string     `json:"status"`
+	Changed   bool       `json:"changed"`
+	ChangedAt *time.Time `json:"changed_at"`
+}
+
+// Statuses of Counter jobs and of each user in a job.
+const (
+	JOB_QUEUED    = "queued"
+	JOB_RUNNING   = "running"
+	JOB_DONE      = "done"
+	JOB_FAILED    = "failed"
+	JOB_CANCELLED = "cancelled"
+	JOB_SKIPPED   = "skipped"
+)
+
+// Users counted within the freshness window of Counter are skipped,
+// LastCountedAt tells when they were counted. A user already queued
+// or running in another job shares its run, SharedWith is that job id.
+type CounterJobUser struct {
+	UserId        string     `json:"user_id"`
+	Status        string     `json:"status"`
+	Error         string     `json:"error,omitempty"`
+	SharedWith    string     `json:"shared_with,omitempty"`
+	LastCountedAt *time.Time `json:"last_counted_at,omitempty"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+}
+
+// A job is done once none of its users is queued or running,
+// Failed and Cancelled count the users that did not finish.
+type RespCounterJob struct {
+	Id         string           `json:"job_id"`
+	Status     string           `json:"status"`
+	CreatedAt  time.Time        `json:"created_at"`
+	FinishedAt *time.Time       `json:"finished_at,omitempty"`
+	Failed     int              `json:"failed"`
+	Cancelled  int              `json:"cancelled"`
+	Skipped    int              `json:"skipped"`
+	Users      []CounterJobUser `json:"users"`
+}
+
+// Images are sent as downloaded, with the url they were downloaded from.
+// DBSaver sniffs their MIME type and stores them under their SHA-256.
 type ReqImagesForDB struct {
-	UserId     string    `json:"user_id"`
-	UserImages []byte    `json:"user_images"`
-	AppName    string    `json:"app_name"`
-	SentAt     time.Time `json:"timestamp"`
+	UserId  string      `json:"user_id" validate:"required,numeric"`
+	Images  []UserImage `json:"images" validate:"nonempty,dive"`
+	AppName string      `json:"app_name"`
+	SentAt  time.Time   `json:"timestamp"`
+}
+
+// Error body returned by Tweety services for every failed request.
+type RespError struct {
+	Error  string       `json:"error"`
+	Code   string       `json:"code"`
+	Fields []FieldError `json:"fields,omitempty"`
 }
 
 type KvPair struct {
@@ -62,15 +179,34 @@ type KvPair struct {
 	Count uint64
 }
 
+type TermScore struct {
+	Term  string  `json:"term"`
+	Score float64 `json:"score"`
+}
+
+// Request for the number of tweets in the corpus containing each term.
+type ReqDocumentFrequencies struct {
+	Terms   []string  `json:"terms" validate:"nonempty"`
+	AppName string    `json:"app_name"`
+	SentAt  time.Time `json:"timestamp"`
+}
+
+// Documents is the number of tweets in the corpus,
+// terms in no tweet are missing from Frequencies.
+type RespDocumentFrequencies struct {
+	Documents   uint64            `json:"documents"`
+	Frequencies map[string]uint64 `json:"frequencies"`
+}
+
 type ReqLocationForDB struct {
-	LocationInfo RespLocation `json:"location_info"`
-	UserId       string       `json:"user_id"`
+	LocationInfo RespLocation `json:"location_info" validate:"dive"`
+	UserId       string       `json:"user_id" validate:"required,numeric"`
 	AppName      string       `json:"app_name"`
 	SentAt       time.Time    `json:"sent_at"`
 }
 
 type RespLocation struct {
-	Name           string              `json:"name"`
+	Name           string              `json:"name" validate:"required"`
 	TopLevelDomain []string            `json:"topLevelDomain"`
 	Alpha2Code     string              `json:"alpha2Code"`
 	Alpha3Code     string              `json:"alpha3Code"`
@@ -115,3 +251,37 @@ type RegionalBlocsType struct {
 	OtherAcronyms []string `json:"otherAcronyms"`
 	OtherNames    []string `json:"otherNames"`
 }
+
+// Sender methods expose who sent the request and when,
+// so receiving services can log requests uniformly.
+func (user ReqUser) Sender() (string, time.Time) {
+	return user.App_name, user.Sent_at
+}
+
+func (userId ReqUserId) Sender() (string, time.Time) {
+	return userId.AppName, userId.SentAt
+}
+
+func (tweets ReqTweetsForDB) Sender() (string, time.Time) {
+	return tweets.AppName, tweets.SentAt
+}
+
+func (frequencies ReqDocumentFrequencies) Sender() (string, time.Time) {
+	return frequencies.AppName, frequencies.SentAt
+}
+
+func (images ReqImagesForDB) Sender() (string, time.Time) {
+	return images.AppName, images.SentAt
+}
+
+func (location ReqLocationForDB) Sender() (string, time.Time) {
+	return location.AppName, location.SentAt
+}
+
+func (window ReqTweetWindowForDB) Sender() (string, time.Time) {
+	return window.AppName, window.SentAt
+}
+
+func (status ReqUserStatusForDB) Sender() (string, time.Time) {
+	return status.AppName, status.SentAt
+}
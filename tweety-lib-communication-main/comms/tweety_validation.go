@@ -0,0 +1,187 @@
+package comms
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Validation rules are declared in `validate` struct tags, separated by commas:
+//
+//	required  value must not be the zero value
+//	numeric   string (or every string of a slice) must contain only digits
+//	nonempty  slice or map must have at least one element
+//	max=N     string or slice must not be longer than N
+//	zip       byte slice must be a readable zip archive
+//	image     byte slice must be a JPEG, PNG, GIF or WebP image
+//	oneof=A B string must be one of the space separated values
+//	dive      nested struct, or every struct of a slice, is validated with its own tags
+type FieldError struct {
+	Field   string `json:"field"`
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+type ValidationError struct {
+	Fields []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	msgs := make([]string, 0, len(e.Fields))
+	for _, f := range e.Fields {
+		msgs = append(msgs, fmt.Sprintf("%s: %s", f.Field, f.Message))
+	}
+	return "validation failed: " + strings.Join(msgs, "; ")
+}
+
+// Function validates struct v against its `validate` tags.
+// It returns *ValidationError listing every failed field, or nil.
+func Validate(v interface{}) error {
+	value := reflect.ValueOf(v)
+	for value.Kind() == reflect.Ptr {
+		if value.IsNil() {
+			return nil
+		}
+		value = value.Elem()
+	}
+	if value.Kind() != reflect.Struct {
+		return nil
+	}
+
+	var fields []FieldError
+	validateStruct(value, "", &fields)
+	if len(fields) > 0 {
+		return &ValidationError{Fields: fields}
+	}
+	return nil
+}
+
+func fieldName(field reflect.StructField) string {
+	name := strings.Split(field.Tag.Get("json"), ",")[0]
+	if name == "" || name == "-" {
+		return field.Name
+	}
+	return name
+}
+
+func validateStruct(value reflect.Value, prefix string, fields *[]FieldError) {
+	t := value.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("validate")
+		if tag == "" || field.PkgPath != "" {
+			continue
+		}
+		name := prefix + fieldName(field)
+		fieldValue := value.Field(i)
+		for _, rule := range strings.Split(tag, ",") {
+			if rule == "dive" {
+				switch fieldValue.Kind() {
+				case reflect.Struct:
+					validateStruct(fieldValue, name+".", fields)
+				case reflect.Slice:
+					for j := 0; j < fieldValue.Len(); j++ {
+						if elem := fieldValue.Index(j); elem.Kind() == reflect.Struct {
+							validateStruct(elem, fmt.Sprintf("%s[%d].", name, j), fields)
+						}
+					}
+				}
+				continue
+			}
+			if msg := checkRule(rule, fieldValue); msg != "" {
+				ruleName := strings.SplitN(rule, "=", 2)[0]
+				*fields = append(*fields, FieldError{Field: name, Rule: ruleName, Message: msg})
+				// Further rules on a field that failed would only repeat the problem.
+				break
+			}
+		}
+	}
+}
+
+func isNumeric(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func checkRule(rule string, value reflect.Value) string {
+	name, arg := rule, ""
+	if i := strings.Index(rule, "="); i >= 0 {
+		name, arg = rule[:i], rule[i+1:]
+	}
+
+	switch name {
+	case "required":
+		if value.IsZero() {
+			return "is required"
+		}
+	case "numeric":
+		switch value.Kind() {
+		case reflect.String:
+			if value.Len() > 0 && !isNumeric(value.String()) {
+				return "must be numeric"
+			}
+		case reflect.Slice:
+			for i := 0; i < value.Len(); i++ {
+				if elem := value.Index(i); elem.Kind() == reflect.String && !isNumeric(elem.String()) {
+					return fmt.Sprintf("element %d must be numeric", i)
+				}
+			}
+		}
+	case "nonempty":
+		switch value.Kind() {
+		case reflect.Slice, reflect.Map, reflect.Array, reflect.String:
+			if value.Len() == 0 {
+				return "must not be empty"
+			}
+		}
+	case "max":
+		limit, err := strconv.Atoi(arg)
+		if err != nil {
+			return fmt.Sprintf("invalid rule %q", rule)
+		}
+		switch value.Kind() {
+		case reflect.Slice, reflect.Map, reflect.Array, reflect.String:
+			if value.Len() > limit {
+				return fmt.Sprintf("must not be longer than %d", limit)
+			}
+		}
+	case "zip":
+		if value.Kind() == reflect.Slice && value.Len() > 0 {
+			data := value.Bytes()
+			reader, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+			if err != nil {
+				return "must be a valid zip archive"
+			}
+			if len(reader.File) == 0 {
+				return "zip archive must not be empty"
+			}
+		}
+	case "image":
+		if value.Kind() == reflect.Slice && value.Len() > 0 && ImageMimeType(value.Bytes()) == "" {
+			return "must be a JPEG, PNG, GIF or WebP image"
+		}
+	case "oneof":
+		if value.Kind() == reflect.String && value.Len() > 0 {
+			for _, allowed := range strings.Fields(arg) {
+				if value.String() == allowed {
+					return ""
+				}
+			}
+			return fmt.Sprintf("must be one of %s", strings.Join(strings.Fields(arg), ", "))
+		}
+	default:
+		return fmt.Sprintf("unknown rule %q", rule)
+	}
+
+	return ""
+}
@@ -0,0 +1,324 @@
+package db
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	TOP_ACTIVITY_ROWS = 10
+)
+
+// Weekday buckets of activity histograms, Monday first.
+var WEEKDAYS = [7]string{"Monday", "Tuesday", "Wednesday", "Thursday", "Friday", "Saturday", "Sunday"}
+
+// When tweets were posted, in local time of Timezone. Burstiness compares the
+// spread of gaps between tweets with their mean, -1 for tweets at regular
+// intervals, 0 for random ones and close to 1 for bursts. Memory correlates
+// consecutive gaps, positive when short gaps follow short ones. Both are nil
+// without enough tweets.
+type ActivityHistogram struct {
+	Timezone   string     `json:"timezone"`
+	Tweets     uint64     `json:"tweets"`
+	Hours      [24]uint64 `json:"hours"`
+	Weekdays   [7]uint64  `json:"weekdays"`
+	Burstiness *float64   `json:"burstiness"`
+	Memory     *float64   `json:"memory"`
+}
+
+// Activity of a user or location named Name.
+type NamedActivity struct {
+	Name string `json:"name"`
+	ActivityHistogram
+}
+
+const (
+	// Tweets are bucketed by epoch seconds shifted by the offset, 1970-01-01 was a Thursday.
+	get_activity_histogram = `SELECT (FLOOR(local_at / 3600)::bigint % 24)::int, ((FLOOR(local_at / 86400)::bigint + 3) % 7)::int, COUNT(*)
+	FROM (
+		SELECT EXTRACT(EPOCH FROM A.created_at) + $5 local_at
+		FROM PUBLIC.tweet A
+		JOIN PUBLIC.user B
+		ON A.user_id_str = B.id_str
+		WHERE ($1 = '' OR A.user_id_str = $1) AND ($2 = '' OR B.location_name = $2)
+		AND A.created_at >= $3 AND A.created_at < $4
+	) local
+	GROUP BY 1, 2`
+
+	// Gaps are taken between tweets of the same user, also for locations.
+	get_activity_gaps = `SELECT COUNT(gap), COALESCE(AVG(gap), 0), COALESCE(STDDEV_POP(gap), 0), CORR(gap, previous_gap)
+	FROM (
+		SELECT gap, LAG(gap) OVER (PARTITION BY user_id_str ORDER BY created_at) previous_gap
+		FROM (
+			SELECT A.user_id_str, A.created_at,
+				EXTRACT(EPOCH FROM A.created_at) - EXTRACT(EPOCH FROM LAG(A.created_at) OVER (PARTITION BY A.user_id_str ORDER BY A.created_at)) gap
+			FROM PUBLIC.tweet A
+			JOIN PUBLIC.user B
+			ON A.user_id_str = B.id_str
+			WHERE ($1 = '' OR A.user_id_str = $1) AND ($2 = '' OR B.location_name = $2)
+			AND A.created_at >= $3 AND A.created_at < $4
+		) gaps
+	) pairs
+	WHERE gap IS NOT NULL`
+
+	get_user_timezones = `SELECT B.timezones
+	FROM PUBLIC.user A
+	LEFT JOIN PUBLIC.location B
+	ON A.location_name = B.name
+	WHERE A.id_str = $1`
+
+	get_location_timezones = `SELECT timezones
+	FROM PUBLIC.location
+	WHERE name = $1`
+
+	get_most_active_users = `SELECT A.user_id_str, COALESCE(B.name, A.user_id_str)
+	FROM PUBLIC.tweet A
+	JOIN PUBLIC.user B
+	ON A.user_id_str = B.id_str
+	WHERE A.created_at >= $1 AND A.created_at < $2
+	GROUP BY A.user_id_str, B.name
+	ORDER BY COUNT(*) DESC, A.user_id_str
+	LIMIT $3`
+
+	get_most_active_locations = `SELECT B.location_name
+	FROM PUBLIC.tweet A
+	JOIN PUBLIC.user B
+	ON A.user_id_str = B.id_str
+	WHERE A.created_at >= $1 AND A.created_at < $2 AND COALESCE(B.location_name, '') <> ''
+	GROUP BY B.location_name
+	ORDER BY COUNT(*) DESC, B.location_name
+	LIMIT $3`
+)
+
+// Function parses a timezone of a location like UTC+05:30 into its offset in seconds.
+func parseUTCOffset(timezone string) (int, bool) {
+	if timezone == "UTC" {
+		return 0, true
+	}
+	if !strings.HasPrefix(timezone, "UTC") || len(timezone) != len("UTC+00:00") {
+		return 0, false
+	}
+
+	sign := 1
+	switch timezone[3] {
+	case '+':
+	case '-':
+		sign = -1
+	default:
+		return 0, false
+	}
+
+	hours, err := strconv.Atoi(timezone[4:6])
+	if err != nil || timezone[6] != ':' {
+		return 0, false
+	}
+	minutes, err := strconv.Atoi(timezone[7:9])
+	if err != nil {
+		return 0, false
+	}
+	return sign * (hours*3600 + minutes*60), true
+}
+
+// Function infers the timezone of users at a location from the timezones it
+// spans, the median one for locations spanning many. Locations without known
+// timezones are taken to be in UTC.
+func InferTimezone(timezones []string) (string, int) {
+	type zone struct {
+		name   string
+		offset int
+	}
+	var zones []zone
+	for _, timezone := range timezones {
+		if offset, ok := parseUTCOffset(timezone); ok {
+			zones = append(zones, zone{timezone, offset})
+		}
+	}
+	if len(zones) == 0 {
+		return "UTC", 0
+	}
+
+	sort.SliceStable(zones, func(i, j int) bool { return zones[i].offset < zones[j].offset })
+	median := zones[(len(zones)-1)/2]
+	return median.name, median.offset
+}
+
+func scanTimezones(row *sql.Row) ([]string, bool, error) {
+	var jsonTimezones []byte
+	err := row.Scan(&jsonTimezones)
+	if err == sql.ErrNoRows {
+		return nil, false, nil
+	}
+	if err != nil || len(jsonTimezones) == 0 {
+		return nil, err == nil, err
+	}
+
+	var timezones []string
+	err = json.Unmarshal(jsonTimezones, &timezones)
+	return timezones, err == nil, err
+}
+
+func getActivity(userId string, location string, timezones []string, from time.Time, to time.Time, db *sql.DB) (ActivityHistogram, error) {
+	var activity ActivityHistogram
+	var offset int
+	activity.Timezone, offset = InferTimezone(timezones)
+
+	rows, err := db.Query(get_activity_histogram, userId, location, from, to, offset)
+	if err != nil {
+		return activity, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var hour, weekday int
+		var count uint64
+		if err := rows.Scan(&hour, &weekday, &count); err != nil {
+			return activity, err
+		}
+		if hour < 0 || hour > 23 || weekday < 0 || weekday > 6 {
+			return activity, fmt.Errorf("tweet bucketed to hour %d and weekday %d", hour, weekday)
+		}
+		activity.Hours[hour] += count
+		activity.Weekdays[weekday] += count
+		activity.Tweets += count
+	}
+	if err := rows.Err(); err != nil {
+		return activity, err
+	}
+
+	var gaps int
+	var mean, stdDev float64
+	var memory sql.NullFloat64
+	if err := db.QueryRow(get_activity_gaps, userId, location, from, to).Scan(&gaps, &mean, &stdDev, &memory); err != nil {
+		return activity, err
+	}
+	if gaps >= 2 && mean+stdDev > 0 {
+		burstiness := (stdDev - mean) / (stdDev + mean)
+		activity.Burstiness = &burstiness
+	}
+	if memory.Valid {
+		activity.Memory = &memory.Float64
+	}
+
+	return activity, nil
+}
+
+// Function returns when a user tweeted in [from, to), in the timezone of its location.
+func GetUserActivity(userId string, from time.Time, to time.Time, db *sql.DB) (ActivityHistogram, bool, error) {
+	timezones, found, err := scanTimezones(db.QueryRow(get_user_timezones, userId))
+	if err != nil || !found {
+		return ActivityHistogram{}, false, err
+	}
+	activity, err := getActivity(userId, "", timezones, from, to, db)
+	return activity, err == nil, err
+}
+
+// Function returns when users at a location tweeted in [from, to), in the
+// timezone of the location. Locations that were never looked up are not found.
+func GetLocationActivity(location string, from time.Time, to time.Time, db *sql.DB) (ActivityHistogram, bool, error) {
+	timezones, found, err := scanTimezones(db.QueryRow(get_location_timezones, location))
+	if err != nil || !found {
+		return ActivityHistogram{}, false, err
+	}
+	activity, err := getActivity("", location, timezones, from, to, db)
+	return activity, err == nil, err
+}
+
+// Function returns the activity of the users tweeting the most in [from, to).
+func GetUserActivityInPeriod(from time.Time, to time.Time, limit int, db *sql.DB) ([]NamedActivity, error) {
+	activities := make([]NamedActivity, 0)
+
+	rows, err := db.Query(get_most_active_users, from, to, limit)
+	if err != nil {
+		return activities, err
+	}
+
+	type user struct{ id, name string }
+	var users []user
+	for rows.Next() {
+		var u user
+		if err := rows.Scan(&u.id, &u.name); err != nil {
+			rows.Close()
+			return activities, err
+		}
+		users = append(users, u)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return activities, err
+	}
+
+	for _, u := range users {
+		activity, _, err := GetUserActivity(u.id, from, to, db)
+		if err != nil {
+			return activities, err
+		}
+		activities = append(activities, NamedActivity{Name: u.name, ActivityHistogram: activity})
+	}
+
+	return activities, nil
+}
+
+// Function returns the activity of the locations tweeting the most in [from, to).
+func GetLocationActivityInPeriod(from time.Time, to time.Time, limit int, db *sql.DB) ([]NamedActivity, error) {
+	activities := make([]NamedActivity, 0)
+
+	rows, err := db.Query(get_most_active_locations, from, to, limit)
+	if err != nil {
+		return activities, err
+	}
+
+	var locations []string
+	for rows.Next() {
+		var location string
+		if err := rows.Scan(&location); err != nil {
+			rows.Close()
+			return activities, err
+		}
+		locations = append(locations, location)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return activities, err
+	}
+
+	for _, location := range locations {
+		// Users may name locations that were never looked up, those are in UTC.
+		timezones, _, err := scanTimezones(db.QueryRow(get_location_timezones, location))
+		if err != nil {
+			return activities, err
+		}
+		activity, err := getActivity("", location, timezones, from, to, db)
+		if err != nil {
+			return activities, err
+		}
+		activities = append(activities, NamedActivity{Name: location, ActivityHistogram: activity})
+	}
+
+	return activities, nil
+}
+
+// Method returns the hour most tweets were posted in, -1 without tweets.
+func (activity ActivityHistogram) PeakHour() int {
+	return peak(activity.Hours[:])
+}
+
+// Method returns the weekday most tweets were posted on, Monday is 0, -1 without tweets.
+func (activity ActivityHistogram) PeakWeekday() int {
+	return peak(activity.Weekdays[:])
+}
+
+func peak(buckets []uint64) int {
+	best := -1
+	for i, count := range buckets {
+		if count > 0 && (best < 0 || count > buckets[best]) {
+			best = i
+		}
+	}
+	return best
+}
@@ -0,0 +1,57 @@
+package db
+
+import "testing"
+
+func TestParseUTCOffset(t *testing.T) {
+	tests := []struct {
+		timezone string
+		want     int
+		ok       bool
+	}{
+		{"UTC", 0, true},
+		{"UTC+00:00", 0, true},
+		{"UTC+01:00", 3600, true},
+		{"UTC-05:00", -5 * 3600, true},
+		{"UTC+05:30", 5*3600 + 30*60, true},
+		{"UTC-09:30", -(9*3600 + 30*60), true},
+		{"UTC+14:00", 14 * 3600, true},
+		{"", 0, false},
+		{"GMT+01:00", 0, false},
+		{"UTC+1", 0, false},
+		{"UTC*01:00", 0, false},
+		{"UTC+01-00", 0, false},
+		{"UTC+aa:00", 0, false},
+		{"UTC+01:00 ", 0, false},
+	}
+
+	for _, test := range tests {
+		got, ok := parseUTCOffset(test.timezone)
+		if got != test.want || ok != test.ok {
+			t.Errorf("parseUTCOffset(%q) = %d, %t, want %d, %t", test.timezone, got, ok, test.want, test.ok)
+		}
+	}
+}
+
+func TestInferTimezone(t *testing.T) {
+	tests := []struct {
+		name       string
+		timezones  []string
+		wantName   string
+		wantOffset int
+	}{
+		{"none", nil, "UTC", 0},
+		{"only invalid", []string{"CET", ""}, "UTC", 0},
+		{"single", []string{"UTC+01:00"}, "UTC+01:00", 3600},
+		{"invalid ones are skipped", []string{"nowhere", "UTC+02:00"}, "UTC+02:00", 7200},
+		{"median of odd", []string{"UTC+10:00", "UTC-05:00", "UTC+01:00"}, "UTC+01:00", 3600},
+		{"lower median of even", []string{"UTC+03:00", "UTC-03:00", "UTC+01:00", "UTC+05:00"}, "UTC+01:00", 3600},
+		{"equal offsets keep their order", []string{"UTC+00:00", "UTC", "UTC+01:00"}, "UTC", 0},
+	}
+
+	for _, test := range tests {
+		name, offset := InferTimezone(test.timezones)
+		if name != test.wantName || offset != test.wantOffset {
+			t.Errorf("%s: InferTimezone(%q) = %q, %d, want %q, %d", test.name, test.timezones, name, offset, test.wantName, test.wantOffset)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package db
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+)
+
+const (
+	TOP_BOT_ROWS = 25
+	// Newest stored tweets of a user tweet cadence and repeated text are taken from.
+	BOT_SAMPLE_TWEETS = 200
+)
+
+// Stored data of a user a bot score is computed from. CreatedAt is nil when
+// the account creation time is unknown, tweets are newest first.
+type BotInputs struct {
+	CreatedAt       *time.Time
+	Followers       uint64
+	Friends         uint64
+	Statuses        uint64
+	Verified        bool
+	ProfileImageUrl string
+	TweetTimes      []time.Time
+	TweetTexts      []string
+}
+
+// Bot likelihood of a user from 0 to 1. Breakdown holds the features and
+// weights the score was computed from and is left out of report rankings.
+type BotScore struct {
+	UserId    string          `json:"user_id"`
+	Name      string          `json:"name"`
+	Score     float64         `json:"score"`
+	Breakdown json.RawMessage `json:"breakdown,omitempty"`
+	ScoredAt  time.Time       `json:"scored_at"`
+}
+
+const (
+	get_bot_user_inputs = `SELECT created_at, COALESCE(followers_count, 0), COALESCE(friends_count, 0), COALESCE(statuses_count, 0), COALESCE(verified, FALSE),
+		COALESCE((
+			SELECT source_url
+			FROM PUBLIC.user_image
+			WHERE user_id_str = $1 AND kind = 'profile'
+			ORDER BY version DESC
+			FETCH FIRST 1 ROWS ONLY
+		), '')
+	FROM PUBLIC.user
+	WHERE id_str = $1 AND name IS NOT NULL`
+
+	get_bot_tweet_inputs = `SELECT created_at, COALESCE(text, '')
+	FROM PUBLIC.tweet
+	WHERE user_id_str = $1 AND created_at IS NOT NULL
+	ORDER BY created_at DESC
+	LIMIT $2`
+
+	update_bot_score = `UPDATE public.user
+		SET bot_score = $2, bot_breakdown = $3, bot_scored_at = NOW()
+		WHERE id_str = $1`
+
+	get_bot_score = `SELECT id_str, COALESCE(name, ''), bot_score, bot_breakdown, bot_scored_at
+	FROM PUBLIC.user
+	WHERE id_str = $1 AND bot_score IS NOT NULL`
+
+	get_unscored_users = `SELECT id_str
+	FROM PUBLIC.user
+	WHERE name IS NOT NULL AND bot_scored_at IS NULL
+	ORDER BY id_str
+	LIMIT $1`
+
+	get_likely_bots_in_period = `SELECT A.id_str, COALESCE(A.name, ''), A.bot_score, A.bot_scored_at
+	FROM PUBLIC.user A
+	WHERE A.bot_score IS NOT NULL
+	AND EXISTS (
+		SELECT 1
+		FROM PUBLIC.tweet B
+		WHERE B.user_id_str = A.id_str AND B.created_at >= $1 AND B.created_at < $2
+	)
+	ORDER BY A.bot_score DESC, A.id_str
+	LIMIT $3`
+)
+
+// Function returns what a bot score of a user is computed from, not found
+// for users without metadata.
+func GetBotInputs(userId string, db *sql.DB) (BotInputs, bool, error) {
+	var inputs BotInputs
+
+	err := db.QueryRow(get_bot_user_inputs, userId).Scan(&inputs.CreatedAt, &inputs.Followers, &inputs.Friends, &inputs.Statuses,
+		&inputs.Verified, &inputs.ProfileImageUrl)
+	if err == sql.ErrNoRows {
+		return inputs, false, nil
+	}
+	if err != nil {
+		return inputs, false, err
+	}
+
+	rows, err := db.Query(get_bot_tweet_inputs, userId, BOT_SAMPLE_TWEETS)
+	if err != nil {
+		return inputs, false, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var createdAt time.Time
+		var text string
+		if err := rows.Scan(&createdAt, &text); err != nil {
+			return inputs, false, err
+		}
+		inputs.TweetTimes = append(inputs.TweetTimes, createdAt)
+		inputs.TweetTexts = append(inputs.TweetTexts, text)
+	}
+
+	return inputs, true, rows.Err()
+}
+
+func SaveBotScore(userId string, score float64, breakdown []byte, db *sql.DB) error {
+	_, err := db.Exec(update_bot_score, userId, score, breakdown)
+	return err
+}
+
+// Function returns the stored bot score of a user with its breakdown.
+func GetBotScore(userId string, db *sql.DB) (BotScore, bool, error) {
+	var score BotScore
+	var breakdown []byte
+
+	err := db.QueryRow(get_bot_score, userId).Scan(&score.UserId, &score.Name, &score.Score, &breakdown, &score.ScoredAt)
+	if err == sql.ErrNoRows {
+		return score, false, nil
+	}
+	if len(breakdown) > 0 {
+		score.Breakdown = json.RawMessage(breakdown)
+	}
+
+	return score, err == nil, err
+}
+
+// Function returns ids of users with metadata that have no bot score yet.
+func GetUnscoredUsers(limit int, db *sql.DB) ([]string, error) {
+	var userIds []string
+
+	rows, err := db.Query(get_unscored_users, limit)
+	if err != nil {
+		return userIds, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var userId string
+		if err := rows.Scan(&userId); err != nil {
+			return userIds, err
+		}
+		userIds = append(userIds, userId)
+	}
+
+	return userIds, rows.Err()
+}
+
+// Function returns the users tweeting in [from, to) with the highest bot scores.
+func GetLikelyBotsInPeriod(from time.Time, to time.Time, limit int, db *sql.DB) ([]BotScore, error) {
+	scores := make([]BotScore, 0)
+
+	rows, err := db.Query(get_likely_bots_in_period, from, to, limit)
+	if err != nil {
+		return scores, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var score BotScore
+		if err := rows.Scan(&score.UserId, &score.Name, &score.Score, &score.ScoredAt); err != nil {
+			return scores, err
+		}
+		scores = append(scores, score)
+	}
+
+	return scores, rows.Err()
+}
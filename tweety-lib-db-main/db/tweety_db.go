@@ -6,11 +6,11 @@ import (
 	"fmt"
 	"log"
 	"sort"
-	"strings"
 	"time"
 
 	pq "github.com/lib/pq"
 	com "gitlab.com/leapbit-practice/tweety-lib-communication/comms"
+	text "gitlab.com/leapbit-practice/tweety-lib-text/text"
 )
 
 type Configuration struct {
@@ -47,12 +47,33 @@ type DBLog struct {
 }
 
 type Tweet struct {
-	Id         uint64
-	Id_str     string
-	UserId     string
-	Text       string
-	Created_at time.Time
-	Url        string
+	Id                 uint64
+	Id_str             string
+	UserId             string
+	Text               string
+	Created_at         time.Time
+	Url                string
+	Hashtags           []string
+	Mentions           []TweetMention
+	Urls               []TweetUrl
+	Sentiment          *float64
+	Language           string
+	LanguageConfidence float64
+	// Terms of the text, repeated ones included. When the tweet is first saved they
+	// are counted in the corpus and added to the word counts of its user.
+	Terms []string
+}
+
+// Tweets of a user sent by Counter, WordCount and DistinctiveTerms are ranked
+// over all of them. With Merge the terms of newly inserted tweets are added to
+// the stored word counts, otherwise WordCount replaces them.
+type TweetBatch struct {
+	UserId           string
+	Tweets           []Tweet
+	WordCount        []com.KvPair
+	DistinctiveTerms []com.TermScore
+	Merge            bool
+	Alerts           []Alert
 }
 
 type TweetCounts struct {
@@ -69,6 +90,7 @@ type LocationInfo struct {
 	Languages      []com.LanguagesType
 	Population     int64
 	RegionalBlocks []com.RegionalBlocsType
+	Timezones      []string
 }
 
 type RegionalBlockCounts struct {
@@ -104,11 +126,6 @@ type TweetLenghts struct {
 }
 
 const (
-	LAST_HOUR  = -1 * time.Hour
-	LAST_DAY   = -24 * time.Hour
-	LAST_WEEK  = -24 * 7 * time.Hour
-	LAST_MONTH = -30 * 24 * time.Hour
-
 	insert_user = `INSERT INTO public.user (
 		id, 
 		id_str, 
@@ -137,10 +154,17 @@ const (
 		text,
 		created_at,
 		last_modified,
-		url)
-		VALUES ($1, $2, $3, $4, $5, NOW(), $6)
+		url,
+		sentiment,
+		language,
+		language_confidence)
+		VALUES ($1, $2, $3, $4, $5, NOW(), $6, $7, NULLIF($8, ''), $9)
 		ON CONFLICT (tweet_id_str)
-		DO UPDATE SET last_modified = NOW();`
+		DO UPDATE SET last_modified = NOW(),
+		sentiment = COALESCE(EXCLUDED.sentiment, tweet.sentiment),
+		language = COALESCE(EXCLUDED.language, tweet.language),
+		language_confidence = CASE WHEN EXCLUDED.language IS NULL THEN tweet.language_confidence ELSE EXCLUDED.language_confidence END
+		RETURNING (xmax = 0);`
 
 	insert_log = `INSERT INTO public.log (
 		app_name, 
@@ -151,39 +175,79 @@ const (
 		response)
 		VALUES ($1, $2, $3, $4, $5, $6)`
 
+	// Timezones of a location are refreshed whenever it is saved with them.
 	insert_location = `INSERT INTO public.location (
 		name, 
 		languages,
 		regional_blocks,
-		population)
-		VALUES ($1, $2, $3, $4)
-		ON CONFLICT (name) DO NOTHING;`
+		population,
+		timezones)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (name) DO UPDATE SET timezones = EXCLUDED.timezones
+		WHERE EXCLUDED.timezones IS NOT NULL AND location.timezones IS DISTINCT FROM EXCLUDED.timezones;`
 
+	// A report made again for the same window replaces the old one and keeps its id.
 	insert_log_report = `INSERT INTO public.log_report(
 		app_most_requests,
 		top_error_requests,
 		top_longest_requests,
 		top_shortest_requests,
 		type,
+		window_from,
+		window_to,
 		reported_at)
-		VALUES ($1, $2, $3, $4, $5, NOW())`
+		VALUES ($1, $2, $3, $4, $5, $6, $7, NOW())
+		ON CONFLICT (type, window_from, window_to)
+		DO UPDATE SET app_most_requests = EXCLUDED.app_most_requests, top_error_requests = EXCLUDED.top_error_requests,
+		top_longest_requests = EXCLUDED.top_longest_requests, top_shortest_requests = EXCLUDED.top_shortest_requests, reported_at = NOW()
+		RETURNING id`
 
 	insert_tweet_report = `INSERT INTO public.tweet_report(
 		most_tweets,
 		largest_tweets,
 		most_used_words,
+		top_hashtags,
+		top_mentions,
+		top_domains,
+		top_emojis,
+		user_sentiment,
+		fastest_growing,
+		likely_bots,
+		user_activity,
 		type,
+		window_from,
+		window_to,
 		reported_at)
-		VALUES ($1, $2, $3, $4, NOW())`
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, NOW())
+		ON CONFLICT (type, window_from, window_to)
+		DO UPDATE SET most_tweets = EXCLUDED.most_tweets, largest_tweets = EXCLUDED.largest_tweets, most_used_words = EXCLUDED.most_used_words,
+		top_hashtags = EXCLUDED.top_hashtags, top_mentions = EXCLUDED.top_mentions, top_domains = EXCLUDED.top_domains, top_emojis = EXCLUDED.top_emojis,
+		user_sentiment = EXCLUDED.user_sentiment, fastest_growing = EXCLUDED.fastest_growing, likely_bots = EXCLUDED.likely_bots,
+		user_activity = EXCLUDED.user_activity, reported_at = NOW()
+		RETURNING id`
 
 	insert_location_report = `INSERT INTO public.location_report(
 		top_tweet_location,
 		top_tweet_regional_blocks,
 		most_spoken_languages,
 		total_population,
+		location_sentiment,
+		languages_tweeted,
+		location_distinctive_terms,
+		bloc_distinctive_terms,
+		location_activity,
 		type,
+		window_from,
+		window_to,
 		reported_at)
-		VALUES ($1, $2, $3, $4, $5, NOW())`
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, NOW())
+		ON CONFLICT (type, window_from, window_to)
+		DO UPDATE SET top_tweet_location = EXCLUDED.top_tweet_location, top_tweet_regional_blocks = EXCLUDED.top_tweet_regional_blocks,
+		most_spoken_languages = EXCLUDED.most_spoken_languages, total_population = EXCLUDED.total_population,
+		location_sentiment = EXCLUDED.location_sentiment, languages_tweeted = EXCLUDED.languages_tweeted,
+		location_distinctive_terms = EXCLUDED.location_distinctive_terms, bloc_distinctive_terms = EXCLUDED.bloc_distinctive_terms,
+		location_activity = EXCLUDED.location_activity, reported_at = NOW()
+		RETURNING id`
 
 	//update_user_location_name = `UPDATE public.user SET location_name = $2 WHERE id_str = $1;`
 
@@ -195,22 +259,22 @@ const (
 		ON CONFLICT (id_str) 
 		DO UPDATE SET location_name = $2, last_modified = NOW();`
 
-	update_user_image = `INSERT INTO public.user (
-		id_str, 
-		images,
-		last_modified) 
-		VALUES ($1, $2, NOW()) 
-		ON CONFLICT (id_str) 
-		DO UPDATE SET images = $2, last_modified = NOW();`
-
 	//update_wc = `UPDATE public.user SET word_counts = $2 WHERE id_str = $1;`
 	update_wc = `INSERT INTO public.user (
 		id_str, 
 		word_counts,
+		distinctive_terms,
 		last_modified) 
-		VALUES ($1, $2, NOW()) 
+		VALUES ($1, $2, $3, NOW()) 
 		ON CONFLICT (id_str) 
-		DO UPDATE SET word_counts = $2, last_modified = NOW();`
+		DO UPDATE SET word_counts = $2, distinctive_terms = COALESCE($3, public.user.distinctive_terms), last_modified = NOW();`
+
+	// The upsert locks the user row, so concurrent batches of one user are saved in turn.
+	lock_user_word_counts = `INSERT INTO public.user (id_str, last_modified)
+		VALUES ($1, NOW())
+		ON CONFLICT (id_str)
+		DO UPDATE SET last_modified = NOW()
+		RETURNING word_counts, distinctive_terms`
 
 	get_last_tweet = `
 	SELECT A.tweet_id_str
@@ -225,49 +289,62 @@ const (
 	FROM PUBLIC.user
 	WHERE id_str LIKE $1;`
 
+	get_last_counted_by_id = `SELECT last_counted_at, COALESCE(status, '')
+	FROM PUBLIC.user
+	WHERE id_str = $1;`
+
+	set_last_counted = `INSERT INTO public.user (
+		id_str,
+		last_counted_at,
+		last_modified)
+		VALUES ($1, NOW(), NOW())
+		ON CONFLICT (id_str)
+		DO UPDATE SET last_counted_at = NOW()
+		RETURNING last_counted_at;`
+
 	check_if_user_exists_by_id = `SELECT EXISTS (SELECT * 
 	FROM PUBLIC.user
 	WHERE id_str LIKE $1 AND name IS NOT NULL);`
 
-	get_tweet_counts_last_period = `SELECT B.name, COUNT(*) tweet_count
+	get_tweet_counts_in_period = `SELECT B.name, COUNT(*) tweet_count
 	FROM PUBLIC.tweet A
 	JOIN PUBLIC.user B
 	ON A.user_id_str = B.id_str
-	WHERE A.last_modified >= $1 AND B.name IS NOT NULL
+	WHERE A.created_at >= $1 AND A.created_at < $2 AND B.name IS NOT NULL
 	GROUP BY B.name
 	ORDER BY tweet_count DESC
 	FETCH FIRST 10 ROWS ONLY`
 
-	get_largest_tweets_last_period = `SELECT B.name, LENGTH(A.text)
+	get_largest_tweets_in_period = `SELECT B.name, LENGTH(A.text)
 	FROM PUBLIC.tweet A
 	JOIN PUBLIC.user B
 	ON A.user_id_str = B.id_str
-	WHERE A.last_modified >= $1 AND B.name IS NOT NULL
+	WHERE A.created_at >= $1 AND A.created_at < $2 AND B.name IS NOT NULL
 	ORDER BY length DESC
 	FETCH FIRST 10 ROWS ONLY `
 
-	get_number_of_requests_by_app_last_period = `SELECT app_name, COUNT(*) request_count
+	get_number_of_requests_by_app_in_period = `SELECT app_name, COUNT(*) request_count
 	FROM PUBLIC.log
-	WHERE arrived_at >= $1
+	WHERE arrived_at >= $1 AND arrived_at < $2
 	GROUP BY app_name
 	ORDER BY request_count DESC
 	FETCH FIRST 1 ROWS ONLY`
 
-	get_error_responses_last_period = `SELECT id, app_name, response   
+	get_error_responses_in_period = `SELECT id, app_name, response   
 	FROM PUBLIC.log
-	WHERE arrived_at >= $1 AND (response LIKE '400%' OR response LIKE '500%')
+	WHERE arrived_at >= $1 AND arrived_at < $2 AND (response LIKE '400%' OR response LIKE '500%')
 	ORDER BY sent_at DESC
 	FETCH FIRST 10 ROWS ONLY`
 
-	get_longest_requests_last_period = `SELECT id, app_name, ABS(EXTRACT(EPOCH FROM (arrived_at - sent_at))) time_diff
+	get_longest_requests_in_period = `SELECT id, app_name, ABS(EXTRACT(EPOCH FROM (arrived_at - sent_at))) time_diff
 	FROM PUBLIC.log
-	WHERE (arrived_at >= $1) AND EXTRACT (YEAR FROM sent_at) != 1
+	WHERE arrived_at >= $1 AND arrived_at < $2 AND EXTRACT (YEAR FROM sent_at) != 1
 	ORDER BY time_diff DESC
 	FETCH FIRST 10 ROWS ONLY`
 
-	get_shortest_requests_last_period = `SELECT id, app_name, ABS(EXTRACT(EPOCH FROM (arrived_at - sent_at))) time_diff
+	get_shortest_requests_in_period = `SELECT id, app_name, ABS(EXTRACT(EPOCH FROM (arrived_at - sent_at))) time_diff
 	FROM PUBLIC.log
-	WHERE (arrived_at >= $1) AND EXTRACT (YEAR FROM sent_at) != 1
+	WHERE arrived_at >= $1 AND arrived_at < $2 AND EXTRACT (YEAR FROM sent_at) != 1
 	ORDER BY time_diff 
 	FETCH FIRST 10 ROWS ONLY`
 
@@ -277,22 +354,32 @@ const (
 	ON A.name = B.location_name
 	JOIN PUBLIC.tweet C
 	ON B.id_str LIKE C.user_id_str
-	WHERE (C.last_modified >= $1)
+	WHERE C.created_at >= $1 AND C.created_at < $2
 	GROUP BY A.name
 	ORDER BY num_of_tweets DESC
 	FETCH FIRST 10 ROWS ONLY`
 
-	get_tweets_last_period = `SELECT text
+	get_languages_tweeted_in_period = `SELECT C.language, COUNT(*) num_of_tweets
+	FROM PUBLIC.location A
+	JOIN PUBLIC.user B
+	ON A.name = B.location_name
+	JOIN PUBLIC.tweet C
+	ON B.id_str = C.user_id_str
+	WHERE C.created_at >= $1 AND C.created_at < $2 AND C.language IS NOT NULL
+	GROUP BY C.language
+	ORDER BY num_of_tweets DESC`
+
+	get_tweets_in_period = `SELECT text
 	FROM PUBLIC.tweet
-	WHERE last_modified >= $1`
+	WHERE created_at >= $1 AND created_at < $2`
 
-	get_tweets_regional_blocks_last_period = `SELECT A.regional_blocks
+	get_tweets_regional_blocks_in_period = `SELECT A.regional_blocks
 	FROM PUBLIC.location A
 	JOIN PUBLIC.user B 
 	ON A.name = B.location_name
 	JOIN PUBLIC.tweet C
 	ON B.id_str LIKE C.user_id_str
-	WHERE C.last_modified >= $1`
+	WHERE C.created_at >= $1 AND C.created_at < $2`
 )
 
 func ConnectToDB(DBinfo string) (*sql.DB, error) {
@@ -325,9 +412,101 @@ func SaveLog(logInfo *DBLog, db *sql.DB) {
 	}
 }
 
-func SaveTweet(t Tweet, db *sql.DB) error {
-	_, err := db.Exec(insert_tweet, t.Id, t.Id_str, t.UserId, t.Text, t.Created_at, t.Url)
-	return err
+// Function saves a batch of tweets with their entities and the word counts of
+// their user in one transaction, so a batch is saved whole or not at all. Newly
+// inserted tweets are counted in the corpus in the same transaction, alerts
+// raised by the tweets too. It returns how many alerts are new.
+func SaveTweets(batch TweetBatch, db *sql.DB) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+
+	var wcJson, dtJson []byte
+	if err := tx.QueryRow(lock_user_word_counts, batch.UserId).Scan(&wcJson, &dtJson); err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	documents := 0
+	var terms []string
+	wordCount := make(map[string]uint64)
+	for _, t := range batch.Tweets {
+		// xmax is 0 only for rows inserted by this statement, so tweets saved again are not counted twice.
+		var inserted bool
+		err = tx.QueryRow(insert_tweet, t.Id, t.Id_str, t.UserId, t.Text, t.Created_at, t.Url, t.Sentiment, t.Language, t.LanguageConfidence).Scan(&inserted)
+		if err != nil {
+			tx.Rollback()
+			return 0, fmt.Errorf("tweet %s: %s", t.Id_str, err.Error())
+		}
+
+		if err := saveTweetEntities(t, tx); err != nil {
+			tx.Rollback()
+			return 0, fmt.Errorf("entities of tweet %s: %s", t.Id_str, err.Error())
+		}
+
+		if inserted {
+			documents++
+			terms = append(terms, distinctTerms(t.Terms)...)
+			for _, term := range t.Terms {
+				wordCount[term]++
+			}
+		}
+	}
+
+	if documents > 0 {
+		if err := addCorpusDocuments(documents, terms, tx); err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+	}
+
+	counts, distinctive := batch.WordCount, batch.DistinctiveTerms
+	if batch.Merge {
+		counts, distinctive, err = mergeWordCount(wcJson, dtJson, wordCount, batch)
+		if err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+	}
+
+	wcJson, dtJson, err = marshalWordCount(counts, distinctive)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	if _, err := tx.Exec(update_wc, batch.UserId, wcJson, dtJson); err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	// Alerts are saved with their tweets, so none is lost when the save is retried.
+	alerts := 0
+	for _, alert := range batch.Alerts {
+		isNew, err := saveAlert(alert, tx)
+		if err != nil {
+			tx.Rollback()
+			return 0, fmt.Errorf("alert of watchlist %d for tweet %s: %s", alert.WatchlistId, alert.TweetId, err.Error())
+		}
+		if isNew {
+			alerts++
+		}
+	}
+
+	return alerts, tx.Commit()
+}
+
+func distinctTerms(terms []string) []string {
+	seen := make(map[string]bool, len(terms))
+	var distinct []string
+	for _, term := range terms {
+		if !seen[term] {
+			seen[term] = true
+			distinct = append(distinct, term)
+		}
+	}
+	return distinct
 }
 
 func GetLastTweet(userId string, db *sql.DB) (tweetId com.RespTweetId, err error) {
@@ -363,35 +542,159 @@ func UserExists(userId string, db *sql.DB) (com.RespUserExists, error) {
 	return existsResponse, nil
 }
 
-func SaveUserMetadata(user com.ReqUser, db *sql.DB) error {
-	_, err := db.Exec(insert_user, user.Id, user.Id_str, user.Name, user.Screen_name, user.Location, user.URL, user.Description,
-		user.Protected, user.Verified, user.Followers_count, user.Friends_count, user.Statuses_count, user.Created_at, pq.Array(user.Followers_id), nil)
+// Function returns when Counter last finished counting a user and its stored account status.
+func GetLastCounted(userId string, db *sql.DB) (com.RespLastCounted, error) {
+	var lastCounted com.RespLastCounted
 
-	return err
+	err := db.QueryRow(get_last_counted_by_id, userId).Scan(&lastCounted.LastCountedAt, &lastCounted.Status)
+	if err == sql.ErrNoRows {
+		return lastCounted, nil
+	}
+
+	return lastCounted, err
 }
 
-func UpdateWordCount(userId string, fWordCount []com.KvPair, db *sql.DB) error {
+// Function records that Counter finished counting a user now.
+func SetLastCounted(userId string, db *sql.DB) (com.RespLastCounted, error) {
+	var lastCounted com.RespLastCounted
 
+	err := db.QueryRow(set_last_counted, userId).Scan(&lastCounted.LastCountedAt)
+
+	return lastCounted, err
+}
+
+// Function upserts a user and appends a snapshot of its profile when a tracked
+// field differs from the last snapshot. It returns the changed fields, none
+// for an unchanged profile and every tracked field for the first snapshot.
+func SaveUserMetadata(user com.ReqUser, db *sql.DB) ([]string, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	// The upsert locks the user row, so concurrent saves of one user snapshot in turn.
+	_, err = tx.Exec(insert_user, user.Id, user.Id_str, user.Name, user.Screen_name, user.Location, user.URL, user.Description,
+		user.Protected, user.Verified, user.Followers_count, user.Friends_count, user.Statuses_count, user.Created_at, pq.Array(user.Followers_id), nil)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	changed, err := snapshotUserProfile(user.Id_str, profileOf(user), tx)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	_, err = tx.Exec(insert_user_count, user.Id_str, user.Followers_count, user.Friends_count, user.Statuses_count)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	return changed, tx.Commit()
+}
+
+// Function marshals word counts and distinctive terms for update_wc.
+// Without distinctive terms the stored ones are kept.
+func marshalWordCount(fWordCount []com.KvPair, distinctiveTerms []com.TermScore) ([]byte, []byte, error) {
 	wcJson, err := json.Marshal(fWordCount)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var dtJson []byte
+	if len(distinctiveTerms) > 0 {
+		dtJson, err = json.Marshal(distinctiveTerms)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return wcJson, dtJson, nil
+}
+
+// Function stores raw word counts and TF-IDF distinctive terms of a user.
+// Without distinctive terms the stored ones are kept.
+func UpdateWordCount(userId string, fWordCount []com.KvPair, distinctiveTerms []com.TermScore, db *sql.DB) error {
+	wcJson, dtJson, err := marshalWordCount(fWordCount, distinctiveTerms)
 	if err != nil {
 		return err
 	}
 
-	_, err = db.Exec(update_wc, userId, wcJson)
+	_, err = db.Exec(update_wc, userId, wcJson, dtJson)
 	return err
 }
 
-func UpdateUserImage(images com.ReqImagesForDB, db *sql.DB) error {
+// Function adds wordCount, the terms of newly inserted tweets, to the stored word
+// counts of a user. Distinctive terms keep the higher score of a term. Both lists
+// are cut to the longer of their stored and sent lengths.
+func mergeWordCount(wcJson []byte, dtJson []byte, wordCount map[string]uint64, batch TweetBatch) ([]com.KvPair, []com.TermScore, error) {
+	var storedCounts []com.KvPair
+	if len(wcJson) > 0 {
+		if err := json.Unmarshal(wcJson, &storedCounts); err != nil {
+			return nil, nil, err
+		}
+	}
+	var storedTerms []com.TermScore
+	if len(dtJson) > 0 {
+		if err := json.Unmarshal(dtJson, &storedTerms); err != nil {
+			return nil, nil, err
+		}
+	}
 
-	_, err := db.Exec(update_user_image, images.UserId, images.UserImages)
-	return err
+	for _, kvPair := range storedCounts {
+		wordCount[kvPair.Word] += kvPair.Count
+	}
+	mergedCounts := make([]com.KvPair, 0, len(wordCount))
+	for word, count := range wordCount {
+		mergedCounts = append(mergedCounts, com.KvPair{Word: word, Count: count})
+	}
+	sort.Slice(mergedCounts, func(i, j int) bool {
+		if mergedCounts[i].Count == mergedCounts[j].Count {
+			return mergedCounts[i].Word < mergedCounts[j].Word
+		}
+		return mergedCounts[i].Count > mergedCounts[j].Count
+	})
+	if n := maxLen(len(storedCounts), len(batch.WordCount)); len(mergedCounts) > n {
+		mergedCounts = mergedCounts[:n]
+	}
+
+	scores := make(map[string]float64)
+	for _, term := range append(storedTerms, batch.DistinctiveTerms...) {
+		if term.Score > scores[term.Term] {
+			scores[term.Term] = term.Score
+		}
+	}
+	mergedTerms := make([]com.TermScore, 0, len(scores))
+	for term, score := range scores {
+		mergedTerms = append(mergedTerms, com.TermScore{Term: term, Score: score})
+	}
+	sort.Slice(mergedTerms, func(i, j int) bool {
+		if mergedTerms[i].Score == mergedTerms[j].Score {
+			return mergedTerms[i].Term < mergedTerms[j].Term
+		}
+		return mergedTerms[i].Score > mergedTerms[j].Score
+	})
+	if n := maxLen(len(storedTerms), len(batch.DistinctiveTerms)); len(mergedTerms) > n {
+		mergedTerms = mergedTerms[:n]
+	}
+
+	return mergedCounts, mergedTerms, nil
+}
+
+func maxLen(a int, b int) int {
+	if a > b {
+		return a
+	}
+	return b
 }
 
-func GetTweetCountsInLastPeriod(period time.Duration, db *sql.DB) (map[string]uint64, error) {
+func GetTweetCountsInPeriod(from time.Time, to time.Time, db *sql.DB) (map[string]uint64, error) {
 
 	counts := make(map[string]uint64)
 
-	rows, err := db.Query(get_tweet_counts_last_period, time.Now().Add(period))
+	rows, err := db.Query(get_tweet_counts_in_period, from, to)
 
 	if err != nil {
 		return counts, err
@@ -411,12 +714,12 @@ func GetTweetCountsInLastPeriod(period time.Duration, db *sql.DB) (map[string]ui
 	return counts, nil
 }
 
-func GetLargestTweetsInLastPeriod(period time.Duration, db *sql.DB) ([]TweetLenghts, error) {
+func GetLargestTweetsInPeriod(from time.Time, to time.Time, db *sql.DB) ([]TweetLenghts, error) {
 
 	//lengths := make(map[string]uint64)
 	var lengths []TweetLenghts
 
-	rows, err := db.Query(get_largest_tweets_last_period, time.Now().Add(period))
+	rows, err := db.Query(get_largest_tweets_in_period, from, to)
 
 	if err != nil {
 		return lengths, err
@@ -437,11 +740,13 @@ func GetLargestTweetsInLastPeriod(period time.Duration, db *sql.DB) ([]TweetLeng
 	return lengths, nil
 }
 
-func GetTopWordCountsInLastPeriod(period time.Duration, db *sql.DB) ([]com.KvPair, error) {
+// Function ranks terms of tweets in period with the same text analysis
+// Counter uses for users' word counts.
+func GetTopWordCountsInPeriod(from time.Time, to time.Time, options text.Options, db *sql.DB) ([]com.KvPair, error) {
 
 	var kvPairs []com.KvPair
 
-	rows, err := db.Query(get_tweets_last_period, time.Now().Add(period))
+	rows, err := db.Query(get_tweets_in_period, from, to)
 
 	if err != nil {
 		return kvPairs, err
@@ -452,36 +757,28 @@ func GetTopWordCountsInLastPeriod(period time.Duration, db *sql.DB) ([]com.KvPai
 	wordCounts := make(map[string]uint64)
 
 	for rows.Next() {
-		var text string
-		if err := rows.Scan(&text); err != nil {
+		var tweetText string
+		if err := rows.Scan(&tweetText); err != nil {
 			return kvPairs, err
 		}
-		words := strings.Fields(text)
-		for _, word := range words {
-			wordCounts[word]++
+		for _, term := range options.Terms(tweetText) {
+			wordCounts[term]++
 		}
 	}
 
-	for k, v := range wordCounts {
-		kvPairs = append(kvPairs, com.KvPair{Word: k, Count: v})
-	}
-	sort.Slice(kvPairs, func(i, j int) bool {
-		return kvPairs[i].Count > kvPairs[j].Count
-	})
-
-	if len(kvPairs) >= 10 {
-		kvPairs = kvPairs[:10]
+	for _, term := range options.Top(wordCounts) {
+		kvPairs = append(kvPairs, com.KvPair{Word: term.Term, Count: term.Count})
 	}
 
 	return kvPairs, nil
 }
 
-func GetNumberOfRequestsByAppInLastPeriod(period time.Duration, db *sql.DB) (string, error) {
+func GetNumberOfRequestsByAppInPeriod(from time.Time, to time.Time, db *sql.DB) (string, error) {
 
 	var appName string
 	var count uint64
 
-	err := db.QueryRow(get_number_of_requests_by_app_last_period, time.Now().Add(period)).Scan(&appName, &count)
+	err := db.QueryRow(get_number_of_requests_by_app_in_period, from, to).Scan(&appName, &count)
 
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -493,11 +790,11 @@ func GetNumberOfRequestsByAppInLastPeriod(period time.Duration, db *sql.DB) (str
 	return fmt.Sprintf("Application: %s, number of requests: %d", appName, count), nil
 }
 
-func GetTopErrorRequestsByAppInLastPeriod(period time.Duration, db *sql.DB) (TopErrorsReport, error) {
+func GetTopErrorRequestsByAppInPeriod(from time.Time, to time.Time, db *sql.DB) (TopErrorsReport, error) {
 
 	var errorReports TopErrorsReport
 
-	rows, err := db.Query(get_error_responses_last_period, time.Now().Add(period))
+	rows, err := db.Query(get_error_responses_in_period, from, to)
 
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -524,10 +821,10 @@ func GetTopErrorRequestsByAppInLastPeriod(period time.Duration, db *sql.DB) (Top
 	return errorReports, nil
 }
 
-func GetTopLongestRequestsInLastPeriod(period time.Duration, db *sql.DB) (TopDurationsReport, error) {
+func GetTopLongestRequestsInPeriod(from time.Time, to time.Time, db *sql.DB) (TopDurationsReport, error) {
 	var requestDurations TopDurationsReport
 
-	rows, err := db.Query(get_longest_requests_last_period, time.Now().Add(period))
+	rows, err := db.Query(get_longest_requests_in_period, from, to)
 
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -554,10 +851,10 @@ func GetTopLongestRequestsInLastPeriod(period time.Duration, db *sql.DB) (TopDur
 	return requestDurations, nil
 }
 
-func GetTopShortestsRequestsInLastPeriod(period time.Duration, db *sql.DB) (TopDurationsReport, error) {
+func GetTopShortestsRequestsInPeriod(from time.Time, to time.Time, db *sql.DB) (TopDurationsReport, error) {
 	var requestDurations TopDurationsReport
 
-	rows, err := db.Query(get_shortest_requests_last_period, time.Now().Add(period))
+	rows, err := db.Query(get_shortest_requests_in_period, from, to)
 
 	if err != nil {
 		return requestDurations, err
@@ -581,12 +878,12 @@ func GetTopShortestsRequestsInLastPeriod(period time.Duration, db *sql.DB) (TopD
 	return requestDurations, nil
 }
 
-func GetTopTweetLocationsData(period time.Duration, db *sql.DB) (map[string]uint64, map[string]uint64, int, error) {
+func GetTopTweetLocationsData(from time.Time, to time.Time, db *sql.DB) (map[string]uint64, map[string]uint64, int, error) {
 	locCounts := make(map[string]uint64)
 	langCounts := make(map[string]uint64)
 	totalPopulation := 0
 
-	rows, err := db.Query(get_top_tweet_locations, time.Now().Add(period))
+	rows, err := db.Query(get_top_tweet_locations, from, to)
 
 	if err != nil {
 		return locCounts, langCounts, totalPopulation, err
@@ -617,10 +914,34 @@ func GetTopTweetLocationsData(period time.Duration, db *sql.DB) (map[string]uint
 	return locCounts, langCounts, totalPopulation, nil
 }
 
-func GetTopTweetRegionalBlocks(period time.Duration, db *sql.DB) ([]RegionalBlockCounts, error) {
+// Function counts tweets of located users by detected language (ISO 639-1),
+// unlike GetTopTweetLocationsData which counts languages of the countries.
+func GetLanguagesTweetedInPeriod(from time.Time, to time.Time, db *sql.DB) (map[string]uint64, error) {
+	langCounts := make(map[string]uint64)
+
+	rows, err := db.Query(get_languages_tweeted_in_period, from, to)
+	if err != nil {
+		return langCounts, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var language string
+		var count uint64
+		if err := rows.Scan(&language, &count); err != nil {
+			return langCounts, err
+		}
+		langCounts[language] = count
+	}
+
+	return langCounts, rows.Err()
+}
+
+func GetTopTweetRegionalBlocks(from time.Time, to time.Time, db *sql.DB) ([]RegionalBlockCounts, error) {
 	var blockCounts []RegionalBlockCounts
 
-	rows, err := db.Query(get_tweets_regional_blocks_last_period, time.Now().Add(period))
+	rows, err := db.Query(get_tweets_regional_blocks_in_period, from, to)
 
 	if err != nil {
 		return blockCounts, err
@@ -661,108 +982,231 @@ func GetTopTweetRegionalBlocks(period time.Duration, db *sql.DB) ([]RegionalBloc
 	return blockCounts, nil
 }
 
-func SaveLogReport(period time.Duration, reportType string, db *sql.DB) error {
-	mostRequests, err := GetNumberOfRequestsByAppInLastPeriod(period, db)
+// Function upserts a report on its type and window, so reports can be made
+// again for a window idempotently. It returns the id of the report.
+func saveReport(insertQuery string, db *sql.DB, args ...interface{}) (uint64, error) {
+	var id uint64
+	err := db.QueryRow(insertQuery, args...).Scan(&id)
+	return id, err
+}
+
+func SaveLogReport(from time.Time, to time.Time, reportType string, db *sql.DB) (uint64, error) {
+	mostRequests, err := GetNumberOfRequestsByAppInPeriod(from, to, db)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	errorRequests, err := GetTopErrorRequestsByAppInLastPeriod(period, db)
+	errorRequests, err := GetTopErrorRequestsByAppInPeriod(from, to, db)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
 	jsonError, err := json.Marshal(errorRequests)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	longestRequests, err := GetTopLongestRequestsInLastPeriod(period, db)
+	longestRequests, err := GetTopLongestRequestsInPeriod(from, to, db)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
 	jsonLongest, err := json.Marshal(longestRequests)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	shortestsRequests, err := GetTopShortestsRequestsInLastPeriod(period, db)
+	shortestsRequests, err := GetTopShortestsRequestsInPeriod(from, to, db)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
 	jsonShortest, err := json.Marshal(shortestsRequests)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
 	//save to database
-	_, err = db.Exec(insert_log_report, mostRequests, jsonError, jsonLongest, jsonShortest, reportType)
-	return err
+	return saveReport(insert_log_report, db, mostRequests, jsonError, jsonLongest, jsonShortest, reportType, from, to)
 }
 
-func SaveTweetReport(period time.Duration, reportType string, db *sql.DB) error {
-	counts, err := GetTweetCountsInLastPeriod(period, db)
+// Function makes the tweet report of [from, to) with the optional sections listed in sections.
+func SaveTweetReport(from time.Time, to time.Time, reportType string, sections []string, words text.Options, db *sql.DB) (uint64, error) {
+	counts, err := GetTweetCountsInPeriod(from, to, db)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
 	jsonCounts, err := json.Marshal(counts)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	lengths, err := GetLargestTweetsInLastPeriod(period, db)
+	lengths, err := GetLargestTweetsInPeriod(from, to, db)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
 	jsonLenghts, err := json.Marshal(lengths)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	words, err := GetTopWordCountsInLastPeriod(period, db)
+	topWords, err := GetTopWordCountsInPeriod(from, to, words, db)
+	if err != nil {
+		return 0, err
+	}
 
-	jsonWords, err := json.Marshal(words)
+	jsonWords, err := json.Marshal(topWords)
 	if err != nil {
-		return err
+		return 0, err
+	}
+
+	topN := words.WithDefaults().TopN
+	var jsonEntities [4][]byte
+	for i, getTop := range []func(time.Time, time.Time, int, *sql.DB) ([]com.KvPair, error){
+		GetTopHashtagsInPeriod, GetTopMentionsInPeriod, GetTopDomainsInPeriod, GetTopEmojisInPeriod} {
+		top, err := getTop(from, to, topN, db)
+		if err != nil {
+			return 0, err
+		}
+		jsonEntities[i], err = json.Marshal(top)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	userSentiment, err := GetUserSentimentInPeriod(from, to, TOP_SENTIMENT_ROWS, db)
+	if err != nil {
+		return 0, err
+	}
+
+	jsonSentiment, err := json.Marshal(userSentiment)
+	if err != nil {
+		return 0, err
+	}
+
+	var jsonGrowing []byte
+	if hasSection(sections, SECTION_FASTEST_GROWING) {
+		growing, err := GetFastestGrowingInPeriod(from, to, TOP_GROWTH_ROWS, db)
+		if err != nil {
+			return 0, err
+		}
+
+		jsonGrowing, err = json.Marshal(growing)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	var jsonBots []byte
+	if hasSection(sections, SECTION_LIKELY_BOTS) {
+		bots, err := GetLikelyBotsInPeriod(from, to, TOP_BOT_ROWS, db)
+		if err != nil {
+			return 0, err
+		}
+
+		jsonBots, err = json.Marshal(bots)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	userActivity, err := GetUserActivityInPeriod(from, to, TOP_ACTIVITY_ROWS, db)
+	if err != nil {
+		return 0, err
+	}
+
+	jsonActivity, err := json.Marshal(userActivity)
+	if err != nil {
+		return 0, err
 	}
 
 	//save to database
-	_, err = db.Exec(insert_tweet_report, jsonCounts, jsonLenghts, jsonWords, reportType)
+	return saveReport(insert_tweet_report, db, jsonCounts, jsonLenghts, jsonWords,
+		jsonEntities[0], jsonEntities[1], jsonEntities[2], jsonEntities[3], jsonSentiment, jsonGrowing, jsonBots, jsonActivity, reportType, from, to)
+}
 
-	return err
+func hasSection(sections []string, section string) bool {
+	for _, s := range sections {
+		if s == section {
+			return true
+		}
+	}
+	return false
 }
 
-func SaveLocationReport(period time.Duration, reportType string, db *sql.DB) error {
-	locCounts, langCounts, totalPopulation, err := GetTopTweetLocationsData(period, db)
+func SaveLocationReport(from time.Time, to time.Time, reportType string, db *sql.DB) (uint64, error) {
+	locCounts, langCounts, totalPopulation, err := GetTopTweetLocationsData(from, to, db)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
 	jsonLocations, err := json.Marshal(locCounts)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
 	jsonLanguages, err := json.Marshal(langCounts)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	blockCounts, err := GetTopTweetRegionalBlocks(period, db)
+	blockCounts, err := GetTopTweetRegionalBlocks(from, to, db)
 
 	jsonBlocks, err := json.Marshal(blockCounts)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	//save to database
-	_, err = db.Exec(insert_location_report, jsonLocations, jsonBlocks, jsonLanguages, totalPopulation, reportType)
+	locationSentiment, err := GetLocationSentimentInPeriod(from, to, TOP_SENTIMENT_ROWS, db)
+	if err != nil {
+		return 0, err
+	}
 
-	return err
+	jsonSentiment, err := json.Marshal(locationSentiment)
+	if err != nil {
+		return 0, err
+	}
+
+	languagesTweeted, err := GetLanguagesTweetedInPeriod(from, to, db)
+	if err != nil {
+		return 0, err
+	}
+
+	jsonTweeted, err := json.Marshal(languagesTweeted)
+	if err != nil {
+		return 0, err
+	}
+
+	locationTerms, blockTerms, err := GetDistinctiveTermsInPeriod(from, to, TOP_DISTINCTIVE_TERMS, db)
+	if err != nil {
+		return 0, err
+	}
+
+	jsonLocationTerms, err := json.Marshal(locationTerms)
+	if err != nil {
+		return 0, err
+	}
+
+	jsonBlockTerms, err := json.Marshal(blockTerms)
+	if err != nil {
+		return 0, err
+	}
+
+	locationActivity, err := GetLocationActivityInPeriod(from, to, TOP_ACTIVITY_ROWS, db)
+	if err != nil {
+		return 0, err
+	}
+
+	jsonActivity, err := json.Marshal(locationActivity)
+	if err != nil {
+		return 0, err
+	}
+
+	//save to database
+	return saveReport(insert_location_report, db, jsonLocations, jsonBlocks, jsonLanguages, totalPopulation,
+		jsonSentiment, jsonTweeted, jsonLocationTerms, jsonBlockTerms, jsonActivity, reportType, from, to)
 }
 
 func SaveLocation(locationInfo LocationInfo, db *sql.DB) error {
@@ -777,7 +1221,15 @@ func SaveLocation(locationInfo LocationInfo, db *sql.DB) error {
 		return err
 	}
 
-	_, err = db.Exec(insert_location, locationInfo.Name, languagesJson, regBlocksJson, locationInfo.Population)
+	var timezonesJson []byte
+	if len(locationInfo.Timezones) > 0 {
+		timezonesJson, err = json.Marshal(locationInfo.Timezones)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = db.Exec(insert_location, locationInfo.Name, languagesJson, regBlocksJson, locationInfo.Population, timezonesJson)
 
 	return err
 }
@@ -0,0 +1,175 @@
+package db
+
+import (
+	"database/sql"
+	"time"
+)
+
+const (
+	DELIVERY_PENDING = "PENDING"
+	DELIVERY_SENDING = "SENDING"
+	DELIVERY_SENT    = "SENT"
+	DELIVERY_FAILED  = "FAILED"
+
+	DELIVERY_WEBHOOK = "webhook"
+	DELIVERY_EMAIL   = "email"
+)
+
+// Webhook names the configured webhook of a webhook delivery, its secret signs the report.
+type ReportDelivery struct {
+	Id            uint64     `json:"id"`
+	ReportType    string     `json:"report_type"`
+	ReportId      uint64     `json:"report_id"`
+	Channel       string     `json:"channel"`
+	Webhook       string     `json:"webhook,omitempty"`
+	Target        string     `json:"target"`
+	Format        string     `json:"format"`
+	Status        string     `json:"status"`
+	Attempts      int        `json:"attempts"`
+	LastError     string     `json:"last_error,omitempty"`
+	NextAttemptAt time.Time  `json:"next_attempt_at"`
+	CreatedAt     time.Time  `json:"created_at"`
+	DeliveredAt   *time.Time `json:"delivered_at,omitempty"`
+}
+
+const (
+	report_delivery_columns = `id, report_type, report_id, channel, COALESCE(webhook, ''), target, format, status, attempts, COALESCE(last_error, ''), next_attempt_at, created_at, delivered_at`
+
+	// A report made again for its window keeps its id and is sent again.
+	insert_report_delivery = `INSERT INTO public.report_delivery (
+		report_type,
+		report_id,
+		channel,
+		webhook,
+		target,
+		format,
+		status)
+		VALUES ($1, $2, $3, NULLIF($4, ''), $5, $6, 'PENDING')
+		ON CONFLICT (report_type, report_id, channel, target)
+		DO UPDATE SET webhook = EXCLUDED.webhook, format = EXCLUDED.format, status = 'PENDING', attempts = 0, last_error = NULL,
+		next_attempt_at = NOW(), delivered_at = NULL
+		WHERE report_delivery.status <> 'SENDING'`
+
+	// Claimed rows are SENDING until they are finished, SKIP LOCKED keeps
+	// two replicas from claiming the same delivery.
+	claim_report_deliveries = `UPDATE public.report_delivery
+	SET status = 'SENDING', attempts = attempts + 1, next_attempt_at = NOW()
+	WHERE id IN (
+		SELECT id FROM public.report_delivery
+		WHERE status = 'PENDING' AND next_attempt_at <= NOW()
+		ORDER BY next_attempt_at
+		LIMIT $1
+		FOR UPDATE SKIP LOCKED)
+	RETURNING ` + report_delivery_columns
+
+	finish_report_delivery = `UPDATE public.report_delivery
+	SET status = $2, last_error = $3, next_attempt_at = $4, delivered_at = CASE WHEN $2 = 'SENT' THEN NOW() ELSE NULL END
+	WHERE id = $1`
+
+	get_report_deliveries = `SELECT ` + report_delivery_columns + `
+	FROM PUBLIC.report_delivery
+	WHERE ($1 = '' OR status = $1) AND ($2 = '' OR report_type = $2) AND ($3 = 0 OR report_id = $3) AND ($4 = 0 OR id < $4)
+	ORDER BY id DESC
+	LIMIT $5`
+
+	retry_report_deliveries = `UPDATE public.report_delivery
+	SET status = 'PENDING', attempts = 0, next_attempt_at = NOW()
+	WHERE status = 'FAILED' AND ($1 = '' OR report_type = $1) AND ($2 = 0 OR report_id = $2)`
+
+	// Deliveries left SENDING by a replica that stopped mid-send are tried again.
+	reset_stale_report_deliveries = `UPDATE public.report_delivery
+	SET status = 'PENDING'
+	WHERE status = 'SENDING' AND next_attempt_at < $1`
+)
+
+func scanReportDelivery(row interface{ Scan(...interface{}) error }) (ReportDelivery, error) {
+	var delivery ReportDelivery
+	err := row.Scan(&delivery.Id, &delivery.ReportType, &delivery.ReportId, &delivery.Channel, &delivery.Webhook, &delivery.Target, &delivery.Format,
+		&delivery.Status, &delivery.Attempts, &delivery.LastError, &delivery.NextAttemptAt, &delivery.CreatedAt, &delivery.DeliveredAt)
+	return delivery, err
+}
+
+func CreateReportDelivery(delivery ReportDelivery, db *sql.DB) error {
+	_, err := db.Exec(insert_report_delivery, delivery.ReportType, delivery.ReportId, delivery.Channel, delivery.Webhook, delivery.Target, delivery.Format)
+	return err
+}
+
+func ClaimReportDeliveries(limit int, db *sql.DB) ([]ReportDelivery, error) {
+	var deliveries []ReportDelivery
+
+	rows, err := db.Query(claim_report_deliveries, limit)
+	if err != nil {
+		return deliveries, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		delivery, err := scanReportDelivery(rows)
+		if err != nil {
+			return deliveries, err
+		}
+		deliveries = append(deliveries, delivery)
+	}
+
+	return deliveries, rows.Err()
+}
+
+// Function records the outcome of a send. A failed delivery goes back to PENDING
+// with nextAttempt set, or to FAILED once the caller gives up on it.
+func FinishReportDelivery(delivery ReportDelivery, status string, sendErr error, nextAttempt time.Time, db *sql.DB) error {
+	var errMsg sql.NullString
+	if sendErr != nil {
+		errMsg = sql.NullString{String: sendErr.Error(), Valid: true}
+	}
+
+	_, err := db.Exec(finish_report_delivery, delivery.Id, status, errMsg, nextAttempt)
+	return err
+}
+
+func GetReportDeliveries(status string, reportType string, reportId uint64, cursor string, limit int, db *sql.DB) ([]ReportDelivery, string, error) {
+	deliveries := make([]ReportDelivery, 0)
+	limit = pageSize(limit)
+
+	beforeId, err := decodeIdCursor(cursor)
+	if err != nil {
+		return deliveries, "", err
+	}
+
+	rows, err := db.Query(get_report_deliveries, status, reportType, reportId, beforeId, limit+1)
+	if err != nil {
+		return deliveries, "", err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		delivery, err := scanReportDelivery(rows)
+		if err != nil {
+			return deliveries, "", err
+		}
+		deliveries = append(deliveries, delivery)
+	}
+
+	next := ""
+	if len(deliveries) > limit {
+		deliveries = deliveries[:limit]
+		next = encodeIdCursor(deliveries[limit-1].Id)
+	}
+
+	return deliveries, next, rows.Err()
+}
+
+// Function puts failed deliveries back in the queue and returns how many were retried.
+func RetryReportDeliveries(reportType string, reportId uint64, db *sql.DB) (int64, error) {
+	result, err := db.Exec(retry_report_deliveries, reportType, reportId)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func ResetStaleReportDeliveries(before time.Time, db *sql.DB) error {
+	_, err := db.Exec(reset_stale_report_deliveries, before)
+	return err
+}
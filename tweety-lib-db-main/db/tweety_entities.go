@@ -0,0 +1,175 @@
+package db
+
+import (
+	"database/sql"
+	"net/url"
+	"strings"
+	"time"
+
+	com "gitlab.com/leapbit-practice/tweety-lib-communication/comms"
+	text "gitlab.com/leapbit-practice/tweety-lib-text/text"
+)
+
+const (
+	URL_LINK = "link"
+)
+
+type TweetMention struct {
+	UserId      string
+	Screen_name string
+}
+
+// Kind is URL_LINK for links in the text, or the media type (photo, video, animated_gif).
+type TweetUrl struct {
+	Url  string
+	Kind string
+}
+
+const (
+	insert_tweet_hashtag = `INSERT INTO public.tweet_hashtag (
+		tweet_id_str,
+		hashtag,
+		created_at)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (tweet_id_str, hashtag) DO NOTHING`
+
+	insert_tweet_mention = `INSERT INTO public.tweet_mention (
+		tweet_id_str,
+		mentioned_id_str,
+		screen_name,
+		created_at)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (tweet_id_str, mentioned_id_str) DO NOTHING`
+
+	insert_tweet_url = `INSERT INTO public.tweet_url (
+		tweet_id_str,
+		url,
+		domain,
+		kind,
+		created_at)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (tweet_id_str, url) DO NOTHING`
+
+	get_top_hashtags_in_period = `SELECT A.hashtag, COUNT(*) hashtag_count
+	FROM PUBLIC.tweet_hashtag A
+	JOIN PUBLIC.tweet B
+	ON A.tweet_id_str = B.tweet_id_str
+	WHERE B.created_at >= $1 AND B.created_at < $2
+	GROUP BY A.hashtag
+	ORDER BY hashtag_count DESC, A.hashtag
+	LIMIT $3`
+
+	get_top_mentions_in_period = `SELECT MAX(A.screen_name), COUNT(*) mention_count
+	FROM PUBLIC.tweet_mention A
+	JOIN PUBLIC.tweet B
+	ON A.tweet_id_str = B.tweet_id_str
+	WHERE B.created_at >= $1 AND B.created_at < $2
+	GROUP BY A.mentioned_id_str
+	ORDER BY mention_count DESC, MAX(A.screen_name)
+	LIMIT $3`
+
+	get_top_domains_in_period = `SELECT A.domain, COUNT(*) domain_count
+	FROM PUBLIC.tweet_url A
+	JOIN PUBLIC.tweet B
+	ON A.tweet_id_str = B.tweet_id_str
+	WHERE B.created_at >= $1 AND B.created_at < $2 AND A.kind = 'link' AND A.domain <> ''
+	GROUP BY A.domain
+	ORDER BY domain_count DESC, A.domain
+	LIMIT $3`
+)
+
+// Function returns the host of rawUrl without the www. prefix.
+func urlDomain(rawUrl string) string {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimPrefix(strings.ToLower(u.Hostname()), "www.")
+}
+
+// Function saves hashtags, mentions and urls of a tweet in the transaction
+// saving the tweet. Hashtags are stored lower case, so #Go and #go count as one.
+func saveTweetEntities(t Tweet, tx *sql.Tx) error {
+	for _, hashtag := range t.Hashtags {
+		if _, err := tx.Exec(insert_tweet_hashtag, t.Id_str, strings.ToLower(hashtag), t.Created_at); err != nil {
+			return err
+		}
+	}
+
+	for _, mention := range t.Mentions {
+		if _, err := tx.Exec(insert_tweet_mention, t.Id_str, mention.UserId, mention.Screen_name, t.Created_at); err != nil {
+			return err
+		}
+	}
+
+	for _, u := range t.Urls {
+		if _, err := tx.Exec(insert_tweet_url, t.Id_str, u.Url, urlDomain(u.Url), u.Kind, t.Created_at); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func getTopCountsInPeriod(query string, from time.Time, to time.Time, limit int, db *sql.DB) ([]com.KvPair, error) {
+	kvPairs := make([]com.KvPair, 0)
+
+	rows, err := db.Query(query, from, to, limit)
+	if err != nil {
+		return kvPairs, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var kvPair com.KvPair
+		if err := rows.Scan(&kvPair.Word, &kvPair.Count); err != nil {
+			return kvPairs, err
+		}
+		kvPairs = append(kvPairs, kvPair)
+	}
+
+	return kvPairs, rows.Err()
+}
+
+func GetTopHashtagsInPeriod(from time.Time, to time.Time, limit int, db *sql.DB) ([]com.KvPair, error) {
+	return getTopCountsInPeriod(get_top_hashtags_in_period, from, to, limit, db)
+}
+
+// Function ranks mentioned accounts by screen name.
+func GetTopMentionsInPeriod(from time.Time, to time.Time, limit int, db *sql.DB) ([]com.KvPair, error) {
+	return getTopCountsInPeriod(get_top_mentions_in_period, from, to, limit, db)
+}
+
+// Function ranks domains of links shared in tweets. Attached media are not counted.
+func GetTopDomainsInPeriod(from time.Time, to time.Time, limit int, db *sql.DB) ([]com.KvPair, error) {
+	return getTopCountsInPeriod(get_top_domains_in_period, from, to, limit, db)
+}
+
+func GetTopEmojisInPeriod(from time.Time, to time.Time, limit int, db *sql.DB) ([]com.KvPair, error) {
+	kvPairs := make([]com.KvPair, 0)
+
+	rows, err := db.Query(get_tweets_in_period, from, to)
+	if err != nil {
+		return kvPairs, err
+	}
+
+	defer rows.Close()
+
+	counts := make(map[string]uint64)
+	for rows.Next() {
+		var tweetText string
+		if err := rows.Scan(&tweetText); err != nil {
+			return kvPairs, err
+		}
+		for _, emoji := range text.Emojis(tweetText) {
+			counts[emoji]++
+		}
+	}
+
+	for _, term := range (text.Options{TopN: limit}).Top(counts) {
+		kvPairs = append(kvPairs, com.KvPair{Word: term.Term, Count: term.Count})
+	}
+
+	return kvPairs, rows.Err()
+}
@@ -0,0 +1,195 @@
+package db
+
+import (
+	"database/sql"
+	"encoding/json"
+	"math/rand"
+	"sort"
+	"time"
+
+	pq "github.com/lib/pq"
+	com "gitlab.com/leapbit-practice/tweety-lib-communication/comms"
+)
+
+const (
+	TOP_DISTINCTIVE_TERMS = 10
+)
+
+// Every save adds to one of corpusShards rows of the corpus count, so
+// concurrent saves rarely wait for each other.
+const corpusShards = 16
+
+// Distinctive terms of the users of one location or regional bloc.
+// Scores of a term are summed over the users.
+type DistinctiveTerms struct {
+	Name  string          `json:"name"`
+	Users uint64          `json:"users"`
+	Terms []com.TermScore `json:"terms"`
+}
+
+const (
+	increment_corpus_documents = `INSERT INTO public.corpus_shard (shard, documents)
+		VALUES ($1, $2)
+		ON CONFLICT (shard)
+		DO UPDATE SET documents = corpus_shard.documents + EXCLUDED.documents`
+
+	// Terms are taken in order, so concurrent saves lock shared terms in the same order.
+	increment_document_frequencies = `INSERT INTO public.document_frequency (term, documents)
+		SELECT term, COUNT(*) FROM UNNEST($1::TEXT[]) term
+		GROUP BY term
+		ORDER BY term
+		ON CONFLICT (term)
+		DO UPDATE SET documents = document_frequency.documents + EXCLUDED.documents`
+
+	get_corpus_documents = `SELECT COALESCE(SUM(documents), 0) FROM public.corpus_shard`
+
+	get_document_frequencies = `SELECT term, documents
+	FROM public.document_frequency
+	WHERE term = ANY($1::TEXT[])`
+
+	get_located_distinctive_terms_in_period = `SELECT A.name, A.regional_blocks, B.distinctive_terms
+	FROM PUBLIC.location A
+	JOIN PUBLIC.user B
+	ON A.name = B.location_name
+	WHERE B.distinctive_terms IS NOT NULL AND EXISTS (
+		SELECT 1 FROM PUBLIC.tweet C
+		WHERE C.user_id_str = B.id_str AND C.created_at >= $1 AND C.created_at < $2)`
+)
+
+// Function counts documents more tweets in the corpus, in the transaction
+// saving them. Terms holds the distinct terms of each of the tweets.
+func addCorpusDocuments(documents int, terms []string, tx *sql.Tx) error {
+	if _, err := tx.Exec(increment_corpus_documents, rand.Intn(corpusShards), documents); err != nil {
+		return err
+	}
+
+	if len(terms) > 0 {
+		if _, err := tx.Exec(increment_document_frequencies, pq.Array(terms)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Function returns the number of tweets in the corpus and how many of them contain each term.
+func GetDocumentFrequencies(terms []string, db *sql.DB) (com.RespDocumentFrequencies, error) {
+	frequencies := com.RespDocumentFrequencies{Frequencies: make(map[string]uint64)}
+
+	if err := db.QueryRow(get_corpus_documents).Scan(&frequencies.Documents); err != nil {
+		return frequencies, err
+	}
+
+	rows, err := db.Query(get_document_frequencies, pq.Array(terms))
+	if err != nil {
+		return frequencies, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var term string
+		var documents uint64
+		if err := rows.Scan(&term, &documents); err != nil {
+			return frequencies, err
+		}
+		frequencies.Frequencies[term] = documents
+	}
+
+	return frequencies, rows.Err()
+}
+
+type termGroup struct {
+	users  uint64
+	scores map[string]float64
+}
+
+func (group *termGroup) add(terms []com.TermScore) {
+	group.users++
+	for _, term := range terms {
+		group.scores[term.Term] += term.Score
+	}
+}
+
+// Function ranks groups by number of users and the terms of each group by score.
+func rankTermGroups(groups map[string]*termGroup, limit int) []DistinctiveTerms {
+	ranked := make([]DistinctiveTerms, 0, len(groups))
+
+	for name, group := range groups {
+		terms := make([]com.TermScore, 0, len(group.scores))
+		for term, score := range group.scores {
+			terms = append(terms, com.TermScore{Term: term, Score: score})
+		}
+		sort.Slice(terms, func(i, j int) bool {
+			if terms[i].Score == terms[j].Score {
+				return terms[i].Term < terms[j].Term
+			}
+			return terms[i].Score > terms[j].Score
+		})
+		if len(terms) > limit {
+			terms = terms[:limit]
+		}
+		ranked = append(ranked, DistinctiveTerms{Name: name, Users: group.users, Terms: terms})
+	}
+
+	sort.Slice(ranked, func(i, j int) bool {
+		if ranked[i].Users == ranked[j].Users {
+			return ranked[i].Name < ranked[j].Name
+		}
+		return ranked[i].Users > ranked[j].Users
+	})
+
+	return ranked
+}
+
+// Function sums the distinctive terms of users who tweeted in [from, to),
+// per location and per regional bloc.
+func GetDistinctiveTermsInPeriod(from time.Time, to time.Time, limit int, db *sql.DB) ([]DistinctiveTerms, []DistinctiveTerms, error) {
+	locations := make(map[string]*termGroup)
+	blocks := make(map[string]*termGroup)
+
+	rows, err := db.Query(get_located_distinctive_terms_in_period, from, to)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var location string
+		var jsonBlocks, jsonTerms []byte
+		if err := rows.Scan(&location, &jsonBlocks, &jsonTerms); err != nil {
+			return nil, nil, err
+		}
+
+		var terms []com.TermScore
+		if err := json.Unmarshal(jsonTerms, &terms); err != nil {
+			return nil, nil, err
+		}
+
+		var regBlocks []com.RegionalBlocsType
+		if len(jsonBlocks) > 0 {
+			if err := json.Unmarshal(jsonBlocks, &regBlocks); err != nil {
+				return nil, nil, err
+			}
+		}
+
+		if locations[location] == nil {
+			locations[location] = &termGroup{scores: make(map[string]float64)}
+		}
+		locations[location].add(terms)
+
+		for _, regBlock := range regBlocks {
+			if blocks[regBlock.Acronym] == nil {
+				blocks[regBlock.Acronym] = &termGroup{scores: make(map[string]float64)}
+			}
+			blocks[regBlock.Acronym].add(terms)
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	return rankTermGroups(locations, limit), rankTermGroups(blocks, limit), nil
+}
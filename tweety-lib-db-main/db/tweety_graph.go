@@ -0,0 +1,131 @@
+package db
+
+import (
+	"database/sql"
+	"time"
+)
+
+type GraphFilter struct {
+	From      time.Time
+	To        time.Time
+	Location  string
+	MinDegree uint64
+}
+
+type GraphNode struct {
+	Id              string
+	Name            string
+	Screen_name     string
+	Followers_count uint64
+	Friends_count   uint64
+	Location_name   string
+	Verified        bool
+	Degree          uint64
+}
+
+type GraphEdge struct {
+	Source string
+	Target string
+}
+
+const (
+	// Nodes are users who tweeted inside the window, edges are follow relations
+	// between two such users, degree counts both directions.
+	graph_filter_cte = `WITH nodes AS (
+		SELECT A.id_str
+		FROM PUBLIC.user A
+		WHERE A.name IS NOT NULL
+		AND ($3 = '' OR A.location_name = $3)
+		AND EXISTS (
+			SELECT 1 FROM PUBLIC.tweet T
+			WHERE T.user_id_str = A.id_str
+			AND T.created_at >= $1 AND T.created_at < $2
+		)
+	),
+	all_edges AS (
+		SELECT A.id_str source, F.target
+		FROM PUBLIC.user A
+		JOIN nodes N ON A.id_str = N.id_str
+		CROSS JOIN LATERAL UNNEST(A.list_of_follower_ids) AS F(target)
+		JOIN nodes M ON F.target = M.id_str
+	),
+	degrees AS (
+		SELECT id, COUNT(*) degree
+		FROM (SELECT source id FROM all_edges UNION ALL SELECT target id FROM all_edges) D
+		GROUP BY id
+	),
+	kept AS (
+		SELECT N.id_str, COALESCE(D.degree, 0) degree
+		FROM nodes N
+		LEFT JOIN degrees D ON N.id_str = D.id
+		WHERE COALESCE(D.degree, 0) >= $4
+	)`
+
+	get_graph_nodes = graph_filter_cte + `
+	SELECT A.id_str, A.name, A.screen_name, A.followers_count, A.friends_count, COALESCE(A.location_name, ''), A.verified, K.degree
+	FROM PUBLIC.user A
+	JOIN kept K ON A.id_str = K.id_str
+	ORDER BY A.id_str`
+
+	get_graph_edges = graph_filter_cte + `
+	SELECT E.source, E.target
+	FROM all_edges E
+	JOIN kept S ON E.source = S.id_str
+	JOIN kept T ON E.target = T.id_str
+	ORDER BY E.source, E.target`
+)
+
+func graphFilterArgs(filter GraphFilter) []interface{} {
+	to := filter.To
+	if to.IsZero() {
+		to = time.Now()
+	}
+	return []interface{}{filter.From, to, filter.Location, filter.MinDegree}
+}
+
+// Function streams crawled users and follow edges matching the filter.
+// All nodes are passed to nodeFn before the first edge reaches edgeFn.
+func ExportGraph(filter GraphFilter, db *sql.DB, nodeFn func(GraphNode) error, edgeFn func(GraphEdge) error) error {
+	args := graphFilterArgs(filter)
+
+	rows, err := db.Query(get_graph_nodes, args...)
+	if err != nil {
+		return err
+	}
+
+	for rows.Next() {
+		var node GraphNode
+		if err := rows.Scan(&node.Id, &node.Name, &node.Screen_name, &node.Followers_count, &node.Friends_count,
+			&node.Location_name, &node.Verified, &node.Degree); err != nil {
+			rows.Close()
+			return err
+		}
+		if err := nodeFn(node); err != nil {
+			rows.Close()
+			return err
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	rows, err = db.Query(get_graph_edges, args...)
+	if err != nil {
+		return err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var edge GraphEdge
+		if err := rows.Scan(&edge.Source, &edge.Target); err != nil {
+			return err
+		}
+		if err := edgeFn(edge); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
@@ -0,0 +1,247 @@
+package db
+
+import (
+	"database/sql"
+	"math"
+	"sort"
+	"time"
+)
+
+const (
+	TOP_GROWTH_ROWS = 25
+	// Accounts starting a window with fewer followers are left out of growth
+	// rankings, so a handful of follows does not put a new account on top.
+	MIN_GROWTH_FOLLOWERS = 100
+	DEFAULT_SPIKE_ZSCORE = 3.0
+)
+
+// Deviations are taken to be at least one count per day, so a jump after
+// days without any change is a spike rather than a division by zero.
+const minSpikeStdDev = 1.0
+
+// Metrics of the count time series.
+const (
+	COUNT_FOLLOWERS = "followers"
+	COUNT_FRIENDS   = "friends"
+	COUNT_STATUSES  = "statuses"
+)
+
+// Last observed counts of a user on a day. Deltas are the change per day since
+// the previous observed day, so a gap in crawling is spread over its days.
+// They are nil when there is no previous day.
+type DailyCounts struct {
+	Day            time.Time `json:"day"`
+	Followers      int64     `json:"followers"`
+	Friends        int64     `json:"friends"`
+	Statuses       int64     `json:"statuses"`
+	FollowersDelta *float64  `json:"followers_delta"`
+	FriendsDelta   *float64  `json:"friends_delta"`
+	StatusesDelta  *float64  `json:"statuses_delta"`
+}
+
+// Follower growth of a user between its first and last observation in a window.
+// Rate is the gain relative to the first count, PerDay the gain per day observed.
+type GrowthRate struct {
+	UserId        string    `json:"user_id"`
+	Name          string    `json:"name"`
+	FromFollowers int64     `json:"from_followers"`
+	ToFollowers   int64     `json:"to_followers"`
+	Gained        int64     `json:"gained"`
+	Rate          float64   `json:"rate"`
+	PerDay        float64   `json:"per_day"`
+	FirstSeenAt   time.Time `json:"first_seen_at"`
+	LastSeenAt    time.Time `json:"last_seen_at"`
+}
+
+// A daily delta of a metric lying ZScore standard deviations from the mean
+// of the other daily deltas of the user.
+type CountSpike struct {
+	Day    time.Time `json:"day"`
+	Metric string    `json:"metric"`
+	Delta  float64   `json:"delta"`
+	Mean   float64   `json:"mean"`
+	StdDev float64   `json:"std_dev"`
+	ZScore float64   `json:"z_score"`
+}
+
+const (
+	insert_user_count = `INSERT INTO public.user_count (user_id_str, followers_count, friends_count, statuses_count)
+		VALUES ($1, $2, $3, $4)`
+
+	// The day before since is read too, so the first day in the window has deltas.
+	get_user_daily_counts = `SELECT day, followers_count, friends_count, statuses_count, followers_delta, friends_delta, statuses_delta
+	FROM (
+		SELECT day, followers_count, friends_count, statuses_count,
+			(followers_count - LAG(followers_count) OVER w)::float / elapsed followers_delta,
+			(friends_count - LAG(friends_count) OVER w)::float / elapsed friends_delta,
+			(statuses_count - LAG(statuses_count) OVER w)::float / elapsed statuses_delta
+		FROM (
+			SELECT day, followers_count, friends_count, statuses_count,
+				GREATEST(ROUND(EXTRACT(EPOCH FROM day - LAG(day) OVER (ORDER BY day)) / 86400), 1) elapsed
+			FROM (
+				SELECT DISTINCT ON (date_trunc('day', observed_at)) date_trunc('day', observed_at) AS day, followers_count, friends_count, statuses_count
+				FROM PUBLIC.user_count
+				WHERE user_id_str = $1 AND observed_at < $3
+				ORDER BY date_trunc('day', observed_at), observed_at DESC
+			) daily
+		) observed
+		WINDOW w AS (ORDER BY day)
+	) deltas
+	WHERE day >= date_trunc('day', $2::timestamptz)
+	ORDER BY day`
+
+	get_growth_in_period = `SELECT A.user_id_str, COALESCE(B.name, ''), A.first_followers, A.last_followers, A.first_at, A.last_at
+	FROM (
+		SELECT user_id_str,
+			(ARRAY_AGG(followers_count ORDER BY observed_at))[1] first_followers,
+			(ARRAY_AGG(followers_count ORDER BY observed_at DESC))[1] last_followers,
+			MIN(observed_at) first_at,
+			MAX(observed_at) last_at
+		FROM PUBLIC.user_count
+		WHERE observed_at >= $1 AND observed_at < $2 AND ($3 = '' OR user_id_str = $3)
+		GROUP BY user_id_str
+		HAVING COUNT(*) > 1
+	) A
+	LEFT JOIN PUBLIC.user B
+	ON A.user_id_str = B.id_str
+	WHERE A.first_followers >= $4
+	ORDER BY (A.last_followers - A.first_followers)::float / GREATEST(A.first_followers, 1) DESC, A.last_followers - A.first_followers DESC, A.user_id_str
+	LIMIT $5`
+)
+
+// Function returns the daily counts of a user in [from, to), oldest first.
+func GetUserDailyCounts(userId string, from time.Time, to time.Time, db *sql.DB) ([]DailyCounts, error) {
+	days := make([]DailyCounts, 0)
+
+	rows, err := db.Query(get_user_daily_counts, userId, from, to)
+	if err != nil {
+		return days, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var day DailyCounts
+		var followers, friends, statuses sql.NullFloat64
+		if err := rows.Scan(&day.Day, &day.Followers, &day.Friends, &day.Statuses, &followers, &friends, &statuses); err != nil {
+			return days, err
+		}
+		day.FollowersDelta, day.FriendsDelta, day.StatusesDelta = nullDelta(followers), nullDelta(friends), nullDelta(statuses)
+		days = append(days, day)
+	}
+
+	return days, rows.Err()
+}
+
+func nullDelta(delta sql.NullFloat64) *float64 {
+	if !delta.Valid {
+		return nil
+	}
+	return &delta.Float64
+}
+
+func getGrowthInPeriod(from time.Time, to time.Time, userId string, minFollowers int64, limit int, db *sql.DB) ([]GrowthRate, error) {
+	growth := make([]GrowthRate, 0)
+
+	rows, err := db.Query(get_growth_in_period, from, to, userId, minFollowers, limit)
+	if err != nil {
+		return growth, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var rate GrowthRate
+		if err := rows.Scan(&rate.UserId, &rate.Name, &rate.FromFollowers, &rate.ToFollowers, &rate.FirstSeenAt, &rate.LastSeenAt); err != nil {
+			return growth, err
+		}
+		rate.Gained = rate.ToFollowers - rate.FromFollowers
+		rate.Rate = float64(rate.Gained) / math.Max(float64(rate.FromFollowers), 1)
+		if days := rate.LastSeenAt.Sub(rate.FirstSeenAt).Hours() / 24; days > 0 {
+			rate.PerDay = float64(rate.Gained) / days
+		}
+		growth = append(growth, rate)
+	}
+
+	return growth, rows.Err()
+}
+
+// Function returns the follower growth of a user in [from, to). It is not
+// found when the user was observed fewer than two times.
+func GetUserGrowth(userId string, from time.Time, to time.Time, db *sql.DB) (GrowthRate, bool, error) {
+	growth, err := getGrowthInPeriod(from, to, userId, 0, 1, db)
+	if err != nil || len(growth) == 0 {
+		return GrowthRate{}, false, err
+	}
+	return growth[0], true, nil
+}
+
+// Function returns the accounts with the highest relative follower growth in
+// [from, to), leaving out ones starting with fewer than MIN_GROWTH_FOLLOWERS.
+func GetFastestGrowingInPeriod(from time.Time, to time.Time, limit int, db *sql.DB) ([]GrowthRate, error) {
+	return getGrowthInPeriod(from, to, "", MIN_GROWTH_FOLLOWERS, limit, db)
+}
+
+// Function returns the daily deltas of a user in [from, to) whose z-score
+// against the other deltas of the same metric in the window reaches threshold.
+func GetUserCountSpikes(userId string, from time.Time, to time.Time, threshold float64, db *sql.DB) ([]CountSpike, error) {
+	days, err := GetUserDailyCounts(userId, from, to, db)
+	if err != nil {
+		return make([]CountSpike, 0), err
+	}
+	return CountSpikes(days, threshold), nil
+}
+
+// Function finds spikes in daily deltas, oldest first. Every delta is compared
+// with the mean and standard deviation of the other deltas of its metric, so a
+// spike does not hide itself by raising them. A delta is only tested against
+// at least three others.
+func CountSpikes(days []DailyCounts, threshold float64) []CountSpike {
+	spikes := make([]CountSpike, 0)
+
+	type point struct {
+		day   time.Time
+		delta float64
+	}
+	series := make(map[string][]point)
+	for _, day := range days {
+		for metric, delta := range map[string]*float64{COUNT_FOLLOWERS: day.FollowersDelta, COUNT_FRIENDS: day.FriendsDelta, COUNT_STATUSES: day.StatusesDelta} {
+			if delta != nil {
+				series[metric] = append(series[metric], point{day.Day, *delta})
+			}
+		}
+	}
+
+	for _, metric := range []string{COUNT_FOLLOWERS, COUNT_FRIENDS, COUNT_STATUSES} {
+		points := series[metric]
+		if len(points) < 4 {
+			continue
+		}
+
+		for i, p := range points {
+			var sum float64
+			for j, other := range points {
+				if j != i {
+					sum += other.delta
+				}
+			}
+			others := float64(len(points) - 1)
+			mean := sum / others
+
+			var squares float64
+			for j, other := range points {
+				if j != i {
+					squares += (other.delta - mean) * (other.delta - mean)
+				}
+			}
+			stdDev := math.Max(math.Sqrt(squares/others), minSpikeStdDev)
+
+			if z := (p.delta - mean) / stdDev; math.Abs(z) >= threshold {
+				spikes = append(spikes, CountSpike{Day: p.day, Metric: metric, Delta: p.delta, Mean: mean, StdDev: stdDev, ZScore: z})
+			}
+		}
+	}
+
+	sort.SliceStable(spikes, func(i, j int) bool { return spikes[i].Day.Before(spikes[j].Day) })
+	return spikes
+}
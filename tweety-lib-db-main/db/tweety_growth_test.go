@@ -0,0 +1,101 @@
+package db
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+var spikeStart = time.Date(2021, 7, 1, 0, 0, 0, 0, time.UTC)
+
+func spikeDay(i int) time.Time {
+	return spikeStart.AddDate(0, 0, i)
+}
+
+// Function returns daily counts with the given follower and status deltas, nil for days without one.
+func spikeDays(followers []*float64, statuses []*float64) []DailyCounts {
+	days := make([]DailyCounts, 0)
+	for i := 0; i < len(followers) || i < len(statuses); i++ {
+		day := DailyCounts{Day: spikeDay(i)}
+		if i < len(followers) {
+			day.FollowersDelta = followers[i]
+		}
+		if i < len(statuses) {
+			day.StatusesDelta = statuses[i]
+		}
+		days = append(days, day)
+	}
+	return days
+}
+
+func deltas(values ...float64) []*float64 {
+	pointers := make([]*float64, len(values))
+	for i := range values {
+		pointers[i] = &values[i]
+	}
+	return pointers
+}
+
+func TestCountSpikes(t *testing.T) {
+	tests := []struct {
+		name      string
+		days      []DailyCounts
+		threshold float64
+		want      []CountSpike
+	}{
+		{
+			name:      "too few deltas",
+			days:      spikeDays(deltas(1, 1, 100), nil),
+			threshold: 3,
+			want:      []CountSpike{},
+		},
+		{
+			name:      "jump in a flat series",
+			days:      spikeDays(deltas(10, 10, 10, 10, 50), nil),
+			threshold: 3,
+			want:      []CountSpike{{Day: spikeDay(4), Metric: COUNT_FOLLOWERS, Delta: 50, Mean: 10, StdDev: 1, ZScore: 40}},
+		},
+		{
+			name:      "drop in a flat series",
+			days:      spikeDays(deltas(10, 10, 10, 10, -40), nil),
+			threshold: 3,
+			want:      []CountSpike{{Day: spikeDay(4), Metric: COUNT_FOLLOWERS, Delta: -40, Mean: 10, StdDev: 1, ZScore: -50}},
+		},
+		{
+			name:      "noise",
+			days:      spikeDays(deltas(5, 7, 6, 8, 5, 7), nil),
+			threshold: 3,
+			want:      []CountSpike{},
+		},
+		{
+			name:      "days without a delta are left out",
+			days:      spikeDays([]*float64{nil, deltas(10)[0], deltas(10)[0], deltas(50)[0]}, nil),
+			threshold: 3,
+			want:      []CountSpike{},
+		},
+		{
+			name:      "oldest first across metrics",
+			days:      spikeDays(deltas(10, 10, 10, 10, 50), deltas(2, 30, 2, 2, 2)),
+			threshold: 3,
+			want: []CountSpike{
+				{Day: spikeDay(1), Metric: COUNT_STATUSES, Delta: 30, Mean: 2, StdDev: 1, ZScore: 28},
+				{Day: spikeDay(4), Metric: COUNT_FOLLOWERS, Delta: 50, Mean: 10, StdDev: 1, ZScore: 40},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		got := CountSpikes(test.days, test.threshold)
+		if len(got) != len(test.want) {
+			t.Errorf("%s: CountSpikes() = %+v, want %+v", test.name, got, test.want)
+			continue
+		}
+		for i, spike := range got {
+			want := test.want[i]
+			if !spike.Day.Equal(want.Day) || spike.Metric != want.Metric || spike.Delta != want.Delta ||
+				math.Abs(spike.Mean-want.Mean) > 1e-9 || math.Abs(spike.StdDev-want.StdDev) > 1e-9 || math.Abs(spike.ZScore-want.ZScore) > 1e-9 {
+				t.Errorf("%s: spike %d = %+v, want %+v", test.name, i, spike, want)
+			}
+		}
+	}
+}
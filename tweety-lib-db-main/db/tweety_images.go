@@ -0,0 +1,431 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	com "gitlab.com/leapbit-practice/tweety-lib-communication/comms"
+)
+
+var ErrImageNotCurrent = errors.New("image is not the current one")
+
+// A distinct image a user had, seen first and last at the given times.
+// Versions counts how many times the user switched to it. DHash is empty
+// for images that cannot be decoded.
+type SeenImage struct {
+	Kind        string    `json:"kind"`
+	Sha256      string    `json:"sha256"`
+	MimeType    string    `json:"mime_type"`
+	Size        int64     `json:"size"`
+	DHash       string    `json:"dhash,omitempty"`
+	Versions    int       `json:"versions"`
+	FirstSeenAt time.Time `json:"first_seen_at"`
+	LastSeenAt  time.Time `json:"last_seen_at"`
+}
+
+// Current image of a user with its difference hash.
+type ImageHash struct {
+	UserId     string `json:"user_id"`
+	ScreenName string `json:"screen_name"`
+	Sha256     string `json:"sha256"`
+	DHashHex   string `json:"dhash"`
+	DHash      uint64 `json:"-"`
+}
+
+const (
+	insert_image_blob = `INSERT INTO public.image_blob (sha256, mime_type, size, data, dhash, dhash_checked)
+		VALUES ($1, $2, $3, $4, $5, TRUE)
+		ON CONFLICT (sha256)
+		DO UPDATE SET dhash = COALESCE(image_blob.dhash, EXCLUDED.dhash), dhash_checked = TRUE`
+
+	lock_user_image_kind = `SELECT pg_advisory_xact_lock(hashtext($1), hashtext($2))`
+
+	get_latest_user_image = `SELECT version, sha256
+	FROM PUBLIC.user_image
+	WHERE user_id_str = $1 AND kind = $2
+	ORDER BY version DESC
+	FETCH FIRST 1 ROWS ONLY
+	FOR UPDATE`
+
+	insert_user_image = `INSERT INTO public.user_image (user_id_str, kind, version, sha256, source_url)
+		VALUES ($1, $2, $3, $4, NULLIF($5, ''))`
+
+	insert_legacy_user_image = `INSERT INTO public.user_image (user_id_str, kind, version, sha256, created_at, last_seen_at)
+		SELECT $1, $2, 1, $3, $4, $4
+		WHERE NOT EXISTS (SELECT 1 FROM public.user_image WHERE user_id_str = $1 AND kind = $2)`
+
+	set_user_images_imported = `UPDATE public.user SET images_imported = TRUE WHERE id_str = $1`
+
+	get_unchecked_image_blobs = `SELECT sha256, data
+	FROM PUBLIC.image_blob
+	WHERE NOT dhash_checked
+	FETCH FIRST $1 ROWS ONLY`
+
+	update_image_blob_dhash = `UPDATE public.image_blob SET dhash = $2, dhash_checked = TRUE WHERE sha256 = $1`
+
+	get_unimported_legacy_images = `SELECT id_str, images, last_modified
+	FROM PUBLIC.user
+	WHERE images IS NOT NULL AND NOT images_imported
+	FETCH FIRST $1 ROWS ONLY`
+
+	update_user_image_seen = `UPDATE public.user_image
+		SET source_url = COALESCE(NULLIF($4, ''), source_url), last_seen_at = NOW()
+		WHERE user_id_str = $1 AND kind = $2 AND version = $3`
+
+	touch_user = `INSERT INTO public.user (id_str, last_modified)
+		VALUES ($1, NOW())
+		ON CONFLICT (id_str)
+		DO UPDATE SET last_modified = NOW()`
+
+	image_version_columns = `A.kind, A.version, A.sha256, B.mime_type, B.size, COALESCE(A.source_url, ''), A.created_at, A.last_seen_at`
+
+	get_user_image = `SELECT ` + image_version_columns + `
+	FROM PUBLIC.user_image A
+	JOIN PUBLIC.image_blob B
+	ON A.sha256 = B.sha256
+	WHERE A.user_id_str = $1 AND A.kind = $2 AND A.version = $3`
+
+	get_current_user_images = `SELECT DISTINCT ON (A.kind) ` + image_version_columns + `
+	FROM PUBLIC.user_image A
+	JOIN PUBLIC.image_blob B
+	ON A.sha256 = B.sha256
+	WHERE A.user_id_str = $1
+	ORDER BY A.kind, A.version DESC`
+
+	get_current_user_image_data = `SELECT ` + image_version_columns + `, B.data
+	FROM PUBLIC.user_image A
+	JOIN PUBLIC.image_blob B
+	ON A.sha256 = B.sha256
+	WHERE A.user_id_str = $1 AND A.kind = $2
+	ORDER BY A.version DESC
+	FETCH FIRST 1 ROWS ONLY`
+
+	get_legacy_user_images = `SELECT images, last_modified
+	FROM PUBLIC.user
+	WHERE id_str = $1 AND images IS NOT NULL`
+
+	get_user_seen_images = `SELECT A.kind, A.sha256, B.mime_type, B.size, B.dhash, COUNT(*), MIN(A.created_at), MAX(A.last_seen_at)
+	FROM PUBLIC.user_image A
+	JOIN PUBLIC.image_blob B
+	ON A.sha256 = B.sha256
+	WHERE A.user_id_str = $1
+	GROUP BY A.kind, A.sha256, B.mime_type, B.size, B.dhash
+	ORDER BY A.kind, MAX(A.last_seen_at) DESC`
+
+	get_current_image_hashes = `SELECT user_id_str, screen_name, sha256, dhash
+	FROM (
+		SELECT DISTINCT ON (A.user_id_str) A.user_id_str, COALESCE(C.screen_name, '') screen_name, A.sha256, B.dhash
+		FROM PUBLIC.user_image A
+		JOIN PUBLIC.image_blob B
+		ON A.sha256 = B.sha256
+		LEFT JOIN PUBLIC.user C
+		ON A.user_id_str = C.id_str
+		WHERE A.kind = $1
+		ORDER BY A.user_id_str, A.version DESC
+	) current
+	WHERE dhash IS NOT NULL`
+)
+
+func scanImageVersion(row interface{ Scan(...interface{}) error }) (com.ImageVersion, error) {
+	var image com.ImageVersion
+	err := row.Scan(&image.Kind, &image.Version, &image.Sha256, &image.MimeType, &image.Size, &image.SourceUrl, &image.CreatedAt, &image.LastSeenAt)
+	return image, err
+}
+
+func dhashHex(dhash int64) string {
+	return fmt.Sprintf("%016x", uint64(dhash))
+}
+
+// Function returns the difference hash of an image to store, nil when it cannot be decoded.
+func imageDHash(data []byte) *int64 {
+	hash, err := com.ImageDHash(data)
+	if err != nil {
+		return nil
+	}
+	signed := int64(hash)
+	return &signed
+}
+
+func saveImageBlob(sha string, mimeType string, data []byte, tx *sql.Tx) error {
+	_, err := tx.Exec(insert_image_blob, sha, mimeType, len(data), data, imageDHash(data))
+	return err
+}
+
+// Function stores an image of a user under its SHA-256 and returns the current
+// version of its kind. A new version is added only when the image differs from
+// the current one, otherwise the current one is seen again. An image without
+// data must name the current one by its SHA-256, else ErrImageNotCurrent is returned.
+func SaveUserImage(userId string, image com.UserImage, db *sql.DB) (com.ImageVersion, bool, error) {
+	sha := image.Sha256
+	if len(image.Data) > 0 {
+		sha = com.ImageDigest(image.Data)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return com.ImageVersion{}, false, err
+	}
+
+	// Locking the latest version locks nothing before the first one, concurrent
+	// saves of a kind of a user wait for each other instead.
+	if _, err := tx.Exec(lock_user_image_kind, userId, image.Kind); err != nil {
+		tx.Rollback()
+		return com.ImageVersion{}, false, err
+	}
+
+	var version int
+	var currentSha string
+	err = tx.QueryRow(get_latest_user_image, userId, image.Kind).Scan(&version, &currentSha)
+	if err != nil && err != sql.ErrNoRows {
+		tx.Rollback()
+		return com.ImageVersion{}, false, err
+	}
+
+	changed := currentSha != sha
+	if changed && len(image.Data) == 0 {
+		tx.Rollback()
+		return com.ImageVersion{}, false, ErrImageNotCurrent
+	}
+
+	// Images sent with their data are upserted even when unchanged. Blobs
+	// stored without a hash before are hashed by HashImageBlobs.
+	if len(image.Data) > 0 {
+		if err := saveImageBlob(sha, com.ImageMimeType(image.Data), image.Data, tx); err != nil {
+			tx.Rollback()
+			return com.ImageVersion{}, false, err
+		}
+	}
+
+	if changed {
+		version++
+		if _, err := tx.Exec(insert_user_image, userId, image.Kind, version, sha, image.SourceUrl); err != nil {
+			tx.Rollback()
+			return com.ImageVersion{}, false, err
+		}
+		if _, err := tx.Exec(touch_user, userId); err != nil {
+			tx.Rollback()
+			return com.ImageVersion{}, false, err
+		}
+	} else if _, err := tx.Exec(update_user_image_seen, userId, image.Kind, version, image.SourceUrl); err != nil {
+		tx.Rollback()
+		return com.ImageVersion{}, false, err
+	}
+
+	stored, err := scanImageVersion(tx.QueryRow(get_user_image, userId, image.Kind, version))
+	if err != nil {
+		tx.Rollback()
+		return stored, false, err
+	}
+
+	return stored, changed, tx.Commit()
+}
+
+// Function returns the current version of every image kind of a user.
+func GetUserImages(userId string, db *sql.DB) ([]com.ImageVersion, error) {
+	images := make([]com.ImageVersion, 0)
+
+	rows, err := db.Query(get_current_user_images, userId)
+	if err != nil {
+		return images, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		image, err := scanImageVersion(rows)
+		if err != nil {
+			return images, err
+		}
+		images = append(images, image)
+	}
+
+	return images, rows.Err()
+}
+
+// Function returns the current image of kind of a user with its data.
+func GetUserImageData(userId string, kind string, db *sql.DB) (com.ImageVersion, []byte, bool, error) {
+	var image com.ImageVersion
+	var data []byte
+
+	err := db.QueryRow(get_current_user_image_data, userId, kind).Scan(&image.Kind, &image.Version, &image.Sha256,
+		&image.MimeType, &image.Size, &image.SourceUrl, &image.CreatedAt, &image.LastSeenAt, &data)
+	if err == sql.ErrNoRows {
+		return image, nil, false, nil
+	}
+
+	return image, data, err == nil, err
+}
+
+// Function returns the zip of images users had before images were stored
+// content-addressed, and when the user was last modified.
+func GetLegacyUserImages(userId string, db *sql.DB) ([]byte, time.Time, bool, error) {
+	var zipped []byte
+	var lastModified time.Time
+
+	err := db.QueryRow(get_legacy_user_images, userId).Scan(&zipped, &lastModified)
+	if err == sql.ErrNoRows {
+		return nil, lastModified, false, nil
+	}
+
+	return zipped, lastModified, err == nil, err
+}
+
+// Function returns every distinct image a user had, last seen first per kind.
+func GetUserSeenImages(userId string, db *sql.DB) ([]SeenImage, error) {
+	images := make([]SeenImage, 0)
+
+	rows, err := db.Query(get_user_seen_images, userId)
+	if err != nil {
+		return images, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var image SeenImage
+		var dhash sql.NullInt64
+		err := rows.Scan(&image.Kind, &image.Sha256, &image.MimeType, &image.Size, &dhash, &image.Versions, &image.FirstSeenAt, &image.LastSeenAt)
+		if err != nil {
+			return images, err
+		}
+		if dhash.Valid {
+			image.DHash = dhashHex(dhash.Int64)
+		}
+		images = append(images, image)
+	}
+
+	return images, rows.Err()
+}
+
+// Function returns the difference hashes of the current images of kind of every user.
+func GetCurrentImageHashes(kind string, db *sql.DB) ([]ImageHash, error) {
+	hashes := make([]ImageHash, 0)
+
+	rows, err := db.Query(get_current_image_hashes, kind)
+	if err != nil {
+		return hashes, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var hash ImageHash
+		var dhash int64
+		if err := rows.Scan(&hash.UserId, &hash.ScreenName, &hash.Sha256, &dhash); err != nil {
+			return hashes, err
+		}
+		hash.DHash = uint64(dhash)
+		hash.DHashHex = dhashHex(dhash)
+		hashes = append(hashes, hash)
+	}
+
+	return hashes, rows.Err()
+}
+
+// Function computes the difference hashes of at most limit blobs stored
+// before they were hashed and returns how many it checked. Blobs that cannot
+// be decoded are checked too, so they are not read again.
+func HashImageBlobs(limit int, db *sql.DB) (int, error) {
+	type blob struct {
+		sha  string
+		data []byte
+	}
+
+	blobs := make([]blob, 0)
+	rows, err := db.Query(get_unchecked_image_blobs, limit)
+	if err != nil {
+		return 0, err
+	}
+
+	for rows.Next() {
+		var b blob
+		if err := rows.Scan(&b.sha, &b.data); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		blobs = append(blobs, b)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for i, b := range blobs {
+		if _, err := db.Exec(update_image_blob_dhash, b.sha, imageDHash(b.data)); err != nil {
+			return i, err
+		}
+	}
+
+	return len(blobs), nil
+}
+
+// Zip of images a user had before images were stored content-addressed.
+type LegacyUserImages struct {
+	UserId       string
+	Zipped       []byte
+	LastModified time.Time
+}
+
+// Function returns at most limit users whose legacy zip was not imported yet.
+func GetUnimportedLegacyImages(limit int, db *sql.DB) ([]LegacyUserImages, error) {
+	users := make([]LegacyUserImages, 0)
+
+	rows, err := db.Query(get_unimported_legacy_images, limit)
+	if err != nil {
+		return users, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var user LegacyUserImages
+		if err := rows.Scan(&user.UserId, &user.Zipped, &user.LastModified); err != nil {
+			return users, err
+		}
+		users = append(users, user)
+	}
+
+	return users, rows.Err()
+}
+
+// Function stores the images of the legacy zip of a user as hashed blobs and
+// makes each the first version of its kind, seen when the user was last
+// modified. Kinds the user already has versions of are left as they are.
+// The zip is marked imported even without images.
+func ImportLegacyUserImages(userId string, images []com.UserImage, lastModified time.Time, db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	for _, image := range images {
+		if _, err := tx.Exec(lock_user_image_kind, userId, image.Kind); err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		mimeType := com.ImageMimeType(image.Data)
+		if mimeType == "" {
+			mimeType = http.DetectContentType(image.Data)
+		}
+		sha := com.ImageDigest(image.Data)
+		if err := saveImageBlob(sha, mimeType, image.Data, tx); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if _, err := tx.Exec(insert_legacy_user_image, userId, image.Kind, sha, lastModified); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	if _, err := tx.Exec(set_user_images_imported, userId); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
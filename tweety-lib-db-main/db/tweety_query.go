@@ -0,0 +1,584 @@
+package db
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	com "gitlab.com/leapbit-practice/tweety-lib-communication/comms"
+)
+
+const (
+	DEFAULT_PAGE_SIZE = 50
+	MAX_PAGE_SIZE     = 500
+
+	REPORT_LOG      = "log"
+	REPORT_TWEET    = "tweet"
+	REPORT_LOCATION = "location"
+
+	// Optional sections of the tweet report, made only when asked for.
+	SECTION_FASTEST_GROWING = "fastest_growing"
+	SECTION_LIKELY_BOTS     = "likely_bots"
+)
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+type UserInfo struct {
+	Id                uint64          `json:"id"`
+	Id_str            string          `json:"id_str"`
+	Name              string          `json:"name"`
+	Screen_name       string          `json:"screen_name"`
+	Location          string          `json:"location"`
+	Location_name     string          `json:"location_name"`
+	URL               string          `json:"url"`
+	Description       string          `json:"description"`
+	Protected         bool            `json:"protected"`
+	Verified          bool            `json:"verified"`
+	Followers_count   uint64          `json:"followers_count"`
+	Friends_count     uint64          `json:"friends_count"`
+	Statuses_count    uint64          `json:"statuses_count"`
+	Created_at        time.Time       `json:"created_at"`
+	Word_counts       json.RawMessage `json:"word_counts"`
+	Distinctive       json.RawMessage `json:"distinctive_terms,omitempty"`
+	Last_modified     time.Time       `json:"last_modified"`
+	Last_counted_at   *time.Time      `json:"last_counted_at,omitempty"`
+	Status            string          `json:"status,omitempty"`
+	Status_changed_at *time.Time      `json:"status_changed_at,omitempty"`
+	Bot_score         *float64        `json:"bot_score,omitempty"`
+	Bot_scored_at     *time.Time      `json:"bot_scored_at,omitempty"`
+}
+
+type UserFilter struct {
+	Location     string
+	Verified     *bool
+	MinFollowers uint64
+	Cursor       string
+	Limit        int
+}
+
+type TweetFilter struct {
+	Since  time.Time
+	Until  time.Time
+	Cursor string
+	Limit  int
+}
+
+type TweetInfo struct {
+	Id_str     string     `json:"tweet_id_str"`
+	UserId     string     `json:"user_id_str"`
+	Text       string     `json:"text"`
+	Created_at time.Time  `json:"created_at"`
+	Url        string     `json:"url"`
+	Deleted_at *time.Time `json:"deleted_at,omitempty"`
+}
+
+type LocationRecord struct {
+	Name           string                  `json:"name"`
+	Languages      []com.LanguagesType     `json:"languages"`
+	RegionalBlocks []com.RegionalBlocsType `json:"regional_blocks"`
+	Population     int64                   `json:"population"`
+	Users          uint64                  `json:"users"`
+}
+
+// Report rows are returned with their JSON columns untouched,
+// only the fields of the requested report type are filled.
+type ReportRecord struct {
+	Id                     uint64          `json:"id"`
+	Type                   string          `json:"type"`
+	Kind                   string          `json:"kind"`
+	ReportedAt             time.Time       `json:"reported_at"`
+	WindowFrom             *time.Time      `json:"window_from,omitempty"`
+	WindowTo               *time.Time      `json:"window_to,omitempty"`
+	AppMostRequests        string          `json:"app_most_requests,omitempty"`
+	TopErrorRequests       json.RawMessage `json:"top_error_requests,omitempty"`
+	TopLongestRequests     json.RawMessage `json:"top_longest_requests,omitempty"`
+	TopShortestRequests    json.RawMessage `json:"top_shortest_requests,omitempty"`
+	MostTweets             json.RawMessage `json:"most_tweets,omitempty"`
+	LargestTweets          json.RawMessage `json:"largest_tweets,omitempty"`
+	MostUsedWords          json.RawMessage `json:"most_used_words,omitempty"`
+	TopHashtags            json.RawMessage `json:"top_hashtags,omitempty"`
+	TopMentions            json.RawMessage `json:"top_mentions,omitempty"`
+	TopDomains             json.RawMessage `json:"top_domains,omitempty"`
+	TopEmojis              json.RawMessage `json:"top_emojis,omitempty"`
+	UserSentiment          json.RawMessage `json:"user_sentiment,omitempty"`
+	FastestGrowing         json.RawMessage `json:"fastest_growing,omitempty"`
+	LikelyBots             json.RawMessage `json:"likely_bots,omitempty"`
+	UserActivity           json.RawMessage `json:"user_activity,omitempty"`
+	TopTweetLocation       json.RawMessage `json:"top_tweet_location,omitempty"`
+	TopTweetRegionalBlocks json.RawMessage `json:"top_tweet_regional_blocks,omitempty"`
+	MostSpokenLanguages    json.RawMessage `json:"most_spoken_languages,omitempty"`
+	TotalPopulation        int64           `json:"total_population,omitempty"`
+	LocationSentiment      json.RawMessage `json:"location_sentiment,omitempty"`
+	LanguagesTweeted       json.RawMessage `json:"languages_tweeted,omitempty"`
+	LocationTerms          json.RawMessage `json:"location_distinctive_terms,omitempty"`
+	BlocTerms              json.RawMessage `json:"bloc_distinctive_terms,omitempty"`
+	LocationActivity       json.RawMessage `json:"location_activity,omitempty"`
+}
+
+const (
+	user_info_columns = `COALESCE(id, 0), id_str, COALESCE(name, ''), COALESCE(screen_name, ''), COALESCE(location, ''),
+	COALESCE(location_name, ''), COALESCE(url, ''), COALESCE(description, ''), COALESCE(protected, FALSE),
+	COALESCE(verified, FALSE), COALESCE(followers_count, 0), COALESCE(friends_count, 0), COALESCE(statuses_count, 0),
+	COALESCE(created_at, 'epoch'), word_counts, distinctive_terms, last_modified, last_counted_at,
+	COALESCE(status, ''), status_changed_at, bot_score, bot_scored_at`
+
+	get_user_by_id = `SELECT ` + user_info_columns + `
+	FROM PUBLIC.user
+	WHERE id_str = $1 AND name IS NOT NULL`
+
+	get_users = `SELECT ` + user_info_columns + `
+	FROM PUBLIC.user
+	WHERE name IS NOT NULL
+	AND ($1 = '' OR location_name = $1)
+	AND ($2::boolean IS NULL OR verified = $2)
+	AND followers_count >= $3
+	AND id_str > $4
+	ORDER BY id_str
+	LIMIT $5`
+
+	get_user_tweets = `SELECT tweet_id_str, user_id_str, text, created_at, COALESCE(url, ''), deleted_at
+	FROM PUBLIC.tweet
+	WHERE user_id_str = $1
+	AND created_at >= $2 AND created_at < $3
+	AND ($4 = '' OR (created_at, tweet_id_str) < ($5, $4))
+	ORDER BY created_at DESC, tweet_id_str DESC
+	LIMIT $6`
+
+	get_user_friends = `SELECT F.friend_id, F.position
+	FROM PUBLIC.user A
+	CROSS JOIN LATERAL UNNEST(A.list_of_follower_ids) WITH ORDINALITY AS F(friend_id, position)
+	WHERE A.id_str = $1 AND F.position > $2
+	ORDER BY F.position
+	LIMIT $3`
+
+	// Users are counted per location name first, so the outer query selects location columns without grouping them.
+	get_locations = `SELECT A.name, A.languages, A.regional_blocks, COALESCE(A.population, 0), COALESCE(B.users, 0)
+	FROM PUBLIC.location A
+	LEFT JOIN (
+		SELECT location_name, COUNT(id_str) users
+		FROM PUBLIC.user
+		GROUP BY location_name
+	) B
+	ON A.name = B.location_name
+	WHERE A.name > $1
+	ORDER BY A.name
+	LIMIT $2`
+
+	user_exists_by_id = `SELECT EXISTS (SELECT 1 FROM PUBLIC.user WHERE id_str = $1 AND name IS NOT NULL)`
+
+	log_report_columns = `id, type, reported_at, window_from, window_to, COALESCE(app_most_requests, ''), top_error_requests, top_longest_requests, top_shortest_requests`
+
+	tweet_report_columns = `id, type, reported_at, window_from, window_to, most_tweets, largest_tweets, most_used_words, top_hashtags, top_mentions, top_domains, top_emojis, user_sentiment, fastest_growing, likely_bots, user_activity`
+
+	location_report_columns = `id, type, reported_at, window_from, window_to, top_tweet_location, top_tweet_regional_blocks, most_spoken_languages, COALESCE(total_population, 0), location_sentiment, languages_tweeted,
+	location_distinctive_terms, bloc_distinctive_terms, location_activity`
+
+	get_log_reports = `SELECT ` + log_report_columns + `
+	FROM PUBLIC.log_report
+	WHERE ($1 = '' OR type = $1) AND ($2 = 0 OR id < $2)
+	ORDER BY id DESC
+	LIMIT $3`
+
+	get_tweet_reports = `SELECT ` + tweet_report_columns + `
+	FROM PUBLIC.tweet_report
+	WHERE ($1 = '' OR type = $1) AND ($2 = 0 OR id < $2)
+	ORDER BY id DESC
+	LIMIT $3`
+
+	get_location_reports = `SELECT ` + location_report_columns + `
+	FROM PUBLIC.location_report
+	WHERE ($1 = '' OR type = $1) AND ($2 = 0 OR id < $2)
+	ORDER BY id DESC
+	LIMIT $3`
+
+	get_log_report_by_id = `SELECT ` + log_report_columns + ` FROM PUBLIC.log_report WHERE id = $1`
+
+	get_tweet_report_by_id = `SELECT ` + tweet_report_columns + ` FROM PUBLIC.tweet_report WHERE id = $1`
+
+	get_location_report_by_id = `SELECT ` + location_report_columns + ` FROM PUBLIC.location_report WHERE id = $1`
+)
+
+// Pages are queried with one row more than the page size, the extra row
+// only tells that there is a next page.
+func pageSize(limit int) int {
+	if limit <= 0 {
+		return DEFAULT_PAGE_SIZE
+	}
+	if limit > MAX_PAGE_SIZE {
+		return MAX_PAGE_SIZE
+	}
+	return limit
+}
+
+// Cursors are opaque to API clients, they only hold
+// the sort key of the last row of the previous page.
+func EncodeCursor(key string) string {
+	if key == "" {
+		return ""
+	}
+	return base64.RawURLEncoding.EncodeToString([]byte(key))
+}
+
+func DecodeCursor(cursor string) (string, error) {
+	if cursor == "" {
+		return "", nil
+	}
+	key, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", ErrInvalidCursor, err.Error())
+	}
+	return string(key), nil
+}
+
+func encodeIdCursor(id uint64) string {
+	return EncodeCursor(strconv.FormatUint(id, 10))
+}
+
+func decodeIdCursor(cursor string) (uint64, error) {
+	key, err := DecodeCursor(cursor)
+	if err != nil || key == "" {
+		return 0, err
+	}
+	id, err := strconv.ParseUint(key, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %s", ErrInvalidCursor, err.Error())
+	}
+	return id, nil
+}
+
+func scanUserInfo(row interface{ Scan(...interface{}) error }) (UserInfo, error) {
+	var user UserInfo
+	var wordCounts, distinctive []byte
+	err := row.Scan(&user.Id, &user.Id_str, &user.Name, &user.Screen_name, &user.Location, &user.Location_name,
+		&user.URL, &user.Description, &user.Protected, &user.Verified, &user.Followers_count, &user.Friends_count,
+		&user.Statuses_count, &user.Created_at, &wordCounts, &distinctive, &user.Last_modified, &user.Last_counted_at,
+		&user.Status, &user.Status_changed_at, &user.Bot_score, &user.Bot_scored_at)
+	if len(wordCounts) > 0 {
+		user.Word_counts = json.RawMessage(wordCounts)
+	}
+	if len(distinctive) > 0 {
+		user.Distinctive = json.RawMessage(distinctive)
+	}
+	return user, err
+}
+
+func GetUser(userId string, db *sql.DB) (UserInfo, bool, error) {
+	user, err := scanUserInfo(db.QueryRow(get_user_by_id, userId))
+	if err == sql.ErrNoRows {
+		return user, false, nil
+	}
+	if err != nil {
+		return user, false, err
+	}
+	return user, true, nil
+}
+
+func GetUsers(filter UserFilter, db *sql.DB) ([]UserInfo, string, error) {
+	users := make([]UserInfo, 0)
+	limit := pageSize(filter.Limit)
+
+	after, err := DecodeCursor(filter.Cursor)
+	if err != nil {
+		return users, "", err
+	}
+
+	var verified sql.NullBool
+	if filter.Verified != nil {
+		verified = sql.NullBool{Bool: *filter.Verified, Valid: true}
+	}
+
+	rows, err := db.Query(get_users, filter.Location, verified, filter.MinFollowers, after, limit+1)
+	if err != nil {
+		return users, "", err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		user, err := scanUserInfo(rows)
+		if err != nil {
+			return users, "", err
+		}
+		users = append(users, user)
+	}
+
+	next := ""
+	if len(users) > limit {
+		users = users[:limit]
+		next = EncodeCursor(users[limit-1].Id_str)
+	}
+
+	return users, next, rows.Err()
+}
+
+// Function returns a page of the tweets of a user, newest first, not found for unknown users.
+func GetUserTweets(userId string, filter TweetFilter, db *sql.DB) ([]TweetInfo, string, bool, error) {
+	tweets := make([]TweetInfo, 0)
+	limit := pageSize(filter.Limit)
+
+	key, err := DecodeCursor(filter.Cursor)
+	if err != nil {
+		return tweets, "", false, err
+	}
+
+	var afterId string
+	var afterTime time.Time
+	if key != "" {
+		parts := strings.SplitN(key, "|", 2)
+		if len(parts) != 2 {
+			return tweets, "", false, ErrInvalidCursor
+		}
+		afterTime, err = time.Parse(time.RFC3339Nano, parts[0])
+		if err != nil {
+			return tweets, "", false, fmt.Errorf("%w: %s", ErrInvalidCursor, err.Error())
+		}
+		afterId = parts[1]
+	}
+
+	until := filter.Until
+	if until.IsZero() {
+		until = time.Now()
+	}
+
+	rows, err := db.Query(get_user_tweets, userId, filter.Since, until, afterId, afterTime, limit+1)
+	if err != nil {
+		return tweets, "", false, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var tweet TweetInfo
+		if err := rows.Scan(&tweet.Id_str, &tweet.UserId, &tweet.Text, &tweet.Created_at, &tweet.Url, &tweet.Deleted_at); err != nil {
+			return tweets, "", false, err
+		}
+		tweets = append(tweets, tweet)
+	}
+
+	if err := rows.Err(); err != nil {
+		return tweets, "", false, err
+	}
+
+	// Users without tweets in the window and pages past the last one are empty too.
+	if len(tweets) == 0 {
+		var exists bool
+		if err := db.QueryRow(user_exists_by_id, userId).Scan(&exists); err != nil {
+			return tweets, "", false, err
+		}
+		return tweets, "", exists, nil
+	}
+
+	next := ""
+	if len(tweets) > limit {
+		tweets = tweets[:limit]
+		last := tweets[limit-1]
+		next = EncodeCursor(last.Created_at.Format(time.RFC3339Nano) + "|" + last.Id_str)
+	}
+
+	return tweets, next, true, nil
+}
+
+// Function returns a page of the friend ids of a user, not found for unknown users.
+func GetUserFriends(userId string, cursor string, limit int, db *sql.DB) ([]string, string, bool, error) {
+	friends := make([]string, 0)
+	limit = pageSize(limit)
+
+	key, err := DecodeCursor(cursor)
+	if err != nil {
+		return friends, "", false, err
+	}
+
+	var position uint64
+	if key != "" {
+		position, err = strconv.ParseUint(key, 10, 64)
+		if err != nil {
+			return friends, "", false, fmt.Errorf("%w: %s", ErrInvalidCursor, err.Error())
+		}
+	}
+
+	rows, err := db.Query(get_user_friends, userId, position, limit+1)
+	if err != nil {
+		return friends, "", false, err
+	}
+
+	defer rows.Close()
+
+	var last uint64
+	for rows.Next() {
+		var friendId string
+		if err := rows.Scan(&friendId, &position); err != nil {
+			return friends, "", false, err
+		}
+		if len(friends) < limit {
+			last = position
+		}
+		friends = append(friends, friendId)
+	}
+	if err := rows.Err(); err != nil {
+		return friends, "", false, err
+	}
+
+	next := ""
+	if len(friends) > limit {
+		friends = friends[:limit]
+		next = EncodeCursor(strconv.FormatUint(last, 10))
+	}
+
+	// Users without friends and pages past the last one are empty too.
+	if len(friends) == 0 {
+		var exists bool
+		if err := db.QueryRow(user_exists_by_id, userId).Scan(&exists); err != nil {
+			return friends, "", false, err
+		}
+		return friends, "", exists, nil
+	}
+
+	return friends, next, true, nil
+}
+
+func GetLocations(cursor string, limit int, db *sql.DB) ([]LocationRecord, string, error) {
+	locations := make([]LocationRecord, 0)
+	limit = pageSize(limit)
+
+	after, err := DecodeCursor(cursor)
+	if err != nil {
+		return locations, "", err
+	}
+
+	rows, err := db.Query(get_locations, after, limit+1)
+	if err != nil {
+		return locations, "", err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var location LocationRecord
+		var jsonLangs, jsonBlocks []byte
+		if err := rows.Scan(&location.Name, &jsonLangs, &jsonBlocks, &location.Population, &location.Users); err != nil {
+			return locations, "", err
+		}
+		if len(jsonLangs) > 0 {
+			if err := json.Unmarshal(jsonLangs, &location.Languages); err != nil {
+				return locations, "", err
+			}
+		}
+		if len(jsonBlocks) > 0 {
+			if err := json.Unmarshal(jsonBlocks, &location.RegionalBlocks); err != nil {
+				return locations, "", err
+			}
+		}
+		locations = append(locations, location)
+	}
+
+	next := ""
+	if len(locations) > limit {
+		locations = locations[:limit]
+		next = EncodeCursor(locations[limit-1].Name)
+	}
+
+	return locations, next, rows.Err()
+}
+
+func scanReport(reportType string, row interface{ Scan(...interface{}) error }) (ReportRecord, error) {
+	report := ReportRecord{Type: reportType}
+	var first, second, third []byte
+	var err error
+	switch reportType {
+	case REPORT_LOG:
+		err = row.Scan(&report.Id, &report.Kind, &report.ReportedAt, &report.WindowFrom, &report.WindowTo, &report.AppMostRequests, &first, &second, &third)
+		report.TopErrorRequests, report.TopLongestRequests, report.TopShortestRequests = first, second, third
+	case REPORT_TWEET:
+		var hashtags, mentions, domains, emojis, sentiment, growing, bots, activity []byte
+		err = row.Scan(&report.Id, &report.Kind, &report.ReportedAt, &report.WindowFrom, &report.WindowTo, &first, &second, &third,
+			&hashtags, &mentions, &domains, &emojis, &sentiment, &growing, &bots, &activity)
+		report.MostTweets, report.LargestTweets, report.MostUsedWords = first, second, third
+		report.TopHashtags, report.TopMentions, report.TopDomains, report.TopEmojis = hashtags, mentions, domains, emojis
+		report.UserSentiment, report.FastestGrowing, report.LikelyBots = sentiment, growing, bots
+		report.UserActivity = activity
+	case REPORT_LOCATION:
+		var sentiment, tweeted, locationTerms, blocTerms, activity []byte
+		err = row.Scan(&report.Id, &report.Kind, &report.ReportedAt, &report.WindowFrom, &report.WindowTo, &first, &second, &third, &report.TotalPopulation,
+			&sentiment, &tweeted, &locationTerms, &blocTerms, &activity)
+		report.TopTweetLocation, report.TopTweetRegionalBlocks, report.MostSpokenLanguages = first, second, third
+		report.LocationSentiment, report.LanguagesTweeted = sentiment, tweeted
+		report.LocationTerms, report.BlocTerms = locationTerms, blocTerms
+		report.LocationActivity = activity
+	default:
+		err = fmt.Errorf("unknown report type %q", reportType)
+	}
+	return report, err
+}
+
+func GetReport(reportType string, id uint64, db *sql.DB) (ReportRecord, bool, error) {
+	var query string
+	switch reportType {
+	case REPORT_LOG:
+		query = get_log_report_by_id
+	case REPORT_TWEET:
+		query = get_tweet_report_by_id
+	case REPORT_LOCATION:
+		query = get_location_report_by_id
+	default:
+		return ReportRecord{}, false, fmt.Errorf("unknown report type %q", reportType)
+	}
+
+	report, err := scanReport(reportType, db.QueryRow(query, id))
+	if err == sql.ErrNoRows {
+		return report, false, nil
+	}
+	if err != nil {
+		return report, false, err
+	}
+	return report, true, nil
+}
+
+func GetReports(reportType string, kind string, cursor string, limit int, db *sql.DB) ([]ReportRecord, string, error) {
+	reports := make([]ReportRecord, 0)
+	limit = pageSize(limit)
+
+	beforeId, err := decodeIdCursor(cursor)
+	if err != nil {
+		return reports, "", err
+	}
+
+	var query string
+	switch reportType {
+	case REPORT_LOG:
+		query = get_log_reports
+	case REPORT_TWEET:
+		query = get_tweet_reports
+	case REPORT_LOCATION:
+		query = get_location_reports
+	default:
+		return reports, "", fmt.Errorf("unknown report type %q", reportType)
+	}
+
+	rows, err := db.Query(query, kind, beforeId, limit+1)
+	if err != nil {
+		return reports, "", err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		report, err := scanReport(reportType, rows)
+		if err != nil {
+			return reports, "", err
+		}
+		reports = append(reports, report)
+	}
+
+	next := ""
+	if len(reports) > limit {
+		reports = reports[:limit]
+		next = encodeIdCursor(reports[limit-1].Id)
+	}
+
+	return reports, next, rows.Err()
+}
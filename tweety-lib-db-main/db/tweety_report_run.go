@@ -0,0 +1,268 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	pq "github.com/lib/pq"
+)
+
+const (
+	REPORT_RUN_RUNNING = "RUNNING"
+	REPORT_RUN_DONE    = "DONE"
+	REPORT_RUN_FAILED  = "FAILED"
+
+	REPORT_BACKFILL_PENDING = "PENDING"
+	REPORT_BACKFILL_DONE    = "DONE"
+)
+
+type ReportRun struct {
+	Id           int64
+	Kind         string
+	ScheduledFor time.Time
+	WindowFrom   time.Time
+	WindowTo     time.Time
+	Status       string
+	Error        string
+}
+
+type BackfillWindow struct {
+	From  time.Time `json:"from"`
+	To    time.Time `json:"to"`
+	Error string    `json:"error,omitempty"`
+}
+
+// Backfill of the reports of one kind for the scheduled windows inside [From, To].
+// The scheduler makes its windows in order, DoneThrough is the last one made.
+// Remade reports are delivered only with Deliver.
+type ReportBackfill struct {
+	Id          uint64           `json:"id"`
+	Kind        string           `json:"kind"`
+	Reports     []string         `json:"reports"`
+	From        time.Time        `json:"from"`
+	To          time.Time        `json:"to"`
+	Deliver     bool             `json:"deliver"`
+	DoneThrough *time.Time       `json:"done_through,omitempty"`
+	Windows     int              `json:"windows"`
+	Failed      []BackfillWindow `json:"failed"`
+	Status      string           `json:"status"`
+	CreatedAt   time.Time        `json:"created_at"`
+	FinishedAt  *time.Time       `json:"finished_at,omitempty"`
+}
+
+const (
+	// Slots after the last finished run are due, failed and abandoned ones
+	// before it are found by get_retry_report_runs.
+	get_last_report_run = `SELECT scheduled_for
+	FROM PUBLIC.report_run
+	WHERE kind = $1 AND status = 'DONE'
+	ORDER BY scheduled_for DESC
+	FETCH FIRST 1 ROWS ONLY`
+
+	get_retry_report_runs = `SELECT scheduled_for
+	FROM PUBLIC.report_run
+	WHERE kind = $1 AND ((status = 'FAILED' AND attempts < $2) OR (status = 'RUNNING' AND started_at < $3))
+	ORDER BY scheduled_for`
+
+	// A failed run is retried until it made maxAttempts attempts, a run still
+	// RUNNING after the timeout was abandoned by a crashed replica and is taken over.
+	start_report_run = `INSERT INTO public.report_run (
+		kind,
+		scheduled_for,
+		window_from,
+		window_to,
+		status,
+		started_at)
+		VALUES ($1, $2, $3, $4, 'RUNNING', NOW())
+		ON CONFLICT (kind, scheduled_for)
+		DO UPDATE SET status = 'RUNNING', error = NULL, attempts = report_run.attempts + 1, started_at = NOW(), finished_at = NULL
+		WHERE (report_run.status = 'FAILED' AND report_run.attempts < $5) OR (report_run.status = 'RUNNING' AND report_run.started_at < $6)
+		RETURNING id`
+
+	finish_report_run = `UPDATE public.report_run
+	SET status = $2, error = $3, finished_at = NOW()
+	WHERE id = $1`
+
+	report_backfill_columns = `id, kind, reports, range_from, range_to, deliver, done_through, windows, failed, status, created_at, finished_at`
+
+	insert_report_backfill = `INSERT INTO public.report_backfill (
+		kind,
+		reports,
+		range_from,
+		range_to,
+		deliver)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING ` + report_backfill_columns
+
+	get_report_backfill = `SELECT ` + report_backfill_columns + `
+	FROM PUBLIC.report_backfill
+	WHERE id = $1`
+
+	get_pending_report_backfills = `SELECT ` + report_backfill_columns + `
+	FROM PUBLIC.report_backfill
+	WHERE status = 'PENDING'
+	ORDER BY id`
+
+	advance_report_backfill = `UPDATE public.report_backfill
+	SET done_through = $2, windows = windows + $3, failed = failed || $4::JSONB,
+		status = CASE WHEN $5 THEN 'DONE' ELSE status END, finished_at = CASE WHEN $5 THEN NOW() END
+	WHERE id = $1`
+
+	try_advisory_lock = `SELECT pg_try_advisory_lock($1)`
+
+	advisory_unlock = `SELECT pg_advisory_unlock($1)`
+)
+
+// Function returns the slot of the last finished run of kind.
+func GetLastReportRun(kind string, db *sql.DB) (time.Time, bool, error) {
+	var scheduledFor time.Time
+
+	err := db.QueryRow(get_last_report_run, kind).Scan(&scheduledFor)
+	if err == sql.ErrNoRows {
+		return scheduledFor, false, nil
+	}
+	if err != nil {
+		return scheduledFor, false, err
+	}
+
+	return scheduledFor, true, nil
+}
+
+// Function returns slots of runs of kind to make again, failed ones with fewer than
+// maxAttempts attempts and ones still running since before staleBefore.
+func GetRetryReportRuns(kind string, maxAttempts int, staleBefore time.Time, db *sql.DB) ([]time.Time, error) {
+	var slots []time.Time
+
+	rows, err := db.Query(get_retry_report_runs, kind, maxAttempts, staleBefore)
+	if err != nil {
+		return slots, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var scheduledFor time.Time
+		if err := rows.Scan(&scheduledFor); err != nil {
+			return slots, err
+		}
+		slots = append(slots, scheduledFor)
+	}
+
+	return slots, rows.Err()
+}
+
+// Function registers a run before it starts. It returns false when the same
+// run is done, running since staleBefore or later, e.g. on another replica,
+// or failed maxAttempts times.
+func StartReportRun(run *ReportRun, maxAttempts int, staleBefore time.Time, db *sql.DB) (bool, error) {
+	err := db.QueryRow(start_report_run, run.Kind, run.ScheduledFor, run.WindowFrom, run.WindowTo, maxAttempts, staleBefore).Scan(&run.Id)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	run.Status = REPORT_RUN_RUNNING
+	return true, nil
+}
+
+func FinishReportRun(run *ReportRun, runErr error, db *sql.DB) error {
+	run.Status = REPORT_RUN_DONE
+	var errMsg sql.NullString
+	if runErr != nil {
+		run.Status = REPORT_RUN_FAILED
+		run.Error = runErr.Error()
+		errMsg = sql.NullString{String: run.Error, Valid: true}
+	}
+
+	_, err := db.Exec(finish_report_run, run.Id, run.Status, errMsg)
+	return err
+}
+
+// Function tries to take a session level advisory lock. The lock lives as long as
+// the returned connection, which must be given back with ReleaseAdvisoryLock.
+func TryAdvisoryLock(ctx context.Context, key int64, db *sql.DB) (*sql.Conn, bool, error) {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+
+	var locked bool
+	err = conn.QueryRowContext(ctx, try_advisory_lock, key).Scan(&locked)
+	if err != nil || !locked {
+		conn.Close()
+		return nil, false, err
+	}
+
+	return conn, true, nil
+}
+
+func ReleaseAdvisoryLock(ctx context.Context, key int64, conn *sql.Conn) error {
+	defer conn.Close()
+	_, err := conn.ExecContext(ctx, advisory_unlock, key)
+	return err
+}
+
+func scanReportBackfill(row interface{ Scan(...interface{}) error }) (ReportBackfill, error) {
+	var backfill ReportBackfill
+	var failed []byte
+	err := row.Scan(&backfill.Id, &backfill.Kind, pq.Array(&backfill.Reports), &backfill.From, &backfill.To, &backfill.Deliver, &backfill.DoneThrough,
+		&backfill.Windows, &failed, &backfill.Status, &backfill.CreatedAt, &backfill.FinishedAt)
+	if err != nil {
+		return backfill, err
+	}
+	err = json.Unmarshal(failed, &backfill.Failed)
+	return backfill, err
+}
+
+// Function stores a backfill for the scheduler to make.
+func CreateReportBackfill(backfill ReportBackfill, db *sql.DB) (ReportBackfill, error) {
+	return scanReportBackfill(db.QueryRow(insert_report_backfill, backfill.Kind, textArray(backfill.Reports), backfill.From, backfill.To, backfill.Deliver))
+}
+
+func GetReportBackfill(id uint64, db *sql.DB) (ReportBackfill, bool, error) {
+	backfill, err := scanReportBackfill(db.QueryRow(get_report_backfill, id))
+	if err == sql.ErrNoRows {
+		return backfill, false, nil
+	}
+	return backfill, err == nil, err
+}
+
+func GetPendingReportBackfills(db *sql.DB) ([]ReportBackfill, error) {
+	backfills := make([]ReportBackfill, 0)
+
+	rows, err := db.Query(get_pending_report_backfills)
+	if err != nil {
+		return backfills, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		backfill, err := scanReportBackfill(rows)
+		if err != nil {
+			return backfills, err
+		}
+		backfills = append(backfills, backfill)
+	}
+
+	return backfills, rows.Err()
+}
+
+// Function records that the windows of a backfill up to doneThrough were made,
+// windows of them in this step with failed ones among them.
+func AdvanceReportBackfill(id uint64, doneThrough time.Time, windows int, failed []BackfillWindow, finished bool, db *sql.DB) error {
+	if failed == nil {
+		failed = []BackfillWindow{}
+	}
+	jsonFailed, err := json.Marshal(failed)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(advance_report_backfill, id, doneThrough, windows, jsonFailed, finished)
+	return err
+}
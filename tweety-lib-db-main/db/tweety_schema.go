@@ -0,0 +1,230 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// Tables created by Tweety services themselves. The original tables
+// (user, tweet, log, location and the report tables) are expected to exist.
+var migrations = []string{
+	`CREATE TABLE IF NOT EXISTS public.report_run (
+		id BIGSERIAL PRIMARY KEY,
+		kind TEXT NOT NULL,
+		scheduled_for TIMESTAMPTZ NOT NULL,
+		window_from TIMESTAMPTZ NOT NULL,
+		window_to TIMESTAMPTZ NOT NULL,
+		status TEXT NOT NULL,
+		error TEXT,
+		attempts INT NOT NULL DEFAULT 1,
+		started_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		finished_at TIMESTAMPTZ,
+		UNIQUE (kind, scheduled_for)
+	);`,
+	`CREATE INDEX IF NOT EXISTS report_run_retry_idx ON public.report_run (kind, scheduled_for) WHERE status <> 'DONE';`,
+	`ALTER TABLE public.log_report
+		ADD COLUMN IF NOT EXISTS window_from TIMESTAMPTZ,
+		ADD COLUMN IF NOT EXISTS window_to TIMESTAMPTZ;`,
+	`ALTER TABLE public.tweet_report
+		ADD COLUMN IF NOT EXISTS window_from TIMESTAMPTZ,
+		ADD COLUMN IF NOT EXISTS window_to TIMESTAMPTZ;`,
+	`ALTER TABLE public.location_report
+		ADD COLUMN IF NOT EXISTS window_from TIMESTAMPTZ,
+		ADD COLUMN IF NOT EXISTS window_to TIMESTAMPTZ;`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS log_report_window_key ON public.log_report (type, window_from, window_to);`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS tweet_report_window_key ON public.tweet_report (type, window_from, window_to);`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS location_report_window_key ON public.location_report (type, window_from, window_to);`,
+	`CREATE TABLE IF NOT EXISTS public.report_delivery (
+		id BIGSERIAL PRIMARY KEY,
+		report_type TEXT NOT NULL,
+		report_id BIGINT NOT NULL,
+		channel TEXT NOT NULL,
+		webhook TEXT,
+		target TEXT NOT NULL,
+		format TEXT NOT NULL,
+		status TEXT NOT NULL,
+		attempts INT NOT NULL DEFAULT 0,
+		last_error TEXT,
+		next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		delivered_at TIMESTAMPTZ,
+		UNIQUE (report_type, report_id, channel, target)
+	);`,
+	`CREATE INDEX IF NOT EXISTS report_delivery_pending_idx ON public.report_delivery (next_attempt_at) WHERE status = 'PENDING';`,
+	`CREATE TABLE IF NOT EXISTS public.tweet_hashtag (
+		tweet_id_str TEXT NOT NULL,
+		hashtag TEXT NOT NULL,
+		created_at TIMESTAMPTZ,
+		PRIMARY KEY (tweet_id_str, hashtag)
+	);`,
+	`CREATE INDEX IF NOT EXISTS tweet_hashtag_hashtag_idx ON public.tweet_hashtag (hashtag);`,
+	`CREATE TABLE IF NOT EXISTS public.tweet_mention (
+		tweet_id_str TEXT NOT NULL,
+		mentioned_id_str TEXT NOT NULL,
+		screen_name TEXT NOT NULL,
+		created_at TIMESTAMPTZ,
+		PRIMARY KEY (tweet_id_str, mentioned_id_str)
+	);`,
+	`CREATE INDEX IF NOT EXISTS tweet_mention_mentioned_idx ON public.tweet_mention (mentioned_id_str);`,
+	`CREATE TABLE IF NOT EXISTS public.tweet_url (
+		tweet_id_str TEXT NOT NULL,
+		url TEXT NOT NULL,
+		domain TEXT NOT NULL,
+		kind TEXT NOT NULL,
+		created_at TIMESTAMPTZ,
+		PRIMARY KEY (tweet_id_str, url)
+	);`,
+	`CREATE INDEX IF NOT EXISTS tweet_url_domain_idx ON public.tweet_url (domain);`,
+	`ALTER TABLE public.tweet_report
+		ADD COLUMN IF NOT EXISTS top_hashtags JSONB,
+		ADD COLUMN IF NOT EXISTS top_mentions JSONB,
+		ADD COLUMN IF NOT EXISTS top_domains JSONB,
+		ADD COLUMN IF NOT EXISTS top_emojis JSONB;`,
+	`ALTER TABLE public.tweet ADD COLUMN IF NOT EXISTS sentiment DOUBLE PRECISION;`,
+	`ALTER TABLE public.tweet_report ADD COLUMN IF NOT EXISTS user_sentiment JSONB;`,
+	`ALTER TABLE public.location_report ADD COLUMN IF NOT EXISTS location_sentiment JSONB;`,
+	`ALTER TABLE public.tweet
+		ADD COLUMN IF NOT EXISTS language TEXT,
+		ADD COLUMN IF NOT EXISTS language_confidence DOUBLE PRECISION;`,
+	`ALTER TABLE public.location_report ADD COLUMN IF NOT EXISTS languages_tweeted JSONB;`,
+	`CREATE TABLE IF NOT EXISTS public.corpus_shard (
+		shard INT PRIMARY KEY,
+		documents BIGINT NOT NULL DEFAULT 0
+	);`,
+	`CREATE TABLE IF NOT EXISTS public.document_frequency (
+		term TEXT PRIMARY KEY,
+		documents BIGINT NOT NULL
+	);`,
+	`ALTER TABLE public.user ADD COLUMN IF NOT EXISTS distinctive_terms JSONB;`,
+	`ALTER TABLE public.location_report
+		ADD COLUMN IF NOT EXISTS location_distinctive_terms JSONB,
+		ADD COLUMN IF NOT EXISTS bloc_distinctive_terms JSONB;`,
+	`ALTER TABLE public.user ADD COLUMN IF NOT EXISTS last_counted_at TIMESTAMPTZ;`,
+	`CREATE TABLE IF NOT EXISTS public.image_blob (
+		sha256 TEXT PRIMARY KEY,
+		mime_type TEXT NOT NULL,
+		size BIGINT NOT NULL,
+		data BYTEA NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	);`,
+	`CREATE TABLE IF NOT EXISTS public.user_image (
+		user_id_str TEXT NOT NULL,
+		kind TEXT NOT NULL,
+		version INTEGER NOT NULL,
+		sha256 TEXT NOT NULL REFERENCES public.image_blob (sha256),
+		source_url TEXT,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		PRIMARY KEY (user_id_str, kind, version)
+	);`,
+	`ALTER TABLE public.image_blob
+		ADD COLUMN IF NOT EXISTS dhash BIGINT,
+		ADD COLUMN IF NOT EXISTS dhash_checked BOOLEAN NOT NULL DEFAULT FALSE;`,
+	`CREATE INDEX IF NOT EXISTS image_blob_unchecked_idx ON public.image_blob (sha256) WHERE NOT dhash_checked;`,
+	`ALTER TABLE public.user_image ADD COLUMN IF NOT EXISTS last_seen_at TIMESTAMPTZ NOT NULL DEFAULT NOW();`,
+	`CREATE TABLE IF NOT EXISTS public.user_snapshot (
+		id BIGSERIAL PRIMARY KEY,
+		user_id_str TEXT NOT NULL,
+		name TEXT NOT NULL,
+		screen_name TEXT NOT NULL,
+		location TEXT NOT NULL,
+		url TEXT NOT NULL,
+		description TEXT NOT NULL,
+		protected BOOLEAN NOT NULL,
+		verified BOOLEAN NOT NULL,
+		changed_fields TEXT[] NOT NULL,
+		captured_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	);`,
+	`CREATE INDEX IF NOT EXISTS user_snapshot_user_idx ON public.user_snapshot (user_id_str, captured_at);`,
+	`CREATE TABLE IF NOT EXISTS public.user_count (
+		user_id_str TEXT NOT NULL,
+		followers_count BIGINT NOT NULL,
+		friends_count BIGINT NOT NULL,
+		statuses_count BIGINT NOT NULL,
+		observed_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	);`,
+	`CREATE INDEX IF NOT EXISTS user_count_user_idx ON public.user_count (user_id_str, observed_at);`,
+	`CREATE INDEX IF NOT EXISTS user_count_observed_idx ON public.user_count (observed_at);`,
+	`ALTER TABLE public.tweet_report ADD COLUMN IF NOT EXISTS fastest_growing JSONB;`,
+	`ALTER TABLE public.tweet ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMPTZ;`,
+	`ALTER TABLE public.user
+		ADD COLUMN IF NOT EXISTS status TEXT,
+		ADD COLUMN IF NOT EXISTS status_changed_at TIMESTAMPTZ;`,
+	`CREATE TABLE IF NOT EXISTS public.user_status_change (
+		id BIGSERIAL PRIMARY KEY,
+		user_id_str TEXT NOT NULL,
+		from_status TEXT,
+		to_status TEXT NOT NULL,
+		changed_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	);`,
+	`CREATE INDEX IF NOT EXISTS user_status_change_user_idx ON public.user_status_change (user_id_str, changed_at);`,
+	`ALTER TABLE public.user
+		ADD COLUMN IF NOT EXISTS bot_score DOUBLE PRECISION,
+		ADD COLUMN IF NOT EXISTS bot_breakdown JSONB,
+		ADD COLUMN IF NOT EXISTS bot_scored_at TIMESTAMPTZ;`,
+	`ALTER TABLE public.tweet_report ADD COLUMN IF NOT EXISTS likely_bots JSONB;`,
+	`ALTER TABLE public.location ADD COLUMN IF NOT EXISTS timezones JSONB;`,
+	`ALTER TABLE public.tweet_report ADD COLUMN IF NOT EXISTS user_activity JSONB;`,
+	`ALTER TABLE public.location_report ADD COLUMN IF NOT EXISTS location_activity JSONB;`,
+	`CREATE TABLE IF NOT EXISTS public.watchlist (
+		id BIGSERIAL PRIMARY KEY,
+		name TEXT NOT NULL,
+		keywords TEXT[] NOT NULL DEFAULT '{}',
+		regexes TEXT[] NOT NULL DEFAULT '{}',
+		hashtags TEXT[] NOT NULL DEFAULT '{}',
+		scope TEXT NOT NULL DEFAULT 'all',
+		location TEXT,
+		user_ids TEXT[] NOT NULL DEFAULT '{}',
+		webhook TEXT,
+		enabled BOOLEAN NOT NULL DEFAULT TRUE,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	);`,
+	`CREATE TABLE IF NOT EXISTS public.alert (
+		id BIGSERIAL PRIMARY KEY,
+		watchlist_id BIGINT NOT NULL REFERENCES public.watchlist (id) ON DELETE CASCADE,
+		tweet_id_str TEXT NOT NULL,
+		user_id_str TEXT NOT NULL,
+		text TEXT NOT NULL,
+		matches TEXT[] NOT NULL,
+		webhook TEXT,
+		target TEXT,
+		status TEXT,
+		attempts INT NOT NULL DEFAULT 0,
+		last_error TEXT,
+		next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		delivered_at TIMESTAMPTZ,
+		UNIQUE (watchlist_id, tweet_id_str)
+	);`,
+	`CREATE INDEX IF NOT EXISTS alert_user_idx ON public.alert (user_id_str, id);`,
+	`CREATE INDEX IF NOT EXISTS alert_pending_idx ON public.alert (next_attempt_at) WHERE status = 'PENDING';`,
+	`CREATE INDEX IF NOT EXISTS tweet_user_tweet_id_idx ON public.tweet (user_id_str, tweet_id);`,
+	`CREATE INDEX IF NOT EXISTS tweet_created_at_idx ON public.tweet (created_at);`,
+	`CREATE TABLE IF NOT EXISTS public.report_backfill (
+		id BIGSERIAL PRIMARY KEY,
+		kind TEXT NOT NULL,
+		reports TEXT[] NOT NULL,
+		range_from TIMESTAMPTZ NOT NULL,
+		range_to TIMESTAMPTZ NOT NULL,
+		deliver BOOLEAN NOT NULL DEFAULT FALSE,
+		done_through TIMESTAMPTZ,
+		windows INT NOT NULL DEFAULT 0,
+		failed JSONB NOT NULL DEFAULT '[]',
+		status TEXT NOT NULL DEFAULT 'PENDING',
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		finished_at TIMESTAMPTZ
+	);`,
+	`CREATE INDEX IF NOT EXISTS user_unscored_idx ON public.user (id_str) WHERE bot_scored_at IS NULL AND name IS NOT NULL;`,
+	// Images of legacy zips are imported in the background.
+	`ALTER TABLE public.user ADD COLUMN IF NOT EXISTS images_imported BOOLEAN NOT NULL DEFAULT FALSE;`,
+	`CREATE INDEX IF NOT EXISTS user_legacy_images_idx ON public.user (id_str) WHERE images IS NOT NULL AND NOT images_imported;`,
+}
+
+func MigrateDB(db *sql.DB) error {
+	for i, migration := range migrations {
+		if _, err := db.Exec(migration); err != nil {
+			return fmt.Errorf("migration %d failed: %s", i+1, err.Error())
+		}
+	}
+	return nil
+}
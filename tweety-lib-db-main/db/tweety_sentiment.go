@@ -0,0 +1,70 @@
+package db
+
+import (
+	"database/sql"
+	"time"
+)
+
+const (
+	TOP_SENTIMENT_ROWS = 25
+)
+
+// Average compound sentiment of the tweets of a user or location.
+type SentimentAverage struct {
+	Name    string  `json:"name"`
+	Average float64 `json:"average"`
+	Tweets  uint64  `json:"tweets"`
+}
+
+const (
+	get_user_sentiment_in_period = `SELECT B.name, AVG(A.sentiment), COUNT(*) tweet_count
+	FROM PUBLIC.tweet A
+	JOIN PUBLIC.user B
+	ON A.user_id_str = B.id_str
+	WHERE A.created_at >= $1 AND A.created_at < $2 AND A.sentiment IS NOT NULL AND B.name IS NOT NULL
+	GROUP BY B.id_str, B.name
+	ORDER BY tweet_count DESC, B.name
+	LIMIT $3`
+
+	get_location_sentiment_in_period = `SELECT A.name, AVG(C.sentiment), COUNT(*) tweet_count
+	FROM PUBLIC.location A
+	JOIN PUBLIC.user B
+	ON A.name = B.location_name
+	JOIN PUBLIC.tweet C
+	ON B.id_str = C.user_id_str
+	WHERE C.created_at >= $1 AND C.created_at < $2 AND C.sentiment IS NOT NULL
+	GROUP BY A.name
+	ORDER BY tweet_count DESC, A.name
+	LIMIT $3`
+)
+
+func getSentimentInPeriod(query string, from time.Time, to time.Time, limit int, db *sql.DB) ([]SentimentAverage, error) {
+	averages := make([]SentimentAverage, 0)
+
+	rows, err := db.Query(query, from, to, limit)
+	if err != nil {
+		return averages, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var average SentimentAverage
+		if err := rows.Scan(&average.Name, &average.Average, &average.Tweets); err != nil {
+			return averages, err
+		}
+		averages = append(averages, average)
+	}
+
+	return averages, rows.Err()
+}
+
+// Function returns the average sentiment of the most active users. Tweets saved
+// before sentiment was scored are left out.
+func GetUserSentimentInPeriod(from time.Time, to time.Time, limit int, db *sql.DB) ([]SentimentAverage, error) {
+	return getSentimentInPeriod(get_user_sentiment_in_period, from, to, limit, db)
+}
+
+func GetLocationSentimentInPeriod(from time.Time, to time.Time, limit int, db *sql.DB) ([]SentimentAverage, error) {
+	return getSentimentInPeriod(get_location_sentiment_in_period, from, to, limit, db)
+}
@@ -0,0 +1,202 @@
+package db
+
+import (
+	"database/sql"
+	"strconv"
+	"time"
+
+	pq "github.com/lib/pq"
+	com "gitlab.com/leapbit-practice/tweety-lib-communication/comms"
+)
+
+// Profile fields of a user tracked in snapshots. Counts change all the time
+// and are left out.
+type UserProfile struct {
+	Name        string `json:"name"`
+	Screen_name string `json:"screen_name"`
+	Location    string `json:"location"`
+	URL         string `json:"url"`
+	Description string `json:"description"`
+	Protected   bool   `json:"protected"`
+	Verified    bool   `json:"verified"`
+}
+
+type FieldChange struct {
+	Field string `json:"field"`
+	From  string `json:"from"`
+	To    string `json:"to"`
+}
+
+// One snapshot of a user's timeline. Changes compare it with the snapshot
+// before it and are empty for the first one.
+type TimelineEntry struct {
+	CapturedAt time.Time     `json:"captured_at"`
+	Changes    []FieldChange `json:"changes"`
+	Profile    UserProfile   `json:"profile"`
+}
+
+// Tracked fields in the order changes are listed.
+var trackedFields = []struct {
+	name  string
+	value func(UserProfile) string
+}{
+	{"name", func(p UserProfile) string { return p.Name }},
+	{"screen_name", func(p UserProfile) string { return p.Screen_name }},
+	{"location", func(p UserProfile) string { return p.Location }},
+	{"url", func(p UserProfile) string { return p.URL }},
+	{"description", func(p UserProfile) string { return p.Description }},
+	{"protected", func(p UserProfile) string { return strconv.FormatBool(p.Protected) }},
+	{"verified", func(p UserProfile) string { return strconv.FormatBool(p.Verified) }},
+}
+
+const (
+	get_last_user_snapshot = `SELECT name, screen_name, location, url, description, protected, verified
+	FROM PUBLIC.user_snapshot
+	WHERE user_id_str = $1
+	ORDER BY captured_at DESC, id DESC
+	FETCH FIRST 1 ROWS ONLY`
+
+	insert_user_snapshot = `INSERT INTO public.user_snapshot (
+		user_id_str,
+		name,
+		screen_name,
+		location,
+		url,
+		description,
+		protected,
+		verified,
+		changed_fields)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`
+
+	get_user_snapshots = `SELECT name, screen_name, location, url, description, protected, verified, captured_at
+	FROM PUBLIC.user_snapshot
+	WHERE user_id_str = $1
+	ORDER BY captured_at, id`
+)
+
+func profileOf(user com.ReqUser) UserProfile {
+	return UserProfile{
+		Name:        user.Name,
+		Screen_name: user.Screen_name,
+		Location:    user.Location,
+		URL:         user.URL,
+		Description: user.Description,
+		Protected:   user.Protected,
+		Verified:    user.Verified,
+	}
+}
+
+func scanUserProfile(row interface{ Scan(...interface{}) error }, extra ...interface{}) (UserProfile, error) {
+	var profile UserProfile
+	dest := append([]interface{}{&profile.Name, &profile.Screen_name, &profile.Location, &profile.URL,
+		&profile.Description, &profile.Protected, &profile.Verified}, extra...)
+	err := row.Scan(dest...)
+	return profile, err
+}
+
+// Function lists the tracked fields that differ between two profiles.
+func profileChanges(from UserProfile, to UserProfile) []FieldChange {
+	var changes []FieldChange
+	for _, field := range trackedFields {
+		if before, after := field.value(from), field.value(to); before != after {
+			changes = append(changes, FieldChange{Field: field.name, From: before, To: after})
+		}
+	}
+	return changes
+}
+
+func snapshotUserProfile(userId string, profile UserProfile, tx *sql.Tx) ([]string, error) {
+	var changed []string
+
+	last, err := scanUserProfile(tx.QueryRow(get_last_user_snapshot, userId))
+	switch {
+	case err == sql.ErrNoRows:
+		for _, field := range trackedFields {
+			changed = append(changed, field.name)
+		}
+	case err != nil:
+		return nil, err
+	default:
+		for _, change := range profileChanges(last, profile) {
+			changed = append(changed, change.Field)
+		}
+		if len(changed) == 0 {
+			return nil, nil
+		}
+	}
+
+	_, err = tx.Exec(insert_user_snapshot, userId, profile.Name, profile.Screen_name, profile.Location, profile.URL,
+		profile.Description, profile.Protected, profile.Verified, pq.Array(changed))
+	return changed, err
+}
+
+// Function returns the profile timeline of a user, oldest first. With field
+// only snapshots changing it are returned, since and until bound capture times
+// when they are not zero. Unknown users are not found.
+func GetUserTimeline(userId string, field string, since time.Time, until time.Time, db *sql.DB) ([]TimelineEntry, bool, error) {
+	timeline := make([]TimelineEntry, 0)
+
+	rows, err := db.Query(get_user_snapshots, userId)
+	if err != nil {
+		return timeline, false, err
+	}
+
+	defer rows.Close()
+
+	var previous *UserProfile
+	for rows.Next() {
+		var capturedAt time.Time
+		profile, err := scanUserProfile(rows, &capturedAt)
+		if err != nil {
+			return timeline, false, err
+		}
+
+		entry := TimelineEntry{CapturedAt: capturedAt, Changes: make([]FieldChange, 0), Profile: profile}
+		if previous != nil {
+			entry.Changes = append(entry.Changes, profileChanges(*previous, profile)...)
+		}
+		previous = &profile
+
+		if !since.IsZero() && capturedAt.Before(since) || !until.IsZero() && !capturedAt.Before(until) {
+			continue
+		}
+		if field != "" && !hasChange(entry.Changes, field) {
+			continue
+		}
+		timeline = append(timeline, entry)
+	}
+
+	if err := rows.Err(); err != nil {
+		return timeline, false, err
+	}
+
+	// Users saved before snapshots were kept have none.
+	if previous == nil {
+		var exists bool
+		if err := db.QueryRow(user_exists_by_id, userId).Scan(&exists); err != nil {
+			return timeline, false, err
+		}
+		return timeline, exists, nil
+	}
+
+	return timeline, true, nil
+}
+
+func hasChange(changes []FieldChange, field string) bool {
+	for _, change := range changes {
+		if change.Field == field {
+			return true
+		}
+	}
+	return false
+}
+
+// Function tells whether field is tracked in user snapshots.
+func IsTrackedField(field string) bool {
+	for _, tracked := range trackedFields {
+		if tracked.name == field {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,166 @@
+package db
+
+import (
+	"database/sql"
+	"strconv"
+	"time"
+
+	pq "github.com/lib/pq"
+	com "gitlab.com/leapbit-practice/tweety-lib-communication/comms"
+)
+
+// A change of the account status of a user. From is empty for users whose
+// first known status was not active.
+type StatusChange struct {
+	From      string    `json:"from"`
+	To        string    `json:"to"`
+	ChangedAt time.Time `json:"changed_at"`
+}
+
+const (
+	// Ids are compared on the numeric tweet_id, they do not sort as text.
+	mark_deleted_tweets = `UPDATE public.tweet
+		SET deleted_at = NOW()
+		WHERE user_id_str = $1 AND deleted_at IS NULL
+		AND tweet_id BETWEEN $2 AND $3
+		AND NOT (tweet_id_str = ANY($4))
+		RETURNING tweet_id_str`
+
+	restore_deleted_tweets = `UPDATE public.tweet
+		SET deleted_at = NULL
+		WHERE user_id_str = $1 AND deleted_at IS NOT NULL AND tweet_id_str = ANY($2)
+		RETURNING tweet_id_str`
+
+	get_user_status = `SELECT COALESCE(status, ''), status_changed_at
+	FROM PUBLIC.user
+	WHERE id_str = $1
+	FOR UPDATE`
+
+	set_user_status = `INSERT INTO public.user (id_str, status, status_changed_at, last_modified)
+		VALUES ($1, $2, NOW(), NOW())
+		ON CONFLICT (id_str)
+		DO UPDATE SET status = $2, status_changed_at = NOW(), last_modified = NOW()
+		RETURNING status_changed_at`
+
+	insert_user_status_change = `INSERT INTO public.user_status_change (user_id_str, from_status, to_status)
+		VALUES ($1, NULLIF($2, ''), $3)`
+
+	get_user_status_changes = `SELECT COALESCE(from_status, ''), to_status, changed_at
+	FROM PUBLIC.user_status_change
+	WHERE user_id_str = $1
+	ORDER BY changed_at, id`
+)
+
+func scanTweetIds(rows *sql.Rows, err error) ([]string, error) {
+	ids := make([]string, 0)
+	if err != nil {
+		return ids, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return ids, err
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, rows.Err()
+}
+
+// Function reconciles the stored tweets of a user with the latest ones fetched
+// from Twitter. Stored tweets with ids from oldestId to newestId missing from
+// tweetIds are marked deleted, deleted ones found again are restored.
+func ReconcileTweets(userId string, oldestId string, newestId string, tweetIds []string, db *sql.DB) (com.RespTweetWindow, error) {
+	var window com.RespTweetWindow
+
+	oldest, err := strconv.ParseInt(oldestId, 10, 64)
+	if err != nil {
+		return window, err
+	}
+	newest, err := strconv.ParseInt(newestId, 10, 64)
+	if err != nil {
+		return window, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return window, err
+	}
+
+	window.Deleted, err = scanTweetIds(tx.Query(mark_deleted_tweets, userId, oldest, newest, pq.Array(tweetIds)))
+	if err != nil {
+		tx.Rollback()
+		return window, err
+	}
+
+	window.Restored, err = scanTweetIds(tx.Query(restore_deleted_tweets, userId, pq.Array(tweetIds)))
+	if err != nil {
+		tx.Rollback()
+		return window, err
+	}
+
+	return window, tx.Commit()
+}
+
+// Function stores the account status of a user and records a change when it
+// differs from the stored one. Users without a stored status count as active.
+func SetUserStatus(userId string, status string, db *sql.DB) (com.RespUserStatus, error) {
+	resp := com.RespUserStatus{Status: status}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return resp, err
+	}
+
+	var stored string
+	err = tx.QueryRow(get_user_status, userId).Scan(&stored, &resp.ChangedAt)
+	if err != nil && err != sql.ErrNoRows {
+		tx.Rollback()
+		return resp, err
+	}
+
+	if stored == status {
+		return resp, tx.Commit()
+	}
+
+	if err := tx.QueryRow(set_user_status, userId, status).Scan(&resp.ChangedAt); err != nil {
+		tx.Rollback()
+		return resp, err
+	}
+
+	// Being active is not news for users seen the first time.
+	if stored != "" || status != com.USER_ACTIVE {
+		resp.Changed = true
+		if _, err := tx.Exec(insert_user_status_change, userId, stored, status); err != nil {
+			tx.Rollback()
+			return resp, err
+		}
+	}
+
+	return resp, tx.Commit()
+}
+
+// Function returns the account status changes of a user, oldest first.
+func GetUserStatusChanges(userId string, db *sql.DB) ([]StatusChange, error) {
+	changes := make([]StatusChange, 0)
+
+	rows, err := db.Query(get_user_status_changes, userId)
+	if err != nil {
+		return changes, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var change StatusChange
+		if err := rows.Scan(&change.From, &change.To, &change.ChangedAt); err != nil {
+			return changes, err
+		}
+		changes = append(changes, change)
+	}
+
+	return changes, rows.Err()
+}
@@ -0,0 +1,309 @@
+package db
+
+import (
+	"database/sql"
+	"time"
+
+	pq "github.com/lib/pq"
+)
+
+const (
+	WATCH_ALL      = "all"
+	WATCH_LOCATION = "location"
+	WATCH_USERS    = "users"
+)
+
+// Keywords, regexes and hashtags a tweet is matched against. Scope limits the
+// users it applies to, to users at Location or with an id in UserIds. Alerts
+// of a watchlist with Webhook are also sent to the configured webhook of that name.
+type Watchlist struct {
+	Id        uint64    `json:"id"`
+	Name      string    `json:"name"`
+	Keywords  []string  `json:"keywords"`
+	Regexes   []string  `json:"regexes"`
+	Hashtags  []string  `json:"hashtags"`
+	Scope     string    `json:"scope"`
+	Location  string    `json:"location,omitempty"`
+	UserIds   []string  `json:"user_ids,omitempty"`
+	Webhook   string    `json:"webhook,omitempty"`
+	Enabled   bool      `json:"enabled"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// A tweet matching a watchlist. Matches lists what matched as kind:term.
+// Alerts of watchlists without a webhook have no Status and are only stored,
+// the others are sent to the webhook named Webhook like report deliveries.
+// Target is its URL when the alert was raised.
+type Alert struct {
+	Id            uint64     `json:"id"`
+	WatchlistId   uint64     `json:"watchlist_id"`
+	WatchlistName string     `json:"watchlist_name"`
+	TweetId       string     `json:"tweet_id"`
+	UserId        string     `json:"user_id"`
+	Text          string     `json:"text"`
+	Matches       []string   `json:"matches"`
+	Webhook       string     `json:"webhook,omitempty"`
+	Target        string     `json:"target,omitempty"`
+	Status        string     `json:"status,omitempty"`
+	Attempts      int        `json:"attempts"`
+	LastError     string     `json:"last_error,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+	DeliveredAt   *time.Time `json:"delivered_at,omitempty"`
+}
+
+const (
+	watchlist_columns = `id, name, keywords, regexes, hashtags, scope, COALESCE(location, ''), user_ids, COALESCE(webhook, ''), enabled, created_at, updated_at`
+
+	insert_watchlist = `INSERT INTO public.watchlist (
+		name,
+		keywords,
+		regexes,
+		hashtags,
+		scope,
+		location,
+		user_ids,
+		webhook,
+		enabled)
+		VALUES ($1, $2, $3, $4, $5, NULLIF($6, ''), $7, NULLIF($8, ''), $9)
+		RETURNING ` + watchlist_columns
+
+	update_watchlist = `UPDATE public.watchlist
+		SET name = $2, keywords = $3, regexes = $4, hashtags = $5, scope = $6, location = NULLIF($7, ''), user_ids = $8,
+			webhook = NULLIF($9, ''), enabled = $10, updated_at = NOW()
+		WHERE id = $1
+		RETURNING ` + watchlist_columns
+
+	delete_watchlist = `DELETE FROM public.watchlist
+		WHERE id = $1`
+
+	get_watchlist = `SELECT ` + watchlist_columns + `
+	FROM PUBLIC.watchlist
+	WHERE id = $1`
+
+	get_watchlists = `SELECT ` + watchlist_columns + `
+	FROM PUBLIC.watchlist
+	WHERE ($1 = FALSE OR enabled)
+	ORDER BY id`
+
+	get_user_location_name = `SELECT COALESCE(location_name, '')
+	FROM PUBLIC.user
+	WHERE id_str = $1`
+
+	alert_columns = `A.id, A.watchlist_id, B.name, A.tweet_id_str, A.user_id_str, A.text, A.matches, COALESCE(A.webhook, ''), COALESCE(A.target, ''), COALESCE(A.status, ''),
+		A.attempts, COALESCE(A.last_error, ''), A.created_at, A.delivered_at`
+
+	// Tweets sent again match again, an alert is only raised the first time.
+	insert_alert = `INSERT INTO public.alert (
+		watchlist_id,
+		tweet_id_str,
+		user_id_str,
+		text,
+		matches,
+		webhook,
+		target,
+		status)
+		VALUES ($1, $2, $3, $4, $5, NULLIF($6, ''), NULLIF($7, ''), CASE WHEN $6 = '' THEN NULL ELSE 'PENDING' END)
+		ON CONFLICT (watchlist_id, tweet_id_str) DO NOTHING
+		RETURNING id`
+
+	get_alerts = `SELECT ` + alert_columns + `
+	FROM PUBLIC.alert A
+	JOIN PUBLIC.watchlist B
+	ON A.watchlist_id = B.id
+	WHERE ($1 = 0 OR A.watchlist_id = $1) AND ($2 = '' OR A.user_id_str = $2) AND ($3 = '' OR A.status = $3) AND ($4 = 0 OR A.id < $4)
+	ORDER BY A.id DESC
+	LIMIT $5`
+
+	// Claimed alerts are SENDING until they are finished, same as report deliveries.
+	claim_alert_deliveries = `WITH claimed AS (
+		UPDATE public.alert
+		SET status = 'SENDING', attempts = attempts + 1, next_attempt_at = NOW()
+		WHERE id IN (
+			SELECT id FROM public.alert
+			WHERE status = 'PENDING' AND next_attempt_at <= NOW()
+			ORDER BY next_attempt_at
+			LIMIT $1
+			FOR UPDATE SKIP LOCKED)
+		RETURNING *)
+	SELECT ` + alert_columns + `
+	FROM claimed A
+	JOIN PUBLIC.watchlist B
+	ON A.watchlist_id = B.id`
+
+	finish_alert_delivery = `UPDATE public.alert
+	SET status = $2, last_error = $3, next_attempt_at = $4, delivered_at = CASE WHEN $2 = 'SENT' THEN NOW() ELSE NULL END
+	WHERE id = $1`
+
+	reset_stale_alert_deliveries = `UPDATE public.alert
+	SET status = 'PENDING'
+	WHERE status = 'SENDING' AND next_attempt_at < $1`
+)
+
+func scanWatchlist(row interface{ Scan(...interface{}) error }) (Watchlist, error) {
+	var watchlist Watchlist
+	err := row.Scan(&watchlist.Id, &watchlist.Name, pq.Array(&watchlist.Keywords), pq.Array(&watchlist.Regexes), pq.Array(&watchlist.Hashtags),
+		&watchlist.Scope, &watchlist.Location, pq.Array(&watchlist.UserIds), &watchlist.Webhook, &watchlist.Enabled, &watchlist.CreatedAt, &watchlist.UpdatedAt)
+	return watchlist, err
+}
+
+func scanAlert(row interface{ Scan(...interface{}) error }) (Alert, error) {
+	var alert Alert
+	err := row.Scan(&alert.Id, &alert.WatchlistId, &alert.WatchlistName, &alert.TweetId, &alert.UserId, &alert.Text, pq.Array(&alert.Matches),
+		&alert.Webhook, &alert.Target, &alert.Status, &alert.Attempts, &alert.LastError, &alert.CreatedAt, &alert.DeliveredAt)
+	return alert, err
+}
+
+// Arrays are stored empty rather than NULL.
+func textArray(values []string) interface{} {
+	if values == nil {
+		values = []string{}
+	}
+	return pq.Array(values)
+}
+
+func CreateWatchlist(watchlist Watchlist, db *sql.DB) (Watchlist, error) {
+	return scanWatchlist(db.QueryRow(insert_watchlist, watchlist.Name, textArray(watchlist.Keywords), textArray(watchlist.Regexes),
+		textArray(watchlist.Hashtags), watchlist.Scope, watchlist.Location, textArray(watchlist.UserIds), watchlist.Webhook, watchlist.Enabled))
+}
+
+// Function replaces a stored watchlist with watchlist, not found when there is none with its id.
+func UpdateWatchlist(watchlist Watchlist, db *sql.DB) (Watchlist, bool, error) {
+	updated, err := scanWatchlist(db.QueryRow(update_watchlist, watchlist.Id, watchlist.Name, textArray(watchlist.Keywords), textArray(watchlist.Regexes),
+		textArray(watchlist.Hashtags), watchlist.Scope, watchlist.Location, textArray(watchlist.UserIds), watchlist.Webhook, watchlist.Enabled))
+	if err == sql.ErrNoRows {
+		return updated, false, nil
+	}
+	return updated, err == nil, err
+}
+
+// Function deletes a watchlist with its alerts, false when there is none with id.
+func DeleteWatchlist(id uint64, db *sql.DB) (bool, error) {
+	result, err := db.Exec(delete_watchlist, id)
+	if err != nil {
+		return false, err
+	}
+	deleted, err := result.RowsAffected()
+	return deleted > 0, err
+}
+
+func GetWatchlist(id uint64, db *sql.DB) (Watchlist, bool, error) {
+	watchlist, err := scanWatchlist(db.QueryRow(get_watchlist, id))
+	if err == sql.ErrNoRows {
+		return watchlist, false, nil
+	}
+	return watchlist, err == nil, err
+}
+
+// Function returns the stored watchlists, only enabled ones when enabledOnly is set.
+func GetWatchlists(enabledOnly bool, db *sql.DB) ([]Watchlist, error) {
+	watchlists := make([]Watchlist, 0)
+
+	rows, err := db.Query(get_watchlists, enabledOnly)
+	if err != nil {
+		return watchlists, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		watchlist, err := scanWatchlist(rows)
+		if err != nil {
+			return watchlists, err
+		}
+		watchlists = append(watchlists, watchlist)
+	}
+
+	return watchlists, rows.Err()
+}
+
+// Function returns the location name of a user, empty for unknown users and users without a location.
+func GetUserLocationName(userId string, db *sql.DB) (string, error) {
+	var location string
+	err := db.QueryRow(get_user_location_name, userId).Scan(&location)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return location, err
+}
+
+// Function stores an alert in the transaction saving its tweet and returns
+// whether it is new. Alerts with a Webhook are queued for sending.
+func saveAlert(alert Alert, tx *sql.Tx) (bool, error) {
+	var id uint64
+	err := tx.QueryRow(insert_alert, alert.WatchlistId, alert.TweetId, alert.UserId, alert.Text, textArray(alert.Matches), alert.Webhook, alert.Target).Scan(&id)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func GetAlerts(watchlistId uint64, userId string, status string, cursor string, limit int, db *sql.DB) ([]Alert, string, error) {
+	alerts := make([]Alert, 0)
+	limit = pageSize(limit)
+
+	beforeId, err := decodeIdCursor(cursor)
+	if err != nil {
+		return alerts, "", err
+	}
+
+	rows, err := db.Query(get_alerts, watchlistId, userId, status, beforeId, limit+1)
+	if err != nil {
+		return alerts, "", err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		alert, err := scanAlert(rows)
+		if err != nil {
+			return alerts, "", err
+		}
+		alerts = append(alerts, alert)
+	}
+
+	next := ""
+	if len(alerts) > limit {
+		alerts = alerts[:limit]
+		next = encodeIdCursor(alerts[limit-1].Id)
+	}
+
+	return alerts, next, rows.Err()
+}
+
+func ClaimAlertDeliveries(limit int, db *sql.DB) ([]Alert, error) {
+	var alerts []Alert
+
+	rows, err := db.Query(claim_alert_deliveries, limit)
+	if err != nil {
+		return alerts, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		alert, err := scanAlert(rows)
+		if err != nil {
+			return alerts, err
+		}
+		alerts = append(alerts, alert)
+	}
+
+	return alerts, rows.Err()
+}
+
+// Function records the outcome of sending an alert, see FinishReportDelivery.
+func FinishAlertDelivery(alert Alert, status string, sendErr error, nextAttempt time.Time, db *sql.DB) error {
+	var errMsg sql.NullString
+	if sendErr != nil {
+		errMsg = sql.NullString{String: sendErr.Error(), Valid: true}
+	}
+
+	_, err := db.Exec(finish_alert_delivery, alert.Id, status, errMsg, nextAttempt)
+	return err
+}
+
+func ResetStaleAlertDeliveries(before time.Time, db *sql.DB) error {
+	_, err := db.Exec(reset_stale_alert_deliveries, before)
+	return err
+}
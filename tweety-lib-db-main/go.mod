@@ -5,4 +5,7 @@ go 1.15
 require (
 	github.com/lib/pq v1.10.2
 	github.com/leapbit-internship/tweety-lib-communication v0.0.0-20210721104227-2d3ec71ad8df
+	github.com/leapbit-internship/tweety-lib-text v0.0.0-00010101000000-000000000000
 )
+
+replace github.com/leapbit-internship/tweety-lib-text => ../tweety-lib-text-main
@@ -0,0 +1,3 @@
+module github.com/leapbit-internship/tweety-lib-text
+
+go 1.15
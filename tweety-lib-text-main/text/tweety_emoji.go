@@ -0,0 +1,70 @@
+package text
+
+const (
+	zeroWidthJoiner    = 0x200D
+	variationEmoji     = 0xFE0F
+	keycapCombining    = 0x20E3
+	regionalIndicatorA = 0x1F1E6
+	regionalIndicatorZ = 0x1F1FF
+)
+
+func isEmoji(r rune) bool {
+	switch {
+	case r >= 0x1F000 && r <= 0x1FAFF:
+		return !isSkinTone(r)
+	case r >= 0x2600 && r <= 0x27BF:
+		return true
+	case r >= 0x2300 && r <= 0x23FF:
+		return true
+	case r == 0x2B50, r == 0x2B55, r == 0x2B1B, r == 0x2B1C, r == 0x3030, r == 0x303D:
+		return true
+	}
+	return false
+}
+
+func isSkinTone(r rune) bool {
+	return r >= 0x1F3FB && r <= 0x1F3FF
+}
+
+func isRegionalIndicator(r rune) bool {
+	return r >= regionalIndicatorA && r <= regionalIndicatorZ
+}
+
+// Function returns the emojis of text in order of appearance. Skin tones,
+// variation selectors and zero width joiner sequences stay with their emoji,
+// and two regional indicators make one flag.
+func Emojis(text string) []string {
+	var emojis []string
+	runes := []rune(text)
+
+	for i := 0; i < len(runes); i++ {
+		if !isEmoji(runes[i]) {
+			continue
+		}
+
+		start := i
+		if isRegionalIndicator(runes[i]) {
+			if i+1 < len(runes) && isRegionalIndicator(runes[i+1]) {
+				i++
+			}
+			emojis = append(emojis, string(runes[start:i+1]))
+			continue
+		}
+
+		for i+1 < len(runes) {
+			next := runes[i+1]
+			if isSkinTone(next) || next == variationEmoji || next == keycapCombining {
+				i++
+				continue
+			}
+			if next == zeroWidthJoiner && i+2 < len(runes) && isEmoji(runes[i+2]) {
+				i += 2
+				continue
+			}
+			break
+		}
+		emojis = append(emojis, string(runes[start:i+1]))
+	}
+
+	return emojis
+}
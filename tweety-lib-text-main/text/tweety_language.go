@@ -0,0 +1,258 @@
+package text
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+const (
+	// Texts with fewer letters are too short to tell languages apart.
+	minLanguageLetters = 10
+	// Trigrams kept in a language profile.
+	profileSize = 400
+)
+
+// A language profile holds the log probability of the trigrams in its
+// sample text. Trigrams missing from the profile get unseen.
+type languageProfile struct {
+	logProbs map[string]float64
+	unseen   float64
+}
+
+type LanguageScore struct {
+	Language   string  `json:"language"`
+	Confidence float64 `json:"confidence"`
+}
+
+var languageNames = map[string]string{
+	"en": "English",
+	"hr": "Croatian",
+	"de": "German",
+	"es": "Spanish",
+	"fr": "French",
+	"it": "Italian",
+}
+
+// Sample texts the profiles are built from. Everyday and news language,
+// close to what users tweet about.
+var languageSamples = map[string]string{
+	"en": `The government said on Monday that it would not change the plan, but many people think that the new law
+		will make life harder for families who are already struggling. I have been waiting for this all week and it was
+		worth it. What do you think about the match last night? We should have won, the referee was terrible and the
+		team played really well in the second half. Thank you all for the kind words and support, it means a lot to me.
+		There is nothing better than a cup of coffee in the morning with the people you love. Please share this with
+		your friends so that everyone can see what is happening in our city right now. The weather is beautiful today
+		and we are going to the beach with the kids. This is one of the most important elections in the history of the
+		country and every vote will count. Breaking news from the capital where thousands of people gathered to protest
+		against rising prices. Happy birthday to my best friend, have a wonderful day. They were asked whether the
+		company would be able to pay its workers, and they could not give an answer.`,
+
+	"hr": `Vlada je u ponedjeljak rekla da neće mijenjati plan, ali mnogi ljudi misle da će novi zakon otežati život
+		obiteljima koje već jedva spajaju kraj s krajem. Čekao sam ovo cijeli tjedan i isplatilo se. Što mislite o
+		sinoćnjoj utakmici? Trebali smo pobijediti, sudac je bio užasan, a momčad je odigrala jako dobro u drugom
+		poluvremenu. Hvala vam svima na lijepim riječima i podršci, to mi puno znači. Nema ništa bolje od šalice kave
+		ujutro s ljudima koje voliš. Molim vas podijelite ovo s prijateljima kako bi svi vidjeli što se upravo događa u
+		našem gradu. Vrijeme je danas prekrasno i idemo s djecom na plažu. Ovo su jedni od najvažnijih izbora u povijesti
+		zemlje i svaki glas će se brojati. Najnovije vijesti iz glavnog grada gdje se tisuće ljudi okupilo kako bi
+		prosvjedovali protiv rasta cijena. Sretan rođendan mojoj najboljoj prijateljici, želim ti divan dan. Pitali su
+		ih hoće li tvrtka moći isplatiti plaće radnicima, a oni nisu znali odgovoriti. Što ćemo sada, gdje ćemo i kada.`,
+
+	"de": `Die Regierung sagte am Montag, dass sie den Plan nicht ändern werde, aber viele Menschen glauben, dass das
+		neue Gesetz das Leben für Familien schwerer machen wird, die schon jetzt kämpfen müssen. Ich habe die ganze Woche
+		darauf gewartet und es hat sich gelohnt. Was haltet ihr von dem Spiel gestern Abend? Wir hätten gewinnen müssen,
+		der Schiedsrichter war schrecklich und die Mannschaft hat in der zweiten Halbzeit wirklich gut gespielt. Danke
+		euch allen für die lieben Worte und die Unterstützung, das bedeutet mir sehr viel. Es gibt nichts Schöneres als
+		eine Tasse Kaffee am Morgen mit den Menschen, die man liebt. Bitte teilt das mit euren Freunden, damit jeder
+		sieht, was gerade in unserer Stadt passiert. Das Wetter ist heute wunderschön und wir gehen mit den Kindern an
+		den Strand. Das ist eine der wichtigsten Wahlen in der Geschichte des Landes und jede Stimme zählt. Eilmeldung
+		aus der Hauptstadt, wo sich tausende Menschen versammelt haben, um gegen steigende Preise zu protestieren.`,
+
+	"es": `El gobierno dijo el lunes que no cambiaría el plan, pero mucha gente piensa que la nueva ley hará la vida más
+		difícil para las familias que ya tienen problemas. He estado esperando esto toda la semana y valió la pena. ¿Qué
+		pensáis del partido de anoche? Deberíamos haber ganado, el árbitro fue terrible y el equipo jugó muy bien en la
+		segunda parte. Gracias a todos por las palabras tan bonitas y por el apoyo, significa mucho para mí. No hay nada
+		mejor que una taza de café por la mañana con las personas que quieres. Por favor compartid esto con vuestros
+		amigos para que todos vean lo que está pasando ahora mismo en nuestra ciudad. Hoy hace un tiempo precioso y
+		vamos a la playa con los niños. Estas son unas de las elecciones más importantes de la historia del país y cada
+		voto cuenta. Última hora desde la capital, donde miles de personas se reunieron para protestar contra la subida
+		de los precios. Feliz cumpleaños a mi mejor amiga, que tengas un día maravilloso.`,
+
+	"fr": `Le gouvernement a déclaré lundi qu'il ne changerait pas le plan, mais beaucoup de gens pensent que la nouvelle
+		loi rendra la vie plus difficile pour les familles qui ont déjà du mal. J'ai attendu ça toute la semaine et ça en
+		valait la peine. Qu'est-ce que vous pensez du match d'hier soir? On aurait dû gagner, l'arbitre était nul et
+		l'équipe a vraiment bien joué en deuxième mi-temps. Merci à tous pour vos gentils mots et votre soutien, cela
+		compte beaucoup pour moi. Il n'y a rien de mieux qu'une tasse de café le matin avec les gens qu'on aime. Partagez
+		ceci avec vos amis pour que tout le monde voie ce qui se passe en ce moment dans notre ville. Il fait très beau
+		aujourd'hui et nous allons à la plage avec les enfants. Ce sont parmi les élections les plus importantes de
+		l'histoire du pays et chaque voix compte. Dernière minute depuis la capitale où des milliers de personnes se sont
+		rassemblées pour protester contre la hausse des prix. Joyeux anniversaire à ma meilleure amie.`,
+
+	"it": `Il governo ha detto lunedì che non cambierà il piano, ma molte persone pensano che la nuova legge renderà la
+		vita più difficile per le famiglie che sono già in difficoltà. Ho aspettato questo tutta la settimana e ne è
+		valsa la pena. Cosa ne pensate della partita di ieri sera? Avremmo dovuto vincere, l'arbitro è stato terribile e
+		la squadra ha giocato davvero bene nel secondo tempo. Grazie a tutti per le belle parole e per il sostegno,
+		significa molto per me. Non c'è niente di meglio di una tazza di caffè la mattina con le persone che ami. Per
+		favore condividete questo con i vostri amici così tutti possono vedere cosa sta succedendo adesso nella nostra
+		città. Oggi il tempo è bellissimo e andiamo al mare con i bambini. Queste sono tra le elezioni più importanti
+		della storia del paese e ogni voto conta. Ultime notizie dalla capitale dove migliaia di persone si sono radunate
+		per protestare contro l'aumento dei prezzi. Buon compleanno alla mia migliore amica, ti auguro una giornata.`,
+}
+
+var languageProfiles = buildLanguageProfiles()
+
+// Function lower cases the letters of text, keeping one space between words.
+// Urls, mentions and digits are dropped.
+func languageLetters(text string) string {
+	var b strings.Builder
+	for _, field := range strings.Fields(text) {
+		if isURL(field) || strings.HasPrefix(field, "@") {
+			continue
+		}
+		word := strings.Map(func(r rune) rune {
+			if unicode.IsLetter(r) {
+				return unicode.ToLower(r)
+			}
+			return -1
+		}, field)
+		if word == "" {
+			continue
+		}
+		if b.Len() > 0 {
+			b.WriteByte(' ')
+		}
+		b.WriteString(word)
+	}
+	return b.String()
+}
+
+// Function returns the trigram counts of text, with words padded by spaces
+// so that word starts and endings have trigrams of their own.
+func trigrams(letters string) map[string]int {
+	counts := make(map[string]int)
+	for _, word := range strings.Fields(letters) {
+		runes := []rune(" " + word + " ")
+		for i := 0; i+3 <= len(runes); i++ {
+			counts[string(runes[i:i+3])]++
+		}
+	}
+	return counts
+}
+
+func buildLanguageProfiles() map[string]languageProfile {
+	profiles := make(map[string]languageProfile, len(languageSamples))
+
+	for language, sample := range languageSamples {
+		counts := trigrams(languageLetters(sample))
+
+		grams := make([]string, 0, len(counts))
+		for gram := range counts {
+			grams = append(grams, gram)
+		}
+		sort.Slice(grams, func(i, j int) bool {
+			if counts[grams[i]] == counts[grams[j]] {
+				return grams[i] < grams[j]
+			}
+			return counts[grams[i]] > counts[grams[j]]
+		})
+		if len(grams) > profileSize {
+			grams = grams[:profileSize]
+		}
+
+		// Add-one smoothing over the kept trigrams and one slot for the unseen ones.
+		total := float64(len(grams) + 1)
+		for _, gram := range grams {
+			total += float64(counts[gram])
+		}
+
+		profile := languageProfile{logProbs: make(map[string]float64, len(grams)), unseen: math.Log(1 / total)}
+		for _, gram := range grams {
+			profile.logProbs[gram] = math.Log(float64(counts[gram]+1) / total)
+		}
+		profiles[language] = profile
+	}
+
+	return profiles
+}
+
+// Function returns the ISO 639-1 codes the language detector knows.
+func DetectableLanguages() []string {
+	languages := make([]string, 0, len(languageProfiles))
+	for language := range languageProfiles {
+		languages = append(languages, language)
+	}
+	return languages
+}
+
+// Function returns the English name of an ISO 639-1 code, or the code itself.
+func LanguageName(code string) string {
+	if name, ok := languageNames[code]; ok {
+		return name
+	}
+	return code
+}
+
+// Function scores text against every language profile, most likely first.
+// Confidences sum up to 1. Texts too short to judge return no scores.
+func ScoreLanguages(text string) []LanguageScore {
+	letters := languageLetters(text)
+	if len([]rune(strings.ReplaceAll(letters, " ", ""))) < minLanguageLetters {
+		return nil
+	}
+
+	counts := trigrams(letters)
+	n := 0
+	for _, count := range counts {
+		n += count
+	}
+
+	logLikelihoods := make(map[string]float64, len(languageProfiles))
+	best := math.Inf(-1)
+	for language, profile := range languageProfiles {
+		sum := 0.0
+		for gram, count := range counts {
+			logProb, ok := profile.logProbs[gram]
+			if !ok {
+				logProb = profile.unseen
+			}
+			sum += float64(count) * logProb
+		}
+		// Trigrams of one text are not independent, scaling by the square root
+		// of their number keeps long texts from getting a confidence of exactly 1.
+		sum /= math.Sqrt(float64(n))
+		logLikelihoods[language] = sum
+		if sum > best {
+			best = sum
+		}
+	}
+
+	scores := make([]LanguageScore, 0, len(logLikelihoods))
+	total := 0.0
+	for language, sum := range logLikelihoods {
+		p := math.Exp(sum - best)
+		scores = append(scores, LanguageScore{Language: language, Confidence: p})
+		total += p
+	}
+	for i := range scores {
+		scores[i].Confidence /= total
+	}
+	sort.Slice(scores, func(i, j int) bool {
+		if scores[i].Confidence == scores[j].Confidence {
+			return scores[i].Language < scores[j].Language
+		}
+		return scores[i].Confidence > scores[j].Confidence
+	})
+
+	return scores
+}
+
+// Function returns the ISO 639-1 code of the most likely language of text and
+// its confidence, or an empty code when the text is too short.
+func DetectLanguage(text string) (string, float64) {
+	scores := ScoreLanguages(text)
+	if len(scores) == 0 {
+		return "", 0
+	}
+	return scores[0].Language, scores[0].Confidence
+}
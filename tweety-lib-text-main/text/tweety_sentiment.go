@@ -0,0 +1,320 @@
+package text
+
+import (
+	"math"
+	"strings"
+	"unicode"
+)
+
+// Constants of the VADER model (Hutto & Gilbert, 2014).
+const (
+	boosterIncrement   = 0.293
+	capsIncrement      = 0.733
+	negationScalar     = -0.74
+	exclamationBoost   = 0.292
+	maxExclamations    = 4
+	questionBoost      = 0.18
+	maxQuestions       = 3
+	normalizationAlpha = 15.0
+)
+
+type Sentiment struct {
+	Compound float64 `json:"compound"`
+	Positive float64 `json:"positive"`
+	Negative float64 `json:"negative"`
+	Neutral  float64 `json:"neutral"`
+}
+
+// Lexicon of one language. Words are lower case valences from -4 to 4,
+// entries ending in * match every word starting with them.
+type lexicon struct {
+	valences  map[string]float64
+	prefixes  map[string]float64
+	negations map[string]bool
+	boosters  map[string]float64
+	contrasts map[string]bool
+}
+
+func newLexicon(valences map[string]float64, negations string, boosters map[string]float64, contrasts string) *lexicon {
+	l := &lexicon{
+		valences:  make(map[string]float64),
+		prefixes:  make(map[string]float64),
+		negations: words(negations),
+		boosters:  boosters,
+		contrasts: words(contrasts),
+	}
+	for word, valence := range valences {
+		if strings.HasSuffix(word, "*") {
+			l.prefixes[strings.TrimSuffix(word, "*")] = valence
+		} else {
+			l.valences[word] = valence
+		}
+	}
+	return l
+}
+
+func (l *lexicon) valence(word string) (float64, bool) {
+	if v, ok := l.valences[word]; ok {
+		return v, true
+	}
+	// The longest matching prefix wins, so "najbolj*" is preferred over "bolj*".
+	best, found, bestLen := 0.0, false, 0
+	for prefix, v := range l.prefixes {
+		if len(prefix) > bestLen && strings.HasPrefix(word, prefix) {
+			best, found, bestLen = v, true, len(prefix)
+		}
+	}
+	return best, found
+}
+
+var lexicons = map[string]*lexicon{
+	"en": newLexicon(map[string]float64{
+		"good": 1.9, "great": 3.1, "excellent": 3.2, "amazing": 2.8, "awesome": 3.1, "fantastic": 2.6,
+		"love": 3.2, "loved": 2.9, "loves": 2.7, "lovely": 2.8, "like": 1.5, "liked": 1.8, "nice": 1.8,
+		"happy": 2.7, "glad": 2.0, "best": 3.2, "better": 1.9, "win": 2.8, "won": 2.7, "winning": 2.4,
+		"thanks": 1.9, "thank": 1.5, "congrats": 2.4, "congratulations": 2.9, "beautiful": 2.9, "wonderful": 2.7,
+		"fun": 2.3, "funny": 1.9, "cool": 1.3, "proud": 2.1, "hope": 1.9, "excited": 1.4, "exciting": 2.2,
+		"perfect": 2.7, "brilliant": 2.8, "enjoy": 2.2, "enjoyed": 2.3, "support": 1.7, "safe": 1.9,
+		"success": 2.7, "successful": 2.8, "strong": 2.3, "peace": 2.5, "free": 2.3, "kind": 2.4, "yes": 1.7,
+		"bad": -2.5, "worse": -2.1, "worst": -3.1, "terrible": -2.1, "awful": -2.0, "horrible": -2.5,
+		"hate": -2.7, "hated": -3.2, "hates": -1.9, "sad": -2.1, "angry": -2.3, "mad": -2.2, "fail": -2.5,
+		"failed": -2.3, "failure": -2.3, "lose": -1.6, "lost": -1.3, "loss": -1.3, "wrong": -2.1,
+		"stupid": -2.4, "ugly": -2.3, "disgusting": -2.4, "boring": -1.3, "sorry": -0.3, "problem": -1.7,
+		"crisis": -3.1, "war": -2.9, "kill": -3.7, "killed": -3.5, "death": -2.9, "dead": -3.3, "die": -2.9,
+		"attack": -2.1, "fear": -2.2, "scared": -1.9, "worried": -1.2, "pain": -2.3, "hurt": -2.4,
+		"crash": -1.7, "disaster": -3.1, "corrupt": -3.0, "lie": -1.6, "lies": -1.8, "fake": -2.1,
+		"no": -1.2, "damn": -1.7, "crap": -1.6, "shit": -2.6, "fuck": -2.5, "wtf": -2.8,
+		"lol": 1.8, "lmao": 2.0, "haha": 2.0, "omg": 0.4,
+	}, "not no never none nobody nothing neither nor nowhere cannot can't don't doesn't didn't isn't aren't wasn't weren't won't wouldn't shouldn't couldn't ain't without",
+		map[string]float64{"very": boosterIncrement, "really": boosterIncrement, "so": boosterIncrement, "extremely": boosterIncrement,
+			"absolutely": boosterIncrement, "totally": boosterIncrement, "incredibly": boosterIncrement, "most": boosterIncrement,
+			"super": boosterIncrement, "barely": -boosterIncrement, "hardly": -boosterIncrement, "slightly": -boosterIncrement,
+			"somewhat": -boosterIncrement, "kinda": -boosterIncrement, "little": -boosterIncrement},
+		"but however although though yet"),
+
+	"hr": newLexicon(map[string]float64{
+		"dobar": 1.9, "dobra": 1.9, "dobro": 1.9, "dobri": 1.9, "odličan": 3.1, "odlično": 3.1, "odlična": 3.1,
+		"sjajan": 2.9, "sjajno": 2.9, "super": 2.6, "krasn*": 2.8, "prekrasn*": 3.0, "lijep*": 2.3,
+		"volim": 3.0, "voli*": 2.6, "ljubav*": 3.0, "sretan": 2.7, "sretna": 2.7, "sretno": 2.5, "sreća": 2.7,
+		"hvala": 1.9, "čestit*": 2.6, "bravo": 2.7, "pobjed*": 2.8, "uspjeh*": 2.7, "uspješn*": 2.7,
+		"najbolj*": 3.1, "bolj*": 1.5, "zabavn*": 2.1, "ponos*": 2.0, "nada": 1.8, "nadam": 1.8, "mir": 2.3,
+		"slobod*": 2.3, "podrš*": 1.7, "sigurn*": 1.6, "divn*": 2.8, "savršen*": 2.9, "zadovolj*": 2.0,
+		"loš*": -2.4, "najgor*": -3.1, "gore": -1.8, "gori": -1.8, "užasn*": -2.6, "grozn*": -2.5, "strašn*": -2.3,
+		"mrzim": -2.9, "mrz*": -2.6, "tužan": -2.1, "tužna": -2.1, "tužno": -2.1, "tuga": -2.1,
+		"ljut*": -2.3, "neuspjeh*": -2.5, "poraz*": -2.3, "izgubi*": -1.6, "problem*": -1.7, "kriz*": -2.9,
+		"rat": -2.9, "rata": -2.9, "ratu": -2.9, "ubij*": -3.5, "ubio": -3.5, "ubila": -3.5, "ubiti": -3.5, "smrt*": -2.9, "mrtv*": -3.2, "napad*": -2.1, "strah*": -2.2,
+		"bol": -2.3, "bolan": -2.3, "katastrof*": -3.1, "korupcij*": -3.0, "korumpiran*": -3.0,
+		"laž*": -1.9, "lažn*": -2.1, "glup*": -2.4, "ružn*": -2.3, "dosadn*": -1.3, "sramot*": -2.5,
+	}, "ne nije nisu nisam nisi nismo niste nema nemam nemamo nikad nikada ništa nitko bez",
+		map[string]float64{"jako": boosterIncrement, "vrlo": boosterIncrement, "baš": boosterIncrement, "stvarno": boosterIncrement,
+			"izuzetno": boosterIncrement, "potpuno": boosterIncrement, "totalno": boosterIncrement, "previše": boosterIncrement,
+			"malo": -boosterIncrement, "pomalo": -boosterIncrement, "jedva": -boosterIncrement},
+		"ali no međutim iako"),
+
+	"de": newLexicon(map[string]float64{
+		"gut": 1.9, "gute": 1.9, "guten": 1.9, "guter": 1.9, "gutes": 1.9, "toll*": 2.6, "super": 2.6,
+		"großartig*": 3.1, "ausgezeichnet*": 3.1, "wunderbar*": 2.8, "wunderschön*": 3.0, "schön*": 2.3,
+		"liebe": 3.0, "lieben": 2.9, "liebt": 2.7, "glücklich*": 2.7, "glück": 2.5, "froh": 2.1, "danke": 1.9,
+		"gratul*": 2.6, "glückwunsch*": 2.6, "bravo": 2.7, "sieg*": 2.8, "gewonnen": 2.7, "erfolg*": 2.7,
+		"beste*": 3.1, "besser*": 1.5, "spaß": 2.3, "lustig*": 1.9, "stolz*": 2.0, "hoffnung*": 1.9,
+		"frieden": 2.5, "frei": 2.0, "perfekt*": 2.9, "genial*": 2.8, "zufrieden*": 2.0, "freude": 2.7,
+		"schlecht*": -2.4, "schlimm*": -2.3, "schrecklich*": -2.6, "furchtbar*": -2.5, "hass*": -2.7,
+		"traurig*": -2.1, "wütend*": -2.3, "ärger*": -2.0, "versag*": -2.5, "verloren": -1.6, "verlust*": -1.6,
+		"problem*": -1.7, "krise*": -2.9, "krieg*": -2.9, "tot": -3.2, "tod*": -2.9, "töten": -3.5,
+		"angriff*": -2.1, "angst": -2.2, "schmerz*": -2.3, "katastroph*": -3.1, "korrupt*": -3.0,
+		"lüge*": -1.9, "dumm*": -2.4, "hässlich*": -2.3, "langweilig*": -1.3, "schande": -2.5, "mist": -1.9,
+		"scheiße": -2.6, "scheiss*": -2.6,
+	}, "nicht kein keine keinen keiner keinem keines nie niemals nichts niemand ohne weder",
+		map[string]float64{"sehr": boosterIncrement, "echt": boosterIncrement, "wirklich": boosterIncrement, "total": boosterIncrement,
+			"extrem": boosterIncrement, "absolut": boosterIncrement, "besonders": boosterIncrement, "so": boosterIncrement,
+			"kaum": -boosterIncrement, "etwas": -boosterIncrement, "bisschen": -boosterIncrement},
+		"aber jedoch obwohl sondern"),
+}
+
+var emojiValences = map[string]float64{
+	"😀": 2.2, "😃": 2.3, "😄": 2.4, "😁": 2.2, "😂": 1.8, "🤣": 2.0, "😊": 2.4, "😍": 3.0, "🥰": 3.0,
+	"😘": 2.3, "❤": 3.0, "❤️": 3.0, "👍": 1.9, "👏": 2.0, "🎉": 2.6, "🙏": 1.5, "💪": 1.8, "🔥": 1.2,
+	"😢": -2.2, "😭": -2.1, "😞": -2.2, "😔": -1.8, "😠": -2.6, "😡": -2.8, "🤬": -3.0, "👎": -1.9,
+	"💔": -2.7, "😱": -1.6, "🤮": -2.8, "😩": -1.8,
+}
+
+// Function returns the ISO 639-1 codes of languages with a sentiment lexicon.
+func SentimentLanguages() []string {
+	languages := make([]string, 0, len(lexicons))
+	for language := range lexicons {
+		languages = append(languages, language)
+	}
+	return languages
+}
+
+func trimPunctuation(word string) string {
+	return strings.TrimFunc(word, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '\'' && r != '’'
+	})
+}
+
+func isShouting(word string) bool {
+	letters, upper := 0, 0
+	for _, r := range word {
+		if unicode.IsLetter(r) {
+			letters++
+			if unicode.IsUpper(r) {
+				upper++
+			}
+		}
+	}
+	return letters > 1 && letters == upper
+}
+
+// Function scores text with the lexicon of language. With an empty or unknown
+// language every lexicon is tried and the first match of a word counts.
+// Compound is normalised to [-1, 1], the other scores are proportions.
+func AnalyzeSentiment(tweetText string, language string) Sentiment {
+	var active []*lexicon
+	if l, ok := lexicons[strings.ToLower(language)]; ok {
+		active = []*lexicon{l}
+	} else {
+		for _, code := range []string{"en", "hr", "de"} {
+			active = append(active, lexicons[code])
+		}
+	}
+
+	var fields []string
+	for _, field := range strings.Fields(tweetText) {
+		if !isURL(field) && !strings.HasPrefix(field, "@") {
+			fields = append(fields, field)
+		}
+	}
+
+	// Shouting only counts as emphasis when the rest of the text is not in caps.
+	allCaps := true
+	for _, field := range fields {
+		if !isShouting(field) && trimPunctuation(field) != "" {
+			allCaps = false
+		}
+	}
+
+	var valences []float64
+	contrastAt := -1
+	var lowered []string
+	for _, field := range fields {
+		lowered = append(lowered, strings.ReplaceAll(strings.ToLower(trimPunctuation(field)), "’", "'"))
+	}
+
+	for i, field := range fields {
+		word := lowered[i]
+
+		for _, emoji := range Emojis(field) {
+			if v, ok := emojiValences[emoji]; ok {
+				valences = append(valences, v)
+			}
+		}
+		if word == "" {
+			continue
+		}
+
+		var lex *lexicon
+		valence, found := 0.0, false
+		for _, l := range active {
+			if l.contrasts[word] && contrastAt < 0 {
+				contrastAt = len(valences)
+			}
+			if _, isBooster := l.boosters[word]; isBooster {
+				break
+			}
+			if valence, found = l.valence(word); found {
+				lex = l
+				break
+			}
+		}
+		if !found {
+			continue
+		}
+
+		if isShouting(field) && !allCaps {
+			valence += math.Copysign(capsIncrement, valence)
+		}
+
+		// Boosters and negations up to three words back change the valence,
+		// the further away the less.
+		for back := 1; back <= 3 && i-back >= 0; back++ {
+			previous := lowered[i-back]
+			if boost, ok := lex.boosters[previous]; ok {
+				boost = math.Copysign(boost, valence)
+				if isShouting(fields[i-back]) && !allCaps {
+					boost += math.Copysign(capsIncrement, valence)
+				}
+				valence += boost * []float64{1, 0.95, 0.9}[back-1]
+			}
+			if lex.negations[previous] || strings.HasSuffix(previous, "n't") {
+				valence *= negationScalar
+			}
+		}
+
+		valences = append(valences, valence)
+	}
+
+	// Words after a contrast such as "but" weigh more than the ones before it.
+	if contrastAt >= 0 {
+		for i := range valences {
+			if i < contrastAt {
+				valences[i] *= 0.5
+			} else {
+				valences[i] *= 1.5
+			}
+		}
+	}
+
+	return scoreValences(valences, tweetText)
+}
+
+func scoreValences(valences []float64, tweetText string) Sentiment {
+	var sentiment Sentiment
+	if len(valences) == 0 {
+		sentiment.Neutral = 1
+		return sentiment
+	}
+
+	sum := 0.0
+	for _, v := range valences {
+		sum += v
+	}
+
+	exclamations := math.Min(float64(strings.Count(tweetText, "!")), maxExclamations)
+	questions := float64(strings.Count(tweetText, "?"))
+	emphasis := exclamations * exclamationBoost
+	if questions > 1 {
+		emphasis += math.Min(questions, maxQuestions) * questionBoost
+	}
+	if sum > 0 {
+		sum += emphasis
+	} else if sum < 0 {
+		sum -= emphasis
+	}
+
+	sentiment.Compound = sum / math.Sqrt(sum*sum+normalizationAlpha)
+
+	var positive, negative, neutral float64
+	for _, v := range valences {
+		switch {
+		case v > 0:
+			positive += v + 1
+		case v < 0:
+			negative += v - 1
+		default:
+			neutral++
+		}
+	}
+	if positive > -negative {
+		positive += emphasis
+	} else if positive < -negative {
+		negative -= emphasis
+	}
+
+	total := positive - negative + neutral
+	sentiment.Positive = positive / total
+	sentiment.Negative = math.Abs(negative) / total
+	sentiment.Neutral = neutral / total
+
+	return sentiment
+}
@@ -0,0 +1,62 @@
+package text
+
+import (
+	"math"
+	"testing"
+)
+
+func TestAnalyzeSentiment(t *testing.T) {
+	tests := []struct {
+		text     string
+		language string
+		want     float64
+	}{
+		// A single word scores valence / sqrt(valence^2 + alpha), as in VADER.
+		{"good", "en", 0.4404},
+		{"bad", "en", -0.5423},
+		{"the weather", "en", 0},
+		{"", "en", 0},
+		{"not good", "en", -0.3412},
+		{"dobar", "hr", 0.4404},
+		{"gut", "de", 0.4404},
+		// Without a language every lexicon is tried.
+		{"dobar", "", 0.4404},
+		// Mentions and URLs are left out.
+		{"@good https://bad.com", "en", 0},
+	}
+
+	for _, test := range tests {
+		got := AnalyzeSentiment(test.text, test.language).Compound
+		if math.Abs(got-test.want) > 0.0001 {
+			t.Errorf("AnalyzeSentiment(%q, %q).Compound = %.4f, want %.4f", test.text, test.language, got, test.want)
+		}
+	}
+}
+
+func TestAnalyzeSentimentEmphasis(t *testing.T) {
+	tests := []struct {
+		stronger string
+		weaker   string
+	}{
+		{"very good", "good"},
+		{"good!", "good"},
+		{"GOOD movie", "good movie"},
+		{"bad but great", "great but bad"},
+	}
+
+	for _, test := range tests {
+		stronger, weaker := AnalyzeSentiment(test.stronger, "en").Compound, AnalyzeSentiment(test.weaker, "en").Compound
+		if stronger <= weaker {
+			t.Errorf("AnalyzeSentiment(%q) = %.4f, want more than AnalyzeSentiment(%q) = %.4f", test.stronger, stronger, test.weaker, weaker)
+		}
+	}
+}
+
+func TestAnalyzeSentimentProportions(t *testing.T) {
+	for _, text := range []string{"good", "good and bad", "the weather is nice but the food is terrible", ""} {
+		s := AnalyzeSentiment(text, "en")
+		if sum := s.Positive + s.Negative + s.Neutral; math.Abs(sum-1) > 0.01 {
+			t.Errorf("AnalyzeSentiment(%q) proportions sum to %.4f, want 1", text, sum)
+		}
+	}
+}
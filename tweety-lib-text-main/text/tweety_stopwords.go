@@ -0,0 +1,84 @@
+package text
+
+import "strings"
+
+// Tokens that carry no meaning on Twitter whatever the language.
+var twitterStopwords = words("rt via amp gt lt cc ht mt dm pls plz lol")
+
+var stopwords = map[string]map[string]bool{
+	"en": words(`a about above after again against all am an and any are aren't as at be because been
+		before being below between both but by can can't cannot could couldn't did didn't do does doesn't
+		doing don't down during each few for from further get got had hadn't has hasn't have haven't having
+		he he'd he'll he's her here here's hers herself him himself his how how's i i'd i'll i'm i've if in
+		into is isn't it it's its itself just let's like me more most mustn't my myself no nor not now of off
+		on once only or other ought our ours ourselves out over own same shan't she she'd she'll she's should
+		shouldn't so some such than that that's the their theirs them themselves then there there's these they
+		they'd they'll they're they've this those through to too under until up us very was wasn't we we'd
+		we'll we're we've were weren't what what's when when's where where's which while who who's whom why
+		why's will with won't would wouldn't you you'd you'll you're you've your yours yourself yourselves
+		also one two new im dont cant youre thats its`),
+	"hr": words(`a ako ali bi bih bila bile bili bilo bio bismo biste biti bude budu da do dok e ga
+		gdje i ih ili im iz ja je jer jesam jesi jesmo jeste jesu joj još ju kad kada kako kao koja koje
+		koji kojima koju kroz li me mene meni mi mnom moj moja moje moji mu na nad nakon nam nama nas naš
+		naša naše naši ne nego neka neki nekog neku nema netko ni nije nikad nisam nisi nismo niste nisu
+		njega njegov njegova njegovo njemu njezin njih njihov njima njoj nju no o od odmah on ona one oni
+		ono onda opet oko pa po pod pored prema pri prije s sa sam samo se sebe sebi si smo ste su sve svi
+		svog svoj svoja svoje svom ta tada taj tako te tebe tebi ti to toj tome tu tvoj tvoja tvoje u uz
+		vam vama vas vaš vaša vaše već vi vrlo za zar zato zbog že`),
+	"de": words(`aber alle allem allen aller alles als also am an ander andere anderem anderen anderer
+		anderes anderm andern anderr anders auch auf aus bei bin bis bist da damit dann das dass dasselbe
+		dazu daß dein deine deinem deinen deiner deines dem demselben den denn denselben der derer derselbe
+		derselben des desselben dessen dich die dies diese dieselbe dieselben diesem diesen dieser dieses
+		dir doch dort du durch ein eine einem einen einer eines einig einige einigem einigen einiger
+		einiges einmal er es etwas euch euer eure eurem euren eurer eures für gegen gewesen hab habe haben
+		hat hatte hatten hier hin hinter ich ihm ihn ihnen ihr ihre ihrem ihren ihrer ihres im in indem
+		ins ist jede jedem jeden jeder jedes jene jenem jenen jener jenes jetzt kann kein keine keinem
+		keinen keiner keines können könnte machen man manche manchem manchen mancher manches mein meine
+		meinem meinen meiner meines mich mir mit muss musste nach nicht nichts noch nun nur ob oder ohne
+		sehr sein seine seinem seinen seiner seines selbst sich sie sind so solche solchem solchen solcher
+		solches soll sollte sondern sonst um und uns unser unsere unserem unseren unserer unseres unter
+		viel vom von vor war waren warst was weg weil weiter welche welchem welchen welcher welches wenn
+		werde werden wie wieder will wir wird wirst wo wollen wollte während würde würden zu zum zur zwar
+		zwischen`),
+}
+
+func words(list string) map[string]bool {
+	set := make(map[string]bool)
+	for _, word := range strings.Fields(list) {
+		set[word] = true
+	}
+	return set
+}
+
+// Function reports whether token is a stopword in one of the languages
+// (ISO 639-1 codes) or Twitter noise. An empty language list checks every list.
+func IsStopword(token string, languages []string) bool {
+	if twitterStopwords[token] {
+		return true
+	}
+
+	if len(languages) == 0 {
+		for _, list := range stopwords {
+			if list[token] {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, language := range languages {
+		if stopwords[strings.ToLower(language)][token] {
+			return true
+		}
+	}
+	return false
+}
+
+// Function returns the ISO 639-1 codes of languages that have a stopword list.
+func StopwordLanguages() []string {
+	languages := make([]string, 0, len(stopwords))
+	for language := range stopwords {
+		languages = append(languages, language)
+	}
+	return languages
+}
@@ -0,0 +1,179 @@
+package text
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+const (
+	DEFAULT_TOP_N      = 10
+	DEFAULT_MIN_LENGTH = 2
+)
+
+// Stem uses the English Porter stemmer, it is only allowed when Languages is
+// English alone so terms of other languages are not cut wrongly.
+type Options struct {
+	Languages   []string `json:"languages"`
+	Stem        bool     `json:"stem"`
+	MinLength   int      `json:"min_length"`
+	KeepNumbers bool     `json:"keep_numbers"`
+	TopN        int      `json:"top_n"`
+}
+
+type TermCount struct {
+	Term  string
+	Count uint64
+}
+
+func DefaultOptions() Options {
+	return Options{
+		Languages: []string{"en", "hr", "de"},
+		MinLength: DEFAULT_MIN_LENGTH,
+		TopN:      DEFAULT_TOP_N,
+	}
+}
+
+// Method fills zero fields with defaults, so options read from
+// configuration only need the fields that differ.
+func (o Options) WithDefaults() Options {
+	defaults := DefaultOptions()
+	if o.Languages == nil {
+		o.Languages = defaults.Languages
+	}
+	if o.MinLength <= 0 {
+		o.MinLength = defaults.MinLength
+	}
+	if o.TopN <= 0 {
+		o.TopN = defaults.TopN
+	}
+	return o
+}
+
+var ErrStemNotEnglish = errors.New(`stem is English only and needs languages ["en"]`)
+
+// Method checks options read from configuration.
+func (o Options) Validate() error {
+	o = o.WithDefaults()
+	if o.Stem && (len(o.Languages) != 1 || o.Languages[0] != "en") {
+		return ErrStemNotEnglish
+	}
+	return nil
+}
+
+func isURL(field string) bool {
+	lower := strings.ToLower(field)
+	return strings.HasPrefix(lower, "http://") || strings.HasPrefix(lower, "https://") || strings.HasPrefix(lower, "www.")
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.Is(unicode.Mn, r)
+}
+
+// Function splits text into lower case tokens. URLs and @mentions are dropped,
+// hashtags keep their word, punctuation around and between words is stripped.
+// An apostrophe inside a word is kept, so "don't" stays one token.
+func Tokenize(text string) []string {
+	var tokens []string
+
+	for _, field := range strings.Fields(text) {
+		if isURL(field) || strings.HasPrefix(field, "@") {
+			continue
+		}
+
+		runes := []rune(field)
+		start := -1
+		for i := 0; i <= len(runes); i++ {
+			inWord := i < len(runes) && (isWordRune(runes[i]) ||
+				(start >= 0 && isApostrophe(runes[i]) && i+1 < len(runes) && unicode.IsLetter(runes[i+1])))
+			if inWord {
+				if start < 0 {
+					start = i
+				}
+				continue
+			}
+			if start >= 0 {
+				tokens = append(tokens, foldCase(string(runes[start:i])))
+				start = -1
+			}
+		}
+	}
+
+	return tokens
+}
+
+func isApostrophe(r rune) bool {
+	return r == '\'' || r == '’'
+}
+
+func foldCase(token string) string {
+	return strings.ToLower(strings.ReplaceAll(token, "’", "'"))
+}
+
+func isNumber(token string) bool {
+	for _, r := range token {
+		if !unicode.IsDigit(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// Method returns the terms of text that are counted: tokens without
+// stopwords, numbers and too short tokens, stemmed when Stem is set.
+func (o Options) Terms(text string) []string {
+	o = o.WithDefaults()
+
+	var terms []string
+	for _, token := range Tokenize(text) {
+		if len([]rune(token)) < o.MinLength {
+			continue
+		}
+		if !o.KeepNumbers && isNumber(token) {
+			continue
+		}
+		if IsStopword(token, o.Languages) {
+			continue
+		}
+		if o.Stem {
+			token = Stem(token)
+		}
+		terms = append(terms, token)
+	}
+
+	return terms
+}
+
+// Method counts the terms of all texts.
+func (o Options) Count(texts []string) map[string]uint64 {
+	counts := make(map[string]uint64)
+	for _, t := range texts {
+		for _, term := range o.Terms(t) {
+			counts[term]++
+		}
+	}
+	return counts
+}
+
+// Method returns the TopN most frequent terms, ties ordered alphabetically
+// so equal counts always rank the same way.
+func (o Options) Top(counts map[string]uint64) []TermCount {
+	o = o.WithDefaults()
+
+	ranked := make([]TermCount, 0, len(counts))
+	for term, count := range counts {
+		ranked = append(ranked, TermCount{Term: term, Count: count})
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		if ranked[i].Count == ranked[j].Count {
+			return ranked[i].Term < ranked[j].Term
+		}
+		return ranked[i].Count > ranked[j].Count
+	})
+
+	if len(ranked) > o.TopN {
+		ranked = ranked[:o.TopN]
+	}
+	return ranked
+}
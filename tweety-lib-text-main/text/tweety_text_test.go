@@ -0,0 +1,78 @@
+package text
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTop(t *testing.T) {
+	tests := []struct {
+		name   string
+		topN   int
+		counts map[string]uint64
+		want   []TermCount
+	}{
+		{
+			name:   "empty",
+			counts: map[string]uint64{},
+			want:   []TermCount{},
+		},
+		{
+			name:   "by count",
+			counts: map[string]uint64{"go": 3, "rust": 5, "zig": 1},
+			want:   []TermCount{{"rust", 5}, {"go", 3}, {"zig", 1}},
+		},
+		{
+			name:   "ties alphabetically",
+			counts: map[string]uint64{"b": 2, "c": 2, "a": 2, "d": 7},
+			want:   []TermCount{{"d", 7}, {"a", 2}, {"b", 2}, {"c", 2}},
+		},
+		{
+			name:   "cut to top n",
+			topN:   2,
+			counts: map[string]uint64{"a": 1, "b": 2, "c": 3},
+			want:   []TermCount{{"c", 3}, {"b", 2}},
+		},
+	}
+
+	for _, test := range tests {
+		got := Options{TopN: test.topN}.Top(test.counts)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: Top() = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestTopDefaultsToTopN(t *testing.T) {
+	counts := make(map[string]uint64)
+	for _, term := range []string{"a", "b", "c", "d", "e", "f", "g", "h", "i", "j", "k", "l"} {
+		counts[term] = 1
+	}
+
+	if got := len(Options{}.Top(counts)); got != DEFAULT_TOP_N {
+		t.Errorf("len(Top()) = %d, want %d", got, DEFAULT_TOP_N)
+	}
+}
+
+func TestOptionsValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		options Options
+		wantErr bool
+	}{
+		{name: "defaults", options: Options{}},
+		{name: "stem english", options: Options{Stem: true, Languages: []string{"en"}}},
+		{name: "stem default languages", options: Options{Stem: true}, wantErr: true},
+		{name: "stem croatian", options: Options{Stem: true, Languages: []string{"en", "hr"}}, wantErr: true},
+		{name: "stem no stopwords", options: Options{Stem: true, Languages: []string{}}, wantErr: true},
+		{name: "croatian without stem", options: Options{Languages: []string{"hr"}}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := test.options.Validate(); (err != nil) != test.wantErr {
+				t.Errorf("Validate() = %v, wantErr %t", err, test.wantErr)
+			}
+		})
+	}
+}
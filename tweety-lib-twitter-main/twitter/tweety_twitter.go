@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"strconv"
 	"time"
 )
@@ -15,7 +16,7 @@ const (
 	httpLookupRequestTemplate     = "https://api.twitter.com/1.1/users/lookup.json?%s"
 	httpFriendsRequestTemplate    = "https://api.twitter.com/1.1/friends/ids.json?stringify_ids=true&screen_name=%s"
 	httpImageUrlsRequestTemplate  = "https://api.twitter.com/1.1/users/show.json?user_id=%s"
-	httpStatusesRequestTemplate   = "https://api.twitter.com/1.1/statuses/user_timeline.json?user_id=%v&count=%v&tweet_mode=extended"
+	httpStatusesRequestTemplate   = "https://api.twitter.com/1.1/statuses/user_timeline.json?%s"
 	httpStatusInfoRequestTemplate = "https://twitter.com/%v/status/%v"
 )
 
@@ -41,17 +42,66 @@ type RespTwitterApiUser struct {
 }
 
 type RespTwitterApiTweet struct {
-	Created_at TwitterTime `json:"created_at"`
-	Id         uint64      `json:"id"`
-	Id_str     string      `json:"id_str"`
-	Text       string      `json:"full_text"`
-	Url        string
-	User       struct {
+	Created_at        TwitterTime `json:"created_at"`
+	Id                uint64      `json:"id"`
+	Id_str            string      `json:"id_str"`
+	Text              string      `json:"full_text"`
+	Url               string
+	Entities          TweetEntities `json:"entities"`
+	Extended_entities struct {
+		Media []TweetMedia `json:"media"`
+	} `json:"extended_entities"`
+	User struct {
 		Id          uint64 `json:"id"`
 		Screen_name string `json:"screen_name"`
 	} `json:"user"`
 }
 
+// Entities Twitter found in the tweet text. Indices are rune offsets into the text.
+type TweetEntities struct {
+	Hashtags      []TweetHashtag `json:"hashtags"`
+	User_mentions []TweetMention `json:"user_mentions"`
+	Urls          []TweetUrl     `json:"urls"`
+	Media         []TweetMedia   `json:"media"`
+}
+
+type TweetHashtag struct {
+	Text    string `json:"text"`
+	Indices []int  `json:"indices"`
+}
+
+type TweetMention struct {
+	Id_str      string `json:"id_str"`
+	Screen_name string `json:"screen_name"`
+	Name        string `json:"name"`
+	Indices     []int  `json:"indices"`
+}
+
+type TweetUrl struct {
+	Url          string `json:"url"`
+	Expanded_url string `json:"expanded_url"`
+	Display_url  string `json:"display_url"`
+	Indices      []int  `json:"indices"`
+}
+
+type TweetMedia struct {
+	Id_str          string `json:"id_str"`
+	Type            string `json:"type"`
+	Media_url_https string `json:"media_url_https"`
+	Url             string `json:"url"`
+	Expanded_url    string `json:"expanded_url"`
+	Indices         []int  `json:"indices"`
+}
+
+// Method returns all media of the tweet. Extended entities hold every attached
+// photo or video, plain entities only the first one.
+func (tweet RespTwitterApiTweet) AllMedia() []TweetMedia {
+	if len(tweet.Extended_entities.Media) > 0 {
+		return tweet.Extended_entities.Media
+	}
+	return tweet.Entities.Media
+}
+
 type RespTwitterApiFriends struct {
 	Friends_ids []string `json:"ids"`
 }
@@ -62,7 +112,7 @@ type RespTwitterApiImages struct {
 }
 
 type ReqFriends struct {
-	Friends_ids []string `json:"ids"`
+	Friends_ids []string `json:"ids" validate:"nonempty,numeric"`
 }
 
 type RespFriends struct {
@@ -96,6 +146,41 @@ func (twTime TwitterTime) MarshalJSON() ([]byte, error) {
 	return []byte("\"" + twTime.Format(time.RubyDate) + "\""), nil
 }
 
+// Error returned when Twitter answers with a status other than 200. Timelines
+// of protected users answer 401, suspended or deleted users answer 404.
+type StatusError struct {
+	StatusCode int
+	Message    string
+}
+
+func (err *StatusError) Error() string {
+	return fmt.Sprintf("Twitter responded with status %d: %s", err.StatusCode, err.Message)
+}
+
+// Function returns a StatusError for responses other than 200, nil otherwise.
+// The message is taken from the error body Twitter sends, if it has one.
+func responseError(resp *http.Response, body []byte) error {
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+
+	var errorBody struct {
+		Errors []struct {
+			Message string `json:"message"`
+		} `json:"errors"`
+		Error string `json:"error"`
+	}
+	message := http.StatusText(resp.StatusCode)
+	if json.Unmarshal(body, &errorBody) == nil {
+		if len(errorBody.Errors) > 0 {
+			message = errorBody.Errors[0].Message
+		} else if errorBody.Error != "" {
+			message = errorBody.Error
+		}
+	}
+	return &StatusError{StatusCode: resp.StatusCode, Message: message}
+}
+
 func UserGetImageUrls(userId string, c *http.Client, bearer string) (RespTwitterApiImages, error, error) {
 	var respImages RespTwitterApiImages
 
@@ -110,6 +195,9 @@ func UserGetImageUrls(userId string, c *http.Client, bearer string) (RespTwitter
 	}
 	defer resp.Body.Close()
 	body, _ := ioutil.ReadAll(resp.Body)
+	if err := responseError(resp, body); err != nil {
+		return respImages, err, nil
+	}
 
 	errMsg = json.Unmarshal(body, &respImages)
 	if errMsg != nil {
@@ -120,12 +208,61 @@ func UserGetImageUrls(userId string, c *http.Client, bearer string) (RespTwitter
 
 }
 
-// Function retrieves up to tweet_no tweets for given users.
-// Users are reached by their ids. Notice that authorization token is required.
-func UserGetTweets(userId string, tweetNo uint64, c *http.Client, bearer string) ([]RespTwitterApiTweet, error, error) {
+// Paging parameters of a user timeline. Twitter returns tweets with
+// SinceId < id <= MaxId, empty ids are left out of the request.
+type TimelineQuery struct {
+	Count   uint64
+	SinceId string
+	MaxId   string
+}
+
+func (query TimelineQuery) values(userId string) url.Values {
+	values := url.Values{}
+	values.Set("user_id", userId)
+	values.Set("count", strconv.FormatUint(query.Count, 10))
+	values.Set("tweet_mode", "extended")
+	if query.SinceId != "" {
+		values.Set("since_id", query.SinceId)
+	}
+	if query.MaxId != "" {
+		values.Set("max_id", query.MaxId)
+	}
+	return values
+}
+
+// Function retrieves every tweet of a user with sinceId < id <= maxId, newest
+// first, starting from the newest tweet when maxId is empty. Pages of pageSize
+// tweets are requested with decreasing max_id until a page is empty or
+// maxPages pages were read.
+func UserGetTweetsBetween(userId string, sinceId string, maxId string, pageSize uint64, maxPages int, c *http.Client, bearer string) ([]RespTwitterApiTweet, error, error) {
+	var userTweets []RespTwitterApiTweet
+	query := TimelineQuery{Count: pageSize, SinceId: sinceId, MaxId: maxId}
+
+	for page := 0; page < maxPages; page++ {
+		tweets, err, errMsg := UserGetTimeline(userId, query, c, bearer)
+		if err != nil || errMsg != nil {
+			return userTweets, err, errMsg
+		}
+		if len(tweets) == 0 {
+			break
+		}
+		userTweets = append(userTweets, tweets...)
+
+		oldest := tweets[len(tweets)-1].Id
+		if oldest == 0 {
+			break
+		}
+		query.MaxId = strconv.FormatUint(oldest-1, 10)
+	}
+
+	return userTweets, nil, nil
+}
+
+// Function retrieves one page of a user timeline.
+func UserGetTimeline(userId string, query TimelineQuery, c *http.Client, bearer string) ([]RespTwitterApiTweet, error, error) {
 	var userTweets []RespTwitterApiTweet
 
-	req, errMsg := http.NewRequest("GET", fmt.Sprintf(httpStatusesRequestTemplate, userId, tweetNo), nil)
+	req, errMsg := http.NewRequest("GET", fmt.Sprintf(httpStatusesRequestTemplate, query.values(userId).Encode()), nil)
 	if errMsg != nil {
 		return nil, nil, fmt.Errorf("cannot create request. Error: %s", errMsg.Error())
 	}
@@ -136,6 +273,9 @@ func UserGetTweets(userId string, tweetNo uint64, c *http.Client, bearer string)
 	}
 	defer resp.Body.Close()
 	body, _ := ioutil.ReadAll(resp.Body)
+	if err := responseError(resp, body); err != nil {
+		return nil, err, nil
+	}
 
 	errMsg = json.Unmarshal(body, &userTweets)
 	if errMsg != nil {